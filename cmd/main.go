@@ -6,28 +6,169 @@ import (
 	"os"
 	"os/signal"
 	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
+	"github.com/super-phenix/volume-replicator/internal/constants"
 	"github.com/super-phenix/volume-replicator/internal/k8s"
+	"github.com/super-phenix/volume-replicator/internal/metrics"
 	"github.com/super-phenix/volume-replicator/internal/replicator"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/validation"
 	"k8s.io/client-go/tools/leaderelection"
 	"k8s.io/klog/v2"
 )
 
 func main() {
-	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer cancel()
 
-	var kubeconfig, namespace, exclusionRegexStr string
+	var leaderElect bool
+	var kubeconfig, backend, volSyncClassesPath, backendTemplatePath, nameTemplateStr, domain, aliasDomainsStr, namespace, watchNamespacesStr, watchNamespaceSelectorStr, fallbackConfigPath, exclusionRegexStr, exclusionRulesPath, metricsAddress, maintenanceWindowStr string
 	flag.StringVar(&kubeconfig, "kubeconfig", "", "path to kubeconfig file")
 	flag.StringVar(&namespace, "namespace", os.Getenv("NAMESPACE"), "deployment namespace")
+	flag.StringVar(&watchNamespacesStr, "watch-namespaces", os.Getenv("WATCH_NAMESPACES"), "comma-separated namespaces to which the controller is restricted, empty to watch every namespace")
+	flag.StringVar(&watchNamespaceSelectorStr, "watch-namespace-selector", os.Getenv("WATCH_NAMESPACE_SELECTOR"), "label selector of the namespaces to which the controller is restricted, empty to watch every namespace")
+	flag.StringVar(&fallbackConfigPath, "fallback-config", os.Getenv("FALLBACK_CONFIG"), "path to a file describing the Namespaces and StorageClasses that the controller isn't allowed to read")
+	flag.StringVar(&backend, "backend", envOrDefault("BACKEND", replicator.BackendCSIAddons), "backend producing the replication objects of PVCs: csi-addons, volsync or template")
+	flag.StringVar(&volSyncClassesPath, "volsync-classes", os.Getenv("VOLSYNC_CLASSES"), "path to a file describing the classes of the volsync backend")
+	flag.StringVar(&backendTemplatePath, "backend-template", os.Getenv("BACKEND_TEMPLATE"), "path to a file describing the replication objects of the template backend")
+	flag.StringVar(&nameTemplateStr, "name-template", os.Getenv("NAME_TEMPLATE"), "Go template naming the replication objects of PVCs, e.g. {{ .PVC.Name }}-replication, empty to name them after their PVC")
 	flag.StringVar(&exclusionRegexStr, "exclusion-regex", os.Getenv("EXCLUSION_REGEX"), "regex to exclude PVCs from replication")
+	flag.StringVar(&exclusionRulesPath, "exclusion-rules", os.Getenv("EXCLUSION_RULES"), "path to a file of ordered rules to include or exclude PVCs from replication")
+	flag.BoolVar(&replicator.WaitForBound, "wait-for-bound", os.Getenv("WAIT_FOR_BOUND") == "true", "wait for PVCs to be bound before creating their VolumeReplication")
+	flag.DurationVar(&replicator.BindTimeout, "bind-timeout", durationFromEnv("BIND_TIMEOUT", 0), "emit a warning Event when a PVC stays pending for longer than this duration, 0 to disable")
+	flag.BoolVar(&replicator.WaitForStable, "wait-for-stable", os.Getenv("WAIT_FOR_STABLE") == "true", "wait for PVCs to be done resizing and not lost before creating their VolumeReplication")
+	flag.BoolVar(&replicator.StrictProvisioner, "strict-provisioner", os.Getenv("STRICT_PROVISIONER") == "true", "refuse to select a VolumeReplicationClass for PVCs whose provisioner is unknown")
+	flag.StringVar(&replicator.ClassChangePolicy, "class-change-policy", envOrDefault("CLASS_CHANGE_POLICY", replicator.ClassChangeImmediate), "policy to re-create VolumeReplications whose class changed: immediate, approval, maintenance or refuse")
+	flag.StringVar(&maintenanceWindowStr, "maintenance-window", os.Getenv("MAINTENANCE_WINDOW"), "daily window (HH:MM-HH:MM, UTC) in which class changes are applied with the maintenance policy")
+	flag.BoolVar(&replicator.SnapshotBeforeRecreate, "snapshot-before-recreate", os.Getenv("SNAPSHOT_BEFORE_RECREATE") == "true", "take a VolumeSnapshot of PVCs before re-creating their VolumeReplication")
+	flag.DurationVar(&replicator.SnapshotTimeout, "snapshot-timeout", durationFromEnv("SNAPSHOT_TIMEOUT", replicator.SnapshotTimeout), "maximum time to wait for a VolumeSnapshot to be ready before re-creating a VolumeReplication")
+	flag.DurationVar(&replicator.RecreateCooldown, "recreate-cooldown", durationFromEnv("RECREATE_COOLDOWN", 0), "minimum time between two re-creations of the VolumeReplication of a PVC, 0 to disable")
+	flag.IntVar(&replicator.FlapThreshold, "flap-threshold", intFromEnv("FLAP_THRESHOLD", 0), "freeze PVCs whose VolumeReplication was re-created this many times within the flap window, 0 to disable")
+	flag.DurationVar(&replicator.FlapWindow, "flap-window", durationFromEnv("FLAP_WINDOW", replicator.FlapWindow), "window in which re-creations are counted to detect flapping PVCs")
+	flag.BoolVar(&replicator.VolumeGroups, "volume-groups", os.Getenv("VOLUME_GROUPS") == "true", "replicate groups of PVCs through a VolumeGroupReplication, instead of a VolumeReplication per PVC")
+	flag.DurationVar(&replicator.APITimeout, "api-timeout", durationFromEnv("API_TIMEOUT", replicator.APITimeout), "timeout of each call to the API server, 0 to disable")
+	flag.DurationVar(&replicator.ShutdownTimeout, "shutdown-timeout", durationFromEnv("SHUTDOWN_TIMEOUT", replicator.ShutdownTimeout), "maximum time given to in-flight reconciliations when stopping, before the lease is released")
+	flag.StringVar(&domain, "domain", envOrDefault("DOMAIN", constants.DefaultDomain), "prefix of the annotations and labels read and written by the controller")
+	flag.StringVar(&aliasDomainsStr, "alias-domains", os.Getenv("ALIAS_DOMAINS"), "comma-separated prefixes whose annotations and labels are read as fallbacks, e.g. to migrate from a previous domain")
+	flag.BoolVar(&replicator.RewriteAliasKeys, "rewrite-alias-keys", os.Getenv("REWRITE_ALIAS_KEYS") == "true", "move the annotations and labels of PVCs from the alias domains to the domain")
+	flag.StringVar(&replicator.InstanceName, "instance-name", os.Getenv("INSTANCE_NAME"), "name of this controller instance, which only reconciles PVCs assigned to it, empty for the default instance")
+	flag.BoolVar(&leaderElect, "leader-elect", os.Getenv("LEADER_ELECT") != "false", "elect a leader among replicas before replicating PVCs, disable for single replicas or local development")
+	flag.IntVar(&replicator.Shards, "shards", intFromEnv("SHARDS", 0), "number of shards among which namespaces are split across replicas, each with its own lease, 0 to disable")
+	flag.StringVar(&k8s.LeaseName, "leader-election-lease-name", envOrDefault("LEADER_ELECTION_LEASE_NAME", k8s.LeaseName), "name of the Lease used to elect a leader, distinct for each instance running in the namespace")
+	flag.DurationVar(&k8s.LeaseDuration, "leader-election-lease-duration", durationFromEnv("LEADER_ELECTION_LEASE_DURATION", k8s.LeaseDuration), "duration that stand-by replicas wait before taking over an unrenewed lease")
+	flag.DurationVar(&k8s.RenewDeadline, "leader-election-renew-deadline", durationFromEnv("LEADER_ELECTION_RENEW_DEADLINE", k8s.RenewDeadline), "duration that the leader retries renewing its lease before giving up leadership")
+	flag.DurationVar(&k8s.RetryPeriod, "leader-election-retry-period", durationFromEnv("LEADER_ELECTION_RETRY_PERIOD", k8s.RetryPeriod), "duration between two attempts to acquire or renew the lease")
+	flag.StringVar(&metricsAddress, "metrics-address", envOrDefault("METRICS_ADDRESS", ":8080"), "address on which to expose metrics and readiness, empty to disable")
 	klog.InitFlags(nil)
 	flag.Parse()
 
-	if namespace == "" {
+	if leaderElect && namespace == "" {
 		klog.Fatalf("must provide the namespace in which the controller is running through --namespace")
 	}
 
+	if replicator.Shards < 0 || (replicator.Shards > 0 && !leaderElect) {
+		klog.Fatalf("sharding requires a positive number of shards and leader election")
+	}
+
+	for _, ns := range strings.Split(watchNamespacesStr, ",") {
+		if ns = strings.TrimSpace(ns); ns == "" {
+			continue
+		}
+		if errs := validation.IsDNS1123Label(ns); len(errs) > 0 {
+			klog.Fatalf("invalid watched namespace %q: %s", ns, strings.Join(errs, ", "))
+		}
+		replicator.WatchNamespaces = append(replicator.WatchNamespaces, ns)
+	}
+
+	if watchNamespaceSelectorStr != "" {
+		if len(replicator.WatchNamespaces) > 0 {
+			klog.Fatalf("cannot watch both a list of namespaces and a namespace selector")
+		}
+
+		var err error
+		replicator.WatchNamespaceSelector, err = labels.Parse(watchNamespaceSelectorStr)
+		if err != nil {
+			klog.Fatalf("failed to parse namespace selector: %s", err.Error())
+		}
+	}
+
+	if fallbackConfigPath != "" {
+		var err error
+		replicator.Fallback, err = replicator.LoadFallbackConfig(fallbackConfigPath)
+		if err != nil {
+			klog.Fatalf("failed to load fallback config: %s", err.Error())
+		}
+	}
+
+	if err := replicator.SetBackend(backend); err != nil {
+		klog.Fatalf("invalid backend: %s", err.Error())
+	}
+
+	if backend == replicator.BackendVolSync {
+		if volSyncClassesPath == "" {
+			klog.Fatalf("must provide the classes of the volsync backend through --volsync-classes")
+		}
+
+		var err error
+		replicator.VolSyncClasses, err = replicator.LoadVolSyncClasses(volSyncClassesPath)
+		if err != nil {
+			klog.Fatalf("failed to load VolSync classes: %s", err.Error())
+		}
+	}
+
+	if backend == replicator.BackendTemplate {
+		if backendTemplatePath == "" {
+			klog.Fatalf("must provide the replication objects of the template backend through --backend-template")
+		}
+
+		var err error
+		replicator.Template, err = replicator.LoadTemplateConfig(backendTemplatePath)
+		if err != nil {
+			klog.Fatalf("failed to load backend template: %s", err.Error())
+		}
+	}
+
+	if nameTemplateStr != "" {
+		var err error
+		replicator.NameTemplate, err = replicator.ParseNameTemplate(nameTemplateStr)
+		if err != nil {
+			klog.Fatalf("invalid name template: %s", err.Error())
+		}
+	}
+
+	if replicator.VolumeGroups && backend != replicator.BackendCSIAddons {
+		klog.Fatalf("volume groups are only supported by the csi-addons backend")
+	}
+
+	var aliasDomains []string
+	for _, alias := range strings.Split(aliasDomainsStr, ",") {
+		if alias = strings.TrimSpace(alias); alias != "" {
+			aliasDomains = append(aliasDomains, alias)
+		}
+	}
+	for _, prefix := range append([]string{domain}, aliasDomains...) {
+		if errs := validation.IsDNS1123Subdomain(prefix); len(errs) > 0 {
+			klog.Fatalf("invalid domain %q: %s", prefix, strings.Join(errs, ", "))
+		}
+	}
+	constants.SetDomain(domain, aliasDomains)
+
+	if replicator.InstanceName != "" {
+		if errs := validation.IsValidLabelValue(replicator.InstanceName); len(errs) > 0 {
+			klog.Fatalf("invalid instance name %q: %s", replicator.InstanceName, strings.Join(errs, ", "))
+		}
+
+		// Instances running in the same namespace must not share their lease
+		if k8s.LeaseName == constants.LockName {
+			k8s.LeaseName = constants.LockName + "-" + replicator.InstanceName
+		}
+	}
+
 	if exclusionRegexStr != "" {
 		var err error
 		replicator.ExclusionRegex, err = regexp.Compile(exclusionRegexStr)
@@ -36,34 +177,161 @@ func main() {
 		}
 	}
 
+	if exclusionRulesPath != "" {
+		var err error
+		replicator.ExclusionRules, err = replicator.LoadExclusionRules(exclusionRulesPath)
+		if err != nil {
+			klog.Fatalf("failed to load exclusion rules: %s", err.Error())
+		}
+	}
+
+	if !replicator.IsValidClassChangePolicy(replicator.ClassChangePolicy) {
+		klog.Fatalf("invalid class change policy %q", replicator.ClassChangePolicy)
+	}
+
+	if maintenanceWindowStr != "" {
+		var err error
+		replicator.MaintenanceWindow, err = replicator.ParseTimeWindow(maintenanceWindowStr)
+		if err != nil {
+			klog.Fatalf("failed to parse maintenance window: %s", err.Error())
+		}
+	}
+
+	if replicator.ClassChangePolicy == replicator.ClassChangeMaintenance && replicator.MaintenanceWindow == nil {
+		klog.Fatalf("must provide a maintenance window through --maintenance-window with the maintenance class change policy")
+	}
+
 	if err := k8s.Load(kubeconfig); err != nil {
 		klog.Fatalf("failed to load kubernetes configuration: %s", err.Error())
 	}
 
-	startElection(namespace, ctx)
+	if metricsAddress != "" {
+		go metrics.Serve(ctx, metricsAddress)
+	}
+
+	// The controller waits for the replication CRDs instead of failing, it is reported as not ready meanwhile
+	if err := replicator.WaitForReplicationAPI(ctx); err != nil {
+		klog.Info("Stopped before the replication API was available")
+		return
+	}
+
+	// Informers are started before the election, so that stand-by replicas keep warm caches
+	controller := replicator.NewController()
+	controller.LoadInformers(ctx)
+	metrics.SetReady()
+
+	switch {
+	case replicator.Shards > 0:
+		identity := getIdentity()
+		klog.Infof("Taking part in %d shard elections in namespace %s as %s", replicator.Shards, namespace, identity)
+		controller.RunShards(ctx, namespace, identity)
+	case leaderElect:
+		startElection(namespace, ctx, controller)
+	default:
+		klog.Info("Leader election disabled, starting controller")
+		controller.Run(ctx, context.Background(), 1)
+	}
+	k8s.ShutdownEventRecorder()
+	klog.Info("Shutdown complete")
 }
 
-// startElection starts elections among multiple controllers
-// The leader starts its internal controller to replicate PVCs, others stay on stand-by
-func startElection(namespace string, ctx context.Context) {
-	identity, err := os.Hostname()
+// envOrDefault returns the value of an environment variable, or the fallback if it is unset
+func envOrDefault(name, fallback string) string {
+	if value, ok := os.LookupEnv(name); ok {
+		return value
+	}
+	return fallback
+}
+
+// durationFromEnv parses a duration from an environment variable, returning the fallback if it is unset
+func durationFromEnv(name string, fallback time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+
+	duration, err := time.ParseDuration(value)
 	if err != nil {
-		klog.Fatalf("failed to get hostname: %s", err.Error())
+		klog.Fatalf("failed to parse %s: %s", name, err.Error())
 	}
+	return duration
+}
 
-	lock := k8s.GetLease(namespace, identity)
-	config := k8s.GetLeaderElectionConfig(lock, startController)
+// intFromEnv parses an integer from an environment variable, returning the fallback if it is unset
+func intFromEnv(name string, fallback int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
 
-	elector, err := leaderelection.NewLeaderElector(config)
+	number, err := strconv.Atoi(value)
 	if err != nil {
-		klog.Fatalf("failed to create leader elector: %s", err.Error())
+		klog.Fatalf("failed to parse %s: %s", name, err.Error())
 	}
-	elector.Run(ctx)
+	return number
 }
 
-// startController starts listening for events and replicating PVCs
-func startController(ctx context.Context) {
-	controller := replicator.NewController()
-	controller.LoadInformers(ctx)
-	controller.Run(ctx, 1)
+// getIdentity returns the identity of the replica in elections.
+// The pod UID is added to the pod name, so that a re-created pod with the same name isn't mistaken for the previous one.
+func getIdentity() string {
+	if podName := os.Getenv("POD_NAME"); podName != "" {
+		if podUID := os.Getenv("POD_UID"); podUID != "" {
+			return podName + "_" + podUID
+		}
+		return podName
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		klog.Fatalf("failed to get hostname: %s", err.Error())
+	}
+	return hostname
+}
+
+// startElection starts elections among multiple controllers
+// The leader runs its internal controller to replicate PVCs, others stay on stand-by.
+// A replica that loses its leadership goes back to stand-by, and returns once the context is cancelled.
+// The lease is only released once the controller is drained, so that the next leader never overlaps with in-flight work.
+func startElection(namespace string, ctx context.Context, controller *replicator.Controller) {
+	identity := getIdentity()
+	klog.Infof("Taking part in election for lease %s/%s as %s", namespace, k8s.LeaseName, identity)
+
+	// The election outlives the context, it is cancelled once the controller stopped
+	electionCtx, cancelElection := context.WithCancel(context.Background())
+	defer cancelElection()
+
+	// Held while the controller runs, so that a new term never starts before the previous one is drained
+	var running sync.Mutex
+
+	lock := k8s.GetLease(namespace, identity)
+	config := k8s.GetLeaderElectionConfig(lock, func(leaderCtx context.Context) {
+		running.Lock()
+		defer running.Unlock()
+
+		// In-flight reconciliations are drained on shutdown, but aborted as soon as the lease is lost
+		controller.Run(ctx, leaderCtx, 1)
+		if ctx.Err() != nil {
+			cancelElection()
+		}
+	})
+
+	for ctx.Err() == nil {
+		elector, err := leaderelection.NewLeaderElector(config)
+		if err != nil {
+			klog.Fatalf("failed to create leader elector: %s", err.Error())
+		}
+
+		// A replica on stand-by has nothing to drain, a leader cancels the election itself once drained
+		stop := context.AfterFunc(ctx, func() {
+			if !elector.IsLeader() {
+				cancelElection()
+			}
+		})
+		elector.Run(electionCtx)
+		stop()
+
+		// Wait for the controller to be drained after a leadership loss
+		running.Lock()
+		running.Unlock()
+	}
 }
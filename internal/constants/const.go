@@ -1,13 +1,154 @@
 package constants
 
+import "strings"
+
 const (
+	ComponentName                          = "volume-replicator"
 	LockName                               = "spx-volume-replicator-leader-election"
-	VrcValueAnnotation                     = "replication.superphenix.net/class"
-	VrcSelectorAnnotation                  = "replication.superphenix.net/classSelector"
-	PauseAnnotation                        = "replication.superphenix.net/pause"
-	ParentLabel                            = "replication.superphenix.net/parent"
-	StorageClassGroup                      = "replication.superphenix.net/storageClassGroup"
-	ReplicationStateAnnotation             = "replication.superphenix.net/replicationState"
+	DefaultDomain                          = "replication.superphenix.net"
 	StorageProvisionerAnnotation           = "volume.kubernetes.io/storage-provisioner"
 	DeprecatedStorageProvisionerAnnotation = "volume.beta.kubernetes.io/storage-provisioner"
 )
+
+// Annotations, labels and attributes of the controller, prefixed with the domain set through SetDomain
+var (
+	VrcValueAnnotation              string
+	VrcSelectorAnnotation           string
+	ExclusionRegexAnnotation        string
+	PauseAnnotation                 string
+	ParentLabel                     string
+	PvcSelectorAnnotation           string
+	NamespaceSelectorAnnotation     string
+	StorageClassSelectorAnnotation  string
+	StorageClassNameAttribute       string
+	VolumeModeAttribute             string
+	VolumeAttributesClassAttribute  string
+	SizeAttribute                   string
+	PriorityLabel                   string
+	VolumeAttributesClassLabel      string
+	StorageClassGroup               string
+	PendingClassChangeAnnotation    string
+	ApproveClassChangeAnnotation    string
+	RecreateSnapshotAnnotation      string
+	RecreateSnapshotErrorAnnotation string
+	RecreateHistoryAnnotation       string
+	FrozenAnnotation                string
+	InstanceLabel                   string
+	ReplicationStateAnnotation      string
+	ShardLeaseLabel                 string
+	MemberLeaseLabel                string
+	GroupAnnotation                 string
+	GroupMemberLabel                string
+	GroupClassAnnotation            string
+	GroupClassSelectorAnnotation    string
+	ConflictAnnotation              string
+	AdoptAnnotation                 string
+	BindTimeoutAnnotation           string
+	ExclusionAnnotation             string
+	ClassResolutionAnnotation       string
+	GroupBlockedAnnotation          string
+)
+
+var (
+	// Domain is the prefix of every key of the controller
+	Domain string
+	// AliasDomains are prefixes whose keys are read as fallbacks when a key is missing under Domain
+	AliasDomains []string
+)
+
+// keyNames are the names of the keys of the controller, without their domain
+var keyNames = map[*string]string{
+	&VrcValueAnnotation:              "class",
+	&VrcSelectorAnnotation:           "classSelector",
+	&ExclusionRegexAnnotation:        "exclusionRegex",
+	&PauseAnnotation:                 "pause",
+	&ParentLabel:                     "parent",
+	&PvcSelectorAnnotation:           "pvcSelector",
+	&NamespaceSelectorAnnotation:     "namespaceSelector",
+	&StorageClassSelectorAnnotation:  "storageClassSelector",
+	&StorageClassNameAttribute:       "storageClassName",
+	&VolumeModeAttribute:             "volumeMode",
+	&VolumeAttributesClassAttribute:  "volumeAttributesClassName",
+	&SizeAttribute:                   "sizeGi",
+	&PriorityLabel:                   "priority",
+	&VolumeAttributesClassLabel:      "volumeAttributesClass",
+	&StorageClassGroup:               "storageClassGroup",
+	&PendingClassChangeAnnotation:    "pendingClassChange",
+	&ApproveClassChangeAnnotation:    "approveClassChange",
+	&RecreateSnapshotAnnotation:      "recreateSnapshot",
+	&RecreateSnapshotErrorAnnotation: "recreateSnapshotError",
+	&RecreateHistoryAnnotation:       "recreateHistory",
+	&FrozenAnnotation:                "frozen",
+	&InstanceLabel:                   "instance",
+	&ReplicationStateAnnotation:      "replicationState",
+	&ShardLeaseLabel:                 "shardOf",
+	&MemberLeaseLabel:                "memberOf",
+	&GroupAnnotation:                 "group",
+	&GroupMemberLabel:                "groupMember",
+	&GroupClassAnnotation:            "groupClass",
+	&GroupClassSelectorAnnotation:    "groupClassSelector",
+	&ConflictAnnotation:              "conflict",
+	&AdoptAnnotation:                 "adopt",
+	&BindTimeoutAnnotation:           "bindTimeout",
+	&ExclusionAnnotation:             "exclusion",
+	&ClassResolutionAnnotation:       "classResolution",
+	&GroupBlockedAnnotation:          "groupBlocked",
+}
+
+func init() {
+	SetDomain(DefaultDomain, nil)
+}
+
+// SetDomain prefixes every key of the controller with a domain.
+// Keys under the alias domains are read as fallbacks, which eases migrating from one domain to another.
+func SetDomain(domain string, aliases []string) {
+	Domain = domain
+	AliasDomains = aliases
+	for key, name := range keyNames {
+		*key = domain + "/" + name
+	}
+}
+
+// Domains returns the domain of the controller followed by its alias domains
+func Domains() []string {
+	return append([]string{Domain}, AliasDomains...)
+}
+
+// InDomain returns a key of the controller under another domain
+func InDomain(key, domain string) string {
+	name, ok := strings.CutPrefix(key, Domain+"/")
+	if !ok {
+		return key
+	}
+	return domain + "/" + name
+}
+
+// Aliases returns a key of the controller under each alias domain
+func Aliases(key string) []string {
+	if !strings.HasPrefix(key, Domain+"/") {
+		return nil
+	}
+
+	aliases := make([]string, 0, len(AliasDomains))
+	for _, domain := range AliasDomains {
+		aliases = append(aliases, InDomain(key, domain))
+	}
+	return aliases
+}
+
+// Canonical returns the key of the controller that a key under an alias domain stands for
+func Canonical(key string) (string, bool) {
+	for _, domain := range AliasDomains {
+		name, ok := strings.CutPrefix(key, domain+"/")
+		if !ok {
+			continue
+		}
+
+		for _, known := range keyNames {
+			if known == name {
+				return Domain + "/" + name, true
+			}
+		}
+	}
+	return "", false
+}
@@ -20,6 +20,7 @@ func Load(path string) error {
 		return fmt.Errorf("failed to load kubernetes configuration: %w", err)
 	}
 
+	loadEventRecorder()
 	return nil
 }
 
@@ -0,0 +1,28 @@
+package k8s
+
+import (
+	"github.com/super-phenix/volume-replicator/internal/constants"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+var (
+	Recorder    record.EventRecorder
+	broadcaster record.EventBroadcaster
+)
+
+// loadEventRecorder creates the recorder used to emit Events on the objects handled by the controller
+func loadEventRecorder() {
+	broadcaster = record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: ClientSet.CoreV1().Events("")})
+	Recorder = broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: constants.ComponentName})
+}
+
+// ShutdownEventRecorder stops the recorder, Events already recorded are still sent to the API server
+func ShutdownEventRecorder() {
+	if broadcaster != nil {
+		broadcaster.Shutdown()
+	}
+}
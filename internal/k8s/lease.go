@@ -2,21 +2,32 @@ package k8s
 
 import (
 	"context"
-	"os"
+	"fmt"
+	"hash/fnv"
+	"strings"
 	"time"
 
 	"github.com/super-phenix/volume-replicator/internal/constants"
+	coordinationv1 "k8s.io/api/coordination/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
 	"k8s.io/client-go/tools/leaderelection"
 	"k8s.io/client-go/tools/leaderelection/resourcelock"
 	"k8s.io/klog/v2"
 )
 
+var (
+	LeaseName     = constants.LockName
+	LeaseDuration = 15 * time.Second
+	RenewDeadline = 10 * time.Second
+	RetryPeriod   = 2 * time.Second
+)
+
 // GetLease returns a Kubernetes lease object
 func GetLease(namespace, identity string) resourcelock.Interface {
 	return &resourcelock.LeaseLock{
 		LeaseMeta: metav1.ObjectMeta{
-			Name:      constants.LockName,
+			Name:      LeaseName,
 			Namespace: namespace,
 		},
 		Client: ClientSet.CoordinationV1(),
@@ -31,17 +42,16 @@ func GetLeaderElectionConfig(lock resourcelock.Interface, startLeading func(ctx
 	return leaderelection.LeaderElectionConfig{
 		Lock:            lock,
 		ReleaseOnCancel: true,
-		LeaseDuration:   15 * time.Second,
-		RenewDeadline:   10 * time.Second,
-		RetryPeriod:     2 * time.Second,
+		LeaseDuration:   LeaseDuration,
+		RenewDeadline:   RenewDeadline,
+		RetryPeriod:     RetryPeriod,
 		Callbacks: leaderelection.LeaderCallbacks{
 			OnStartedLeading: func(ctx context.Context) {
 				klog.Info("Became leader, starting controller")
 				startLeading(ctx)
 			},
 			OnStoppedLeading: func() {
-				klog.Info("Lost leadership, exiting")
-				os.Exit(0)
+				klog.Info("Stopped leading, standing by")
 			},
 			OnNewLeader: func(identity string) {
 				klog.Infof("Current leader: %s", identity)
@@ -49,3 +59,110 @@ func GetLeaderElectionConfig(lock resourcelock.Interface, startLeading func(ctx
 		},
 	}
 }
+
+// GetShardLease returns the lease of a shard, labelled so that replicas can find every shard of the election
+func GetShardLease(namespace, identity string, shard int) resourcelock.Interface {
+	return &resourcelock.LeaseLock{
+		LeaseMeta: metav1.ObjectMeta{
+			Name:      GetShardLeaseName(shard),
+			Namespace: namespace,
+		},
+		Client: ClientSet.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{
+			Identity: identity,
+		},
+		Labels: map[string]string{constants.ShardLeaseLabel: leaseLabelValue()},
+	}
+}
+
+// leaseLabelValue returns the value labelling the leases of a sharded election.
+// Lease names can be longer than label values, e.g. with an instance suffix, long names are truncated and suffixed with their hash.
+func leaseLabelValue() string {
+	if len(LeaseName) <= validation.LabelValueMaxLength {
+		return LeaseName
+	}
+
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(LeaseName))
+	suffix := fmt.Sprintf("%08x", hash.Sum32())
+	prefix := strings.TrimRight(LeaseName[:validation.LabelValueMaxLength-len(suffix)-1], "-.")
+	return prefix + "-" + suffix
+}
+
+// GetShardLeaseName returns the name of the lease of a shard
+func GetShardLeaseName(shard int) string {
+	return fmt.Sprintf("%s-shard-%d", LeaseName, shard)
+}
+
+// GetMemberLease returns the lease through which a replica announces itself to the other replicas of a sharded election
+func GetMemberLease(namespace, identity string) resourcelock.Interface {
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(identity))
+
+	return &resourcelock.LeaseLock{
+		LeaseMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("%s-member-%08x", LeaseName, hash.Sum32()),
+			Namespace: namespace,
+		},
+		Client: ClientSet.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{
+			Identity: identity,
+		},
+		Labels: map[string]string{constants.MemberLeaseLabel: leaseLabelValue()},
+	}
+}
+
+// GetShardElectionConfig returns the election config used to elect the owner of a shard, or to hold a member lease
+func GetShardElectionConfig(lock resourcelock.Interface, startLeading func(ctx context.Context)) leaderelection.LeaderElectionConfig {
+	return leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		ReleaseOnCancel: true,
+		LeaseDuration:   LeaseDuration,
+		RenewDeadline:   RenewDeadline,
+		RetryPeriod:     RetryPeriod,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				klog.Infof("Acquired lease %s", lock.Describe())
+				startLeading(ctx)
+			},
+			OnStoppedLeading: func() {
+				klog.Infof("Released lease %s", lock.Describe())
+			},
+		},
+	}
+}
+
+// ListShardLeases returns the member leases and the shard leases of a sharded election
+func ListShardLeases(ctx context.Context, namespace string) (members, shards []coordinationv1.Lease, err error) {
+	leases := ClientSet.CoordinationV1().Leases(namespace)
+
+	memberList, err := leases.List(ctx, metav1.ListOptions{LabelSelector: constants.MemberLeaseLabel + "=" + leaseLabelValue()})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	shardList, err := leases.List(ctx, metav1.ListOptions{LabelSelector: constants.ShardLeaseLabel + "=" + leaseLabelValue()})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return memberList.Items, shardList.Items, nil
+}
+
+// GetLeaseHolder returns the holder of a lease, or an empty string if the lease expired or was released
+func GetLeaseHolder(lease coordinationv1.Lease, now time.Time) string {
+	spec := lease.Spec
+	if spec.HolderIdentity == nil || *spec.HolderIdentity == "" || spec.RenewTime == nil {
+		return ""
+	}
+
+	duration := LeaseDuration
+	if spec.LeaseDurationSeconds != nil {
+		duration = time.Duration(*spec.LeaseDurationSeconds) * time.Second
+	}
+	if spec.RenewTime.Add(duration).Before(now) {
+		return ""
+	}
+
+	return *spec.HolderIdentity
+}
@@ -0,0 +1,101 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"k8s.io/klog/v2"
+)
+
+const namespace = "volume_replicator"
+
+var (
+	Registry = prometheus.NewRegistry()
+
+	ClassResolutions = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "class_resolutions",
+		Help:      "Number of PVC targets by outcome of the resolution of their VolumeReplicationClass.",
+	}, []string{"outcome"})
+
+	AliasKeyReads = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "alias_key_reads_total",
+		Help:      "Number of values read from a key under an alias domain, by key.",
+	}, []string{"key"})
+
+	OwnedShards = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "owned_shards",
+		Help:      "Number of shards owned by this replica when sharding.",
+	})
+
+	NameConflicts = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "name_conflicts",
+		Help:      "Number of replication objects that can't be managed as an object that isn't managed by the controller has their name.",
+	})
+
+	// notReadyReason explains why the controller isn't ready, nil once it is
+	notReadyReason atomic.Pointer[string]
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		ClassResolutions,
+		AliasKeyReads,
+		OwnedShards,
+		NameConflicts,
+	)
+	SetNotReady("starting")
+}
+
+// SetNotReady reports the controller as not ready on /readyz, with the reason why
+func SetNotReady(reason string) {
+	notReadyReason.Store(&reason)
+}
+
+// SetReady reports the controller as ready on /readyz
+func SetReady() {
+	notReadyReason.Store(nil)
+}
+
+// serveReadiness answers whether the controller is ready, and why it isn't
+func serveReadiness(w http.ResponseWriter, _ *http.Request) {
+	if reason := notReadyReason.Load(); reason != nil {
+		http.Error(w, "not ready: "+*reason, http.StatusServiceUnavailable)
+		return
+	}
+	_, _ = w.Write([]byte("ok\n"))
+}
+
+// Serve exposes the metrics and the readiness of the controller over HTTP on the given address until the context is cancelled
+func Serve(ctx context.Context, address string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(Registry, promhttp.HandlerOpts{}))
+	mux.HandleFunc("/readyz", serveReadiness)
+
+	server := &http.Server{
+		Addr:              address,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+		_ = server.Close()
+	}()
+
+	klog.Infof("Serving metrics on %s", address)
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		klog.Errorf("metrics server stopped: %s", err.Error())
+	}
+}
@@ -0,0 +1,137 @@
+package replicator
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// Backends producing the replication objects of PVCs
+const (
+	// BackendCSIAddons replicates PVCs through CSI-addons VolumeReplications
+	BackendCSIAddons = "csi-addons"
+	// BackendVolSync replicates PVCs through VolSync ReplicationSources
+	BackendVolSync = "volsync"
+	// BackendTemplate replicates PVCs through objects rendered from the template passed through --backend-template
+	BackendTemplate = "template"
+)
+
+// comparison is how an existing replication object differs from the desired one
+type comparison int
+
+const (
+	// upToDate objects are left untouched
+	upToDate comparison = iota
+	// needsUpdate objects are updated in place
+	needsUpdate
+	// needsRecreate objects have immutable fields that changed, they are deleted and created again
+	needsRecreate
+)
+
+// replicationBackend produces the replication objects of the targets of a PVC, in the namespace of the PVC.
+// Every backend is driven through the same lifecycle by the reconcile loop, and reads the same annotations.
+type replicationBackend interface {
+	// kind returns the kind of the replication objects, used in logs and Events
+	kind() string
+	// resource returns the resource of the replication objects
+	resource() schema.GroupVersionResource
+	// requiredResources returns every resource that must be served for the backend to work
+	requiredResources() []schema.GroupVersionResource
+	// resolve resolves the class of a target of a PVC, from a value or a selector set on the PVC or on its namespace
+	resolve(ctx context.Context, pvc *corev1.PersistentVolumeClaim, target replicationTarget) classResolution
+	// build returns the fields of the replication object owned by the controller for a target of a PVC and its class
+	build(ctx context.Context, pvc *corev1.PersistentVolumeClaim, target replicationTarget, class string) (*unstructured.Unstructured, error)
+	// compare returns how an existing replication object differs from the desired one
+	compare(existing, desired *unstructured.Unstructured) comparison
+	// class returns the class of an existing replication object
+	class(obj *unstructured.Unstructured) string
+	// statusFields returns the fields of the status read by status, the rest of the status isn't cached
+	statusFields() [][]string
+	// status returns whether a replication object is healthy, and a message explaining why if it isn't
+	status(obj *unstructured.Unstructured) (bool, string)
+}
+
+// activeBackend is the backend selected through --backend
+var activeBackend replicationBackend = csiAddonsBackend{}
+
+// SetBackend selects the backend producing the replication objects of PVCs
+func SetBackend(name string) error {
+	switch name {
+	case BackendCSIAddons:
+		activeBackend = csiAddonsBackend{}
+	case BackendVolSync:
+		activeBackend = volSyncBackend{}
+	case BackendTemplate:
+		activeBackend = templateBackend{}
+	default:
+		return fmt.Errorf("unknown backend %q", name)
+	}
+	return nil
+}
+
+// isSubset returns whether every field set in desired has the same value in existing.
+// Fields only set in existing, e.g. defaulted by the API server or owned by other tools, are ignored.
+func isSubset(desired, existing any) bool {
+	switch desiredValue := desired.(type) {
+	case map[string]any:
+		existingMap, ok := existing.(map[string]any)
+		if !ok {
+			return false
+		}
+		for key, value := range desiredValue {
+			if !isSubset(value, existingMap[key]) {
+				return false
+			}
+		}
+		return true
+	case []any:
+		existingSlice, ok := existing.([]any)
+		if !ok || len(existingSlice) != len(desiredValue) {
+			return false
+		}
+		for i := range desiredValue {
+			if !isSubset(desiredValue[i], existingSlice[i]) {
+				return false
+			}
+		}
+		return true
+	}
+
+	// Numbers are decoded as float64 from files, and as int64 from the API server
+	if desiredNumber, ok := toFloat(desired); ok {
+		existingNumber, ok := toFloat(existing)
+		return ok && desiredNumber == existingNumber
+	}
+	return reflect.DeepEqual(desired, existing)
+}
+
+// toFloat converts a number decoded from JSON to a float64
+func toFloat(value any) (float64, bool) {
+	switch number := value.(type) {
+	case float64:
+		return number, true
+	case int64:
+		return float64(number), true
+	case int:
+		return float64(number), true
+	}
+	return 0, false
+}
+
+// getConditionMessage returns whether a condition of a replication object has a status, and its message
+func getConditionMessage(obj *unstructured.Unstructured, conditionType, status string) (bool, string) {
+	conditions, _, _ := unstructured.NestedSlice(obj.Object, "status", "conditions")
+	for _, item := range conditions {
+		condition, ok := item.(map[string]any)
+		if !ok || condition["type"] != conditionType {
+			continue
+		}
+		message, _ := condition["message"].(string)
+		return condition["status"] == status, message
+	}
+	return false, ""
+}
@@ -0,0 +1,223 @@
+package replicator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/super-phenix/volume-replicator/internal/constants"
+	"github.com/super-phenix/volume-replicator/internal/k8s"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog/v2"
+)
+
+// Policies applied when the VolumeReplication of a PVC must be re-created to change its class or dataSource
+const (
+	// ClassChangeImmediate re-creates the VolumeReplication as soon as the change is detected
+	ClassChangeImmediate = "immediate"
+	// ClassChangeApproval waits for the change to be approved through an annotation on the PVC
+	ClassChangeApproval = "approval"
+	// ClassChangeMaintenance waits for the maintenance window, or for the change to be approved
+	ClassChangeMaintenance = "maintenance"
+	// ClassChangeRefuse never re-creates the VolumeReplication, it must be deleted manually
+	ClassChangeRefuse = "refuse"
+)
+
+var (
+	ClassChangePolicy = ClassChangeImmediate
+	MaintenanceWindow *TimeWindow
+)
+
+// now returns the current time, it is replaced in tests
+var now = time.Now
+
+// IsValidClassChangePolicy returns whether a class change policy is supported
+func IsValidClassChangePolicy(policy string) bool {
+	switch policy {
+	case ClassChangeImmediate, ClassChangeApproval, ClassChangeMaintenance, ClassChangeRefuse:
+		return true
+	default:
+		return false
+	}
+}
+
+// TimeWindow is a daily window of time, expressed in UTC.
+// The window wraps around midnight if it ends before it starts (e.g. 22:00-04:00).
+type TimeWindow struct {
+	start time.Duration
+	end   time.Duration
+}
+
+// ParseTimeWindow parses a daily window of time in the HH:MM-HH:MM format
+func ParseTimeWindow(value string) (*TimeWindow, error) {
+	startStr, endStr, found := strings.Cut(value, "-")
+	if !found {
+		return nil, fmt.Errorf("invalid time window %q, expected HH:MM-HH:MM", value)
+	}
+
+	start, err := parseTimeOfDay(startStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid start of time window %q: %w", value, err)
+	}
+
+	end, err := parseTimeOfDay(endStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid end of time window %q: %w", value, err)
+	}
+
+	if start == end {
+		return nil, fmt.Errorf("invalid time window %q, it must not be empty", value)
+	}
+
+	return &TimeWindow{start: start, end: end}, nil
+}
+
+// parseTimeOfDay parses a time of day in the HH:MM format into the duration since midnight
+func parseTimeOfDay(value string) (time.Duration, error) {
+	hoursStr, minutesStr, found := strings.Cut(strings.TrimSpace(value), ":")
+	if !found {
+		return 0, fmt.Errorf("expected HH:MM, got %q", value)
+	}
+
+	hours, err := strconv.Atoi(hoursStr)
+	if err != nil || hours < 0 || hours > 23 {
+		return 0, fmt.Errorf("invalid hours %q", hoursStr)
+	}
+
+	minutes, err := strconv.Atoi(minutesStr)
+	if err != nil || minutes < 0 || minutes > 59 {
+		return 0, fmt.Errorf("invalid minutes %q", minutesStr)
+	}
+
+	return time.Duration(hours)*time.Hour + time.Duration(minutes)*time.Minute, nil
+}
+
+// Contains returns whether a time is within the window, a nil window never contains any time
+func (w *TimeWindow) Contains(t time.Time) bool {
+	if w == nil {
+		return false
+	}
+
+	offset := sinceMidnight(t)
+	if w.start < w.end {
+		return offset >= w.start && offset < w.end
+	}
+	return offset >= w.start || offset < w.end
+}
+
+// Until returns the delay before the window opens, zero if it is already open or if there is no window
+func (w *TimeWindow) Until(t time.Time) time.Duration {
+	if w == nil || w.Contains(t) {
+		return 0
+	}
+
+	delay := w.start - sinceMidnight(t)
+	if delay < 0 {
+		delay += 24 * time.Hour
+	}
+	return delay
+}
+
+// sinceMidnight returns the time elapsed since midnight UTC
+func sinceMidnight(t time.Time) time.Duration {
+	t = t.UTC()
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+}
+
+// isClassChangeAllowed returns whether the VolumeReplication of a PVC can be re-created to apply a class or dataSource change.
+// If it can't, the change is recorded on the PVC, and the delay after which the PVC must be reconciled again is returned.
+func isClassChangeAllowed(ctx context.Context, pvc *corev1.PersistentVolumeClaim, currentClass, replicationClass string) (bool, time.Duration) {
+	change := fmt.Sprintf("%s -> %s", currentClass, replicationClass)
+	approved := isClassChangeApproved(pvc, replicationClass)
+
+	switch ClassChangePolicy {
+	case ClassChangeRefuse:
+		recordPendingClassChange(ctx, pvc, change, "refused by the class change policy, delete the VolumeReplication to apply it")
+		return false, 0
+	case ClassChangeApproval:
+		if !approved {
+			recordPendingClassChange(ctx, pvc, change, fmt.Sprintf("waiting for the %s annotation to be set to %q", constants.ApproveClassChangeAnnotation, replicationClass))
+			return false, 0
+		}
+	case ClassChangeMaintenance:
+		if !approved && !MaintenanceWindow.Contains(now()) {
+			recordPendingClassChange(ctx, pvc, change, "waiting for the maintenance window")
+			return false, MaintenanceWindow.Until(now())
+		}
+	}
+
+	return true, 0
+}
+
+// isClassChangeApproved returns whether the PVC approves the switch to a VolumeReplicationClass
+func isClassChangeApproved(pvc *corev1.PersistentVolumeClaim, replicationClass string) bool {
+	approval, ok := lookupKey(pvc.Annotations, constants.ApproveClassChangeAnnotation)
+	return ok && approval == replicationClass
+}
+
+// recordPendingClassChange records a pending change on the PVC, and emits an Event the first time it is seen
+func recordPendingClassChange(ctx context.Context, pvc *corev1.PersistentVolumeClaim, change, message string) {
+	klog.Infof("not re-creating VolumeReplication for PVC %s/%s to apply change %s: %s", pvc.Namespace, pvc.Name, change, message)
+	if getKeyValue(pvc.Annotations, constants.PendingClassChangeAnnotation) == change {
+		return
+	}
+
+	if err := patchPvcAnnotations(ctx, pvc, map[string]*string{constants.PendingClassChangeAnnotation: &change}); err != nil {
+		klog.Errorf("failed to record pending class change on PVC %s/%s: %s", pvc.Namespace, pvc.Name, err.Error())
+	}
+	recordEvent(pvc, corev1.EventTypeWarning, reasonClassChangePending, "Change %s is pending: %s", change, message)
+}
+
+// clearClassChange removes the pending change and its approval from a PVC whose VolumeReplication is up-to-date
+func clearClassChange(ctx context.Context, pvc *corev1.PersistentVolumeClaim) {
+	_, pending := lookupKey(pvc.Annotations, constants.PendingClassChangeAnnotation)
+	_, approved := lookupKey(pvc.Annotations, constants.ApproveClassChangeAnnotation)
+	if !pending && !approved {
+		return
+	}
+
+	err := patchPvcAnnotations(ctx, pvc, map[string]*string{
+		constants.PendingClassChangeAnnotation: nil,
+		constants.ApproveClassChangeAnnotation: nil,
+	})
+	if err != nil {
+		klog.Errorf("failed to clear class change on PVC %s/%s: %s", pvc.Namespace, pvc.Name, err.Error())
+	}
+}
+
+// patchPvcAnnotations sets annotations on a PVC, nil values remove the annotation
+func patchPvcAnnotations(ctx context.Context, pvc *corev1.PersistentVolumeClaim, annotations map[string]*string) error {
+	return patchPvcMetadata(ctx, pvc, annotations, nil)
+}
+
+// patchPvcMetadata sets annotations and labels on a PVC, nil values remove the annotation or label.
+// Removing a key of the controller also removes it under the alias domains.
+func patchPvcMetadata(ctx context.Context, pvc *corev1.PersistentVolumeClaim, annotations, labels map[string]*string) error {
+	annotations = withAliasRemovals(annotations)
+	labels = withAliasRemovals(labels)
+
+	metadata := map[string]any{}
+	if len(annotations) > 0 {
+		metadata["annotations"] = annotations
+	}
+	if len(labels) > 0 {
+		metadata["labels"] = labels
+	}
+
+	patch, err := json.Marshal(map[string]any{
+		"metadata": metadata,
+	})
+	if err != nil {
+		return err
+	}
+
+	callCtx, cancel := withAPITimeout(ctx)
+	defer cancel()
+	_, err = k8s.ClientSet.CoreV1().PersistentVolumeClaims(pvc.Namespace).Patch(callCtx, pvc.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+	return err
+}
@@ -0,0 +1,291 @@
+package replicator
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/super-phenix/volume-replicator/internal/constants"
+	"github.com/super-phenix/volume-replicator/internal/k8s"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/kubernetes/fake"
+	k8s_testing "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestParseTimeWindow(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name      string
+		value     string
+		expected  *TimeWindow
+		expectErr bool
+	}{
+		{
+			name:     "Same day",
+			value:    "01:30-05:00",
+			expected: &TimeWindow{start: 90 * time.Minute, end: 5 * time.Hour},
+		},
+		{
+			name:     "Wraps around midnight",
+			value:    "22:00 - 04:00",
+			expected: &TimeWindow{start: 22 * time.Hour, end: 4 * time.Hour},
+		},
+		{
+			name:      "Missing end",
+			value:     "22:00",
+			expectErr: true,
+		},
+		{
+			name:      "Invalid hours",
+			value:     "25:00-04:00",
+			expectErr: true,
+		},
+		{
+			name:      "Invalid minutes",
+			value:     "22:60-04:00",
+			expectErr: true,
+		},
+		{
+			name:      "Empty window",
+			value:     "04:00-04:00",
+			expectErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			window, err := ParseTimeWindow(tt.value)
+			if tt.expectErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, window)
+		})
+	}
+}
+
+func TestTimeWindow(t *testing.T) {
+	t.Parallel()
+
+	at := func(hour, minute int) time.Time {
+		return time.Date(2025, 1, 1, hour, minute, 0, 0, time.UTC)
+	}
+
+	sameDay := &TimeWindow{start: 2 * time.Hour, end: 4 * time.Hour}
+	overnight := &TimeWindow{start: 22 * time.Hour, end: 4 * time.Hour}
+
+	tests := []struct {
+		name             string
+		window           *TimeWindow
+		time             time.Time
+		expectedContains bool
+		expectedUntil    time.Duration
+	}{
+		{name: "Before same day window", window: sameDay, time: at(1, 0), expectedContains: false, expectedUntil: time.Hour},
+		{name: "Inside same day window", window: sameDay, time: at(2, 0), expectedContains: true, expectedUntil: 0},
+		{name: "After same day window", window: sameDay, time: at(4, 0), expectedContains: false, expectedUntil: 22 * time.Hour},
+		{name: "Inside overnight window before midnight", window: overnight, time: at(23, 0), expectedContains: true, expectedUntil: 0},
+		{name: "Inside overnight window after midnight", window: overnight, time: at(3, 59), expectedContains: true, expectedUntil: 0},
+		{name: "Outside overnight window", window: overnight, time: at(12, 30), expectedContains: false, expectedUntil: 9*time.Hour + 30*time.Minute},
+		{name: "No window", window: nil, time: at(12, 0), expectedContains: false, expectedUntil: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.expectedContains, tt.window.Contains(tt.time))
+			require.Equal(t, tt.expectedUntil, tt.window.Until(tt.time))
+		})
+	}
+}
+
+func TestIsClassChangeAllowed(t *testing.T) {
+	nsName := "test-namespace"
+	pvcName := "test-pvc"
+
+	tests := []struct {
+		name            string
+		policy          string
+		window          *TimeWindow
+		annotations     map[string]string
+		expectedAllowed bool
+		expectedRequeue time.Duration
+		expectedPatch   bool
+	}{
+		{
+			name:            "Immediate",
+			policy:          ClassChangeImmediate,
+			expectedAllowed: true,
+		},
+		{
+			name:            "Refuse",
+			policy:          ClassChangeRefuse,
+			annotations:     map[string]string{constants.ApproveClassChangeAnnotation: "hourly"},
+			expectedAllowed: false,
+			expectedPatch:   true,
+		},
+		{
+			name:            "Approval pending",
+			policy:          ClassChangeApproval,
+			expectedAllowed: false,
+			expectedPatch:   true,
+		},
+		{
+			name:            "Approval already recorded",
+			policy:          ClassChangeApproval,
+			annotations:     map[string]string{constants.PendingClassChangeAnnotation: "daily -> hourly"},
+			expectedAllowed: false,
+			expectedPatch:   false,
+		},
+		{
+			name:            "Approval for another class",
+			policy:          ClassChangeApproval,
+			annotations:     map[string]string{constants.ApproveClassChangeAnnotation: "weekly"},
+			expectedAllowed: false,
+			expectedPatch:   true,
+		},
+		{
+			name:            "Approved",
+			policy:          ClassChangeApproval,
+			annotations:     map[string]string{constants.ApproveClassChangeAnnotation: "hourly"},
+			expectedAllowed: true,
+		},
+		{
+			name:            "Outside maintenance window",
+			policy:          ClassChangeMaintenance,
+			window:          &TimeWindow{start: 14 * time.Hour, end: 16 * time.Hour},
+			expectedAllowed: false,
+			expectedRequeue: 2 * time.Hour,
+			expectedPatch:   true,
+		},
+		{
+			name:            "Outside maintenance window but approved",
+			policy:          ClassChangeMaintenance,
+			window:          &TimeWindow{start: 14 * time.Hour, end: 16 * time.Hour},
+			annotations:     map[string]string{constants.ApproveClassChangeAnnotation: "hourly"},
+			expectedAllowed: true,
+		},
+		{
+			name:            "Inside maintenance window",
+			policy:          ClassChangeMaintenance,
+			window:          &TimeWindow{start: 11 * time.Hour, end: 13 * time.Hour},
+			expectedAllowed: true,
+		},
+	}
+
+	now = func() time.Time { return time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC) }
+	defer func() {
+		now = time.Now
+		ClassChangePolicy = ClassChangeImmediate
+		MaintenanceWindow = nil
+	}()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pvc := &corev1.PersistentVolumeClaim{
+				ObjectMeta: metav1.ObjectMeta{Name: pvcName, Namespace: nsName, Annotations: tt.annotations},
+			}
+			client := fake.NewClientset(pvc)
+			k8s.ClientSet = client
+
+			ClassChangePolicy = tt.policy
+			MaintenanceWindow = tt.window
+
+			allowed, requeueAfter := isClassChangeAllowed(t.Context(), pvc, "daily", "hourly")
+			require.Equal(t, tt.expectedAllowed, allowed)
+			require.Equal(t, tt.expectedRequeue, requeueAfter)
+
+			patched, err := client.CoreV1().PersistentVolumeClaims(nsName).Get(t.Context(), pvcName, metav1.GetOptions{})
+			require.NoError(t, err)
+			if tt.expectedPatch {
+				require.Equal(t, "daily -> hourly", patched.Annotations[constants.PendingClassChangeAnnotation])
+			} else {
+				require.Equal(t, tt.annotations[constants.PendingClassChangeAnnotation], patched.Annotations[constants.PendingClassChangeAnnotation])
+			}
+		})
+	}
+}
+
+func TestClearClassChange(t *testing.T) {
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test-pvc",
+			Namespace: "test-namespace",
+			Annotations: map[string]string{
+				constants.VrcValueAnnotation:           "hourly",
+				constants.PendingClassChangeAnnotation: "daily -> hourly",
+				constants.ApproveClassChangeAnnotation: "hourly",
+			},
+		},
+	}
+	client := fake.NewClientset(pvc)
+	k8s.ClientSet = client
+
+	clearClassChange(t.Context(), pvc)
+
+	patched, err := client.CoreV1().PersistentVolumeClaims(pvc.Namespace).Get(t.Context(), pvc.Name, metav1.GetOptions{})
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{constants.VrcValueAnnotation: "hourly"}, patched.Annotations)
+}
+
+func TestClassChangeAppliedEvent(t *testing.T) {
+	nsName := "test-namespace"
+	stcName := "ceph-rbd"
+
+	vr := &unstructured.Unstructured{Object: map[string]any{
+		"metadata": map[string]any{
+			"name":      "test-pvc",
+			"namespace": nsName,
+			"uid":       "0a1b2c3d-4e5f-6789-abcd-ef0123456789",
+			"labels":    map[string]any{constants.ParentLabel: "test-pvc"},
+		},
+		"spec": map[string]any{
+			"volumeReplicationClass": "daily",
+			"replicationState":       "primary",
+			"dataSource":             map[string]any{"apiGroup": "v1", "kind": "PersistentVolumeClaim", "name": "test-pvc"},
+		},
+	}}
+	snapshot := newVolumeSnapshot("test-pvc-0a1b2c3d", nsName, false, time.Now())
+	dynamicClient := setupSnapshotEnvironment(stcName, "ceph", snapshot)
+
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-pvc", Namespace: nsName, Annotations: map[string]string{constants.VrcValueAnnotation: "hourly"}},
+		Spec:       corev1.PersistentVolumeClaimSpec{StorageClassName: &stcName},
+	}
+	_, err := k8s.ClientSet.CoreV1().PersistentVolumeClaims(nsName).Create(t.Context(), pvc, metav1.CreateOptions{})
+	require.NoError(t, err)
+
+	recorder := record.NewFakeRecorder(10)
+	k8s.Recorder = recorder
+	SnapshotBeforeRecreate = true
+	defer func() {
+		k8s.Recorder = nil
+		SnapshotBeforeRecreate = false
+	}()
+
+	target := getReplicationTargets(pvc)[0]
+	resolution := classResolution{class: "hourly", outcome: resolutionValue}
+
+	// The change is allowed, but the VolumeReplication isn't re-created until the snapshot is ready
+	_, pending, _ := reconcileTarget(t.Context(), pvc, target, resolution, vr, false)
+	require.True(t, pending)
+	require.Empty(t, recorder.Events)
+
+	require.NoError(t, unstructured.SetNestedField(snapshot.Object, true, "status", "readyToUse"))
+	_, err = dynamicClient.Resource(VolumeSnapshotResource).Namespace(nsName).Update(t.Context(), snapshot, metav1.UpdateOptions{})
+	require.NoError(t, err)
+
+	// The change is only reported once the VolumeReplication is deleted
+	_, pending, _ = reconcileTarget(t.Context(), pvc, target, resolution, vr, false)
+	require.True(t, pending)
+	require.Len(t, recorder.Events, 1)
+	require.Contains(t, <-recorder.Events, reasonClassChangeApplied)
+	require.True(t, slices.ContainsFunc(dynamicClient.Actions(), func(action k8s_testing.Action) bool {
+		return action.GetVerb() == "delete" && action.GetResource().Resource == "volumereplications"
+	}))
+}
@@ -0,0 +1,91 @@
+package replicator
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/super-phenix/volume-replicator/internal/constants"
+	"github.com/super-phenix/volume-replicator/internal/metrics"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/klog/v2"
+)
+
+var (
+	// nameConflicts is the number of conflicting targets of each PVC, their sum is exposed as a metric
+	nameConflicts     = make(map[string]int)
+	nameConflictsLock sync.Mutex
+)
+
+// checkNameConflict returns why an object that isn't owned by our controller prevents a target from being replicated,
+// empty if the object was handed over to the PVC through the adopt annotation and can be taken over.
+// Objects are only adopted if their class and source match the target, as those can't be changed in place.
+func checkNameConflict(pvc *corev1.PersistentVolumeClaim, target replicationTarget, other, desired *unstructured.Unstructured) string {
+	kind := activeBackend.kind()
+
+	// The object is managed by another instance, or by another PVC whose name renders the same
+	if parent := getKeyValue(other.GetLabels(), constants.ParentLabel); parent != "" {
+		if instance := getKeyValue(other.GetLabels(), constants.InstanceLabel); instance != InstanceName {
+			return fmt.Sprintf("%s %s is managed by instance %q", kind, target.name, instance)
+		}
+		return fmt.Sprintf("%s %s is managed for PVC %s", kind, target.name, parent)
+	}
+
+	adopter, requested := lookupKey(other.GetAnnotations(), constants.AdoptAnnotation)
+	switch {
+	case !requested:
+		return fmt.Sprintf("%s %s isn't managed by the controller, set its %s annotation to %q to adopt it", kind, target.name, constants.AdoptAnnotation, pvc.Name)
+	case adopter != pvc.Name:
+		return fmt.Sprintf("%s %s is handed over to PVC %s", kind, target.name, adopter)
+	case activeBackend.compare(other, desired) == needsRecreate:
+		return fmt.Sprintf("%s %s can't be adopted as its class or source doesn't match the PVC", kind, target.name)
+	}
+	return ""
+}
+
+// reportNameConflicts records the conflicts of the targets of a PVC in an annotation of the PVC,
+// and emits an Event when they change. The annotation is removed once every conflict is solved.
+func reportNameConflicts(ctx context.Context, pvc *corev1.PersistentVolumeClaim, conflicts []string) {
+	setNameConflicts(pvc.Namespace+"/"+pvc.Name, len(conflicts))
+
+	message := strings.Join(conflicts, "; ")
+	current, found := lookupKey(pvc.Annotations, constants.ConflictAnnotation)
+	if message == "" {
+		if found {
+			klog.Infof("name conflicts of PVC %s/%s are solved", pvc.Namespace, pvc.Name)
+			if err := patchPvcAnnotations(ctx, pvc, map[string]*string{constants.ConflictAnnotation: nil}); err != nil {
+				klog.Errorf("failed to clear name conflicts on PVC %s/%s: %s", pvc.Namespace, pvc.Name, err.Error())
+			}
+		}
+		return
+	}
+
+	if current == message {
+		return
+	}
+
+	if err := patchPvcAnnotations(ctx, pvc, map[string]*string{constants.ConflictAnnotation: &message}); err != nil {
+		klog.Errorf("failed to record name conflicts on PVC %s/%s: %s", pvc.Namespace, pvc.Name, err.Error())
+	}
+	recordEvent(pvc, corev1.EventTypeWarning, reasonReplicationConflict, "%s", message)
+}
+
+// setNameConflicts sets the number of conflicting targets of a PVC, zero forgets the PVC
+func setNameConflicts(key string, count int) {
+	nameConflictsLock.Lock()
+	defer nameConflictsLock.Unlock()
+
+	if count == 0 {
+		delete(nameConflicts, key)
+	} else {
+		nameConflicts[key] = count
+	}
+
+	total := 0
+	for _, conflicts := range nameConflicts {
+		total += conflicts
+	}
+	metrics.NameConflicts.Set(float64(total))
+}
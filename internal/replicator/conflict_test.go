@@ -0,0 +1,151 @@
+package replicator
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/super-phenix/volume-replicator/internal/constants"
+	"github.com/super-phenix/volume-replicator/internal/k8s"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestCheckNameConflict(t *testing.T) {
+	pvc := &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: "test-pvc", Namespace: "test-namespace"}}
+	target := replicationTarget{name: "test-pvc", value: "daily", state: "primary"}
+	desired := buildTargetVolumeReplication(pvc, target, "daily")
+
+	newObject := func(class string, labels, annotations map[string]string) *unstructured.Unstructured {
+		obj := buildTargetVolumeReplication(pvc, target, class)
+		obj.SetLabels(labels)
+		obj.SetAnnotations(annotations)
+		return obj
+	}
+
+	tests := []struct {
+		name     string
+		other    *unstructured.Unstructured
+		expected string
+	}{
+		{
+			name:     "Hand-made object",
+			other:    newObject("daily", nil, nil),
+			expected: `VolumeReplication test-pvc isn't managed by the controller, set its ` + constants.AdoptAnnotation + ` annotation to "test-pvc" to adopt it`,
+		},
+		{
+			name:     "Object handed over to another PVC",
+			other:    newObject("daily", nil, map[string]string{constants.AdoptAnnotation: "other-pvc"}),
+			expected: "VolumeReplication test-pvc is handed over to PVC other-pvc",
+		},
+		{
+			name:     "Adopted object with another class",
+			other:    newObject("hourly", nil, map[string]string{constants.AdoptAnnotation: "test-pvc"}),
+			expected: "VolumeReplication test-pvc can't be adopted as its class or source doesn't match the PVC",
+		},
+		{
+			name:  "Adopted object with the class of the PVC",
+			other: newObject("daily", nil, map[string]string{constants.AdoptAnnotation: "test-pvc"}),
+		},
+		{
+			name:     "Object of another instance",
+			other:    newObject("daily", map[string]string{constants.ParentLabel: "test-pvc", constants.InstanceLabel: "blue"}, map[string]string{constants.AdoptAnnotation: "test-pvc"}),
+			expected: `VolumeReplication test-pvc is managed by instance "blue"`,
+		},
+		{
+			name:     "Object of another PVC",
+			other:    newObject("daily", map[string]string{constants.ParentLabel: "other-pvc"}, nil),
+			expected: "VolumeReplication test-pvc is managed for PVC other-pvc",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.expected, checkNameConflict(pvc, target, tt.other, desired))
+		})
+	}
+}
+
+func TestReportNameConflicts(t *testing.T) {
+	pvc := &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: "test-pvc", Namespace: "test-namespace"}}
+	client := fake.NewClientset(pvc)
+	k8s.ClientSet = client
+	t.Cleanup(func() { setNameConflicts("test-namespace/test-pvc", 0) })
+
+	getAnnotations := func() map[string]string {
+		patched, err := client.CoreV1().PersistentVolumeClaims(pvc.Namespace).Get(t.Context(), pvc.Name, metav1.GetOptions{})
+		require.NoError(t, err)
+		return patched.Annotations
+	}
+
+	reportNameConflicts(t.Context(), pvc, []string{"VolumeReplication test-pvc isn't managed", "VolumeReplication test-pvc-1 isn't managed"})
+	require.Equal(t, "VolumeReplication test-pvc isn't managed; VolumeReplication test-pvc-1 isn't managed", getAnnotations()[constants.ConflictAnnotation])
+	require.Equal(t, 2, nameConflicts["test-namespace/test-pvc"])
+
+	// Solved conflicts are removed from the PVC
+	pvc.Annotations = getAnnotations()
+	reportNameConflicts(t.Context(), pvc, nil)
+	require.NotContains(t, getAnnotations(), constants.ConflictAnnotation)
+	require.NotContains(t, nameConflicts, "test-namespace/test-pvc")
+}
+
+func TestReconcileAdoption(t *testing.T) {
+	dynamicClient := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme())
+	addApplyReactor(dynamicClient)
+	k8s.DynamicClientSet = dynamicClient
+
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "test-pvc",
+			Namespace:   "test-namespace",
+			Annotations: map[string]string{constants.VrcValueAnnotation: "daily"},
+		},
+	}
+	client := fake.NewClientset(pvc)
+	k8s.ClientSet = client
+	t.Cleanup(func() { setNameConflicts("test-namespace/test-pvc", 0) })
+
+	informerFactory := informers.NewSharedInformerFactory(client, 0)
+	PvcInformer = informerFactory.Core().V1().PersistentVolumeClaims()
+	NamespaceInformer = informerFactory.Core().V1().Namespaces()
+	VolumeReplicationInformer = dynamicinformer.NewDynamicSharedInformerFactory(dynamicClient, 0).ForResource(VolumeReplicationResource)
+	require.NoError(t, VolumeReplicationInformer.Informer().AddIndexers(volumeReplicationIndexers))
+	require.NoError(t, NamespaceInformer.Informer().GetIndexer().Add(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "test-namespace"}}))
+	require.NoError(t, PvcInformer.Informer().GetIndexer().Add(pvc))
+
+	// A hand-made VolumeReplication has the name of the PVC
+	handMade := buildVolumeReplication(pvc, "daily")
+	handMade.SetLabels(nil)
+	handMade.SetAnnotations(nil)
+	handMade, err := dynamicClient.Resource(VolumeReplicationResource).Namespace("test-namespace").Create(t.Context(), handMade, metav1.CreateOptions{})
+	require.NoError(t, err)
+	require.NoError(t, VolumeReplicationInformer.Informer().GetIndexer().Add(handMade))
+
+	// The conflict is recorded on the PVC, and the VolumeReplication is left alone
+	reconcileVolumeReplication(t.Context(), "test-namespace/test-pvc")
+	patched, err := client.CoreV1().PersistentVolumeClaims("test-namespace").Get(t.Context(), "test-pvc", metav1.GetOptions{})
+	require.NoError(t, err)
+	require.Contains(t, patched.Annotations[constants.ConflictAnnotation], "isn't managed by the controller")
+	vr, err := dynamicClient.Resource(VolumeReplicationResource).Namespace("test-namespace").Get(t.Context(), "test-pvc", metav1.GetOptions{})
+	require.NoError(t, err)
+	require.Empty(t, vr.GetLabels())
+
+	// The VolumeReplication is handed over to the PVC, which takes it over and clears the conflict
+	vr.SetAnnotations(map[string]string{constants.AdoptAnnotation: "test-pvc"})
+	require.NoError(t, VolumeReplicationInformer.Informer().GetIndexer().Update(vr))
+	require.Equal(t, "test-namespace/test-pvc", getParentKey(vr))
+	require.NoError(t, PvcInformer.Informer().GetIndexer().Update(patched))
+
+	reconcileVolumeReplication(t.Context(), "test-namespace/test-pvc")
+	vr, err = dynamicClient.Resource(VolumeReplicationResource).Namespace("test-namespace").Get(t.Context(), "test-pvc", metav1.GetOptions{})
+	require.NoError(t, err)
+	require.Equal(t, "test-pvc", vr.GetLabels()[constants.ParentLabel])
+	patched, err = client.CoreV1().PersistentVolumeClaims("test-namespace").Get(t.Context(), "test-pvc", metav1.GetOptions{})
+	require.NoError(t, err)
+	require.NotContains(t, patched.Annotations, constants.ConflictAnnotation)
+}
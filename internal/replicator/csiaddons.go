@@ -0,0 +1,79 @@
+package replicator
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/klog/v2"
+)
+
+// csiAddonsBackend replicates PVCs through CSI-addons VolumeReplications, their class is a VolumeReplicationClass
+type csiAddonsBackend struct{}
+
+func (csiAddonsBackend) kind() string {
+	return "VolumeReplication"
+}
+
+func (csiAddonsBackend) resource() schema.GroupVersionResource {
+	return VolumeReplicationResource
+}
+
+func (csiAddonsBackend) requiredResources() []schema.GroupVersionResource {
+	return []schema.GroupVersionResource{VolumeReplicationResource, VolumeReplicationClassesResource}
+}
+
+func (csiAddonsBackend) resolve(ctx context.Context, pvc *corev1.PersistentVolumeClaim, target replicationTarget) classResolution {
+	return resolveTargetClass(ctx, pvc, target, listClassesOf(VolumeReplicationClassesResource), "VolumeReplicationClass")
+}
+
+func (csiAddonsBackend) build(_ context.Context, pvc *corev1.PersistentVolumeClaim, target replicationTarget, class string) (*unstructured.Unstructured, error) {
+	return buildTargetVolumeReplication(pvc, target, class), nil
+}
+
+// compare re-creates VolumeReplications whose class or dataSource changed, as they can't be live updated.
+// The replicationState is updated in place.
+func (csiAddonsBackend) compare(existing, desired *unstructured.Unstructured) comparison {
+	key := fmt.Sprintf("%s/%s", existing.GetNamespace(), existing.GetName())
+
+	// Check that the VRC correspond to the one inherited from the PVC
+	replicationClass, _, _ := unstructured.NestedString(existing.Object, "spec", "volumeReplicationClass")
+	desiredClass, _, _ := unstructured.NestedString(desired.Object, "spec", "volumeReplicationClass")
+	if replicationClass != desiredClass {
+		klog.Infof("VolumeReplication %s has a replication class mismatch with its parent (got %s)", key, replicationClass)
+		return needsRecreate
+	}
+
+	// Check that the dataSource points to the PVC
+	dataSource, _, _ := unstructured.NestedNullCoercingStringMap(existing.Object, "spec", "dataSource")
+	desiredDataSource, _, _ := unstructured.NestedNullCoercingStringMap(desired.Object, "spec", "dataSource")
+	if dataSource["apiGroup"] != desiredDataSource["apiGroup"] || dataSource["kind"] != desiredDataSource["kind"] || dataSource["name"] != desiredDataSource["name"] {
+		klog.Infof("VolumeReplication %s has a dataSource mismatch with its parent", key)
+		return needsRecreate
+	}
+
+	currentState, _, _ := unstructured.NestedString(existing.Object, "spec", "replicationState")
+	desiredState, _, _ := unstructured.NestedString(desired.Object, "spec", "replicationState")
+	if currentState != desiredState {
+		klog.Infof("VolumeReplication %s has a new replication state %s (was %s)", key, desiredState, currentState)
+		return needsUpdate
+	}
+	return upToDate
+}
+
+func (csiAddonsBackend) class(obj *unstructured.Unstructured) string {
+	replicationClass, _, _ := unstructured.NestedString(obj.Object, "spec", "volumeReplicationClass")
+	return replicationClass
+}
+
+func (csiAddonsBackend) statusFields() [][]string {
+	return [][]string{{"status", "conditions"}}
+}
+
+// status reports VolumeReplications as unhealthy while they are degraded
+func (csiAddonsBackend) status(obj *unstructured.Unstructured) (bool, string) {
+	degraded, message := getConditionMessage(obj, "Degraded", "True")
+	return !degraded, message
+}
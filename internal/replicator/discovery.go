@@ -0,0 +1,102 @@
+package replicator
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/super-phenix/volume-replicator/internal/k8s"
+	"github.com/super-phenix/volume-replicator/internal/metrics"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+)
+
+var (
+	// discoveryRetryPeriod is the initial delay between two discoveries of the replication API, doubled up to discoveryRetryCap
+	discoveryRetryPeriod = 5 * time.Second
+	discoveryRetryCap    = 2 * time.Minute
+)
+
+// WaitForReplicationAPI waits for the CRDs of the replication API of the backend to be served by the cluster,
+// at the version the controller writes. The controller is reported as not ready until they are.
+// It only returns an error if the context is cancelled first.
+func WaitForReplicationAPI(ctx context.Context) error {
+	groupVersion := activeBackend.resource().GroupVersion()
+	backoff := wait.Backoff{Duration: discoveryRetryPeriod, Factor: 2, Cap: discoveryRetryCap, Steps: math.MaxInt32}
+	for {
+		err := checkReplicationAPI(groupVersion)
+		if err == nil {
+			klog.Infof("using %s for %ss", groupVersion, activeBackend.kind())
+			return nil
+		}
+
+		metrics.SetNotReady(err.Error())
+		delay := backoff.Step()
+		klog.Warningf("replication API unavailable, retrying in %s: %s", delay, err.Error())
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// checkReplicationAPI returns why a version of a replication API can't be used by the controller,
+// nil if the cluster serves it with every resource needed by the controller.
+// The controller only writes the version its resources are pinned to, other served versions are ignored.
+func checkReplicationAPI(groupVersion schema.GroupVersion) error {
+	groups, err := k8s.ClientSet.Discovery().ServerGroups()
+	if err != nil {
+		return fmt.Errorf("failed to discover API groups: %w", err)
+	}
+
+	var served []string
+	for _, apiGroup := range groups.Groups {
+		if apiGroup.Name != groupVersion.Group {
+			continue
+		}
+		for _, version := range apiGroup.Versions {
+			served = append(served, version.Version)
+		}
+	}
+	if len(served) == 0 {
+		return fmt.Errorf("API group %s isn't served, the CRDs of the %s backend must be installed", groupVersion.Group, activeBackend.kind())
+	}
+	if !slices.Contains(served, groupVersion.Version) {
+		return fmt.Errorf("API group %s serves versions %s, but the controller only supports %s",
+			groupVersion.Group, strings.Join(served, ", "), groupVersion.Version)
+	}
+
+	resources, err := k8s.ClientSet.Discovery().ServerResourcesForGroupVersion(groupVersion.String())
+	if err != nil {
+		return fmt.Errorf("failed to discover resources of %s: %w", groupVersion, err)
+	}
+	if missing := missingResources(resources); len(missing) > 0 {
+		return fmt.Errorf("%s doesn't serve %s, the CRDs must be installed", groupVersion, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// missingResources returns the resources needed by the controller that aren't in a list of served resources
+func missingResources(resources *metav1.APIResourceList) []string {
+	needed := activeBackend.requiredResources()
+	if VolumeGroups {
+		needed = append(needed, VolumeGroupReplicationResource, VolumeGroupReplicationClassesResource)
+	}
+
+	var missing []string
+	for _, resource := range needed {
+		if !slices.ContainsFunc(resources.APIResources, func(served metav1.APIResource) bool {
+			return served.Name == resource.Resource
+		}) {
+			missing = append(missing, resource.Resource)
+		}
+	}
+	return missing
+}
@@ -0,0 +1,101 @@
+package replicator
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/super-phenix/volume-replicator/internal/k8s"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// newReplicationAPI returns the resources served by a version of the replication API
+func newReplicationAPI(version string, resources ...string) *metav1.APIResourceList {
+	list := &metav1.APIResourceList{GroupVersion: volumeReplicationGroup + "/" + version}
+	for _, resource := range resources {
+		list.APIResources = append(list.APIResources, metav1.APIResource{Name: resource, Namespaced: true})
+	}
+	return list
+}
+
+func TestCheckReplicationAPI(t *testing.T) {
+	tests := []struct {
+		name          string
+		resources     []*metav1.APIResourceList
+		volumeGroups  bool
+		expectedError string
+	}{
+		{
+			name:      "Supported version",
+			resources: []*metav1.APIResourceList{newReplicationAPI("v1alpha1", "volumereplications", "volumereplicationclasses")},
+		},
+		{
+			name: "Supported version among several served",
+			resources: []*metav1.APIResourceList{
+				newReplicationAPI("v1alpha1", "volumereplications", "volumereplicationclasses"),
+				newReplicationAPI("v1beta1", "volumereplications", "volumereplicationclasses"),
+			},
+		},
+		{
+			name:          "Missing CRDs",
+			resources:     []*metav1.APIResourceList{{GroupVersion: "v1", APIResources: []metav1.APIResource{{Name: "pods"}}}},
+			expectedError: "isn't served",
+		},
+		{
+			name:          "Unsupported version",
+			resources:     []*metav1.APIResourceList{newReplicationAPI("v2", "volumereplications", "volumereplicationclasses")},
+			expectedError: "only supports v1alpha1",
+		},
+		{
+			name:          "Missing class CRD",
+			resources:     []*metav1.APIResourceList{newReplicationAPI("v1alpha1", "volumereplications")},
+			expectedError: "doesn't serve volumereplicationclasses",
+		},
+		{
+			name:          "Missing group CRDs with volume groups",
+			resources:     []*metav1.APIResourceList{newReplicationAPI("v1alpha1", "volumereplications", "volumereplicationclasses")},
+			volumeGroups:  true,
+			expectedError: "doesn't serve volumegroupreplications, volumegroupreplicationclasses",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := fake.NewClientset()
+			client.Discovery().(*fakediscovery.FakeDiscovery).Resources = tt.resources
+			k8s.ClientSet = client
+			VolumeGroups = tt.volumeGroups
+			defer func() { VolumeGroups = false }()
+
+			err := checkReplicationAPI(VolumeReplicationResource.GroupVersion())
+			if tt.expectedError != "" {
+				require.ErrorContains(t, err, tt.expectedError)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestWaitForReplicationAPI(t *testing.T) {
+	previousPeriod := discoveryRetryPeriod
+	discoveryRetryPeriod = 10 * time.Millisecond
+	defer func() { discoveryRetryPeriod = previousPeriod }()
+
+	client := fake.NewClientset()
+	k8s.ClientSet = client
+
+	// Without the CRDs, the controller waits until it is stopped
+	ctx, cancel := context.WithTimeout(t.Context(), 50*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, WaitForReplicationAPI(ctx), context.DeadlineExceeded)
+
+	// Once the CRDs are installed, the controller goes on
+	client.Discovery().(*fakediscovery.FakeDiscovery).Resources = []*metav1.APIResourceList{
+		newReplicationAPI("v1alpha1", "volumereplications", "volumereplicationclasses"),
+	}
+	require.NoError(t, WaitForReplicationAPI(t.Context()))
+}
@@ -0,0 +1,159 @@
+package replicator
+
+import (
+	"context"
+	"maps"
+
+	"github.com/super-phenix/volume-replicator/internal/constants"
+	"github.com/super-phenix/volume-replicator/internal/k8s"
+	"github.com/super-phenix/volume-replicator/internal/metrics"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/klog/v2"
+)
+
+// RewriteAliasKeys moves the annotations and labels of PVCs from the alias domains to the domain of the controller
+var RewriteAliasKeys bool
+
+// findKey returns the value of a key of the controller, falling back to the key under each alias domain.
+// The key that supplied the value is returned along with it.
+func findKey(values map[string]string, key string) (value, source string, ok bool) {
+	if value, ok = values[key]; ok {
+		return value, key, true
+	}
+
+	for _, alias := range constants.Aliases(key) {
+		if value, ok = values[alias]; ok {
+			return value, alias, true
+		}
+	}
+
+	return "", "", false
+}
+
+// lookupKey returns the value of a key of the controller, falling back to the key under each alias domain.
+// Values supplied by an alias are reported, so that remaining legacy keys can be found before an alias is dropped.
+func lookupKey(values map[string]string, key string) (string, bool) {
+	value, source, ok := findKey(values, key)
+	if ok && source != key {
+		klog.V(2).Infof("read %s from alias %s", key, source)
+		metrics.AliasKeyReads.WithLabelValues(source).Inc()
+	}
+	return value, ok
+}
+
+// getKeyValue returns the value of a key of the controller, or an empty string if neither the key nor its aliases are set
+func getKeyValue(values map[string]string, key string) string {
+	value, _ := lookupKey(values, key)
+	return value
+}
+
+// withAliases returns a copy of attributes in which every key of the controller is also set under each alias domain,
+// so that selector expressions written for an alias domain keep matching
+func withAliases(attributes map[string]string) map[string]string {
+	res := maps.Clone(attributes)
+	for key, value := range attributes {
+		for _, alias := range constants.Aliases(key) {
+			if _, ok := res[alias]; !ok {
+				res[alias] = value
+			}
+		}
+	}
+	return res
+}
+
+// withAliasRemovals returns a copy of a patch in which every removed key of the controller is also removed under the alias domains
+func withAliasRemovals(patch map[string]*string) map[string]*string {
+	res := maps.Clone(patch)
+	for key, value := range patch {
+		if value != nil {
+			continue
+		}
+		for _, alias := range constants.Aliases(key) {
+			res[alias] = nil
+		}
+	}
+	return res
+}
+
+// listWithDomainLabels lists the cluster-scoped objects of a resource that have some labels of the controller.
+// As a label selector can't express fallbacks, the objects are listed once for each domain, then deduplicated by name.
+func listWithDomainLabels(ctx context.Context, resource schema.GroupVersionResource, labels map[string]string) ([]unstructured.Unstructured, error) {
+	var items []unstructured.Unstructured
+	seen := make(map[string]bool)
+
+	for _, domain := range constants.Domains() {
+		matchLabels := make(map[string]string, len(labels))
+		for key, value := range labels {
+			matchLabels[constants.InDomain(key, domain)] = value
+		}
+		labelSelector := &metav1.LabelSelector{MatchLabels: matchLabels}
+
+		callCtx, cancel := withAPITimeout(ctx)
+		list, err := k8s.DynamicClientSet.Resource(resource).List(callCtx, metav1.ListOptions{LabelSelector: metav1.FormatLabelSelector(labelSelector)})
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, item := range list.Items {
+			if seen[item.GetName()] {
+				continue
+			}
+			seen[item.GetName()] = true
+
+			if domain != constants.Domain {
+				klog.V(2).Infof("found %s %s through alias domain %s", resource.Resource, item.GetName(), domain)
+				for key := range labels {
+					metrics.AliasKeyReads.WithLabelValues(constants.InDomain(key, domain)).Inc()
+				}
+			}
+			items = append(items, item)
+		}
+	}
+
+	return items, nil
+}
+
+// rewriteAliasKeys moves the annotations and labels of a PVC from the alias domains to the domain of the controller.
+// A key already set under the domain of the controller has priority, its aliases are only removed.
+func rewriteAliasKeys(ctx context.Context, pvc *corev1.PersistentVolumeClaim) {
+	if !RewriteAliasKeys || len(constants.AliasDomains) == 0 {
+		return
+	}
+
+	annotations := getAliasRewrites(pvc.Annotations)
+	labels := getAliasRewrites(pvc.Labels)
+	if len(annotations) == 0 && len(labels) == 0 {
+		return
+	}
+
+	if err := patchPvcMetadata(ctx, pvc, annotations, labels); err != nil {
+		klog.Errorf("failed to rewrite alias keys of PVC %s/%s: %s", pvc.Namespace, pvc.Name, err.Error())
+		return
+	}
+
+	klog.Infof("moved annotations and labels of PVC %s/%s to domain %s", pvc.Namespace, pvc.Name, constants.Domain)
+	recordEvent(pvc, corev1.EventTypeNormal, reasonAliasKeysRewritten, "Moved annotations and labels to domain %s", constants.Domain)
+}
+
+// getAliasRewrites returns the patch moving keys from the alias domains to the domain of the controller, nil values remove a key
+func getAliasRewrites(values map[string]string) map[string]*string {
+	rewrites := make(map[string]*string)
+	for key := range values {
+		canonical, ok := constants.Canonical(key)
+		if !ok {
+			continue
+		}
+		rewrites[key] = nil
+
+		// The value follows the same precedence as when it is read
+		if _, exists := values[canonical]; !exists {
+			value, _, _ := findKey(values, canonical)
+			rewrites[canonical] = &value
+		}
+	}
+	return rewrites
+}
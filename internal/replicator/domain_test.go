@@ -0,0 +1,155 @@
+package replicator
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/super-phenix/volume-replicator/internal/constants"
+	"github.com/super-phenix/volume-replicator/internal/k8s"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+const (
+	testDomain      = "replication.example.com"
+	testAliasDomain = "legacy.example.com"
+)
+
+func TestLookupKey(t *testing.T) {
+	constants.SetDomain(testDomain, []string{constants.DefaultDomain, testAliasDomain})
+	defer constants.SetDomain(constants.DefaultDomain, nil)
+
+	tests := []struct {
+		name           string
+		values         map[string]string
+		expectedValue  string
+		expectedSource string
+		expectedOk     bool
+	}{
+		{
+			name:           "Key under the domain",
+			values:         map[string]string{testDomain + "/class": "daily"},
+			expectedValue:  "daily",
+			expectedSource: testDomain + "/class",
+			expectedOk:     true,
+		},
+		{
+			name:           "Key under an alias domain",
+			values:         map[string]string{testAliasDomain + "/class": "hourly"},
+			expectedValue:  "hourly",
+			expectedSource: testAliasDomain + "/class",
+			expectedOk:     true,
+		},
+		{
+			name: "Domain has priority over aliases",
+			values: map[string]string{
+				testDomain + "/class":      "daily",
+				testAliasDomain + "/class": "hourly",
+			},
+			expectedValue:  "daily",
+			expectedSource: testDomain + "/class",
+			expectedOk:     true,
+		},
+		{
+			name: "Aliases are read in order",
+			values: map[string]string{
+				constants.DefaultDomain + "/class": "weekly",
+				testAliasDomain + "/class":         "hourly",
+			},
+			expectedValue:  "weekly",
+			expectedSource: constants.DefaultDomain + "/class",
+			expectedOk:     true,
+		},
+		{
+			name:       "Missing key",
+			values:     map[string]string{"example.org/class": "daily"},
+			expectedOk: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			value, source, ok := findKey(tt.values, constants.VrcValueAnnotation)
+			require.Equal(t, tt.expectedValue, value)
+			require.Equal(t, tt.expectedSource, source)
+			require.Equal(t, tt.expectedOk, ok)
+		})
+	}
+}
+
+func TestRewriteAliasKeys(t *testing.T) {
+	constants.SetDomain(testDomain, []string{testAliasDomain})
+	RewriteAliasKeys = true
+	defer func() {
+		constants.SetDomain(constants.DefaultDomain, nil)
+		RewriteAliasKeys = false
+	}()
+
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test-pvc",
+			Namespace: "test-namespace",
+			Annotations: map[string]string{
+				testAliasDomain + "/class":         "hourly",
+				testAliasDomain + "/pause":         "true",
+				testDomain + "/pause":              "false",
+				testAliasDomain + "/notControlled": "kept",
+			},
+			Labels: map[string]string{
+				testAliasDomain + "/instance": "tenant-a",
+				"app":                         "db",
+			},
+		},
+	}
+	client := fake.NewClientset(pvc)
+	k8s.ClientSet = client
+
+	rewriteAliasKeys(t.Context(), pvc)
+
+	patched, err := client.CoreV1().PersistentVolumeClaims(pvc.Namespace).Get(t.Context(), pvc.Name, metav1.GetOptions{})
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{
+		testDomain + "/class":              "hourly",
+		testDomain + "/pause":              "false",
+		testAliasDomain + "/notControlled": "kept",
+	}, patched.Annotations)
+	require.Equal(t, map[string]string{
+		testDomain + "/instance": "tenant-a",
+		"app":                    "db",
+	}, patched.Labels)
+}
+
+func TestFilterVrcFromSelectorWithAliases(t *testing.T) {
+	_, dynamicClient, _ := setupTestEnvironment()
+
+	// VRCs labelled before the migration use the previous domain
+	legacy := newVrc("legacy", "group-1", "match", "provisioner-1", nil)
+	constants.SetDomain(testDomain, []string{constants.DefaultDomain})
+	defer constants.SetDomain(constants.DefaultDomain, nil)
+	current := newVrc("current", "group-1", "match", "provisioner-1", nil)
+
+	_, err := dynamicClient.Resource(VolumeReplicationClassesResource).Create(t.Context(), legacy, metav1.CreateOptions{})
+	require.NoError(t, err)
+	_, err = dynamicClient.Resource(VolumeReplicationClassesResource).Create(t.Context(), current, metav1.CreateOptions{})
+	require.NoError(t, err)
+
+	list, err := filterVrcFromSelector(t.Context(), "group-1", "match", "provisioner-1")
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"legacy", "current"}, vrcNames(list))
+}
+
+func TestWithAliases(t *testing.T) {
+	constants.SetDomain(testDomain, []string{testAliasDomain})
+	defer constants.SetDomain(constants.DefaultDomain, nil)
+
+	attributes := withAliases(map[string]string{
+		constants.VolumeModeAttribute: "Block",
+		"app":                         "db",
+	})
+	require.Equal(t, map[string]string{
+		testDomain + "/volumeMode":      "Block",
+		testAliasDomain + "/volumeMode": "Block",
+		"app":                           "db",
+	}, attributes)
+}
@@ -0,0 +1,53 @@
+package replicator
+
+import (
+	"github.com/super-phenix/volume-replicator/internal/k8s"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+const (
+	reasonReplicationExcluded = "ReplicationExcluded"
+	reasonReplicationIncluded = "ReplicationIncluded"
+
+	reasonInvalidExclusionRegex = "InvalidExclusionRegex"
+	reasonBindTimeout           = "BindTimeout"
+	reasonProvisionerFallback   = "ProvisionerFallback"
+	reasonUnknownProvisioner    = "UnknownProvisioner"
+
+	reasonVolumeReplicationClassResolved  = "VolumeReplicationClassResolved"
+	reasonAmbiguousVolumeReplicationClass = "AmbiguousVolumeReplicationClass"
+	reasonVolumeReplicationClassError     = "VolumeReplicationClassError"
+
+	reasonClassChangePending = "ClassChangePending"
+	reasonClassChangeApplied = "ClassChangeApplied"
+
+	reasonSnapshotCreated = "SnapshotCreated"
+	reasonSnapshotFailed  = "SnapshotFailed"
+	reasonSnapshotTimeout = "SnapshotTimeout"
+
+	reasonReplicationFrozen = "ReplicationFrozen"
+
+	reasonAliasKeysRewritten = "AliasKeysRewritten"
+
+	reasonReplicationDegraded = "ReplicationDegraded"
+	reasonReplicationHealthy  = "ReplicationHealthy"
+
+	reasonVolumeGroupJoined     = "VolumeGroupJoined"
+	reasonVolumeGroupLeft       = "VolumeGroupLeft"
+	reasonVolumeGroupUnresolved = "VolumeGroupUnresolved"
+	reasonVolumeGroupBlocked    = "VolumeGroupBlocked"
+	reasonVolumeGroupUnblocked  = "VolumeGroupUnblocked"
+
+	reasonReplicationConflict = "ReplicationConflict"
+	reasonReplicationAdopted  = "ReplicationAdopted"
+	reasonFieldConflict       = "FieldConflict"
+)
+
+// recordEvent emits an Event on an object, if an event recorder is available
+func recordEvent(object runtime.Object, eventType, reason, messageFmt string, args ...any) {
+	if k8s.Recorder == nil || object == nil {
+		return
+	}
+
+	k8s.Recorder.Eventf(object, eventType, reason, messageFmt, args...)
+}
@@ -0,0 +1,287 @@
+package replicator
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"sync"
+
+	"github.com/super-phenix/volume-replicator/internal/constants"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	RuleActionInclude = "include"
+	RuleActionExclude = "exclude"
+)
+
+var (
+	ExclusionRules []*ExclusionRule
+
+	// namespaceRegexCache holds the compiled exclusion regex of each namespace, replaced when its pattern changes
+	namespaceRegexCache sync.Map
+)
+
+// namespaceRegex is the exclusion regex of a namespace, compiled from its pattern
+type namespaceRegex struct {
+	pattern string
+	regex   *regexp.Regexp
+	err     error
+}
+
+// ExclusionRuleList is the content of the file passed through --exclusion-rules
+type ExclusionRuleList struct {
+	Rules []*ExclusionRule `json:"rules"`
+}
+
+// ExclusionRule decides whether matching PVCs are included in or excluded from replication.
+// Every criterion that is set must match for the rule to apply, unset criteria match everything.
+type ExclusionRule struct {
+	Name              string                              `json:"name"`
+	Action            string                              `json:"action"`
+	NameRegex         string                              `json:"nameRegex,omitempty"`
+	Namespaces        []string                            `json:"namespaces,omitempty"`
+	NamespaceSelector *metav1.LabelSelector               `json:"namespaceSelector,omitempty"`
+	Selector          *metav1.LabelSelector               `json:"selector,omitempty"`
+	StorageClasses    []string                            `json:"storageClasses,omitempty"`
+	VolumeModes       []corev1.PersistentVolumeMode       `json:"volumeModes,omitempty"`
+	AccessModes       []corev1.PersistentVolumeAccessMode `json:"accessModes,omitempty"`
+	MinSize           *resource.Quantity                  `json:"minSize,omitempty"`
+	MaxSize           *resource.Quantity                  `json:"maxSize,omitempty"`
+	OwnerKinds        []string                            `json:"ownerKinds,omitempty"`
+
+	nameRegex         *regexp.Regexp
+	namespaceSelector labels.Selector
+	selector          labels.Selector
+}
+
+// LoadExclusionRules reads and validates the exclusion rules from a YAML or JSON file
+func LoadExclusionRules(path string) ([]*ExclusionRule, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read exclusion rules: %w", err)
+	}
+
+	var list ExclusionRuleList
+	if err = yaml.UnmarshalStrict(content, &list); err != nil {
+		return nil, fmt.Errorf("failed to parse exclusion rules: %w", err)
+	}
+
+	for i, rule := range list.Rules {
+		if err = rule.compile(); err != nil {
+			return nil, fmt.Errorf("invalid exclusion rule %d (%s): %w", i, rule.Name, err)
+		}
+	}
+
+	return list.Rules, nil
+}
+
+// compile validates a rule and prepares its regex and selectors for evaluation
+func (r *ExclusionRule) compile() (err error) {
+	if r.Action != RuleActionInclude && r.Action != RuleActionExclude {
+		return fmt.Errorf("action must be %q or %q, got %q", RuleActionInclude, RuleActionExclude, r.Action)
+	}
+
+	if r.NameRegex != "" {
+		if r.nameRegex, err = regexp.Compile(r.NameRegex); err != nil {
+			return fmt.Errorf("invalid nameRegex: %w", err)
+		}
+	}
+
+	if r.NamespaceSelector != nil {
+		if r.namespaceSelector, err = metav1.LabelSelectorAsSelector(r.NamespaceSelector); err != nil {
+			return fmt.Errorf("invalid namespaceSelector: %w", err)
+		}
+	}
+
+	if r.Selector != nil {
+		if r.selector, err = metav1.LabelSelectorAsSelector(r.Selector); err != nil {
+			return fmt.Errorf("invalid selector: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// matches returns whether a PVC fulfills every criterion of the rule
+func (r *ExclusionRule) matches(pvc *corev1.PersistentVolumeClaim) bool {
+	if r.nameRegex != nil && !r.nameRegex.MatchString(pvc.Name) {
+		return false
+	}
+
+	if len(r.Namespaces) > 0 && !slices.Contains(r.Namespaces, pvc.Namespace) {
+		return false
+	}
+
+	if r.namespaceSelector != nil && !namespaceMatchesSelector(pvc.Namespace, r.namespaceSelector) {
+		return false
+	}
+
+	if r.selector != nil && !r.selector.Matches(labels.Set(pvc.Labels)) {
+		return false
+	}
+
+	if len(r.StorageClasses) > 0 && (pvc.Spec.StorageClassName == nil || !slices.Contains(r.StorageClasses, *pvc.Spec.StorageClassName)) {
+		return false
+	}
+
+	if len(r.VolumeModes) > 0 && !slices.Contains(r.VolumeModes, getPvcVolumeMode(pvc)) {
+		return false
+	}
+
+	if len(r.AccessModes) > 0 && !slices.ContainsFunc(pvc.Spec.AccessModes, func(mode corev1.PersistentVolumeAccessMode) bool {
+		return slices.Contains(r.AccessModes, mode)
+	}) {
+		return false
+	}
+
+	size := pvc.Spec.Resources.Requests[corev1.ResourceStorage]
+	if r.MinSize != nil && size.Cmp(*r.MinSize) < 0 {
+		return false
+	}
+	if r.MaxSize != nil && size.Cmp(*r.MaxSize) > 0 {
+		return false
+	}
+
+	if len(r.OwnerKinds) > 0 && !slices.ContainsFunc(pvc.OwnerReferences, func(owner metav1.OwnerReference) bool {
+		return slices.Contains(r.OwnerKinds, owner.Kind)
+	}) {
+		return false
+	}
+
+	return true
+}
+
+// matchExclusionRule returns the first rule matching a PVC, rules are evaluated in order
+func matchExclusionRule(pvc *corev1.PersistentVolumeClaim) *ExclusionRule {
+	for _, rule := range ExclusionRules {
+		if rule.matches(pvc) {
+			return rule
+		}
+	}
+
+	return nil
+}
+
+// explainExclusion returns whether a PVC is excluded from replication and a human-readable explanation.
+// The first matching rule decides, the global and namespace exclusion regex only apply when no rule matches.
+// The explanation is empty when nothing in the exclusion configuration applied to the PVC.
+func explainExclusion(pvc *corev1.PersistentVolumeClaim) (bool, string) {
+	if rule := matchExclusionRule(pvc); rule != nil {
+		return rule.Action == RuleActionExclude, fmt.Sprintf("%sd by rule %q", rule.Action, rule.Name)
+	}
+
+	if pvcNameMatchesExclusion(pvc) {
+		return true, fmt.Sprintf("excluded by exclusion regex %q", ExclusionRegex.String())
+	}
+
+	if pattern := pvcNameMatchesNamespaceExclusion(pvc); pattern != "" {
+		return true, fmt.Sprintf("excluded by namespace exclusion regex %q", pattern)
+	}
+
+	return false, ""
+}
+
+// pvcNameMatchesNamespaceExclusion returns the exclusion regex of the PVC's namespace if the PVC name matches it.
+// An empty string is returned if the namespace has no exclusion regex, or if the name doesn't match it.
+func pvcNameMatchesNamespaceExclusion(pvc *corev1.PersistentVolumeClaim) string {
+	pattern := getNamespaceAnnotationValue(pvc.Namespace, constants.ExclusionRegexAnnotation)
+	if pattern == "" {
+		forgetNamespaceRegex(pvc.Namespace)
+		return ""
+	}
+
+	regex, err := compileNamespaceRegex(pvc.Namespace, pattern)
+	if err != nil || !regex.MatchString(pvc.Name) {
+		return ""
+	}
+
+	return pattern
+}
+
+// compileNamespaceRegex compiles the exclusion regex of a namespace, reusing it until the pattern of the namespace changes.
+// An invalid pattern is reported on the namespace once, when it is first compiled.
+func compileNamespaceRegex(namespace, pattern string) (*regexp.Regexp, error) {
+	if cached, ok := namespaceRegexCache.Load(namespace); ok && cached.(*namespaceRegex).pattern == pattern {
+		return cached.(*namespaceRegex).regex, cached.(*namespaceRegex).err
+	}
+
+	// Another worker may have compiled the same pattern concurrently, it is then reported only once
+	regex, err := regexp.Compile(pattern)
+	previous, loaded := namespaceRegexCache.Swap(namespace, &namespaceRegex{pattern: pattern, regex: regex, err: err})
+	if err != nil && (!loaded || previous.(*namespaceRegex).pattern != pattern) {
+		klog.Errorf("invalid exclusion regex on namespace %s: %s", namespace, err.Error())
+		if ns, nsErr := getNamespace(namespace); nsErr == nil {
+			recordEvent(ns, corev1.EventTypeWarning, reasonInvalidExclusionRegex, "Invalid exclusion regex %q: %s", pattern, err.Error())
+		}
+	}
+	return regex, err
+}
+
+// forgetNamespaceRegex forgets the exclusion regex of a namespace
+func forgetNamespaceRegex(namespace string) {
+	namespaceRegexCache.Delete(namespace)
+}
+
+// isPvcExcluded returns whether a PVC is excluded from replication
+func isPvcExcluded(pvc *corev1.PersistentVolumeClaim) bool {
+	excluded, _ := explainExclusion(pvc)
+	return excluded
+}
+
+// namespaceMatchesSelector returns whether the labels of a namespace match a selector
+func namespaceMatchesSelector(namespace string, selector labels.Selector) bool {
+	ns, err := getNamespace(namespace)
+	if err != nil {
+		klog.Errorf("failed to retrieve namespace %s: %s", namespace, err.Error())
+		return false
+	}
+
+	return selector.Matches(labels.Set(ns.Labels))
+}
+
+// getPvcVolumeMode returns the volumeMode of a PVC, defaulting to Filesystem like the API server does
+func getPvcVolumeMode(pvc *corev1.PersistentVolumeClaim) corev1.PersistentVolumeMode {
+	if pvc.Spec.VolumeMode == nil {
+		return corev1.PersistentVolumeFilesystem
+	}
+
+	return *pvc.Spec.VolumeMode
+}
+
+// reportExclusion logs and emits an Event explaining which exclusion setting applies to a PVC.
+// The decision is recorded in an annotation of the PVC, so that it is only reported when it changes.
+func reportExclusion(ctx context.Context, pvc *corev1.PersistentVolumeClaim) {
+	excluded, explanation := explainExclusion(pvc)
+	current, found := lookupKey(pvc.Annotations, constants.ExclusionAnnotation)
+	if explanation == current {
+		return
+	}
+
+	if explanation == "" {
+		klog.Infof("PVC %s/%s isn't matched by any exclusion setting anymore", pvc.Namespace, pvc.Name)
+		if found {
+			if err := patchPvcAnnotations(ctx, pvc, map[string]*string{constants.ExclusionAnnotation: nil}); err != nil {
+				klog.Errorf("failed to clear the exclusion decision of PVC %s/%s: %s", pvc.Namespace, pvc.Name, err.Error())
+			}
+		}
+		return
+	}
+
+	klog.Infof("PVC %s/%s is %s", pvc.Namespace, pvc.Name, explanation)
+	if err := patchPvcAnnotations(ctx, pvc, map[string]*string{constants.ExclusionAnnotation: &explanation}); err != nil {
+		klog.Errorf("failed to record the exclusion decision of PVC %s/%s: %s", pvc.Namespace, pvc.Name, err.Error())
+	}
+	if excluded {
+		recordEvent(pvc, corev1.EventTypeNormal, reasonReplicationExcluded, "PVC is %s", explanation)
+	} else {
+		recordEvent(pvc, corev1.EventTypeNormal, reasonReplicationIncluded, "PVC is %s", explanation)
+	}
+}
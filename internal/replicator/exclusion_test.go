@@ -0,0 +1,430 @@
+package replicator
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/super-phenix/volume-replicator/internal/constants"
+	"github.com/super-phenix/volume-replicator/internal/k8s"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestLoadExclusionRules(t *testing.T) {
+	tests := []struct {
+		name      string
+		content   string
+		expectErr bool
+		expected  int
+	}{
+		{
+			name: "Valid rules",
+			content: `
+rules:
+  - name: cdi-prime
+    action: exclude
+    ownerKinds: [PersistentVolumeClaim]
+  - name: keep-databases
+    action: include
+    selector:
+      matchLabels:
+        app: database
+  - name: huge-scratch
+    action: exclude
+    minSize: 10Ti
+    volumeModes: [Block]
+`,
+			expected: 3,
+		},
+		{
+			name: "Invalid action",
+			content: `
+rules:
+  - name: broken
+    action: drop
+`,
+			expectErr: true,
+		},
+		{
+			name: "Invalid regex",
+			content: `
+rules:
+  - name: broken
+    action: exclude
+    nameRegex: "[invalid"
+`,
+			expectErr: true,
+		},
+		{
+			name: "Invalid selector",
+			content: `
+rules:
+  - name: broken
+    action: exclude
+    selector:
+      matchExpressions:
+        - key: app
+          operator: Unknown
+`,
+			expectErr: true,
+		},
+		{
+			name: "Unknown field",
+			content: `
+rules:
+  - name: broken
+    action: exclude
+    storageClass: typo
+`,
+			expectErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "rules.yaml")
+			require.NoError(t, os.WriteFile(path, []byte(tt.content), 0o600))
+
+			rules, err := LoadExclusionRules(path)
+			if tt.expectErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Len(t, rules, tt.expected)
+		})
+	}
+
+	t.Run("Missing file", func(t *testing.T) {
+		_, err := LoadExclusionRules(filepath.Join(t.TempDir(), "missing.yaml"))
+		require.Error(t, err)
+	})
+}
+
+func TestExplainExclusion(t *testing.T) {
+	client := fake.NewClientset()
+	informerFactory := informers.NewSharedInformerFactory(client, 0)
+	NamespaceInformer = informerFactory.Core().V1().Namespaces()
+
+	nsName := "test-namespace"
+
+	stcName := "fast"
+	blockMode := corev1.PersistentVolumeBlock
+	hugeSize := resource.MustParse("1Ti")
+	smallSize := resource.MustParse("1Gi")
+
+	newRule := func(rule *ExclusionRule) *ExclusionRule {
+		require.NoError(t, rule.compile())
+		return rule
+	}
+
+	tests := []struct {
+		name             string
+		rules            []*ExclusionRule
+		exclusionRegex   string
+		nsAnnotations    map[string]string
+		pvc              *corev1.PersistentVolumeClaim
+		expectedExcluded bool
+		expectedReason   string
+	}{
+		{
+			name: "No configuration",
+			pvc: &corev1.PersistentVolumeClaim{
+				ObjectMeta: metav1.ObjectMeta{Name: "pvc", Namespace: nsName},
+			},
+			expectedExcluded: false,
+			expectedReason:   "",
+		},
+		{
+			name:           "Global regex only",
+			exclusionRegex: "^prime-",
+			pvc: &corev1.PersistentVolumeClaim{
+				ObjectMeta: metav1.ObjectMeta{Name: "prime-123", Namespace: nsName},
+			},
+			expectedExcluded: true,
+			expectedReason:   `excluded by exclusion regex "^prime-"`,
+		},
+		{
+			name: "Owner kind rule",
+			rules: []*ExclusionRule{
+				newRule(&ExclusionRule{Name: "ephemeral", Action: RuleActionExclude, OwnerKinds: []string{"Pod"}}),
+			},
+			pvc: &corev1.PersistentVolumeClaim{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:            "pod-data",
+					Namespace:       nsName,
+					OwnerReferences: []metav1.OwnerReference{{Kind: "Pod", Name: "pod"}},
+				},
+			},
+			expectedExcluded: true,
+			expectedReason:   `excluded by rule "ephemeral"`,
+		},
+		{
+			name: "Include rule takes precedence over later exclude rule",
+			rules: []*ExclusionRule{
+				newRule(&ExclusionRule{Name: "keep-db", Action: RuleActionInclude, Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "db"}}}),
+				newRule(&ExclusionRule{Name: "scratch-ns", Action: RuleActionExclude, NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"tier": "scratch"}}}),
+			},
+			pvc: &corev1.PersistentVolumeClaim{
+				ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: nsName, Labels: map[string]string{"app": "db"}},
+			},
+			expectedExcluded: false,
+			expectedReason:   `included by rule "keep-db"`,
+		},
+		{
+			name: "Include rule overrides global regex",
+			rules: []*ExclusionRule{
+				newRule(&ExclusionRule{Name: "keep-ns", Action: RuleActionInclude, Namespaces: []string{nsName}}),
+			},
+			exclusionRegex: "^prime-",
+			pvc: &corev1.PersistentVolumeClaim{
+				ObjectMeta: metav1.ObjectMeta{Name: "prime-123", Namespace: nsName},
+			},
+			expectedExcluded: false,
+			expectedReason:   `included by rule "keep-ns"`,
+		},
+		{
+			name: "Namespace label rule",
+			rules: []*ExclusionRule{
+				newRule(&ExclusionRule{Name: "scratch-ns", Action: RuleActionExclude, NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"tier": "scratch"}}}),
+			},
+			pvc: &corev1.PersistentVolumeClaim{
+				ObjectMeta: metav1.ObjectMeta{Name: "pvc", Namespace: nsName},
+			},
+			expectedExcluded: true,
+			expectedReason:   `excluded by rule "scratch-ns"`,
+		},
+		{
+			name: "All criteria must match",
+			rules: []*ExclusionRule{
+				newRule(&ExclusionRule{
+					Name:           "huge-block",
+					Action:         RuleActionExclude,
+					StorageClasses: []string{stcName},
+					VolumeModes:    []corev1.PersistentVolumeMode{corev1.PersistentVolumeBlock},
+					MinSize:        &hugeSize,
+				}),
+			},
+			pvc: &corev1.PersistentVolumeClaim{
+				ObjectMeta: metav1.ObjectMeta{Name: "pvc", Namespace: nsName},
+				Spec: corev1.PersistentVolumeClaimSpec{
+					StorageClassName: &stcName,
+					VolumeMode:       &blockMode,
+					Resources: corev1.VolumeResourceRequirements{
+						Requests: corev1.ResourceList{corev1.ResourceStorage: smallSize},
+					},
+				},
+			},
+			expectedExcluded: false,
+			expectedReason:   "",
+		},
+		{
+			name: "Size range and access modes",
+			rules: []*ExclusionRule{
+				newRule(&ExclusionRule{
+					Name:        "small-rwx",
+					Action:      RuleActionExclude,
+					AccessModes: []corev1.PersistentVolumeAccessMode{corev1.ReadWriteMany},
+					MaxSize:     &smallSize,
+				}),
+			},
+			pvc: &corev1.PersistentVolumeClaim{
+				ObjectMeta: metav1.ObjectMeta{Name: "pvc", Namespace: nsName},
+				Spec: corev1.PersistentVolumeClaimSpec{
+					AccessModes: []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce, corev1.ReadWriteMany},
+					Resources: corev1.VolumeResourceRequirements{
+						Requests: corev1.ResourceList{corev1.ResourceStorage: smallSize},
+					},
+				},
+			},
+			expectedExcluded: true,
+			expectedReason:   `excluded by rule "small-rwx"`,
+		},
+		{
+			name: "Volume mode defaults to Filesystem",
+			rules: []*ExclusionRule{
+				newRule(&ExclusionRule{Name: "filesystem", Action: RuleActionExclude, VolumeModes: []corev1.PersistentVolumeMode{corev1.PersistentVolumeFilesystem}}),
+			},
+			pvc: &corev1.PersistentVolumeClaim{
+				ObjectMeta: metav1.ObjectMeta{Name: "pvc", Namespace: nsName},
+			},
+			expectedExcluded: true,
+			expectedReason:   `excluded by rule "filesystem"`,
+		},
+		{
+			name:          "Namespace regex",
+			nsAnnotations: map[string]string{constants.ExclusionRegexAnnotation: "^cache-"},
+			pvc: &corev1.PersistentVolumeClaim{
+				ObjectMeta: metav1.ObjectMeta{Name: "cache-redis", Namespace: nsName},
+			},
+			expectedExcluded: true,
+			expectedReason:   `excluded by namespace exclusion regex "^cache-"`,
+		},
+		{
+			name:          "Namespace regex does not match",
+			nsAnnotations: map[string]string{constants.ExclusionRegexAnnotation: "^cache-"},
+			pvc: &corev1.PersistentVolumeClaim{
+				ObjectMeta: metav1.ObjectMeta{Name: "data", Namespace: nsName},
+			},
+			expectedExcluded: false,
+			expectedReason:   "",
+		},
+		{
+			name:           "Global regex evaluated alongside namespace regex",
+			exclusionRegex: "^prime-",
+			nsAnnotations:  map[string]string{constants.ExclusionRegexAnnotation: "^cache-"},
+			pvc: &corev1.PersistentVolumeClaim{
+				ObjectMeta: metav1.ObjectMeta{Name: "prime-123", Namespace: nsName},
+			},
+			expectedExcluded: true,
+			expectedReason:   `excluded by exclusion regex "^prime-"`,
+		},
+		{
+			name:          "Invalid namespace regex is ignored",
+			nsAnnotations: map[string]string{constants.ExclusionRegexAnnotation: "[invalid"},
+			pvc: &corev1.PersistentVolumeClaim{
+				ObjectMeta: metav1.ObjectMeta{Name: "cache-redis", Namespace: nsName},
+			},
+			expectedExcluded: false,
+			expectedReason:   "",
+		},
+		{
+			name: "Include rule overrides namespace regex",
+			rules: []*ExclusionRule{
+				newRule(&ExclusionRule{Name: "keep-redis", Action: RuleActionInclude, NameRegex: "redis"}),
+			},
+			nsAnnotations: map[string]string{constants.ExclusionRegexAnnotation: "^cache-"},
+			pvc: &corev1.PersistentVolumeClaim{
+				ObjectMeta: metav1.ObjectMeta{Name: "cache-redis", Namespace: nsName},
+			},
+			expectedExcluded: false,
+			expectedReason:   `included by rule "keep-redis"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clearNamespaceIndexer(t)
+			require.NoError(t, NamespaceInformer.Informer().GetIndexer().Add(&corev1.Namespace{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        nsName,
+					Labels:      map[string]string{"tier": "scratch"},
+					Annotations: tt.nsAnnotations,
+				},
+			}))
+
+			ExclusionRules = tt.rules
+			ExclusionRegex = nil
+			if tt.exclusionRegex != "" {
+				ExclusionRegex = regexp.MustCompile(tt.exclusionRegex)
+			}
+			defer func() {
+				ExclusionRules = nil
+				ExclusionRegex = nil
+			}()
+
+			excluded, reason := explainExclusion(tt.pvc)
+			require.Equal(t, tt.expectedExcluded, excluded)
+			require.Equal(t, tt.expectedReason, reason)
+			require.Equal(t, tt.expectedExcluded, isPvcExcluded(tt.pvc))
+		})
+	}
+}
+
+func TestReportExclusion(t *testing.T) {
+	pvc := &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: "cache-redis", Namespace: "test-namespace"}}
+	client := fake.NewClientset(pvc)
+	k8s.ClientSet = client
+	NamespaceInformer = informers.NewSharedInformerFactory(client, 0).Core().V1().Namespaces()
+	recorder := record.NewFakeRecorder(10)
+	k8s.Recorder = recorder
+
+	ExclusionRegex = regexp.MustCompile("^cache-")
+	defer func() {
+		ExclusionRegex = nil
+		k8s.Recorder = nil
+	}()
+
+	reconcile := func() {
+		patched, err := client.CoreV1().PersistentVolumeClaims(pvc.Namespace).Get(t.Context(), pvc.Name, metav1.GetOptions{})
+		require.NoError(t, err)
+		pvc = patched
+		reportExclusion(t.Context(), pvc)
+	}
+
+	// The decision is reported once, and recorded on the PVC
+	reconcile()
+	reconcile()
+	require.Len(t, recorder.Events, 1)
+	require.Contains(t, <-recorder.Events, reasonReplicationExcluded)
+	reconcile()
+	require.Equal(t, `excluded by exclusion regex "^cache-"`, pvc.Annotations[constants.ExclusionAnnotation])
+
+	// The decision is reported again when it changes
+	ExclusionRules = []*ExclusionRule{{Name: "keep-redis", Action: RuleActionInclude, NameRegex: "redis$"}}
+	defer func() { ExclusionRules = nil }()
+	require.NoError(t, ExclusionRules[0].compile())
+	reconcile()
+	reconcile()
+	require.Len(t, recorder.Events, 1)
+	require.Contains(t, <-recorder.Events, reasonReplicationIncluded)
+
+	// The annotation is removed once no exclusion setting applies anymore
+	ExclusionRules = nil
+	ExclusionRegex = nil
+	reconcile()
+	reconcile()
+	require.NotContains(t, pvc.Annotations, constants.ExclusionAnnotation)
+	require.Empty(t, recorder.Events)
+}
+
+func TestCompileNamespaceRegex(t *testing.T) {
+	client := fake.NewClientset()
+	NamespaceInformer = informers.NewSharedInformerFactory(client, 0).Core().V1().Namespaces()
+	recorder := record.NewFakeRecorder(10)
+	k8s.Recorder = recorder
+	defer func() {
+		k8s.Recorder = nil
+		forgetNamespaceRegex("test-namespace")
+	}()
+
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+		Name:        "test-namespace",
+		Annotations: map[string]string{constants.ExclusionRegexAnnotation: "^cache-("},
+	}}
+	require.NoError(t, NamespaceInformer.Informer().GetIndexer().Add(ns))
+	newPvc := func(name string) *corev1.PersistentVolumeClaim {
+		return &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "test-namespace"}}
+	}
+
+	// An invalid pattern is reported once on the namespace, whatever the number of PVCs
+	require.Empty(t, pvcNameMatchesNamespaceExclusion(newPvc("cache-redis")))
+	require.Empty(t, pvcNameMatchesNamespaceExclusion(newPvc("cache-postgres")))
+	require.Len(t, recorder.Events, 1)
+	require.Contains(t, <-recorder.Events, reasonInvalidExclusionRegex)
+
+	// The regex of the namespace is replaced when its pattern changes
+	ns = ns.DeepCopy()
+	ns.Annotations[constants.ExclusionRegexAnnotation] = "^cache-"
+	require.NoError(t, NamespaceInformer.Informer().GetIndexer().Update(ns))
+	require.Equal(t, "^cache-", pvcNameMatchesNamespaceExclusion(newPvc("cache-redis")))
+	require.Empty(t, recorder.Events)
+	cached, ok := namespaceRegexCache.Load("test-namespace")
+	require.True(t, ok)
+	require.Equal(t, "^cache-", cached.(*namespaceRegex).pattern)
+
+	// The regex is forgotten once the namespace has no pattern anymore
+	ns = ns.DeepCopy()
+	ns.Annotations = nil
+	require.NoError(t, NamespaceInformer.Informer().GetIndexer().Update(ns))
+	require.Empty(t, pvcNameMatchesNamespaceExclusion(newPvc("cache-redis")))
+	_, ok = namespaceRegexCache.Load("test-namespace")
+	require.False(t, ok)
+}
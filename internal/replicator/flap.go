@@ -0,0 +1,119 @@
+package replicator
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/super-phenix/volume-replicator/internal/constants"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/klog/v2"
+)
+
+var (
+	RecreateCooldown time.Duration
+	FlapThreshold    int
+	FlapWindow       = time.Hour
+)
+
+// checkRecreateRate returns whether the VolumeReplication of a PVC can be re-created without re-creating it too often.
+// If it can't, the delay after which the PVC must be reconciled again is returned, zero if the PVC is frozen.
+//   - a PVC frozen because of flapping is never re-created until the annotation is removed by an operator
+//   - a PVC re-created less than the cooldown ago must wait for the cooldown to expire
+//   - a PVC re-created too many times within the flap window is frozen
+func checkRecreateRate(ctx context.Context, pvc *corev1.PersistentVolumeClaim) (bool, time.Duration) {
+	key := pvc.Namespace + "/" + pvc.Name
+	if frozen, ok := lookupKey(pvc.Annotations, constants.FrozenAnnotation); ok {
+		klog.Infof("not re-creating VolumeReplication for PVC %s as it is frozen: %s", key, frozen)
+		return false, 0
+	}
+
+	history := getRecreateHistory(pvc)
+	currentTime := now()
+
+	if RecreateCooldown > 0 && len(history) > 0 {
+		if remaining := RecreateCooldown - currentTime.Sub(history[len(history)-1]); remaining > 0 {
+			klog.Infof("not re-creating VolumeReplication for PVC %s during its cooldown, %s remaining", key, remaining.Round(time.Second))
+			return false, remaining
+		}
+	}
+
+	if FlapThreshold > 0 && countSince(history, currentTime.Add(-FlapWindow)) >= FlapThreshold {
+		freezePvc(ctx, pvc)
+		return false, 0
+	}
+
+	return true, 0
+}
+
+// freezePvc stops re-creating the VolumeReplication of a flapping PVC until an operator intervenes
+func freezePvc(ctx context.Context, pvc *corev1.PersistentVolumeClaim) {
+	reason := "VolumeReplication re-created too often"
+	klog.Errorf("freezing PVC %s/%s: %s (%d times in %s)", pvc.Namespace, pvc.Name, reason, FlapThreshold, FlapWindow)
+
+	// The history is cleared, so that the PVC isn't frozen again as soon as it is unfrozen
+	err := patchPvcAnnotations(ctx, pvc, map[string]*string{
+		constants.FrozenAnnotation:          &reason,
+		constants.RecreateHistoryAnnotation: nil,
+	})
+	if err != nil {
+		klog.Errorf("failed to freeze PVC %s/%s: %s", pvc.Namespace, pvc.Name, err.Error())
+	}
+
+	recordEvent(pvc, corev1.EventTypeWarning, reasonReplicationFrozen,
+		"VolumeReplication was re-created %d times in %s, remove the %s annotation to resume", FlapThreshold, FlapWindow, constants.FrozenAnnotation)
+}
+
+// recordRecreate adds the current time to the recreate history of a PVC, forgetting entries that don't matter anymore
+func recordRecreate(ctx context.Context, pvc *corev1.PersistentVolumeClaim) {
+	if RecreateCooldown <= 0 && FlapThreshold <= 0 {
+		return
+	}
+
+	currentTime := now()
+	history := getRecreateHistory(pvc)
+
+	var entries []string
+	for _, entry := range history {
+		if entry.After(currentTime.Add(-max(FlapWindow, RecreateCooldown))) {
+			entries = append(entries, entry.UTC().Format(time.RFC3339))
+		}
+	}
+	entries = append(entries, currentTime.UTC().Format(time.RFC3339))
+
+	value := strings.Join(entries, ",")
+	if err := patchPvcAnnotations(ctx, pvc, map[string]*string{constants.RecreateHistoryAnnotation: &value}); err != nil {
+		klog.Errorf("failed to record recreate history on PVC %s/%s: %s", pvc.Namespace, pvc.Name, err.Error())
+	}
+}
+
+// getRecreateHistory returns the times at which the VolumeReplication of a PVC was re-created, oldest first
+func getRecreateHistory(pvc *corev1.PersistentVolumeClaim) []time.Time {
+	value := getKeyValue(pvc.Annotations, constants.RecreateHistoryAnnotation)
+	if value == "" {
+		return nil
+	}
+
+	var history []time.Time
+	for _, entry := range strings.Split(value, ",") {
+		recreatedAt, err := time.Parse(time.RFC3339, strings.TrimSpace(entry))
+		if err != nil {
+			klog.Errorf("ignoring invalid recreate history entry %q on PVC %s/%s", entry, pvc.Namespace, pvc.Name)
+			continue
+		}
+		history = append(history, recreatedAt)
+	}
+
+	return history
+}
+
+// countSince returns the number of times after a given time
+func countSince(history []time.Time, since time.Time) int {
+	count := 0
+	for _, entry := range history {
+		if entry.After(since) {
+			count++
+		}
+	}
+	return count
+}
@@ -0,0 +1,139 @@
+package replicator
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/super-phenix/volume-replicator/internal/constants"
+	"github.com/super-phenix/volume-replicator/internal/k8s"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestCheckRecreateRate(t *testing.T) {
+	nsName := "test-namespace"
+	pvcName := "test-pvc"
+	currentTime := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	history := func(agos ...time.Duration) string {
+		var entries []string
+		for _, ago := range agos {
+			entries = append(entries, currentTime.Add(-ago).Format(time.RFC3339))
+		}
+		return strings.Join(entries, ",")
+	}
+
+	tests := []struct {
+		name            string
+		cooldown        time.Duration
+		threshold       int
+		annotations     map[string]string
+		expectedAllowed bool
+		expectedRequeue time.Duration
+		expectedFrozen  bool
+	}{
+		{
+			name:            "Disabled",
+			annotations:     map[string]string{constants.RecreateHistoryAnnotation: history(3*time.Minute, time.Minute)},
+			expectedAllowed: true,
+		},
+		{
+			name:            "Frozen",
+			annotations:     map[string]string{constants.FrozenAnnotation: "flapping"},
+			expectedAllowed: false,
+			expectedFrozen:  true,
+		},
+		{
+			name:            "Within cooldown",
+			cooldown:        10 * time.Minute,
+			annotations:     map[string]string{constants.RecreateHistoryAnnotation: history(30*time.Minute, 4*time.Minute)},
+			expectedAllowed: false,
+			expectedRequeue: 6 * time.Minute,
+		},
+		{
+			name:            "Cooldown expired",
+			cooldown:        10 * time.Minute,
+			annotations:     map[string]string{constants.RecreateHistoryAnnotation: history(30 * time.Minute)},
+			expectedAllowed: true,
+		},
+		{
+			name:            "Below flap threshold",
+			threshold:       3,
+			annotations:     map[string]string{constants.RecreateHistoryAnnotation: history(2*time.Hour, 30*time.Minute, 10*time.Minute)},
+			expectedAllowed: true,
+		},
+		{
+			name:            "Flapping",
+			threshold:       3,
+			annotations:     map[string]string{constants.RecreateHistoryAnnotation: history(50*time.Minute, 30*time.Minute, 10*time.Minute)},
+			expectedAllowed: false,
+			expectedFrozen:  true,
+		},
+		{
+			name:            "Invalid history entries are ignored",
+			threshold:       2,
+			annotations:     map[string]string{constants.RecreateHistoryAnnotation: "invalid," + history(10*time.Minute)},
+			expectedAllowed: true,
+		},
+	}
+
+	now = func() time.Time { return currentTime }
+	defer func() {
+		now = time.Now
+		RecreateCooldown = 0
+		FlapThreshold = 0
+	}()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pvc := &corev1.PersistentVolumeClaim{
+				ObjectMeta: metav1.ObjectMeta{Name: pvcName, Namespace: nsName, Annotations: tt.annotations},
+			}
+			client := fake.NewClientset(pvc)
+			k8s.ClientSet = client
+
+			RecreateCooldown = tt.cooldown
+			FlapThreshold = tt.threshold
+
+			allowed, requeueAfter := checkRecreateRate(t.Context(), pvc)
+			require.Equal(t, tt.expectedAllowed, allowed)
+			require.Equal(t, tt.expectedRequeue, requeueAfter)
+
+			patched, err := client.CoreV1().PersistentVolumeClaims(nsName).Get(t.Context(), pvcName, metav1.GetOptions{})
+			require.NoError(t, err)
+			_, frozen := patched.Annotations[constants.FrozenAnnotation]
+			require.Equal(t, tt.expectedFrozen, frozen)
+		})
+	}
+}
+
+func TestRecordRecreate(t *testing.T) {
+	currentTime := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	now = func() time.Time { return currentTime }
+	FlapThreshold = 3
+	defer func() {
+		now = time.Now
+		FlapThreshold = 0
+	}()
+
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test-pvc",
+			Namespace: "test-namespace",
+			Annotations: map[string]string{
+				constants.RecreateHistoryAnnotation: "2025-01-01T10:00:00Z,2025-01-01T11:30:00Z",
+			},
+		},
+	}
+	client := fake.NewClientset(pvc)
+	k8s.ClientSet = client
+
+	recordRecreate(t.Context(), pvc)
+
+	patched, err := client.CoreV1().PersistentVolumeClaims(pvc.Namespace).Get(t.Context(), pvc.Name, metav1.GetOptions{})
+	require.NoError(t, err)
+	require.Equal(t, "2025-01-01T11:30:00Z,2025-01-01T12:00:00Z", patched.Annotations[constants.RecreateHistoryAnnotation])
+}
@@ -0,0 +1,563 @@
+package replicator
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/super-phenix/volume-replicator/internal/constants"
+	"github.com/super-phenix/volume-replicator/internal/k8s"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// groupKeyPrefix marks the keys of the queue that designate a group of PVCs instead of a PVC
+	groupKeyPrefix = "group:"
+	// maxOwnerDepth is the number of owners walked up from a PVC to find the group of its workload
+	maxOwnerDepth = 3
+	// groupRecreateDelay is the delay after which a deleted VolumeGroupReplication is re-created
+	groupRecreateDelay = 5 * time.Second
+)
+
+var (
+	// VolumeGroups enables the replication of groups of PVCs through VolumeGroupReplications
+	VolumeGroups bool
+
+	VolumeGroupReplicationResource = schema.GroupVersionResource{
+		Group:    volumeReplicationGroup,
+		Version:  volumeReplicationVersion,
+		Resource: "volumegroupreplications",
+	}
+
+	VolumeGroupReplicationClassesResource = schema.GroupVersionResource{
+		Group:    volumeReplicationGroup,
+		Version:  volumeReplicationVersion,
+		Resource: "volumegroupreplicationclasses",
+	}
+
+	// workloadResources are the kinds of workloads whose group annotation applies to the PVCs they own
+	workloadResources = map[schema.GroupKind]schema.GroupVersionResource{
+		{Group: "apps", Kind: "StatefulSet"}:           {Group: "apps", Version: "v1", Resource: "statefulsets"},
+		{Group: "cdi.kubevirt.io", Kind: "DataVolume"}: {Group: "cdi.kubevirt.io", Version: "v1beta1", Resource: "datavolumes"},
+		{Group: "kubevirt.io", Kind: "VirtualMachine"}: {Group: "kubevirt.io", Version: "v1", Resource: "virtualmachines"},
+	}
+)
+
+// groupResolution is the result of the resolution of the classes and state of a group of PVCs
+type groupResolution struct {
+	groupClass       string
+	replicationClass string
+	state            string
+	// message explains why the group couldn't be resolved, empty if it was
+	message string
+}
+
+// groupKey returns the key of the queue of a group of PVCs
+func groupKey(namespace, group string) string {
+	return groupKeyPrefix + namespace + "/" + group
+}
+
+// parseGroupKey returns the namespace and name of the group designated by a key of the queue, if it designates one
+func parseGroupKey(key string) (string, string, bool) {
+	rest, ok := strings.CutPrefix(key, groupKeyPrefix)
+	if !ok {
+		return "", "", false
+	}
+	return strings.Cut(rest, "/")
+}
+
+// reconcile reconciles a key of the queue, which designates either a PVC or a group of PVCs
+func reconcile(ctx context.Context, key string) time.Duration {
+	if namespace, group, ok := parseGroupKey(key); ok {
+		return reconcileVolumeGroupReplication(ctx, namespace, group)
+	}
+	return reconcileVolumeReplication(ctx, key)
+}
+
+// getPvcGroup returns the group of a PVC, from its annotation or from the annotation of the workload owning it.
+// An empty group is returned if the PVC doesn't belong to any group.
+func getPvcGroup(ctx context.Context, pvc *corev1.PersistentVolumeClaim) (string, error) {
+	group := getKeyValue(pvc.Annotations, constants.GroupAnnotation)
+	if group == "" {
+		var err error
+		if group, err = getWorkloadGroup(ctx, pvc.Namespace, pvc.OwnerReferences); err != nil {
+			return "", err
+		}
+	}
+
+	// The group names the VolumeGroupReplication and labels its members
+	if errs := validation.IsDNS1123Label(group); group != "" && len(errs) > 0 {
+		return "", fmt.Errorf("invalid group %q: %s", group, strings.Join(errs, ", "))
+	}
+	return group, nil
+}
+
+// getWorkloadGroup walks up the controllers of a PVC, and returns the group annotation of the first workload that has one.
+// Only the kinds of workloadResources are walked, e.g. the DataVolume and the VirtualMachine owning the disk of a VM.
+func getWorkloadGroup(ctx context.Context, namespace string, owners []metav1.OwnerReference) (string, error) {
+	for range maxOwnerDepth {
+		owner := getControllerOf(owners)
+		if owner == nil {
+			return "", nil
+		}
+
+		gv, err := schema.ParseGroupVersion(owner.APIVersion)
+		if err != nil {
+			return "", nil
+		}
+		resource, ok := workloadResources[schema.GroupKind{Group: gv.Group, Kind: owner.Kind}]
+		if !ok {
+			return "", nil
+		}
+
+		callCtx, cancel := withAPITimeout(ctx)
+		workload, err := k8s.DynamicClientSet.Resource(resource).Namespace(namespace).Get(callCtx, owner.Name, metav1.GetOptions{})
+		cancel()
+		if errors.IsNotFound(err) {
+			return "", nil
+		} else if err != nil {
+			return "", fmt.Errorf("failed to get %s %s/%s: %w", owner.Kind, namespace, owner.Name, err)
+		}
+
+		if group := getKeyValue(workload.GetAnnotations(), constants.GroupAnnotation); group != "" {
+			return group, nil
+		}
+		owners = workload.GetOwnerReferences()
+	}
+	return "", nil
+}
+
+// getControllerOf returns the owner reference that is the controller of an object, nil if it has none
+func getControllerOf(owners []metav1.OwnerReference) *metav1.OwnerReference {
+	for i := range owners {
+		if owners[i].Controller != nil && *owners[i].Controller {
+			return &owners[i]
+		}
+	}
+	return nil
+}
+
+// reconcileGroupMembership labels a PVC with its group, so that the VolumeGroupReplication of the group selects it.
+// PVCs that aren't replicated leave their group. It returns whether the PVC belongs to a group, in which case its own
+// VolumeReplications are left to the group: they are only deleted once the VolumeGroupReplication replicates the PVC,
+// so that the PVC is never left without a replica. Only the first target of a member is replicated by its group.
+func reconcileGroupMembership(ctx context.Context, pvc *corev1.PersistentVolumeClaim, volumeReplications []*unstructured.Unstructured, replicationClass string) (bool, error) {
+	key := pvc.Namespace + "/" + pvc.Name
+
+	var group string
+	if replicationClass != "" {
+		var err error
+		if group, err = getPvcGroup(ctx, pvc); err != nil {
+			return false, err
+		}
+	}
+
+	if current := getKeyValue(pvc.Labels, constants.GroupMemberLabel); current != group {
+		var value *string
+		if group != "" {
+			value = &group
+		}
+		if err := patchPvcMetadata(ctx, pvc, nil, map[string]*string{constants.GroupMemberLabel: value}); err != nil {
+			return false, fmt.Errorf("failed to label PVC with its group: %w", err)
+		}
+
+		if current != "" {
+			klog.Infof("PVC %s left group %s", key, current)
+			recordEvent(pvc, corev1.EventTypeNormal, reasonVolumeGroupLeft, "Left volume group %s", current)
+		}
+		if group != "" {
+			klog.Infof("PVC %s joined group %s", key, group)
+			recordEvent(pvc, corev1.EventTypeNormal, reasonVolumeGroupJoined, "Joined volume group %s", group)
+		}
+	}
+
+	if group == "" {
+		return false, nil
+	}
+
+	if len(volumeReplications) == 0 {
+		return true, nil
+	}
+
+	// The reason why the group doesn't replicate the PVC yet is reported on the PVC by the reconciliation of the group
+	replicated, err := isReplicatedByGroup(pvc, group)
+	if err != nil {
+		return false, err
+	}
+	if !replicated {
+		klog.Infof("keeping VolumeReplications of PVC %s until group %s replicates it", key, group)
+		return true, nil
+	}
+
+	// The PVC is replicated by the VolumeGroupReplication of its group from now on
+	klog.Infof("deleting VolumeReplications of PVC %s as it is replicated by group %s", key, group)
+	cleanupVolumeReplications(ctx, volumeReplications)
+	return true, nil
+}
+
+// isReplicatedByGroup returns whether the VolumeGroupReplication of a group exists, is controlled by us, and reports the PVC
+// among the PVCs it replicates
+func isReplicatedByGroup(pvc *corev1.PersistentVolumeClaim, group string) (bool, error) {
+	volumeGroupReplication, err := getVolumeGroupReplication(pvc.Namespace, group)
+	if err != nil || volumeGroupReplication == nil || !isParentLabelPresent(volumeGroupReplication.GetLabels()) {
+		return false, err
+	}
+
+	refs, _, _ := unstructured.NestedSlice(volumeGroupReplication.Object, "status", "persistentVolumeClaimsRefList")
+	return slices.ContainsFunc(refs, func(ref any) bool {
+		name, _, _ := unstructured.NestedString(ref.(map[string]any), "name")
+		return name == pvc.Name
+	}), nil
+}
+
+// reportGroupBlocked records on the members of a group why its VolumeGroupReplication can't be created or updated,
+// an empty message meaning that it isn't blocked anymore. Events are only emitted to the members whose reason changed.
+func reportGroupBlocked(ctx context.Context, group string, members []*corev1.PersistentVolumeClaim, reason, message string) {
+	for _, pvc := range members {
+		current, found := lookupKey(pvc.Annotations, constants.GroupBlockedAnnotation)
+		if current == message {
+			continue
+		}
+
+		var value *string
+		if message != "" {
+			value = &message
+		} else if !found {
+			continue
+		}
+		if err := patchPvcAnnotations(ctx, pvc, map[string]*string{constants.GroupBlockedAnnotation: value}); err != nil {
+			klog.Errorf("failed to record why group %s is blocked on PVC %s/%s: %s", group, pvc.Namespace, pvc.Name, err.Error())
+		}
+
+		if message == "" {
+			recordEvent(pvc, corev1.EventTypeNormal, reasonVolumeGroupUnblocked, "Volume group %s can be replicated again", group)
+		} else {
+			recordEvent(pvc, corev1.EventTypeWarning, reason, "Volume group %s can't be replicated: %s", group, message)
+		}
+	}
+}
+
+// Reconcile a group of PVCs:
+// - if the group has no member left, delete its VolumeGroupReplication (if it exists)
+//
+// - if a member is paused, or the members don't agree on the classes or the replication state, leave it untouched
+//
+// - if the classes of the VolumeGroupReplication changed, delete it once every member allows it like the re-creation of
+// a VolumeReplication (recreate rate, class change policy, snapshot), and re-create it after a delay
+//
+// - otherwise, create or update the VolumeGroupReplication
+//
+// It returns the delay after which the group must be reconciled again, zero if no requeue is needed.
+func reconcileVolumeGroupReplication(ctx context.Context, namespace, group string) time.Duration {
+	key := namespace + "/" + group
+	if ctx.Err() != nil {
+		klog.Infof("not reconciling VolumeGroupReplication %s as the controller is stopping", key)
+		return 0
+	}
+
+	// The shard of the namespace isn't released until the group is reconciled
+	ctx, done, owned := trackNamespaceWork(ctx, namespace)
+	defer done()
+	if !owned {
+		klog.V(2).Infof("not reconciling VolumeGroupReplication %s as its namespace isn't owned by this replica", key)
+		return 0
+	}
+
+	klog.Infof("reconciling VolumeGroupReplication %s", key)
+
+	members, err := getGroupMembers(namespace, group)
+	if err != nil {
+		klog.Errorf("failed to list members of group %s: %s", key, err.Error())
+		return requeueWithBackoff
+	}
+
+	volumeGroupReplication, err := getVolumeGroupReplication(namespace, group)
+	if err != nil {
+		klog.Errorf("couldn't get VolumeGroupReplication %s: %s", key, err.Error())
+		return 0
+	}
+
+	// If the VGR exists, and it isn't owned by our controller, do not proceed further
+	if volumeGroupReplication != nil && !isParentLabelPresent(volumeGroupReplication.GetLabels()) {
+		klog.Infof("VolumeGroupReplication %s isn't owned by us, skipping", key)
+		reportGroupBlocked(ctx, group, members, reasonVolumeGroupBlocked, fmt.Sprintf("VolumeGroupReplication %s isn't controlled by %s", group, constants.ComponentName))
+		return 0
+	}
+
+	// The last member left the group
+	if len(members) == 0 {
+		if volumeGroupReplication != nil {
+			klog.Infof("deleting VolumeGroupReplication %s as its group has no member left", key)
+			cleanupVolumeGroupReplication(ctx, namespace, group)
+		}
+		return 0
+	}
+
+	if i := slices.IndexFunc(members, func(pvc *corev1.PersistentVolumeClaim) bool {
+		return isPvcPaused(pvc, namespace)
+	}); i >= 0 {
+		klog.Infof("group %s has paused members, skipping reconciliation", key)
+		reportGroupBlocked(ctx, group, members, reasonVolumeGroupBlocked, fmt.Sprintf("PVC %s is paused", members[i].Name))
+		return 0
+	}
+
+	// If the group couldn't be resolved, leave the existing VolumeGroupReplication alone
+	resolution := resolveGroup(ctx, members)
+	if resolution.message != "" {
+		klog.Errorf("couldn't resolve group %s, leaving it untouched: %s", key, resolution.message)
+		reportGroupBlocked(ctx, group, members, reasonVolumeGroupUnresolved, resolution.message)
+		return 0
+	}
+
+	if volumeGroupReplication != nil {
+		groupClass, _, _ := unstructured.NestedString(volumeGroupReplication.Object, "spec", "volumeGroupReplicationClassName")
+		replicationClass, _, _ := unstructured.NestedString(volumeGroupReplication.Object, "spec", "volumeReplicationClassName")
+
+		// Classes can't be live updated, the VolumeGroupReplication is re-created once deleted
+		current, desired := groupClass+"/"+replicationClass, resolution.groupClass+"/"+resolution.replicationClass
+		if current != desired {
+			if allowed, requeueAfter := isGroupRecreateAllowed(ctx, members, volumeGroupReplication, current, desired); !allowed {
+				return requeueAfter
+			}
+
+			klog.Infof("deleting VolumeGroupReplication %s as its classes changed (%s -> %s)", key, current, desired)
+			for _, pvc := range members {
+				recordEvent(pvc, corev1.EventTypeNormal, reasonClassChangeApplied, "Re-creating VolumeGroupReplication %s to apply change %s -> %s", group, current, desired)
+			}
+			cleanupVolumeGroupReplication(ctx, namespace, group)
+			return groupRecreateDelay
+		}
+
+		for _, pvc := range members {
+			clearClassChange(ctx, pvc)
+		}
+
+		currentState, _, _ := unstructured.NestedString(volumeGroupReplication.Object, "spec", "replicationState")
+		if currentState == resolution.state {
+			reportGroupBlocked(ctx, group, members, "", "")
+			return 0
+		}
+		klog.Infof("updating VolumeGroupReplication %s with new replication state %s (was %s)", key, resolution.state, currentState)
+	} else {
+		klog.Infof("creating VolumeGroupReplication %s for %d PVCs", key, len(members))
+	}
+
+	if err = applyVolumeGroupReplication(ctx, namespace, group, resolution); err != nil {
+		klog.Errorf("failed to apply VolumeGroupReplication %s: %s", key, err.Error())
+		reportGroupBlocked(ctx, group, members, reasonVolumeGroupBlocked, fmt.Sprintf("failed to apply VolumeGroupReplication %s: %s", group, err.Error()))
+		return 0
+	}
+	reportGroupBlocked(ctx, group, members, "", "")
+	return 0
+}
+
+// getGroupMembers returns the PVCs labelled with a group that are managed by our instance, sorted by name
+func getGroupMembers(namespace, group string) ([]*corev1.PersistentVolumeClaim, error) {
+	pvcs, err := listPvcs(namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	var members []*corev1.PersistentVolumeClaim
+	for _, pvc := range pvcs {
+		if pvc.Namespace != namespace || pvc.DeletionTimestamp != nil || getKeyValue(pvc.Labels, constants.GroupMemberLabel) != group {
+			continue
+		}
+
+		// A member whose instance is unknown may still be ours, the group isn't reconciled without it
+		managed, err := isPvcManagedByInstance(pvc)
+		if err != nil {
+			return nil, err
+		}
+		if managed {
+			members = append(members, pvc)
+		}
+	}
+
+	slices.SortFunc(members, func(a, b *corev1.PersistentVolumeClaim) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return members, nil
+}
+
+// resolveGroup resolves the classes and the replication state of a group, which every member must agree on
+func resolveGroup(ctx context.Context, members []*corev1.PersistentVolumeClaim) groupResolution {
+	var res groupResolution
+	for i, pvc := range members {
+		replicationClass := resolveVolumeReplicationClass(ctx, pvc)
+		if replicationClass.isUnresolved() || replicationClass.class == "" {
+			return groupResolution{message: fmt.Sprintf("no VolumeReplicationClass for PVC %s: %s", pvc.Name, replicationClass.message)}
+		}
+
+		groupClass := resolveVolumeGroupReplicationClass(ctx, pvc)
+		if groupClass.isUnresolved() || groupClass.class == "" {
+			return groupResolution{message: fmt.Sprintf("no VolumeGroupReplicationClass for PVC %s: %s", pvc.Name, groupClass.message)}
+		}
+
+		member := groupResolution{groupClass: groupClass.class, replicationClass: replicationClass.class, state: getReplicationState(pvc)}
+		if i == 0 {
+			res = member
+			continue
+		}
+
+		switch {
+		case member.groupClass != res.groupClass:
+			return groupResolution{message: fmt.Sprintf("PVCs %s and %s have different VolumeGroupReplicationClasses (%s and %s)", members[0].Name, pvc.Name, res.groupClass, member.groupClass)}
+		case member.replicationClass != res.replicationClass:
+			return groupResolution{message: fmt.Sprintf("PVCs %s and %s have different VolumeReplicationClasses (%s and %s)", members[0].Name, pvc.Name, res.replicationClass, member.replicationClass)}
+		case member.state != res.state:
+			return groupResolution{message: fmt.Sprintf("PVCs %s and %s have different replication states (%s and %s)", members[0].Name, pvc.Name, res.state, member.state)}
+		}
+	}
+	return res
+}
+
+// resolveVolumeGroupReplicationClass resolves the VolumeGroupReplicationClass of a PVC like its VolumeReplicationClass,
+// from a value or a selector set on the PVC or on its namespace
+func resolveVolumeGroupReplicationClass(ctx context.Context, pvc *corev1.PersistentVolumeClaim) classResolution {
+	if isPvcExcluded(pvc) {
+		return classResolution{outcome: resolutionExcluded, message: "PVC is excluded from replication"}
+	}
+
+	if value := getAnnotationValue(pvc, constants.GroupClassAnnotation); value != "" {
+		return classResolution{class: value, outcome: resolutionValue, message: fmt.Sprintf("VolumeGroupReplicationClass %s set explicitly", value)}
+	}
+
+	return resolveClassFromSelector(ctx, pvc, listClassesOf(VolumeGroupReplicationClassesResource), "VolumeGroupReplicationClass", getAnnotationValue(pvc, constants.GroupClassSelectorAnnotation))
+}
+
+// isGroupRecreateAllowed returns whether the VolumeGroupReplication of a group can be re-created to apply a class change.
+// Its re-creation goes through the same checks as the one of a VolumeReplication, which every member must pass:
+// the recreate rate, the class change policy and the snapshot taken before re-creating.
+// If it can't be re-created yet, the delay after which the group must be reconciled again is returned.
+func isGroupRecreateAllowed(ctx context.Context, members []*corev1.PersistentVolumeClaim, volumeGroupReplication *unstructured.Unstructured, current, desired string) (bool, time.Duration) {
+	checks := []func(pvc *corev1.PersistentVolumeClaim) (bool, time.Duration){
+		func(pvc *corev1.PersistentVolumeClaim) (bool, time.Duration) {
+			return checkRecreateRate(ctx, pvc)
+		},
+		func(pvc *corev1.PersistentVolumeClaim) (bool, time.Duration) {
+			return isClassChangeAllowed(ctx, pvc, current, desired)
+		},
+		func(pvc *corev1.PersistentVolumeClaim) (bool, time.Duration) {
+			return snapshotBeforeRecreate(ctx, pvc, volumeGroupReplication)
+		},
+	}
+
+	// Every member goes through a check before the next one, so that they are all snapshotted together
+	for _, check := range checks {
+		allowed, backoff, requeueAfter := true, false, time.Duration(0)
+		for _, pvc := range members {
+			if ok, after := check(pvc); !ok {
+				allowed = false
+				backoff = backoff || after == requeueWithBackoff
+				if after > 0 && (requeueAfter == 0 || after < requeueAfter) {
+					requeueAfter = after
+				}
+			}
+		}
+		if backoff {
+			return false, requeueWithBackoff
+		}
+		if !allowed {
+			return false, requeueAfter
+		}
+	}
+
+	for _, pvc := range members {
+		recordRecreate(ctx, pvc)
+	}
+	return true, 0
+}
+
+// getVolumeGroupReplication returns the cached VolumeGroupReplication of a group, nil if it doesn't exist
+func getVolumeGroupReplication(namespace, group string) (*unstructured.Unstructured, error) {
+	indexer := getVolumeGroupReplicationIndexer(namespace)
+	if indexer == nil {
+		return nil, fmt.Errorf("VolumeGroupReplications of namespace %s aren't cached", namespace)
+	}
+
+	obj, exists, err := indexer.GetByKey(namespace + "/" + group)
+	if err != nil || !exists {
+		return nil, err
+	}
+	return obj.(*unstructured.Unstructured), nil
+}
+
+// applyVolumeGroupReplication creates or updates the VolumeGroupReplication of a group through server-side apply.
+// It selects the members of the group through their group label.
+func applyVolumeGroupReplication(ctx context.Context, namespace, group string, res groupResolution) error {
+	labels := make(map[string]any)
+	for k, v := range getLabelsWithParent(nil, group) {
+		labels[k] = v
+	}
+
+	volumeGroupReplication := &unstructured.Unstructured{}
+	volumeGroupReplication.SetUnstructuredContent(map[string]any{
+		"apiVersion": fmt.Sprintf("%s/%s", VolumeGroupReplicationResource.Group, VolumeGroupReplicationResource.Version),
+		"kind":       "VolumeGroupReplication",
+		"metadata": map[string]any{
+			"name":      group,
+			"namespace": namespace,
+			"labels":    labels,
+		},
+		"spec": map[string]any{
+			"volumeGroupReplicationClassName": res.groupClass,
+			"volumeReplicationClassName":      res.replicationClass,
+			"replicationState":                res.state,
+			"source": map[string]any{
+				"selector": map[string]any{
+					"matchLabels": map[string]any{
+						constants.GroupMemberLabel: group,
+					},
+				},
+			},
+		},
+	})
+
+	// Like VolumeReplications, the fields of the controller are taken over from other managers
+	resourceInterface := k8s.DynamicClientSet.Resource(VolumeGroupReplicationResource).Namespace(namespace)
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		callCtx, cancel := withAPITimeout(ctx)
+		defer cancel()
+		_, err := resourceInterface.Apply(callCtx, group, volumeGroupReplication, metav1.ApplyOptions{
+			FieldManager: fieldManager,
+			Force:        true,
+		})
+		return err
+	})
+}
+
+// cleanupVolumeGroupReplication deletes the VolumeGroupReplication of a group
+func cleanupVolumeGroupReplication(ctx context.Context, namespace, group string) {
+	callCtx, cancel := withAPITimeout(ctx)
+	defer cancel()
+	err := k8s.DynamicClientSet.Resource(VolumeGroupReplicationResource).Namespace(namespace).Delete(callCtx, group, metav1.DeleteOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		klog.Errorf("couldn't delete VolumeGroupReplication %s/%s: %s", namespace, group, err.Error())
+	}
+}
+
+// enqueueGroups adds the groups of PVCs to the queue, so that their VolumeGroupReplication follows their membership
+func (c *Controller) enqueueGroups(pvcs ...*corev1.PersistentVolumeClaim) {
+	if !VolumeGroups {
+		return
+	}
+
+	for _, pvc := range pvcs {
+		if pvc == nil {
+			continue
+		}
+		if group := getKeyValue(pvc.Labels, constants.GroupMemberLabel); group != "" {
+			c.enqueue(groupKey(pvc.Namespace, group))
+		}
+	}
+}
@@ -0,0 +1,414 @@
+package replicator
+
+import (
+	"cmp"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/super-phenix/volume-replicator/internal/constants"
+	"github.com/super-phenix/volume-replicator/internal/k8s"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	k8s_testing "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/ptr"
+)
+
+// newWorkload returns a workload with a group annotation, owned by another workload if any
+func newWorkload(apiVersion, kind, name, group string, owner *metav1.OwnerReference) *unstructured.Unstructured {
+	workload := &unstructured.Unstructured{}
+	workload.SetAPIVersion(apiVersion)
+	workload.SetKind(kind)
+	workload.SetName(name)
+	workload.SetNamespace("test-namespace")
+	if group != "" {
+		workload.SetAnnotations(map[string]string{constants.GroupAnnotation: group})
+	}
+	if owner != nil {
+		workload.SetOwnerReferences([]metav1.OwnerReference{*owner})
+	}
+	return workload
+}
+
+// newVolumeGroupReplication returns a VolumeGroupReplication owned by the controller
+func newVolumeGroupReplication(name, groupClass, replicationClass, state string) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]any{
+		"apiVersion": fmt.Sprintf("%s/%s", VolumeGroupReplicationResource.Group, VolumeGroupReplicationResource.Version),
+		"kind":       "VolumeGroupReplication",
+		"metadata": map[string]any{
+			"name":      name,
+			"namespace": "test-namespace",
+			"labels":    map[string]any{constants.ParentLabel: name},
+		},
+		"spec": map[string]any{
+			"volumeGroupReplicationClassName": groupClass,
+			"volumeReplicationClassName":      replicationClass,
+			"replicationState":                state,
+		},
+	}}
+}
+
+// setupGroupEnvironment registers the namespace of the tests and the given PVCs in the informers
+func setupGroupEnvironment(t *testing.T, pvcs ...*corev1.PersistentVolumeClaim) {
+	informerFactory := informers.NewSharedInformerFactory(fake.NewClientset(), 0)
+	PvcInformer = informerFactory.Core().V1().PersistentVolumeClaims()
+	NamespaceInformer = informerFactory.Core().V1().Namespaces()
+	require.NoError(t, NamespaceInformer.Informer().GetIndexer().Add(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "test-namespace"}}))
+	for _, pvc := range pvcs {
+		require.NoError(t, PvcInformer.Informer().GetIndexer().Add(pvc))
+	}
+
+	dynamicInformerFactory := dynamicinformer.NewDynamicSharedInformerFactory(dynamicfake.NewSimpleDynamicClient(runtime.NewScheme()), 0)
+	VolumeGroupReplicationInformer = dynamicInformerFactory.ForResource(VolumeGroupReplicationResource)
+}
+
+// cacheVolumeGroupReplication registers a VolumeGroupReplication in the informer, and returns it as an object of the API
+func cacheVolumeGroupReplication(t *testing.T, vgr *unstructured.Unstructured) []runtime.Object {
+	if vgr == nil {
+		return nil
+	}
+	require.NoError(t, VolumeGroupReplicationInformer.Informer().GetIndexer().Add(vgr))
+	return []runtime.Object{vgr}
+}
+
+func TestParseGroupKey(t *testing.T) {
+	namespace, group, ok := parseGroupKey(groupKey("test-namespace", "database"))
+	require.True(t, ok)
+	require.Equal(t, "test-namespace", namespace)
+	require.Equal(t, "database", group)
+
+	_, _, ok = parseGroupKey("test-namespace/test-pvc")
+	require.False(t, ok)
+}
+
+func TestGetPvcGroup(t *testing.T) {
+	vmOwner := &metav1.OwnerReference{APIVersion: "kubevirt.io/v1", Kind: "VirtualMachine", Name: "vm", Controller: ptr.To(true)}
+	dvOwner := metav1.OwnerReference{APIVersion: "cdi.kubevirt.io/v1beta1", Kind: "DataVolume", Name: "vm-disk", Controller: ptr.To(true)}
+
+	tests := []struct {
+		name          string
+		annotations   map[string]string
+		owners        []metav1.OwnerReference
+		workloads     []runtime.Object
+		expectedGroup string
+		expectedError bool
+	}{
+		{
+			name:          "PVC annotation",
+			annotations:   map[string]string{constants.GroupAnnotation: "database"},
+			expectedGroup: "database",
+		},
+		{
+			name:   "VirtualMachine annotation through its DataVolume",
+			owners: []metav1.OwnerReference{dvOwner},
+			workloads: []runtime.Object{
+				newWorkload("cdi.kubevirt.io/v1beta1", "DataVolume", "vm-disk", "", vmOwner),
+				newWorkload("kubevirt.io/v1", "VirtualMachine", "vm", "vm-group", nil),
+			},
+			expectedGroup: "vm-group",
+		},
+		{
+			name:        "PVC annotation has priority over the workload",
+			annotations: map[string]string{constants.GroupAnnotation: "database"},
+			owners:      []metav1.OwnerReference{dvOwner},
+			workloads: []runtime.Object{
+				newWorkload("cdi.kubevirt.io/v1beta1", "DataVolume", "vm-disk", "disk-group", nil),
+			},
+			expectedGroup: "database",
+		},
+		{
+			name:   "Missing owner",
+			owners: []metav1.OwnerReference{dvOwner},
+		},
+		{
+			name:   "Unknown owner kind",
+			owners: []metav1.OwnerReference{{APIVersion: "example.com/v1", Kind: "Database", Name: "db", Controller: ptr.To(true)}},
+		},
+		{
+			name:          "Invalid group",
+			annotations:   map[string]string{constants.GroupAnnotation: "Not_A_Name"},
+			expectedError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k8s.DynamicClientSet = dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), tt.workloads...)
+			pvc := &corev1.PersistentVolumeClaim{
+				ObjectMeta: metav1.ObjectMeta{Name: "test-pvc", Namespace: "test-namespace", Annotations: tt.annotations, OwnerReferences: tt.owners},
+			}
+
+			group, err := getPvcGroup(t.Context(), pvc)
+			if tt.expectedError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.expectedGroup, group)
+		})
+	}
+}
+
+func TestReconcileGroupMembership(t *testing.T) {
+	replicating := newVolumeGroupReplication("database", "test-vgrc", "test-vrc", "primary")
+	require.NoError(t, unstructured.SetNestedSlice(replicating.Object, []any{map[string]any{"name": "test-pvc"}}, "status", "persistentVolumeClaimsRefList"))
+
+	tests := []struct {
+		name              string
+		annotations       map[string]string
+		labels            map[string]string
+		replicationClass  string
+		vrExists          bool
+		existing          *unstructured.Unstructured
+		expectedGrouped   bool
+		expectedLabel     string
+		expectedVrDeleted bool
+	}{
+		{
+			name:             "Joining a group without VolumeGroupReplication",
+			annotations:      map[string]string{constants.GroupAnnotation: "database"},
+			replicationClass: "test-vrc",
+			vrExists:         true,
+			expectedGrouped:  true,
+			expectedLabel:    "database",
+		},
+		{
+			name:             "VolumeGroupReplication doesn't replicate the PVC yet",
+			annotations:      map[string]string{constants.GroupAnnotation: "database"},
+			labels:           map[string]string{constants.GroupMemberLabel: "database"},
+			replicationClass: "test-vrc",
+			vrExists:         true,
+			existing:         newVolumeGroupReplication("database", "test-vgrc", "test-vrc", "primary"),
+			expectedGrouped:  true,
+			expectedLabel:    "database",
+		},
+		{
+			name:              "VolumeGroupReplication replicates the PVC",
+			annotations:       map[string]string{constants.GroupAnnotation: "database"},
+			labels:            map[string]string{constants.GroupMemberLabel: "database"},
+			replicationClass:  "test-vrc",
+			vrExists:          true,
+			existing:          replicating,
+			expectedGrouped:   true,
+			expectedLabel:     "database",
+			expectedVrDeleted: true,
+		},
+		{
+			name:             "Already in the group",
+			annotations:      map[string]string{constants.GroupAnnotation: "database"},
+			labels:           map[string]string{constants.GroupMemberLabel: "database"},
+			replicationClass: "test-vrc",
+			expectedGrouped:  true,
+			expectedLabel:    "database",
+		},
+		{
+			name:             "Leaving a group",
+			labels:           map[string]string{constants.GroupMemberLabel: "database"},
+			replicationClass: "test-vrc",
+		},
+		{
+			name:        "Not replicated anymore",
+			annotations: map[string]string{constants.GroupAnnotation: "database"},
+			labels:      map[string]string{constants.GroupMemberLabel: "database"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pvc := &corev1.PersistentVolumeClaim{
+				ObjectMeta: metav1.ObjectMeta{Name: "test-pvc", Namespace: "test-namespace", Annotations: tt.annotations, Labels: tt.labels},
+			}
+			client := fake.NewClientset(pvc)
+			k8s.ClientSet = client
+			setupGroupEnvironment(t)
+			dynamicClient := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), cacheVolumeGroupReplication(t, tt.existing)...)
+			k8s.DynamicClientSet = dynamicClient
+
+			var vrs []*unstructured.Unstructured
+			if tt.vrExists {
+				vr := &unstructured.Unstructured{}
+				vr.SetName(pvc.Name)
+				vr.SetNamespace(pvc.Namespace)
+				vrs = append(vrs, vr)
+			}
+
+			grouped, err := reconcileGroupMembership(t.Context(), pvc, vrs, tt.replicationClass)
+			require.NoError(t, err)
+			require.Equal(t, tt.expectedGrouped, grouped)
+
+			patched, err := client.CoreV1().PersistentVolumeClaims(pvc.Namespace).Get(t.Context(), pvc.Name, metav1.GetOptions{})
+			require.NoError(t, err)
+			require.Equal(t, tt.expectedLabel, patched.Labels[constants.GroupMemberLabel])
+
+			deleted := false
+			for _, action := range dynamicClient.Actions() {
+				deleted = deleted || (action.GetVerb() == "delete" && action.GetResource() == VolumeReplicationResource)
+			}
+			require.Equal(t, tt.expectedVrDeleted, deleted)
+		})
+	}
+}
+
+func TestReconcileVolumeGroupReplication(t *testing.T) {
+	newMember := func(name, groupClass string) *corev1.PersistentVolumeClaim {
+		return &corev1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: "test-namespace",
+				Labels:    map[string]string{constants.GroupMemberLabel: "database"},
+				Annotations: map[string]string{
+					constants.VrcValueAnnotation:   "test-vrc",
+					constants.GroupClassAnnotation: groupClass,
+				},
+			},
+		}
+	}
+
+	recentlyRecreated := newMember("data", "other-vgrc")
+	recentlyRecreated.Annotations[constants.RecreateHistoryAnnotation] = now().Add(-time.Minute).UTC().Format(time.RFC3339)
+
+	tests := []struct {
+		name            string
+		members         []*corev1.PersistentVolumeClaim
+		existing        *unstructured.Unstructured
+		policy          string
+		cooldown        time.Duration
+		expectedApply   bool
+		expectedDelete  bool
+		expectedRequeue bool
+	}{
+		{
+			name:          "Creating the VolumeGroupReplication",
+			members:       []*corev1.PersistentVolumeClaim{newMember("data", "test-vgrc"), newMember("logs", "test-vgrc")},
+			expectedApply: true,
+		},
+		{
+			name:     "Up-to-date VolumeGroupReplication",
+			members:  []*corev1.PersistentVolumeClaim{newMember("data", "test-vgrc")},
+			existing: newVolumeGroupReplication("database", "test-vgrc", "test-vrc", "primary"),
+		},
+		{
+			name:          "Replication state changed",
+			members:       []*corev1.PersistentVolumeClaim{newMember("data", "test-vgrc")},
+			existing:      newVolumeGroupReplication("database", "test-vgrc", "test-vrc", "secondary"),
+			expectedApply: true,
+		},
+		{
+			name:            "Group class changed",
+			members:         []*corev1.PersistentVolumeClaim{newMember("data", "other-vgrc")},
+			existing:        newVolumeGroupReplication("database", "test-vgrc", "test-vrc", "primary"),
+			expectedDelete:  true,
+			expectedRequeue: true,
+		},
+		{
+			name:     "Group class change waiting for approval",
+			members:  []*corev1.PersistentVolumeClaim{newMember("data", "other-vgrc")},
+			existing: newVolumeGroupReplication("database", "test-vgrc", "test-vrc", "primary"),
+			policy:   ClassChangeApproval,
+		},
+		{
+			name:            "Group class change during the cooldown",
+			members:         []*corev1.PersistentVolumeClaim{recentlyRecreated},
+			existing:        newVolumeGroupReplication("database", "test-vgrc", "test-vrc", "primary"),
+			cooldown:        time.Hour,
+			expectedRequeue: true,
+		},
+		{
+			name:    "Members disagree",
+			members: []*corev1.PersistentVolumeClaim{newMember("data", "test-vgrc"), newMember("logs", "other-vgrc")},
+		},
+		{
+			name:           "Last member left",
+			existing:       newVolumeGroupReplication("database", "test-vgrc", "test-vrc", "primary"),
+			expectedDelete: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupGroupEnvironment(t, tt.members...)
+			var pvcs []runtime.Object
+			for _, pvc := range tt.members {
+				pvcs = append(pvcs, pvc)
+			}
+			k8s.ClientSet = fake.NewClientset(pvcs...)
+
+			dynamicClient := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), cacheVolumeGroupReplication(t, tt.existing)...)
+			k8s.DynamicClientSet = dynamicClient
+
+			ClassChangePolicy = cmp.Or(tt.policy, ClassChangeImmediate)
+			RecreateCooldown = tt.cooldown
+			defer func() {
+				ClassChangePolicy = ClassChangeImmediate
+				RecreateCooldown = 0
+			}()
+
+			requeueAfter := reconcileVolumeGroupReplication(t.Context(), "test-namespace", "database")
+			require.Equal(t, tt.expectedRequeue, requeueAfter > 0)
+
+			applied, deleted := false, false
+			for _, action := range dynamicClient.Actions() {
+				if action.GetResource() != VolumeGroupReplicationResource {
+					continue
+				}
+				if patchAction, ok := action.(k8s_testing.PatchAction); ok && patchAction.GetPatchType() == types.ApplyPatchType {
+					applied = true
+				}
+				deleted = deleted || action.GetVerb() == "delete"
+			}
+			require.Equal(t, tt.expectedApply, applied)
+			require.Equal(t, tt.expectedDelete, deleted)
+		})
+	}
+}
+
+func TestReportGroupBlocked(t *testing.T) {
+	pvc := &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: "data", Namespace: "test-namespace"}}
+	client := fake.NewClientset(pvc)
+	k8s.ClientSet = client
+	recorder := record.NewFakeRecorder(10)
+	k8s.Recorder = recorder
+	defer func() {
+		k8s.Recorder = nil
+	}()
+
+	report := func(reason, message string) {
+		pvc, err := client.CoreV1().PersistentVolumeClaims("test-namespace").Get(t.Context(), "data", metav1.GetOptions{})
+		require.NoError(t, err)
+		reportGroupBlocked(t.Context(), "database", []*corev1.PersistentVolumeClaim{pvc}, reason, message)
+	}
+
+	// The reason is recorded on the member, and only reported once
+	report(reasonVolumeGroupBlocked, "PVC logs is paused")
+	report(reasonVolumeGroupBlocked, "PVC logs is paused")
+	require.Len(t, recorder.Events, 1)
+	require.Contains(t, <-recorder.Events, reasonVolumeGroupBlocked)
+
+	patched, err := client.CoreV1().PersistentVolumeClaims("test-namespace").Get(t.Context(), "data", metav1.GetOptions{})
+	require.NoError(t, err)
+	require.Equal(t, "PVC logs is paused", patched.Annotations[constants.GroupBlockedAnnotation])
+
+	// A new reason is reported
+	report(reasonVolumeGroupUnresolved, "no VolumeGroupReplicationClass for PVC logs")
+	require.Len(t, recorder.Events, 1)
+	require.Contains(t, <-recorder.Events, reasonVolumeGroupUnresolved)
+
+	// The reason is cleared once the group is replicated
+	report("", "")
+	report("", "")
+	require.Len(t, recorder.Events, 1)
+	require.Contains(t, <-recorder.Events, reasonVolumeGroupUnblocked)
+
+	patched, err = client.CoreV1().PersistentVolumeClaims("test-namespace").Get(t.Context(), "data", metav1.GetOptions{})
+	require.NoError(t, err)
+	require.NotContains(t, patched.Annotations, constants.GroupBlockedAnnotation)
+}
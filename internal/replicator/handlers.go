@@ -1,31 +1,43 @@
 package replicator
 
 import (
+	"maps"
 	"reflect"
+	"slices"
 
 	"github.com/super-phenix/volume-replicator/internal/constants"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
-	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/klog/v2"
 )
 
 // namespaceUpdate is called whenever an update is detected on a namespace
-// We check if annotations have changed, and if it has,
-// we propagate the update to every PVC inside the namespace
+// We check if annotations or labels have changed, and if they have,
+// we propagate the update to every PVC inside the namespace.
+// Labels are matched by namespace selectors, in exclusion rules and in the match criteria of VolumeReplicationClasses.
 func (c *Controller) namespaceUpdate(oldNs, newNs *corev1.Namespace) {
-	// Don't continue if the annotations have not changed/were not deleted
-	if oldNs.Annotations[constants.VrcValueAnnotation] == newNs.Annotations[constants.VrcValueAnnotation] &&
-		oldNs.Annotations[constants.VrcSelectorAnnotation] == newNs.Annotations[constants.VrcSelectorAnnotation] &&
-		oldNs.Annotations[constants.PauseAnnotation] == newNs.Annotations[constants.PauseAnnotation] &&
-		oldNs.Annotations[constants.ReplicationStateAnnotation] == newNs.Annotations[constants.ReplicationStateAnnotation] {
+	// Don't continue if the annotations and labels have not changed/were not deleted
+	keys := []string{
+		constants.VrcValueAnnotation,
+		constants.VrcSelectorAnnotation,
+		constants.PauseAnnotation,
+		constants.ReplicationStateAnnotation,
+		constants.ExclusionRegexAnnotation,
+		constants.GroupClassAnnotation,
+		constants.GroupClassSelectorAnnotation,
+	}
+	if !slices.ContainsFunc(keys, func(key string) bool {
+		oldValue, _, _ := findKey(oldNs.Annotations, key)
+		newValue, _, _ := findKey(newNs.Annotations, key)
+		return oldValue != newValue
+	}) && getNamespaceInstance(oldNs) == getNamespaceInstance(newNs) && maps.Equal(oldNs.Labels, newNs.Labels) {
 		return
 	}
 
-	// If the annotation has changed, we grab every PVC inside the namespace to propagate the update
-	klog.Infof("detected volumeReplicationClass update for namespace %s", newNs.Name)
-	pvcs, err := PvcInformer.Lister().PersistentVolumeClaims(newNs.Name).List(labels.Everything())
+	// If an annotation or a label has changed, we grab every PVC inside the namespace to propagate the update
+	klog.Infof("detected replication settings update for namespace %s", newNs.Name)
+	pvcs, err := listPvcs(newNs.Name)
 	if err != nil {
 		klog.Errorf("failed to list PVCs in namespace %s: %s", newNs.Namespace, err.Error())
 		return
@@ -38,53 +50,113 @@ func (c *Controller) namespaceUpdate(oldNs, newNs *corev1.Namespace) {
 			klog.Errorf("failed to get key for PVC %s/%s: %s", pvc.Namespace, pvc.Name, err.Error())
 		}
 
-		c.pvcQueue.Add(key)
+		c.enqueue(key)
+		c.enqueueGroups(pvc)
 	}
 }
 
-// pvcUpdate is called whenever a PVC is created or updated
-func (c *Controller) pvcUpdate(pvc *corev1.PersistentVolumeClaim) {
+// pvcUpdate is called whenever a PVC is created, updated or deleted.
+// The previous version of the PVC is only provided for updates.
+func (c *Controller) pvcUpdate(oldPvc, pvc *corev1.PersistentVolumeClaim) {
 	key, err := cache.MetaNamespaceKeyFunc(pvc)
 	if err != nil {
 		klog.Errorf("failed to get key for PVC %s/%s: %s", pvc.Namespace, pvc.Name, err.Error())
 		return
 	}
 
+	// Skip updates that can't change the VolumeReplication, such as status-only changes
+	if oldPvc != nil && !pvcChanged(oldPvc, pvc) {
+		klog.V(4).Infof("ignoring irrelevant update to PVC %s", key)
+		return
+	}
+
 	klog.Infof("detected PVC update for %s", key)
-	c.pvcQueue.Add(key)
+	c.enqueue(key)
+
+	// Groups that the PVC joined or left must update their VolumeGroupReplication
+	c.enqueueGroups(oldPvc, pvc)
 }
 
-// volumeReplicationCreateOrDelete is called whenever a VolumeReplication is created or deleted
+// volumeReplicationCreateOrDelete is called whenever a VolumeReplication is created or deleted.
+// The PVC of the VolumeReplication is reconciled, as a PVC has a VolumeReplication per target.
 func (c *Controller) volumeReplicationCreateOrDelete(volumeReplication *unstructured.Unstructured) {
-	key, err := cache.MetaNamespaceKeyFunc(volumeReplication)
-	if err != nil {
-		klog.Errorf("failed to get key for VolumeReplication %s/%s: %s", volumeReplication.GetNamespace(), volumeReplication.GetName(), err.Error())
-		return
-	}
-
-	klog.Infof("detected VolumeReplication creation or deletion for %s", key)
-	c.pvcQueue.Add(key)
+	key := getParentKey(volumeReplication)
+	klog.Infof("detected VolumeReplication creation or deletion for %s/%s, reconciling PVC %s", volumeReplication.GetNamespace(), volumeReplication.GetName(), key)
+	c.enqueue(key)
 }
 
 // volumeReplicationUpdate is called whenever a VolumeReplication is updated
 func (c *Controller) volumeReplicationUpdate(oldVr, newVr *unstructured.Unstructured) {
-	key, err := cache.MetaNamespaceKeyFunc(newVr)
-	if err != nil {
-		klog.Errorf("failed to get key for VolumeReplication %s/%s: %s", newVr.GetNamespace(), newVr.GetName(), err.Error())
-		return
-	}
+	key := newVr.GetNamespace() + "/" + newVr.GetName()
 
-	// Don't handle VolumeReplications that we don't control
+	// Don't handle VolumeReplications that we don't control, unless they are handed over to a PVC
 	if !isParentLabelPresent(newVr.GetLabels()) {
+		if adopter := getKeyValue(newVr.GetAnnotations(), constants.AdoptAnnotation); adopter != getKeyValue(oldVr.GetAnnotations(), constants.AdoptAnnotation) {
+			klog.Infof("detected adoption request for VolumeReplication %s", key)
+			c.enqueue(getParentKey(newVr))
+			return
+		}
 		klog.Infof("ignoring update to VolumeReplication %s as it isn't controlled by us", key)
 		return
 	}
 
+	reportReplicationStatus(oldVr, newVr)
+
 	// Skip updates if nothing happened to the specs
 	if reflect.DeepEqual(oldVr.Object["spec"], newVr.Object["spec"]) {
 		return
 	}
 
 	klog.Infof("detected VolumeReplication update for %s", key)
-	c.pvcQueue.Add(key)
+	c.enqueue(getParentKey(newVr))
+}
+
+// volumeGroupReplicationUpdate is called whenever a VolumeGroupReplication is created, updated or deleted, oldVgr being nil unless updated.
+// The group is reconciled, as well as its members, whose VolumeReplications are only deleted once the group replicates them.
+func (c *Controller) volumeGroupReplicationUpdate(oldVgr, newVgr *unstructured.Unstructured) {
+	namespace, group := newVgr.GetNamespace(), newVgr.GetName()
+	if !isParentLabelPresent(newVgr.GetLabels()) {
+		klog.V(2).Infof("ignoring VolumeGroupReplication %s/%s as it isn't controlled by us", namespace, group)
+		return
+	}
+
+	// Skip updates if nothing happened to the specs or to the replicated PVCs
+	if oldVgr != nil && reflect.DeepEqual(oldVgr.Object["spec"], newVgr.Object["spec"]) && reflect.DeepEqual(oldVgr.Object["status"], newVgr.Object["status"]) {
+		return
+	}
+
+	klog.Infof("detected VolumeGroupReplication change for %s/%s", namespace, group)
+	c.enqueue(groupKey(namespace, group))
+
+	members, err := getGroupMembers(namespace, group)
+	if err != nil {
+		klog.Errorf("failed to list members of group %s/%s: %s", namespace, group, err.Error())
+		return
+	}
+	for _, pvc := range members {
+		c.enqueue(pvc.Namespace + "/" + pvc.Name)
+	}
+}
+
+// reportReplicationStatus emits an Event on the PVC of a VolumeReplication whose health changed
+func reportReplicationStatus(oldVr, newVr *unstructured.Unstructured) {
+	wasHealthy, _ := activeBackend.status(oldVr)
+	healthy, message := activeBackend.status(newVr)
+	if healthy == wasHealthy {
+		return
+	}
+
+	pvc, err := getPersistentVolumeClaim(getParentKey(newVr))
+	if err != nil || pvc == nil {
+		return
+	}
+
+	kind, name := activeBackend.kind(), newVr.GetName()
+	if healthy {
+		klog.Infof("%s %s/%s is healthy again", kind, newVr.GetNamespace(), name)
+		recordEvent(pvc, corev1.EventTypeNormal, reasonReplicationHealthy, "%s %s is healthy again", kind, name)
+	} else {
+		klog.Warningf("%s %s/%s is unhealthy: %s", kind, newVr.GetNamespace(), name, message)
+		recordEvent(pvc, corev1.EventTypeWarning, reasonReplicationDegraded, "%s %s is unhealthy: %s", kind, name, message)
+	}
 }
@@ -0,0 +1,91 @@
+package replicator
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/super-phenix/volume-replicator/internal/constants"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/util/workqueue"
+)
+
+func TestNamespaceUpdate(t *testing.T) {
+	informerFactory := informers.NewSharedInformerFactory(fake.NewClientset(), 0)
+	PvcInformer = informerFactory.Core().V1().PersistentVolumeClaims()
+	for _, pvc := range []*corev1.PersistentVolumeClaim{
+		{ObjectMeta: metav1.ObjectMeta{Name: "data", Namespace: "test-namespace"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "logs", Namespace: "test-namespace"}},
+		{ObjectMeta: metav1.ObjectMeta{Name: "data", Namespace: "other-namespace"}},
+	} {
+		require.NoError(t, PvcInformer.Informer().GetIndexer().Add(pvc))
+	}
+
+	tests := []struct {
+		name     string
+		update   func(ns *corev1.Namespace)
+		expected []string
+	}{
+		{
+			name:   "Resync",
+			update: func(ns *corev1.Namespace) {},
+		},
+		{
+			name: "Unrelated annotation",
+			update: func(ns *corev1.Namespace) {
+				ns.Annotations["team"] = "storage"
+			},
+		},
+		{
+			name: "VolumeReplicationClass annotation",
+			update: func(ns *corev1.Namespace) {
+				ns.Annotations[constants.VrcValueAnnotation] = "hourly"
+			},
+			expected: []string{"test-namespace/data", "test-namespace/logs"},
+		},
+		{
+			// Labels are matched by the namespaceSelector of exclusion rules and VolumeReplicationClass match criteria
+			name: "Relabelled namespace",
+			update: func(ns *corev1.Namespace) {
+				ns.Labels["tier"] = "production"
+			},
+			expected: []string{"test-namespace/data", "test-namespace/logs"},
+		},
+		{
+			name: "Removed label",
+			update: func(ns *corev1.Namespace) {
+				delete(ns.Labels, "env")
+			},
+			expected: []string{"test-namespace/data", "test-namespace/logs"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			controller := NewController()
+			queue := workqueue.NewTypedRateLimitingQueue(workqueue.DefaultTypedControllerRateLimiter[string]())
+			defer queue.ShutDown()
+			controller.setQueue(queue)
+
+			oldNs := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+				Name:        "test-namespace",
+				Labels:      map[string]string{"env": "staging"},
+				Annotations: map[string]string{constants.VrcValueAnnotation: "daily"},
+			}}
+			newNs := oldNs.DeepCopy()
+			tt.update(newNs)
+
+			controller.namespaceUpdate(oldNs, newNs)
+
+			var enqueued []string
+			for queue.Len() > 0 {
+				key, _ := queue.Get()
+				enqueued = append(enqueued, key)
+				queue.Done(key)
+			}
+			require.ElementsMatch(t, tt.expected, enqueued)
+		})
+	}
+}
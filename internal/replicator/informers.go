@@ -2,16 +2,21 @@ package replicator
 
 import (
 	"context"
+	"sync"
 	"time"
 
 	"github.com/super-phenix/volume-replicator/internal/k8s"
 	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/client-go/dynamic/dynamicinformer"
 	"k8s.io/client-go/informers"
 	v1 "k8s.io/client-go/informers/core/v1"
+	storagev1informers "k8s.io/client-go/informers/storage/v1"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
 )
 
 const (
@@ -21,9 +26,12 @@ const (
 )
 
 var (
-	NamespaceInformer         v1.NamespaceInformer
-	PvcInformer               v1.PersistentVolumeClaimInformer
-	VolumeReplicationInformer informers.GenericInformer
+	NamespaceInformer              v1.NamespaceInformer
+	PvcInformer                    v1.PersistentVolumeClaimInformer
+	VolumeReplicationInformer      informers.GenericInformer
+	VolumeGroupReplicationInformer informers.GenericInformer
+	StorageClassInformer           storagev1informers.StorageClassInformer
+	PersistentVolumeInformer       v1.PersistentVolumeInformer
 
 	VolumeReplicationResource = schema.GroupVersionResource{
 		Group:    volumeReplicationGroup,
@@ -36,40 +44,134 @@ var (
 		Version:  volumeReplicationVersion,
 		Resource: "volumereplicationclasses",
 	}
+
+	// volumeReplicationIndexers index replication objects by their parent PVC, a PVC having one per target
+	volumeReplicationIndexers = cache.Indexers{parentIndex: indexByParent}
 )
 
+// LoadInformers starts the informers and waits for their caches to be synced.
+// When sharding or watching some namespaces, only namespaces are watched cluster-wide,
+// PVCs and VolumeReplications are watched per owned namespace.
+// Namespaces aren't watched at all if the controller isn't allowed to list them, which requires an explicit list of namespaces.
 func (c *Controller) LoadInformers(ctx context.Context) {
-	informerFactory := informers.NewSharedInformerFactory(k8s.ClientSet, resync)
+	var options []informers.SharedInformerOption
+	if WatchNamespaceSelector != nil {
+		options = append(options, informers.WithTweakListOptions(func(opts *metav1.ListOptions) {
+			opts.LabelSelector = WatchNamespaceSelector.String()
+		}))
+	}
+	informerFactory := informers.NewSharedInformerFactoryWithOptions(k8s.ClientSet, resync, options...)
 	dynamicInformerFactory := dynamicinformer.NewDynamicSharedInformerFactory(k8s.DynamicClientSet, resync)
 
-	c.createNamespaceInformer(informerFactory)
-	c.createPvcInformer(informerFactory)
-	c.createVolumeReplicationInformer(dynamicInformerFactory)
+	if canListNamespaces(ctx) {
+		c.createNamespaceInformer(informerFactory)
+	} else if len(WatchNamespaces) == 0 {
+		klog.Fatalf("not allowed to list namespaces, an explicit list of namespaces must be watched through --watch-namespaces")
+	}
+
+	if !usesNamespaceCaches() {
+		PvcInformer = c.createPvcInformer(informerFactory)
+		VolumeReplicationInformer = c.createVolumeReplicationInformer(dynamicInformerFactory)
+		if VolumeGroups {
+			VolumeGroupReplicationInformer = c.createVolumeGroupReplicationInformer(dynamicInformerFactory)
+		}
+	}
+
+	// StorageClasses and PersistentVolumes are cached when they can be listed, the fallback config is used otherwise.
+	// They aren't filtered by the namespace selector, so they have their own factory.
+	storageInformerFactory := informers.NewSharedInformerFactory(k8s.ClientSet, resync)
+	if canList(ctx, resourceStorageClasses, func(ctx context.Context, opts metav1.ListOptions) error {
+		_, err := k8s.ClientSet.StorageV1().StorageClasses().List(ctx, opts)
+		return err
+	}) {
+		StorageClassInformer = storageInformerFactory.Storage().V1().StorageClasses()
+		setTransform(StorageClassInformer.Informer(), transformStorageClass)
+	}
+	if canList(ctx, resourcePersistentVolumes, func(ctx context.Context, opts metav1.ListOptions) error {
+		_, err := k8s.ClientSet.CoreV1().PersistentVolumes().List(ctx, opts)
+		return err
+	}) {
+		PersistentVolumeInformer = storageInformerFactory.Core().V1().PersistentVolumes()
+		setTransform(PersistentVolumeInformer.Informer(), transformPersistentVolume)
+	}
 
 	informerFactory.Start(ctx.Done())
 	informerFactory.WaitForCacheSync(ctx.Done())
 
+	storageInformerFactory.Start(ctx.Done())
+	storageInformerFactory.WaitForCacheSync(ctx.Done())
+
 	dynamicInformerFactory.Start(ctx.Done())
 	dynamicInformerFactory.WaitForCacheSync(ctx.Done())
+
+	// Without sharding, every watched namespace is owned by this replica
+	if isNamespaceScoped() && Shards == 0 {
+		c.startWatchedNamespaceCaches()
+	}
+}
+
+// startWatchedNamespaceCaches starts the caches of every namespace in the scope of the controller
+func (c *Controller) startWatchedNamespaceCaches() {
+	namespaces, err := listWatchedNamespaces()
+	if err != nil {
+		klog.Errorf("failed to list watched namespaces: %s", err.Error())
+		return
+	}
+
+	var started sync.WaitGroup
+	for _, ns := range namespaces {
+		started.Go(func() {
+			c.startNamespaceCache(ns)
+		})
+	}
+	started.Wait()
+	klog.Infof("watching %d namespaces", len(namespaces))
 }
 
 func (c *Controller) createNamespaceInformer(factory informers.SharedInformerFactory) {
 	NamespaceInformer = factory.Core().V1().Namespaces()
+	setTransform(NamespaceInformer.Informer(), transformNamespace)
 	NamespaceInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
 		UpdateFunc: func(oldObj, newObj any) {
 			c.namespaceUpdate(oldObj.(*corev1.Namespace), newObj.(*corev1.Namespace))
 		},
+		DeleteFunc: func(obj any) {
+			ns, ok := obj.(*corev1.Namespace)
+			if !ok {
+				tombstone, ok := obj.(cache.DeletedFinalStateUnknown)
+				if !ok {
+					return
+				}
+				ns, ok = tombstone.Obj.(*corev1.Namespace)
+				if !ok {
+					return
+				}
+			}
+			forgetNamespaceRegex(ns.Name)
+			if usesNamespaceCaches() {
+				stopNamespaceCache(ns.Name)
+			}
+		},
 	})
+
+	if usesNamespaceCaches() {
+		NamespaceInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc: func(obj any) {
+				c.namespaceCreated(obj.(*corev1.Namespace))
+			},
+		})
+	}
 }
 
-func (c *Controller) createPvcInformer(factory informers.SharedInformerFactory) {
-	PvcInformer = factory.Core().V1().PersistentVolumeClaims()
-	PvcInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+func (c *Controller) createPvcInformer(factory informers.SharedInformerFactory) v1.PersistentVolumeClaimInformer {
+	pvcInformer := factory.Core().V1().PersistentVolumeClaims()
+	setTransform(pvcInformer.Informer(), transformPvc)
+	pvcInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
 		AddFunc: func(obj any) {
-			c.pvcUpdate(obj.(*corev1.PersistentVolumeClaim))
+			c.pvcUpdate(nil, obj.(*corev1.PersistentVolumeClaim))
 		},
-		UpdateFunc: func(_, newObj any) {
-			c.pvcUpdate(newObj.(*corev1.PersistentVolumeClaim))
+		UpdateFunc: func(oldObj, newObj any) {
+			c.pvcUpdate(oldObj.(*corev1.PersistentVolumeClaim), newObj.(*corev1.PersistentVolumeClaim))
 		},
 		DeleteFunc: func(obj any) {
 			pvc, ok := obj.(*corev1.PersistentVolumeClaim)
@@ -83,14 +185,19 @@ func (c *Controller) createPvcInformer(factory informers.SharedInformerFactory)
 					return
 				}
 			}
-			c.pvcUpdate(pvc)
+			c.pvcUpdate(nil, pvc)
 		},
 	})
+	return pvcInformer
 }
 
-func (c *Controller) createVolumeReplicationInformer(factory dynamicinformer.DynamicSharedInformerFactory) {
-	VolumeReplicationInformer = factory.ForResource(VolumeReplicationResource)
-	VolumeReplicationInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+func (c *Controller) createVolumeReplicationInformer(factory dynamicinformer.DynamicSharedInformerFactory) informers.GenericInformer {
+	vrInformer := factory.ForResource(activeBackend.resource())
+	setTransform(vrInformer.Informer(), transformVolumeReplication)
+	if err := vrInformer.Informer().AddIndexers(volumeReplicationIndexers); err != nil {
+		klog.Errorf("failed to add VolumeReplication indexers: %s", err.Error())
+	}
+	vrInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
 		AddFunc: func(obj any) {
 			c.volumeReplicationCreateOrDelete(obj.(*unstructured.Unstructured))
 		},
@@ -112,4 +219,100 @@ func (c *Controller) createVolumeReplicationInformer(factory dynamicinformer.Dyn
 			c.volumeReplicationCreateOrDelete(vr)
 		},
 	})
+	return vrInformer
+}
+
+func (c *Controller) createVolumeGroupReplicationInformer(factory dynamicinformer.DynamicSharedInformerFactory) informers.GenericInformer {
+	vgrInformer := factory.ForResource(VolumeGroupReplicationResource)
+	setTransform(vgrInformer.Informer(), transformVolumeGroupReplication)
+	vgrInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj any) {
+			c.volumeGroupReplicationUpdate(nil, obj.(*unstructured.Unstructured))
+		},
+		UpdateFunc: func(oldObj, newObj any) {
+			c.volumeGroupReplicationUpdate(oldObj.(*unstructured.Unstructured), newObj.(*unstructured.Unstructured))
+		},
+		DeleteFunc: func(obj any) {
+			vgr, ok := obj.(*unstructured.Unstructured)
+			if !ok {
+				tombstone, ok := obj.(cache.DeletedFinalStateUnknown)
+				if !ok {
+					return
+				}
+				vgr, ok = tombstone.Obj.(*unstructured.Unstructured)
+				if !ok {
+					return
+				}
+			}
+			c.volumeGroupReplicationUpdate(nil, vgr)
+		},
+	})
+	return vgrInformer
+}
+
+// setTransform strips the fields that are never read by the controller from the objects cached by an informer
+func setTransform(informer cache.SharedIndexInformer, transform cache.TransformFunc) {
+	if err := informer.SetTransform(transform); err != nil {
+		klog.Errorf("failed to set informer transform: %s", err.Error())
+	}
+}
+
+// getPvcIndexer returns the cache of the PVCs of a namespace, nil if the namespace isn't owned by this replica
+func getPvcIndexer(namespace string) cache.Indexer {
+	if !usesNamespaceCaches() {
+		return PvcInformer.Informer().GetIndexer()
+	}
+
+	if nsCache := getNamespaceCache(namespace); nsCache != nil {
+		return nsCache.pvcInformer.Informer().GetIndexer()
+	}
+	return nil
+}
+
+// getVolumeReplicationIndexer returns the cache of the VolumeReplications of a namespace, nil if the namespace isn't owned by this replica
+func getVolumeReplicationIndexer(namespace string) cache.Indexer {
+	if !usesNamespaceCaches() {
+		return VolumeReplicationInformer.Informer().GetIndexer()
+	}
+
+	if nsCache := getNamespaceCache(namespace); nsCache != nil {
+		return nsCache.vrInformer.Informer().GetIndexer()
+	}
+	return nil
+}
+
+// getVolumeGroupReplicationIndexer returns the cache of the VolumeGroupReplications of a namespace,
+// nil if the namespace isn't owned by this replica or if volume groups are disabled
+func getVolumeGroupReplicationIndexer(namespace string) cache.Indexer {
+	if !usesNamespaceCaches() {
+		if VolumeGroupReplicationInformer == nil {
+			return nil
+		}
+		return VolumeGroupReplicationInformer.Informer().GetIndexer()
+	}
+
+	if nsCache := getNamespaceCache(namespace); nsCache != nil && nsCache.vgrInformer != nil {
+		return nsCache.vgrInformer.Informer().GetIndexer()
+	}
+	return nil
+}
+
+// listPvcs returns the cached PVCs of a namespace, or of every namespace owned by this replica if the namespace is empty
+func listPvcs(namespace string) ([]*corev1.PersistentVolumeClaim, error) {
+	if !usesNamespaceCaches() {
+		if namespace == "" {
+			return PvcInformer.Lister().List(labels.Everything())
+		}
+		return PvcInformer.Lister().PersistentVolumeClaims(namespace).List(labels.Everything())
+	}
+
+	var pvcs []*corev1.PersistentVolumeClaim
+	for _, nsCache := range getNamespaceCaches(namespace) {
+		list, err := nsCache.pvcInformer.Lister().List(labels.Everything())
+		if err != nil {
+			return nil, err
+		}
+		pvcs = append(pvcs, list...)
+	}
+	return pvcs, nil
 }
@@ -0,0 +1,64 @@
+package replicator
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/super-phenix/volume-replicator/internal/constants"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// errUndescribedNamespace is returned when a namespace can't be read and isn't described in the fallback config either
+var errUndescribedNamespace = errors.New("namespace isn't described in the fallback config")
+
+// InstanceName is the name of this controller instance, empty for the default instance.
+// Each instance only reconciles the PVCs that are assigned to it, like an IngressClass.
+var InstanceName string
+
+// getPvcInstance returns the name of the instance in charge of a PVC.
+// It is read from the instance annotation or label of the PVC, falling back to the ones of its namespace.
+// An empty name designates the default instance. An error is returned if the namespace can't be resolved,
+// in which case the instance of the PVC is unknown.
+func getPvcInstance(pvc *corev1.PersistentVolumeClaim) (string, error) {
+	if instance := getInstanceFromMetadata(pvc.Annotations, pvc.Labels); instance != "" {
+		return instance, nil
+	}
+
+	// Without access to namespaces, only the ones described in the fallback config are known
+	if NamespaceInformer == nil && Fallback.getNamespace(pvc.Namespace) == nil {
+		return "", fmt.Errorf("namespace %s: %w", pvc.Namespace, errUndescribedNamespace)
+	}
+
+	ns, err := getNamespace(pvc.Namespace)
+	if err != nil {
+		return "", fmt.Errorf("failed to retrieve namespace %s: %w", pvc.Namespace, err)
+	}
+	return getNamespaceInstance(ns), nil
+}
+
+// getNamespaceInstance returns the name of the instance in charge of the PVCs of a namespace
+func getNamespaceInstance(ns *corev1.Namespace) string {
+	return getInstanceFromMetadata(ns.Annotations, ns.Labels)
+}
+
+// getInstanceFromMetadata returns the instance of an object, the annotation has priority over the label
+func getInstanceFromMetadata(annotations, labels map[string]string) string {
+	if instance := getKeyValue(annotations, constants.InstanceLabel); instance != "" {
+		return instance
+	}
+	return getKeyValue(labels, constants.InstanceLabel)
+}
+
+// isPvcManagedByInstance returns whether a PVC is assigned to our instance.
+// PVCs of namespaces that aren't described in the fallback config have no instance, they are managed by the default instance.
+// An error is returned if the instance of the PVC is unknown, the PVC must neither be managed nor released then.
+func isPvcManagedByInstance(pvc *corev1.PersistentVolumeClaim) (bool, error) {
+	instance, err := getPvcInstance(pvc)
+	if errors.Is(err, errUndescribedNamespace) && InstanceName == "" {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return instance == InstanceName, nil
+}
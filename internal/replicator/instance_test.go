@@ -0,0 +1,146 @@
+package replicator
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/super-phenix/volume-replicator/internal/constants"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestGetPvcInstance(t *testing.T) {
+	_, _, _ = setupTestEnvironment()
+
+	nsName := "test-namespace"
+
+	tests := []struct {
+		name           string
+		pvcAnnotations map[string]string
+		pvcLabels      map[string]string
+		nsAnnotations  map[string]string
+		nsLabels       map[string]string
+		missingNs      bool
+		expected       string
+		expectedError  bool
+	}{
+		{
+			name:     "Default instance",
+			expected: "",
+		},
+		{
+			name:           "PVC annotation",
+			pvcAnnotations: map[string]string{constants.InstanceLabel: "tenant-a"},
+			expected:       "tenant-a",
+		},
+		{
+			name:      "PVC label",
+			pvcLabels: map[string]string{constants.InstanceLabel: "tenant-a"},
+			expected:  "tenant-a",
+		},
+		{
+			name:           "PVC annotation has priority over its label",
+			pvcAnnotations: map[string]string{constants.InstanceLabel: "tenant-a"},
+			pvcLabels:      map[string]string{constants.InstanceLabel: "tenant-b"},
+			expected:       "tenant-a",
+		},
+		{
+			name:     "Namespace label",
+			nsLabels: map[string]string{constants.InstanceLabel: "tenant-b"},
+			expected: "tenant-b",
+		},
+		{
+			name:          "PVC has priority over its namespace",
+			pvcLabels:     map[string]string{constants.InstanceLabel: "tenant-a"},
+			nsAnnotations: map[string]string{constants.InstanceLabel: "tenant-b"},
+			expected:      "tenant-a",
+		},
+		{
+			name:          "Unknown namespace",
+			missingNs:     true,
+			expectedError: true,
+		},
+		{
+			name:      "PVC of an unknown namespace",
+			pvcLabels: map[string]string{constants.InstanceLabel: "tenant-a"},
+			missingNs: true,
+			expected:  "tenant-a",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, obj := range NamespaceInformer.Informer().GetIndexer().List() {
+				_ = NamespaceInformer.Informer().GetIndexer().Delete(obj)
+			}
+			if !tt.missingNs {
+				err := NamespaceInformer.Informer().GetIndexer().Add(&corev1.Namespace{
+					ObjectMeta: metav1.ObjectMeta{Name: nsName, Annotations: tt.nsAnnotations, Labels: tt.nsLabels},
+				})
+				require.NoError(t, err)
+			}
+
+			pvc := &corev1.PersistentVolumeClaim{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "test-pvc",
+					Namespace:   nsName,
+					Annotations: tt.pvcAnnotations,
+					Labels:      tt.pvcLabels,
+				},
+			}
+			instance, err := getPvcInstance(pvc)
+			require.Equal(t, tt.expectedError, err != nil)
+			require.Equal(t, tt.expected, instance)
+		})
+	}
+}
+
+func TestIsPvcManagedByInstanceWithFallback(t *testing.T) {
+	NamespaceInformer = nil
+	Fallback = &FallbackConfig{Namespaces: []FallbackNamespace{
+		{Name: "tenant-b-namespace", Labels: map[string]string{constants.InstanceLabel: "tenant-b"}},
+	}}
+	defer func() {
+		Fallback = nil
+		InstanceName = ""
+	}()
+
+	newPvc := func(namespace string) *corev1.PersistentVolumeClaim {
+		return &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: "test-pvc", Namespace: namespace}}
+	}
+
+	// Namespaces that aren't described have no instance, their PVCs belong to the default instance
+	managed, err := isPvcManagedByInstance(newPvc("undescribed"))
+	require.NoError(t, err)
+	require.True(t, managed)
+
+	managed, err = isPvcManagedByInstance(newPvc("tenant-b-namespace"))
+	require.NoError(t, err)
+	require.False(t, managed)
+
+	// Other instances can't tell whether the PVCs of an undescribed namespace are assigned elsewhere
+	InstanceName = "tenant-b"
+	managed, err = isPvcManagedByInstance(newPvc("tenant-b-namespace"))
+	require.NoError(t, err)
+	require.True(t, managed)
+
+	_, err = isPvcManagedByInstance(newPvc("undescribed"))
+	require.ErrorIs(t, err, errUndescribedNamespace)
+}
+
+func TestInstanceStamp(t *testing.T) {
+	InstanceName = "tenant-a"
+	defer func() { InstanceName = "" }()
+
+	labels := getLabelsWithParent(map[string]string{constants.InstanceLabel: "tenant-b", "a": "b"}, "test-pvc")
+	require.Equal(t, map[string]string{
+		constants.ParentLabel:   "test-pvc",
+		constants.InstanceLabel: "tenant-a",
+		"a":                     "b",
+	}, labels)
+	require.True(t, isParentLabelPresent(labels))
+
+	// VolumeReplications of the default instance or of other instances aren't ours
+	require.False(t, isParentLabelPresent(map[string]string{constants.ParentLabel: "test-pvc"}))
+	require.False(t, isParentLabelPresent(map[string]string{constants.ParentLabel: "test-pvc", constants.InstanceLabel: "tenant-b"}))
+}
@@ -0,0 +1,170 @@
+package replicator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/super-phenix/volume-replicator/internal/constants"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/klog/v2"
+)
+
+const bytesPerGi = 1 << 30
+
+// errInvalidSelector is returned for match criteria that can't be parsed, as opposed to criteria that can't be evaluated
+var errInvalidSelector = errors.New("invalid selector")
+
+// filterVrcFromMatchCriteria returns the VRCs whose match criteria are fulfilled by a PVC.
+// VRCs can restrict the PVCs they apply to through label selector expressions placed in their annotations:
+//   - the PVC selector is evaluated against the labels of the PVC, along with attributes of the PVC
+//     (StorageClass name, VolumeAttributesClass name, volumeMode and requested size in Gi)
+//   - the namespace selector is evaluated against the labels of the namespace of the PVC
+//   - the StorageClass selector is evaluated against the labels and parameters of the StorageClass of the PVC
+//
+// VRCs without any criteria match every PVC, VRCs with invalid criteria match none.
+// An error is returned when criteria can't be evaluated, e.g. because the namespace or the StorageClass can't be read,
+// so that the VolumeReplication of the PVC isn't deleted because of a transient failure.
+func filterVrcFromMatchCriteria(ctx context.Context, classes []unstructured.Unstructured, pvc *corev1.PersistentVolumeClaim) ([]unstructured.Unstructured, error) {
+	var matching []unstructured.Unstructured
+	for _, vrc := range classes {
+		matches, err := vrcMatchesPvc(ctx, vrc, pvc)
+		if errors.Is(err, errInvalidSelector) {
+			klog.Errorf("discarded VRC %s as its match criteria are invalid: %s", vrc.GetName(), err.Error())
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to evaluate match criteria of VRC %s: %w", vrc.GetName(), err)
+		}
+
+		if !matches {
+			klog.V(2).Infof("discarded VRC %s as its match criteria don't match PVC %s/%s", vrc.GetName(), pvc.Namespace, pvc.Name)
+			continue
+		}
+
+		matching = append(matching, vrc)
+	}
+
+	return matching, nil
+}
+
+// vrcMatchesPvc returns whether a PVC fulfills every match criterion of a VRC
+func vrcMatchesPvc(ctx context.Context, vrc unstructured.Unstructured, pvc *corev1.PersistentVolumeClaim) (bool, error) {
+	annotations := vrc.GetAnnotations()
+
+	if expression := getKeyValue(annotations, constants.PvcSelectorAnnotation); expression != "" {
+		matches, err := matchExpression(expression, withAliases(getPvcAttributes(pvc)))
+		if err != nil || !matches {
+			return false, err
+		}
+	}
+
+	if expression := getKeyValue(annotations, constants.NamespaceSelectorAnnotation); expression != "" {
+		ns, err := getNamespace(pvc.Namespace)
+		if err != nil {
+			return false, fmt.Errorf("failed to retrieve namespace %s: %w", pvc.Namespace, err)
+		}
+
+		matches, err := matchExpression(expression, ns.Labels)
+		if err != nil || !matches {
+			return false, err
+		}
+	}
+
+	if expression := getKeyValue(annotations, constants.StorageClassSelectorAnnotation); expression != "" {
+		attributes, err := getStorageClassAttributes(ctx, pvc)
+		if err != nil {
+			return false, err
+		}
+
+		matches, err := matchExpression(expression, attributes)
+		if err != nil || !matches {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+// matchExpression evaluates a label selector expression (e.g. "app in (db,cache),tier!=scratch") against a set of attributes
+func matchExpression(expression string, attributes map[string]string) (bool, error) {
+	selector, err := labels.Parse(expression)
+	if err != nil {
+		return false, fmt.Errorf("%w %q: %w", errInvalidSelector, expression, err)
+	}
+
+	return selector.Matches(labels.Set(attributes)), nil
+}
+
+// getPvcAttributes returns the labels of a PVC along with attributes that VRCs can match on
+func getPvcAttributes(pvc *corev1.PersistentVolumeClaim) map[string]string {
+	attributes := make(map[string]string, len(pvc.Labels)+4)
+	for k, v := range pvc.Labels {
+		attributes[k] = v
+	}
+
+	if pvc.Spec.StorageClassName != nil {
+		attributes[constants.StorageClassNameAttribute] = *pvc.Spec.StorageClassName
+	}
+	if vac := getVolumeAttributesClassName(pvc); vac != "" {
+		attributes[constants.VolumeAttributesClassAttribute] = vac
+	}
+	attributes[constants.VolumeModeAttribute] = string(getPvcVolumeMode(pvc))
+
+	// Sizes are rounded up to the next Gi, so that they can be compared with the > and < operators
+	size := pvc.Spec.Resources.Requests[corev1.ResourceStorage]
+	attributes[constants.SizeAttribute] = strconv.FormatInt((size.Value()+bytesPerGi-1)/bytesPerGi, 10)
+
+	return attributes
+}
+
+// getStorageClassAttributes returns the labels and parameters of the StorageClass of a PVC
+func getStorageClassAttributes(ctx context.Context, pvc *corev1.PersistentVolumeClaim) (map[string]string, error) {
+	storageClass, err := getStorageClass(ctx, pvc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get StorageClass: %w", err)
+	}
+
+	attributes := make(map[string]string)
+	if storageClass == nil {
+		return attributes, nil
+	}
+
+	for k, v := range storageClass.Parameters {
+		attributes[k] = v
+	}
+	for k, v := range storageClass.Labels {
+		attributes[k] = v
+	}
+
+	return attributes, nil
+}
+
+// filterVrcFromVolumeAttributesClass returns the VRCs matching the VolumeAttributesClass of a PVC.
+// VRCs labelled with a VolumeAttributesClass only match PVCs requesting that VolumeAttributesClass.
+// If some VRCs are labelled with the exact VolumeAttributesClass of the PVC, they are preferred over unlabelled VRCs,
+// which lets a performance tier be mapped to its own replication policy within a StorageClass group.
+func filterVrcFromVolumeAttributesClass(classes []unstructured.Unstructured, pvc *corev1.PersistentVolumeClaim) []unstructured.Unstructured {
+	pvcVac := getVolumeAttributesClassName(pvc)
+
+	var exact, generic []unstructured.Unstructured
+	for _, vrc := range classes {
+		vrcVac, ok := lookupKey(vrc.GetLabels(), constants.VolumeAttributesClassLabel)
+		switch {
+		case !ok || vrcVac == "":
+			generic = append(generic, vrc)
+		case vrcVac == pvcVac:
+			exact = append(exact, vrc)
+		default:
+			klog.V(2).Infof("discarded VRC %s as it is for VolumeAttributesClass %s, PVC %s/%s uses %q", vrc.GetName(), vrcVac, pvc.Namespace, pvc.Name, pvcVac)
+		}
+	}
+
+	if len(exact) > 0 {
+		return exact
+	}
+	return generic
+}
@@ -0,0 +1,282 @@
+package replicator
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/super-phenix/volume-replicator/internal/constants"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestGetPvcAttributes(t *testing.T) {
+	t.Parallel()
+
+	stcName := "fast"
+	vacName := "gold"
+	blockMode := corev1.PersistentVolumeBlock
+
+	tests := []struct {
+		name     string
+		pvc      *corev1.PersistentVolumeClaim
+		expected map[string]string
+	}{
+		{
+			name: "Defaults",
+			pvc:  &corev1.PersistentVolumeClaim{},
+			expected: map[string]string{
+				constants.VolumeModeAttribute: "Filesystem",
+				constants.SizeAttribute:       "0",
+			},
+		},
+		{
+			name: "All attributes with labels",
+			pvc: &corev1.PersistentVolumeClaim{
+				ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": "db"}},
+				Spec: corev1.PersistentVolumeClaimSpec{
+					StorageClassName:          &stcName,
+					VolumeAttributesClassName: &vacName,
+					VolumeMode:                &blockMode,
+					Resources: corev1.VolumeResourceRequirements{
+						Requests: corev1.ResourceList{corev1.ResourceStorage: resource.MustParse("1500Mi")},
+					},
+				},
+			},
+			expected: map[string]string{
+				"app":                                    "db",
+				constants.StorageClassNameAttribute:      stcName,
+				constants.VolumeAttributesClassAttribute: vacName,
+				constants.VolumeModeAttribute:            "Block",
+				constants.SizeAttribute:                  "2",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.expected, getPvcAttributes(tt.pvc))
+		})
+	}
+}
+
+func TestVrcMatchesPvc(t *testing.T) {
+	client, _, _ := setupTestEnvironment()
+
+	nsName := "test-namespace"
+	stcName := "fast"
+	blockMode := corev1.PersistentVolumeBlock
+
+	_ = NamespaceInformer.Informer().GetIndexer().Add(&corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   nsName,
+			Labels: map[string]string{"tenant": "gold"},
+		},
+	})
+
+	_, _ = client.StorageV1().StorageClasses().Create(t.Context(), &storagev1.StorageClass{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   stcName,
+			Labels: map[string]string{"tier": "ssd"},
+		},
+		Parameters: map[string]string{"pool": "replicated"},
+	}, metav1.CreateOptions{})
+
+	blockPvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "vm-disk",
+			Namespace: nsName,
+			Labels:    map[string]string{"kubevirt.io/created-by": "vm"},
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			StorageClassName: &stcName,
+			VolumeMode:       &blockMode,
+			Resources: corev1.VolumeResourceRequirements{
+				Requests: corev1.ResourceList{corev1.ResourceStorage: resource.MustParse("500Gi")},
+			},
+		},
+	}
+
+	tests := []struct {
+		name            string
+		annotations     map[string]string
+		pvc             *corev1.PersistentVolumeClaim
+		expected        bool
+		expectErr       bool
+		expectFilterErr bool
+	}{
+		{
+			name:     "No criteria",
+			pvc:      blockPvc,
+			expected: true,
+		},
+		{
+			name:        "Volume mode matches",
+			annotations: map[string]string{constants.PvcSelectorAnnotation: constants.VolumeModeAttribute + "=Block"},
+			pvc:         blockPvc,
+			expected:    true,
+		},
+		{
+			name:        "Volume mode doesn't match",
+			annotations: map[string]string{constants.PvcSelectorAnnotation: constants.VolumeModeAttribute + "=Filesystem"},
+			pvc:         blockPvc,
+			expected:    false,
+		},
+		{
+			name:        "Size range",
+			annotations: map[string]string{constants.PvcSelectorAnnotation: constants.SizeAttribute + ">100," + constants.SizeAttribute + "<1024"},
+			pvc:         blockPvc,
+			expected:    true,
+		},
+		{
+			name:        "Size too small",
+			annotations: map[string]string{constants.PvcSelectorAnnotation: constants.SizeAttribute + ">1024"},
+			pvc:         blockPvc,
+			expected:    false,
+		},
+		{
+			name:        "PVC label and StorageClass name",
+			annotations: map[string]string{constants.PvcSelectorAnnotation: "kubevirt.io/created-by," + constants.StorageClassNameAttribute + " in (fast,slow)"},
+			pvc:         blockPvc,
+			expected:    true,
+		},
+		{
+			name:        "Namespace labels",
+			annotations: map[string]string{constants.NamespaceSelectorAnnotation: "tenant in (gold,silver)"},
+			pvc:         blockPvc,
+			expected:    true,
+		},
+		{
+			name:        "Namespace labels don't match",
+			annotations: map[string]string{constants.NamespaceSelectorAnnotation: "tenant=bronze"},
+			pvc:         blockPvc,
+			expected:    false,
+		},
+		{
+			name:        "StorageClass labels and parameters",
+			annotations: map[string]string{constants.StorageClassSelectorAnnotation: "tier=ssd,pool=replicated"},
+			pvc:         blockPvc,
+			expected:    true,
+		},
+		{
+			name:        "StorageClass parameters don't match",
+			annotations: map[string]string{constants.StorageClassSelectorAnnotation: "pool!=replicated"},
+			pvc:         blockPvc,
+			expected:    false,
+		},
+		{
+			name: "Every criterion must match",
+			annotations: map[string]string{
+				constants.PvcSelectorAnnotation:          constants.VolumeModeAttribute + "=Block",
+				constants.NamespaceSelectorAnnotation:    "tenant=gold",
+				constants.StorageClassSelectorAnnotation: "tier=hdd",
+			},
+			pvc:      blockPvc,
+			expected: false,
+		},
+		{
+			name:        "Invalid expression",
+			annotations: map[string]string{constants.PvcSelectorAnnotation: "size >> 10"},
+			pvc:         blockPvc,
+			expected:    false,
+			expectErr:   true,
+		},
+		{
+			name:        "Namespace not found",
+			annotations: map[string]string{constants.NamespaceSelectorAnnotation: "tenant=gold"},
+			pvc: &corev1.PersistentVolumeClaim{
+				ObjectMeta: metav1.ObjectMeta{Name: "pvc", Namespace: "missing"},
+			},
+			expected:        false,
+			expectErr:       true,
+			expectFilterErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vrc := unstructured.Unstructured{}
+			vrc.SetName("test-vrc")
+			vrc.SetAnnotations(tt.annotations)
+
+			matches, err := vrcMatchesPvc(t.Context(), vrc, tt.pvc)
+			if tt.expectErr {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+			require.Equal(t, tt.expected, matches)
+
+			// Invalid criteria discard the VRC, criteria that can't be evaluated fail the filter
+			filtered, err := filterVrcFromMatchCriteria(t.Context(), []unstructured.Unstructured{vrc}, tt.pvc)
+			if tt.expectFilterErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, len(filtered) == 1)
+		})
+	}
+}
+
+func TestFilterVrcFromVolumeAttributesClass(t *testing.T) {
+	t.Parallel()
+
+	newClass := func(name, vac string) unstructured.Unstructured {
+		vrc := unstructured.Unstructured{}
+		vrc.SetName(name)
+		if vac != "" {
+			vrc.SetLabels(map[string]string{constants.VolumeAttributesClassLabel: vac})
+		}
+		return vrc
+	}
+
+	generic := newClass("generic", "")
+	gold := newClass("gold", "gold")
+	silver := newClass("silver", "silver")
+
+	tests := []struct {
+		name     string
+		vac      string
+		classes  []unstructured.Unstructured
+		expected []string
+	}{
+		{
+			name:     "PVC without VolumeAttributesClass only matches generic VRCs",
+			vac:      "",
+			classes:  []unstructured.Unstructured{generic, gold, silver},
+			expected: []string{"generic"},
+		},
+		{
+			name:     "Exact VolumeAttributesClass is preferred",
+			vac:      "gold",
+			classes:  []unstructured.Unstructured{generic, gold, silver},
+			expected: []string{"gold"},
+		},
+		{
+			name:     "Falls back to generic VRCs",
+			vac:      "bronze",
+			classes:  []unstructured.Unstructured{generic, gold, silver},
+			expected: []string{"generic"},
+		},
+		{
+			name:     "No generic VRC",
+			vac:      "bronze",
+			classes:  []unstructured.Unstructured{gold, silver},
+			expected: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pvc := &corev1.PersistentVolumeClaim{}
+			if tt.vac != "" {
+				pvc.Spec.VolumeAttributesClassName = &tt.vac
+			}
+
+			require.Equal(t, tt.expected, vrcNames(filterVrcFromVolumeAttributesClass(tt.classes, pvc)))
+		})
+	}
+}
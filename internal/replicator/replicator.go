@@ -2,153 +2,474 @@ package replicator
 
 import (
 	"context"
+	"slices"
+	"sync"
 	"time"
 
-	"k8s.io/apimachinery/pkg/api/errors"
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/util/runtime"
-	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/util/workqueue"
 	"k8s.io/klog/v2"
 )
 
+// ShutdownTimeout is the maximum time given to in-flight reconciliations when the controller stops
+var ShutdownTimeout = 10 * time.Second
+
+// requeueWithBackoff is returned by reconciliations that couldn't proceed because of an error that may be transient,
+// the key is then retried with the exponential backoff of the queue instead of a fixed delay
+const requeueWithBackoff time.Duration = -1
+
 type Controller struct {
+	// pvcQueue is only set while the controller is leading, keys are dropped otherwise
+	mu       sync.RWMutex
 	pvcQueue workqueue.TypedRateLimitingInterface[string]
 }
 
 func NewController() *Controller {
-	return &Controller{
-		pvcQueue: workqueue.NewTypedRateLimitingQueue(workqueue.DefaultTypedControllerRateLimiter[string]()),
-	}
+	return &Controller{}
 }
 
-// Run begins watching and syncing.
-func (c *Controller) Run(ctx context.Context, workers int) {
+// Run begins syncing until the context is cancelled, e.g. on shutdown, or until the lease context is cancelled on leadership loss.
+// The informers must already be loaded, so that a new leader starts from warm caches.
+// On shutdown, no new key is accepted and in-flight reconciliations are given ShutdownTimeout to finish before being aborted,
+// the lease being held meanwhile. On leadership loss, they are aborted right away, as another replica may already be taking over.
+func (c *Controller) Run(ctx, leaseCtx context.Context, workers int) {
 	defer runtime.HandleCrashWithContext(ctx)
-
-	// Let the workers stop when we are done
-	defer c.pvcQueue.ShutDown()
 	klog.Info("Starting replication controller")
 
+	queue := workqueue.NewTypedRateLimitingQueue(workqueue.DefaultTypedControllerRateLimiter[string]())
+	c.setQueue(queue)
+
+	// Events received while on stand-by were dropped, so every known PVC is synced again
+	c.enqueueAllPvcs()
+
+	// The controller stops on shutdown as well as on leadership loss
+	runCtx, stop := context.WithCancel(ctx)
+	defer stop()
+	stopOnLoss := context.AfterFunc(leaseCtx, stop)
+	defer stopOnLoss()
+
+	// In-flight reconciliations outlive a shutdown, so that they aren't interrupted halfway through, but not the lease
+	workCtx, cancelWork := context.WithCancel(leaseCtx)
+	defer cancelWork()
+
+	var wg sync.WaitGroup
 	for range workers {
-		go wait.UntilWithContext(ctx, c.runWorker, time.Second)
+		wg.Go(func() {
+			for c.processNextItem(runCtx, workCtx, queue) {
+			}
+		})
+	}
+
+	<-runCtx.Done()
+	if leaseCtx.Err() != nil {
+		klog.Warning("Lost the lease, aborting in-flight reconciliations")
+	} else {
+		klog.Info("Stopping replication controller")
+	}
+
+	// Stop accepting new keys, workers exit once their in-flight key is reconciled
+	c.setQueue(nil)
+	queue.ShutDown()
+
+	drained := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+	case <-time.After(ShutdownTimeout):
+		klog.Warningf("in-flight reconciliations didn't finish within %s, aborting them", ShutdownTimeout)
+		cancelWork()
+		<-drained
 	}
 
-	<-ctx.Done()
-	klog.Info("Stopping replication controller")
+	klog.Info("Replication controller stopped")
+}
+
+// setQueue sets the queue to which keys are added, nil to drop them
+func (c *Controller) setQueue(queue workqueue.TypedRateLimitingInterface[string]) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pvcQueue = queue
+}
+
+// enqueue adds a PVC key to the queue if the controller is running
+func (c *Controller) enqueue(key string) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.pvcQueue != nil {
+		c.pvcQueue.Add(key)
+	}
 }
 
-func (c *Controller) runWorker(ctx context.Context) {
-	for c.processNextItem() {
+// enqueueAllPvcs adds every PVC of the informer cache to the queue
+func (c *Controller) enqueueAllPvcs() {
+	pvcs, err := listPvcs("")
+	if err != nil {
+		klog.Errorf("failed to list PVCs: %s", err.Error())
+		return
+	}
+
+	for _, pvc := range pvcs {
+		key, err := cache.MetaNamespaceKeyFunc(pvc)
+		if err != nil {
+			klog.Errorf("failed to get key for PVC %s/%s: %s", pvc.Namespace, pvc.Name, err.Error())
+			continue
+		}
+		c.enqueue(key)
+		c.enqueueGroups(pvc)
 	}
 }
 
-func (c *Controller) processNextItem() bool {
+// processNextItem reconciles the next PVC of the queue.
+// Keys still queued once the controller is stopped are left to the next leader.
+// The work context is only cancelled on leadership loss, or when in-flight reconciliations exceed the shutdown timeout.
+func (c *Controller) processNextItem(ctx, workCtx context.Context, queue workqueue.TypedRateLimitingInterface[string]) bool {
 	// Wait until there is a new item in the working queue
-	key, quit := c.pvcQueue.Get()
+	key, quit := queue.Get()
 	if quit {
 		return false
 	}
+	defer queue.Done(key)
+
+	if ctx.Err() != nil {
+		return false
+	}
 
-	reconcileVolumeReplication(key)
+	switch requeueAfter := reconcile(workCtx, key); {
+	case requeueAfter == requeueWithBackoff:
+		queue.AddRateLimited(key)
+	case requeueAfter > 0:
+		queue.Forget(key)
+		queue.AddAfter(key, requeueAfter)
+	default:
+		queue.Forget(key)
+	}
 
-	defer c.pvcQueue.Done(key)
 	return true
 }
 
 // Reconcile:
-// - if the PVC doesn't exist anymore, delete the corresponding VolumeReplication (if it exists)
+// - if the PVC doesn't exist anymore, delete the corresponding VolumeReplications (if they exist)
 //
-// - if the VolumeReplication exists
-//   - check if the PVC has a matching VolumeReplicationClass
-//   - and if it doesn't, delete the VolumeReplication
-//   - check if the class/target of the VolumeReplication is correct
-//   - and if it isn't, delete it, and it will be re-created on the next sync
-//   - check if the replicationState of the VolumeReplication is correct
-//   - and if it isn't, live update the VolumeReplication
+// - if the PVC is assigned to another controller instance, delete the VolumeReplications (if they exist)
 //
-// - if the VolumeReplication doesn't exist
-//   - and if a corresponding VolumeReplicationClass exists, create the VolumeReplication
-func reconcileVolumeReplication(key string) {
+// - if the PVC belongs to a group, label it with its group and delete its VolumeReplications (if they exist)
+//
+// - if the PVC isn't ready to be replicated yet and one of its VolumeReplications doesn't exist, wait for it
+//
+// - reconcile the VolumeReplication of each target of the PVC (see reconcileTarget)
+//
+// - record the targets whose name is taken by an object that isn't owned by us on the PVC
+//
+// - delete the VolumeReplications of the PVC that don't match any of its targets anymore
+//
+// The VolumeReplication and its class are the replication object and class of the active backend.
+//
+// It returns the delay after which the PVC must be reconciled again, zero if no requeue is needed.
+func reconcileVolumeReplication(ctx context.Context, key string) time.Duration {
+	// The controller is stopping, the PVC will be reconciled again by the next leader
+	if ctx.Err() != nil {
+		klog.Infof("not reconciling VolumeReplication for PVC %s as the controller is stopping", key)
+		return 0
+	}
+
+	namespace, _, _ := cache.SplitMetaNamespaceKey(key)
+
+	// The namespace moved to a shard owned by another replica, which reconciles it from now on.
+	// Otherwise, the shard of the namespace isn't released until the PVC is reconciled.
+	ctx, done, owned := trackNamespaceWork(ctx, namespace)
+	defer done()
+	if !owned {
+		klog.V(2).Infof("not reconciling VolumeReplication for PVC %s as its namespace isn't owned by this replica", key)
+		forgetPvc(key)
+		return 0
+	}
+
 	klog.Infof("reconciling VolumeReplication for PVC %s", key)
-	namespace, name, _ := cache.SplitMetaNamespaceKey(key)
 
 	// Retrieve the PVC that we might need to replicate (or that shouldn't be replicated anymore)
 	pvc, err := getPersistentVolumeClaim(key)
 	if err != nil {
 		klog.Error(err)
-		return
+		return 0
 	}
 
-	// Retrieve the VolumeReplication that corresponds to the PVC (it has the same name)
-	volumeReplication, err := getVolumeReplication(key)
-	if err != nil && !errors.IsNotFound(err) {
-		klog.Errorf("couldn't get VolumeReplication for pvc %s: %s", key, err.Error())
-		return
+	// Retrieve the VolumeReplications of the PVC, one per target, through their parent label
+	volumeReplications, err := getVolumeReplications(key)
+	if err != nil {
+		klog.Errorf("couldn't get VolumeReplications for pvc %s: %s", key, err.Error())
+		return 0
 	}
 
-	// If the VR exists, and it isn't owned by our controller, do not proceed further
-	if volumeReplication != nil && !isParentLabelPresent(volumeReplication.GetLabels()) {
-		klog.Infof("VolumeReplication %s isn't owned by us, skipping", key)
-		return
+	// The PVC got deleted, delete the VolumeReplications associated with it
+	if pvc == nil || pvc.DeletionTimestamp != nil {
+		forgetPvc(key)
+		if len(volumeReplications) > 0 {
+			klog.Infof("deleting VolumeReplications of PVC %s as it doesn't exist anymore", key)
+			cleanupVolumeReplications(ctx, volumeReplications)
+		}
+		return 0
 	}
 
-	// The PVC got deleted, delete the VolumeReplication associated with it
-	if pvc == nil || pvc.DeletionTimestamp != nil {
-		klog.Infof("deleting VolumeReplication %s as its PVC doesn't exist anymore", key)
-		cleanupVolumeReplication(name, namespace)
-		return
+	// An unknown instance is never mistaken for another instance, the VolumeReplications are kept until it is resolved
+	managed, err := isPvcManagedByInstance(pvc)
+	if err != nil {
+		klog.Errorf("couldn't resolve the instance of PVC %s, leaving it untouched: %s", key, err.Error())
+		return requeueWithBackoff
 	}
 
+	// The PVC is assigned to another instance, release our VolumeReplications so that the other instance can create its own
+	if !managed {
+		forgetPvc(key)
+		instance, _ := getPvcInstance(pvc)
+		if len(volumeReplications) > 0 {
+			klog.Infof("deleting VolumeReplications of PVC %s as it is assigned to instance %q", key, instance)
+			cleanupVolumeReplications(ctx, volumeReplications)
+		} else {
+			klog.Infof("PVC %s is assigned to instance %q, skipping", key, instance)
+		}
+		return 0
+	}
+
+	// Move the keys of the PVC to the domain of the controller, the update brings us back here
+	rewriteAliasKeys(ctx, pvc)
+
 	// Both PVC-level and namespace-level pause skip create/update
 	if isPvcPaused(pvc, namespace) {
 		klog.Infof("PVC %s is paused, skipping reconciliation", key)
-		return
+		return 0
 	}
 
-	// Retrieve the VRC that should apply to this PVC
-	replicationClass := getVolumeReplicationClass(pvc)
+	existing := make(map[string]*unstructured.Unstructured, len(volumeReplications))
+	for _, vr := range volumeReplications {
+		existing[vr.GetName()] = vr
+	}
+	targets := getReplicationTargets(pvc)
+
+	// Wait for the PVC to be bound (and not resizing, if configured) before creating its VolumeReplications
+	if slices.ContainsFunc(targets, func(target replicationTarget) bool { return existing[target.name] == nil }) {
+		if reason := getPvcNotReadyReason(pvc); reason != "" {
+			klog.Infof("not creating VolumeReplication for PVC %s yet: %s", key, reason)
+			return waitForPvc(ctx, pvc, reason)
+		}
+	}
+	clearBindTimeout(ctx, pvc)
+
+	// Explain which exclusion setting applies to a PVC that requests replication
+	if getVolumeReplicationClassValue(pvc) != "" || getVolumeReplicationClassSelector(pvc) != "" {
+		reportExclusion(ctx, pvc)
+	}
+
+	// Retrieve the class that should apply to each target of this PVC, its provisioner is resolved once for every target
+	ctx = withPvcProvisioner(ctx, pvc)
+	resolutions := make([]classResolution, len(targets))
+	for i, target := range targets {
+		resolutions[i] = activeBackend.resolve(ctx, pvc, target)
+		if resolutions[i].class != "" {
+			klog.Infof("found class %s for target %s of PVC %s (%s)", resolutions[i].class, target.name, key, resolutions[i].outcome)
+		}
+	}
+	reportClassResolutions(ctx, pvc, targets, resolutions)
+
+	// PVCs of a group are replicated by the VolumeGroupReplication of their group instead of their own VolumeReplications
+	if VolumeGroups {
+		if resolutions[0].isUnresolved() {
+			klog.Errorf("couldn't resolve class for PVC %s, leaving it untouched: %s", key, resolutions[0].message)
+			return requeueWithBackoff
+		}
+
+		grouped, err := reconcileGroupMembership(ctx, pvc, volumeReplications, resolutions[0].class)
+		if err != nil {
+			klog.Errorf("couldn't reconcile the group of PVC %s, leaving it untouched: %s", key, err.Error())
+			return 0
+		}
+		if grouped {
+			return 0
+		}
+	}
+
+	// Each target has its own lifecycle, but re-creations are applied one at a time
+	var requeueAfter time.Duration
+	var conflicts []string
+	recreating, backoff := false, false
+	for i, target := range targets {
+		delay, pending, conflict := reconcileTarget(ctx, pvc, target, resolutions[i], existing[target.name], recreating)
+		recreating = recreating || pending
+		backoff = backoff || delay == requeueWithBackoff
+		if conflict != "" {
+			conflicts = append(conflicts, conflict)
+		}
+		if delay > 0 && (requeueAfter == 0 || delay < requeueAfter) {
+			requeueAfter = delay
+		}
+		delete(existing, target.name)
+	}
+
+	// Every VolumeReplication is up-to-date, any pending change has been applied or abandoned
+	if !recreating && len(volumeReplications) > 0 {
+		clearClassChange(ctx, pvc)
+	}
+
+	// Surface the targets whose name is taken by an object that isn't owned by our controller
+	reportNameConflicts(ctx, pvc, conflicts)
+
+	// The remaining VolumeReplications belong to targets that were removed from the PVC
+	for name := range existing {
+		klog.Infof("deleting %s %s/%s as it doesn't match any target of its PVC anymore", activeBackend.kind(), namespace, name)
+		cleanupVolumeReplication(ctx, name, namespace)
+	}
+
+	if backoff {
+		return requeueWithBackoff
+	}
+	return requeueAfter
+}
+
+// forgetPvc forgets the state kept in memory for a PVC that isn't reconciled by this replica anymore
+func forgetPvc(key string) {
+	setNameConflicts(key, 0)
+	setClassResolutions(key, nil)
+	setProvisionerFallback(key, "")
+}
+
+// reconcileTarget reconciles the VolumeReplication of a target of a PVC:
+// - if the VolumeReplication exists
+//   - check if the target has a matching VolumeReplicationClass
+//   - and if it can't be resolved (error, ambiguity or unknown provisioner), leave the VolumeReplication untouched and retry
+//   - and if it doesn't, delete the VolumeReplication
+//   - check if the class/target of the VolumeReplication is correct
+//   - and if it isn't, delete it if the class change policy and the recreate cooldown allow it, and it will be re-created on the next sync
+//   - and if configured, take a VolumeSnapshot of the PVC before deleting it
+//   - check if the other fields of the VolumeReplication are correct
+//   - and if they aren't, live update the VolumeReplication
+//
+// - if the VolumeReplication doesn't exist
+//   - and if a corresponding VolumeReplicationClass exists, create the VolumeReplication
+//   - and if an object that isn't owned by us has its name, take it over if it was adopted, or report the conflict
+//
+// The class change policy and the flap protection keep their state on the PVC, so re-creations are serialized:
+// when deferred is set, another target of the PVC is being re-created and a re-creation of this one waits for a later sync.
+// It returns the delay after which the PVC must be reconciled again, whether the VolumeReplication waits to be re-created,
+// and why the target can't be replicated if an object that isn't owned by our controller already has its name.
+func reconcileTarget(ctx context.Context, pvc *corev1.PersistentVolumeClaim, target replicationTarget, resolution classResolution, volumeReplication *unstructured.Unstructured, deferred bool) (time.Duration, bool, string) {
+	key := pvc.Namespace + "/" + target.name
+	replicationClass := resolution.class
+
+	// If an object with the name of the target exists, and it isn't owned by our controller, leave it alone
+	// unless the target needs it, in which case it is taken over once it is adopted
+	var unowned *unstructured.Unstructured
+	if volumeReplication == nil {
+		if other, err := getVolumeReplication(key); err == nil && other != nil {
+			if replicationClass == "" {
+				klog.Infof("%s %s isn't owned by us, skipping", activeBackend.kind(), key)
+				return 0, false, ""
+			}
+			unowned = other
+		}
+	}
+
+	// If the VRC couldn't be resolved because of an error, an ambiguity or an unknown provisioner, leave the existing
+	// VolumeReplication alone and retry. Deleting it would stop the replication of the target until the situation is fixed.
+	if resolution.isUnresolved() {
+		klog.Errorf("couldn't resolve class for %s %s, leaving it untouched: %s", activeBackend.kind(), key, resolution.message)
+		return requeueWithBackoff, false, ""
+	}
+
+	// Build the VolumeReplication expected by the target, the backend compares it with the existing one
+	var desired *unstructured.Unstructured
 	if replicationClass != "" {
-		klog.Infof("found VolumeReplicationClass %s for PVC %s", replicationClass, key)
+		var err error
+		if desired, err = activeBackend.build(ctx, pvc, target, replicationClass); err != nil {
+			klog.Errorf("couldn't build %s %s, leaving it untouched: %s", activeBackend.kind(), key, err.Error())
+			return 0, false, ""
+		}
+	}
+
+	if unowned != nil {
+		if conflict := checkNameConflict(pvc, target, unowned, desired); conflict != "" {
+			klog.Warningf("can't replicate target %s of PVC %s/%s: %s", target.name, pvc.Namespace, pvc.Name, conflict)
+			return 0, false, conflict
+		}
+	}
+
+	// No volume replication object was found for this target, we need to create it, or to take over the adopted one
+	if volumeReplication == nil {
+		if replicationClass != "" {
+			if unowned != nil {
+				klog.Infof("adopting %s %s for PVC %s/%s", activeBackend.kind(), key, pvc.Namespace, pvc.Name)
+			} else {
+				klog.Infof("creating %s %s for PVC %s/%s", activeBackend.kind(), key, pvc.Namespace, pvc.Name)
+			}
+			if err := applyVolumeReplication(ctx, pvc, desired); err != nil {
+				klog.Errorf("failed to create %s %s: %s", activeBackend.kind(), key, err.Error())
+			} else if unowned != nil {
+				recordEvent(pvc, corev1.EventTypeNormal, reasonReplicationAdopted, "Adopted %s %s", activeBackend.kind(), target.name)
+			}
+		}
+		return 0, false, ""
 	}
 
 	// The VolumeReplication exists, we need to check:
-	//  - if the PVC still has a matching VolumeReplicationClass
+	//  - if the target still has a matching VolumeReplicationClass
 	//    - and if it doesn't, we need to delete the VolumeReplication
 	//  - if the class/target of the VolumeReplication is correct
-	//    - and if it isn't, we need to delete the VolumeReplication (we can't live update those fields)
+	//    - and if it isn't, we need to delete the VolumeReplication (we can't live update those fields),
+	//      as it is destructive, the class change policy decides when it can happen
 	//  - if the replicationState of the VolumeReplication is correct
 	//    - and if it isn't, we live update the VR
-	if volumeReplication != nil {
-		vrcExists := replicationClass != ""
-		vrCorrect := isVolumeReplicationCorrect(pvc, volumeReplication)
-
-		if !vrcExists || !vrCorrect {
-			klog.Infof("deleting VolumeReplication %s as it doesn't conform anymore, vrcExists(%t), vrCorrect(%t)", key, vrcExists, vrCorrect)
-
-			// If we're meant to re-create the VolumeReplication (!vrCorrect), we delete it here, and it will trigger an
-			// event that will bring us back in this function to re-create it with the correct definition
-			cleanupVolumeReplication(name, namespace)
-			return
-		}
-
-		// Check if the replicationState needs an update
-		expectedState := getReplicationState(pvc)
-		currentState, _, _ := unstructured.NestedString(volumeReplication.Object, "spec", "replicationState")
-		if currentState != expectedState {
-			klog.Infof("updating VolumeReplication %s with new replication state %s (was %s)", key, expectedState, currentState)
-			if err = updateVolumeReplication(pvc, volumeReplication); err != nil {
-				klog.Errorf("failed to update VolumeReplication %s: %s", key, err.Error())
-			}
+	vrcExists := replicationClass != ""
+	change := upToDate
+	if vrcExists {
+		change = activeBackend.compare(volumeReplication, desired)
+	}
+	vrCorrect := change != needsRecreate
+
+	// The VRC still exists but the VolumeReplication must be re-created, check that the change can be applied now
+	if vrcExists && !vrCorrect {
+		if deferred {
+			klog.Infof("deferring the re-creation of %s %s after the other targets of its PVC", activeBackend.kind(), key)
+			return 0, true, ""
+		}
+
+		// Protect the replica from PVCs whose class keeps changing
+		if allowed, requeueAfter := checkRecreateRate(ctx, pvc); !allowed {
+			return requeueAfter, true, ""
 		}
+
+		if allowed, requeueAfter := isClassChangeAllowed(ctx, pvc, activeBackend.class(volumeReplication), replicationClass); !allowed {
+			return requeueAfter, true, ""
+		}
+
+		// Keep a restore point of the PVC, as the replica may be discarded and resynced
+		if ready, requeueAfter := snapshotBeforeRecreate(ctx, pvc, volumeReplication); !ready {
+			return requeueAfter, true, ""
+		}
+
+		recordRecreate(ctx, pvc)
+		recordEvent(pvc, corev1.EventTypeNormal, reasonClassChangeApplied, "Re-creating VolumeReplication to apply change %s -> %s", activeBackend.class(volumeReplication), replicationClass)
+	}
+
+	if !vrcExists || !vrCorrect {
+		klog.Infof("deleting %s %s as it doesn't conform anymore, vrcExists(%t), vrCorrect(%t)", activeBackend.kind(), key, vrcExists, vrCorrect)
+
+		// If we're meant to re-create the VolumeReplication (!vrCorrect), we delete it here, and it will trigger an
+		// event that will bring us back in this function to re-create it with the correct definition
+		cleanupVolumeReplication(ctx, target.name, pvc.Namespace)
+		return 0, !vrCorrect, ""
 	}
 
-	// No volume replication object was found for this PVC, we need to create it
-	if volumeReplication == nil && replicationClass != "" {
-		klog.Infof("creating VolumeReplication for PVC %s", key)
-		if err = createVolumeReplication(pvc); err != nil {
-			klog.Errorf("failed to create VolumeReplication for PVC %s: %s", key, err.Error())
+	// Fields that can be live updated, such as the replicationState, changed
+	if change == needsUpdate {
+		klog.Infof("updating %s %s in place", activeBackend.kind(), key)
+		if err := applyVolumeReplication(ctx, pvc, desired); err != nil {
+			klog.Errorf("failed to update %s %s: %s", activeBackend.kind(), key, err.Error())
 		}
 	}
+	return 0, false, ""
 }
@@ -1,9 +1,11 @@
 package replicator
 
 import (
+	"context"
 	"fmt"
 	"slices"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 	"github.com/super-phenix/volume-replicator/internal/constants"
@@ -12,11 +14,13 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/dynamic/dynamicinformer"
 	dynamicfake "k8s.io/client-go/dynamic/fake"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes/fake"
 	k8s_testing "k8s.io/client-go/testing"
+	"k8s.io/client-go/util/workqueue"
 )
 
 func TestReconcileVolumeReplication(t *testing.T) {
@@ -31,6 +35,7 @@ func TestReconcileVolumeReplication(t *testing.T) {
 
 	dynamicInformerFactory := dynamicinformer.NewDynamicSharedInformerFactory(dynamicClient, 0)
 	VolumeReplicationInformer = dynamicInformerFactory.ForResource(VolumeReplicationResource)
+	require.NoError(t, VolumeReplicationInformer.Informer().AddIndexers(volumeReplicationIndexers))
 
 	nsName := "test-namespace"
 	pvcName := "test-pvc"
@@ -126,7 +131,7 @@ func TestReconcileVolumeReplication(t *testing.T) {
 				actions := dynamicClient.Actions()
 				for _, action := range actions {
 					require.NotEqual(t, "delete", action.GetVerb())
-					require.NotEqual(t, "create", action.GetVerb())
+					require.False(t, isVolumeReplicationApply(action))
 				}
 			},
 		},
@@ -166,6 +171,47 @@ func TestReconcileVolumeReplication(t *testing.T) {
 				require.True(t, deleted, "VR should have been deleted")
 			},
 		},
+		{
+			name: "VR exists, VR incorrect, change not approved -> keep VR",
+			setup: func() {
+				ClassChangePolicy = ClassChangeApproval
+				k8s.ClientSet = fake.NewClientset(pvc)
+				err := PvcInformer.Informer().GetIndexer().Add(pvc)
+				require.NoError(t, err)
+				vrIncorrect := vr.DeepCopy()
+				_ = unstructured.SetNestedField(vrIncorrect.Object, "wrong-vrc", "spec", "volumeReplicationClass")
+				err = VolumeReplicationInformer.Informer().GetIndexer().Add(vrIncorrect)
+				require.NoError(t, err)
+			},
+			verify: func(t *testing.T) {
+				actions := dynamicClient.Actions()
+				for _, action := range actions {
+					require.NotEqual(t, "delete", action.GetVerb())
+				}
+			},
+		},
+		{
+			name: "VR exists, VR incorrect, change approved -> delete VR",
+			setup: func() {
+				ClassChangePolicy = ClassChangeApproval
+				approvedPvc := pvc.DeepCopy()
+				approvedPvc.Annotations[constants.ApproveClassChangeAnnotation] = vrcName
+				k8s.ClientSet = fake.NewClientset(approvedPvc)
+				err := PvcInformer.Informer().GetIndexer().Add(approvedPvc)
+				require.NoError(t, err)
+				vrIncorrect := vr.DeepCopy()
+				_ = unstructured.SetNestedField(vrIncorrect.Object, "wrong-vrc", "spec", "volumeReplicationClass")
+				err = VolumeReplicationInformer.Informer().GetIndexer().Add(vrIncorrect)
+				require.NoError(t, err)
+			},
+			verify: func(t *testing.T) {
+				actions := dynamicClient.Actions()
+				deleted := slices.ContainsFunc(actions, func(action k8s_testing.Action) bool {
+					return action.GetVerb() == "delete" && action.GetResource().Resource == "volumereplications"
+				})
+				require.True(t, deleted, "VR should have been deleted")
+			},
+		},
 		{
 			name: "VR missing, VRC present -> create VR",
 			setup: func() {
@@ -175,7 +221,7 @@ func TestReconcileVolumeReplication(t *testing.T) {
 			verify: func(t *testing.T) {
 				actions := dynamicClient.Actions()
 				created := slices.ContainsFunc(actions, func(action k8s_testing.Action) bool {
-					return action.GetVerb() == "create" && action.GetResource().Resource == "volumereplications"
+					return isVolumeReplicationApply(action)
 				})
 				require.True(t, created, "VR should have been created")
 			},
@@ -191,7 +237,7 @@ func TestReconcileVolumeReplication(t *testing.T) {
 			verify: func(t *testing.T) {
 				actions := dynamicClient.Actions()
 				for _, action := range actions {
-					require.NotEqual(t, "create", action.GetVerb())
+					require.False(t, isVolumeReplicationApply(action))
 				}
 			},
 		},
@@ -207,7 +253,7 @@ func TestReconcileVolumeReplication(t *testing.T) {
 				actions := dynamicClient.Actions()
 				for _, action := range actions {
 					require.NotEqual(t, "delete", action.GetVerb())
-					require.NotEqual(t, "create", action.GetVerb())
+					require.False(t, isVolumeReplicationApply(action))
 				}
 			},
 		},
@@ -222,7 +268,7 @@ func TestReconcileVolumeReplication(t *testing.T) {
 			verify: func(t *testing.T) {
 				actions := dynamicClient.Actions()
 				for _, action := range actions {
-					require.NotEqual(t, "create", action.GetVerb())
+					require.False(t, isVolumeReplicationApply(action))
 					require.NotEqual(t, "delete", action.GetVerb())
 				}
 			},
@@ -310,7 +356,7 @@ func TestReconcileVolumeReplication(t *testing.T) {
 			verify: func(t *testing.T) {
 				actions := dynamicClient.Actions()
 				for _, action := range actions {
-					require.NotEqual(t, "create", action.GetVerb())
+					require.False(t, isVolumeReplicationApply(action))
 				}
 			},
 		},
@@ -332,7 +378,7 @@ func TestReconcileVolumeReplication(t *testing.T) {
 			verify: func(t *testing.T) {
 				actions := dynamicClient.Actions()
 				created := slices.ContainsFunc(actions, func(action k8s_testing.Action) bool {
-					return action.GetVerb() == "create" && action.GetResource().Resource == "volumereplications"
+					return isVolumeReplicationApply(action)
 				})
 				require.True(t, created, "VR should have been created")
 			},
@@ -350,11 +396,11 @@ func TestReconcileVolumeReplication(t *testing.T) {
 			verify: func(t *testing.T) {
 				actions := dynamicClient.Actions()
 				updated := slices.ContainsFunc(actions, func(action k8s_testing.Action) bool {
-					if action.GetVerb() != "update" {
+					if !isVolumeReplicationApply(action) {
 						return false
 					}
-					updateAction := action.(k8s_testing.UpdateAction)
-					obj := updateAction.GetObject().(*unstructured.Unstructured)
+					obj := &unstructured.Unstructured{}
+					require.NoError(t, obj.UnmarshalJSON(action.(k8s_testing.PatchAction).GetPatch()))
 					state, _, _ := unstructured.NestedString(obj.Object, "spec", "replicationState")
 					return state == "secondary"
 				})
@@ -366,8 +412,174 @@ func TestReconcileVolumeReplication(t *testing.T) {
 				require.False(t, deleted, "VR should not have been deleted")
 			},
 		},
+		{
+			name: "Waiting for bound, PVC pending -> do not create VR",
+			setup: func() {
+				WaitForBound = true
+				pendingPvc := pvc.DeepCopy()
+				pendingPvc.Status.Phase = corev1.ClaimPending
+				err := PvcInformer.Informer().GetIndexer().Add(pendingPvc)
+				require.NoError(t, err)
+			},
+			verify: func(t *testing.T) {
+				actions := dynamicClient.Actions()
+				for _, action := range actions {
+					require.False(t, isVolumeReplicationApply(action))
+				}
+			},
+		},
+		{
+			name: "Waiting for bound, PVC bound -> create VR",
+			setup: func() {
+				WaitForBound = true
+				boundPvc := pvc.DeepCopy()
+				boundPvc.Status.Phase = corev1.ClaimBound
+				err := PvcInformer.Informer().GetIndexer().Add(boundPvc)
+				require.NoError(t, err)
+			},
+			verify: func(t *testing.T) {
+				actions := dynamicClient.Actions()
+				created := slices.ContainsFunc(actions, func(action k8s_testing.Action) bool {
+					return isVolumeReplicationApply(action)
+				})
+				require.True(t, created, "VR should have been created")
+			},
+		},
+		{
+			name: "Waiting for stable, PVC resizing -> do not create VR",
+			setup: func() {
+				WaitForStable = true
+				resizingPvc := pvc.DeepCopy()
+				resizingPvc.Status.Phase = corev1.ClaimBound
+				resizingPvc.Status.Conditions = []corev1.PersistentVolumeClaimCondition{
+					{Type: corev1.PersistentVolumeClaimResizing, Status: corev1.ConditionTrue},
+				}
+				err := PvcInformer.Informer().GetIndexer().Add(resizingPvc)
+				require.NoError(t, err)
+			},
+			verify: func(t *testing.T) {
+				actions := dynamicClient.Actions()
+				for _, action := range actions {
+					require.False(t, isVolumeReplicationApply(action))
+				}
+			},
+		},
+		{
+			name: "Waiting for stable, PVC resizing with existing VR -> keep VR",
+			setup: func() {
+				WaitForStable = true
+				resizingPvc := pvc.DeepCopy()
+				resizingPvc.Status.Phase = corev1.ClaimBound
+				resizingPvc.Status.Conditions = []corev1.PersistentVolumeClaimCondition{
+					{Type: corev1.PersistentVolumeClaimResizing, Status: corev1.ConditionTrue},
+				}
+				err := PvcInformer.Informer().GetIndexer().Add(resizingPvc)
+				require.NoError(t, err)
+				err = VolumeReplicationInformer.Informer().GetIndexer().Add(vr)
+				require.NoError(t, err)
+			},
+			verify: func(t *testing.T) {
+				actions := dynamicClient.Actions()
+				for _, action := range actions {
+					require.NotEqual(t, "delete", action.GetVerb())
+					require.False(t, isVolumeReplicationApply(action))
+				}
+			},
+		},
+		{
+			name: "VR exists, VRC resolution error -> keep VR",
+			setup: func() {
+				k8s.ClientSet = fake.NewClientset()
+				missingStc := "missing-storage-class"
+				pvcSelector := pvc.DeepCopy()
+				pvcSelector.Annotations = map[string]string{constants.VrcSelectorAnnotation: "daily"}
+				pvcSelector.Spec.StorageClassName = &missingStc
+				err := PvcInformer.Informer().GetIndexer().Add(pvcSelector)
+				require.NoError(t, err)
+				err = VolumeReplicationInformer.Informer().GetIndexer().Add(vr)
+				require.NoError(t, err)
+			},
+			verify: func(t *testing.T) {
+				actions := dynamicClient.Actions()
+				for _, action := range actions {
+					require.NotEqual(t, "delete", action.GetVerb())
+					require.False(t, isVolumeReplicationApply(action))
+				}
+			},
+		},
+		{
+			name: "PVC assigned to another instance -> delete VR",
+			setup: func() {
+				pvcOtherInstance := pvc.DeepCopy()
+				pvcOtherInstance.Labels = map[string]string{constants.InstanceLabel: "other"}
+				err := PvcInformer.Informer().GetIndexer().Add(pvcOtherInstance)
+				require.NoError(t, err)
+				err = VolumeReplicationInformer.Informer().GetIndexer().Add(vr)
+				require.NoError(t, err)
+			},
+			verify: func(t *testing.T) {
+				actions := dynamicClient.Actions()
+				deleted := slices.ContainsFunc(actions, func(action k8s_testing.Action) bool {
+					return action.GetVerb() == "delete" && action.GetResource().Resource == "volumereplications"
+				})
+				require.True(t, deleted, "VR should have been deleted")
+			},
+		},
+		{
+			name: "Namespace assigned to another instance -> do not create VR",
+			setup: func() {
+				err := NamespaceInformer.Informer().GetIndexer().Add(&corev1.Namespace{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:        nsName,
+						Annotations: map[string]string{constants.InstanceLabel: "other"},
+					},
+				})
+				require.NoError(t, err)
+				err = PvcInformer.Informer().GetIndexer().Add(pvc)
+				require.NoError(t, err)
+			},
+			verify: func(t *testing.T) {
+				require.False(t, slices.ContainsFunc(dynamicClient.Actions(), isVolumeReplicationApply), "VR should not have been created")
+			},
+		},
+		{
+			name: "VR of another instance -> do nothing",
+			setup: func() {
+				InstanceName = "mine"
+				pvcMine := pvc.DeepCopy()
+				pvcMine.Annotations[constants.InstanceLabel] = "mine"
+				err := PvcInformer.Informer().GetIndexer().Add(pvcMine)
+				require.NoError(t, err)
+				err = VolumeReplicationInformer.Informer().GetIndexer().Add(vr)
+				require.NoError(t, err)
+			},
+			verify: func(t *testing.T) {
+				actions := dynamicClient.Actions()
+				for _, action := range actions {
+					require.NotEqual(t, "delete", action.GetVerb())
+					require.False(t, isVolumeReplicationApply(action))
+				}
+			},
+		},
+		{
+			name: "Unknown namespace -> keep VR",
+			setup: func() {
+				InstanceName = "mine"
+				err := NamespaceInformer.Informer().GetIndexer().Delete(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: nsName}})
+				require.NoError(t, err)
+				err = PvcInformer.Informer().GetIndexer().Add(pvc)
+				require.NoError(t, err)
+				err = VolumeReplicationInformer.Informer().GetIndexer().Add(vr)
+				require.NoError(t, err)
+			},
+			verify: func(t *testing.T) {
+				require.Empty(t, dynamicClient.Actions(), "VR should have been left untouched")
+			},
+		},
 	}
 
+	defer func() { InstanceName = "" }()
+
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			// Clear indexers
@@ -380,13 +592,18 @@ func TestReconcileVolumeReplication(t *testing.T) {
 			for _, obj := range NamespaceInformer.Informer().GetIndexer().List() {
 				_ = NamespaceInformer.Informer().GetIndexer().Delete(obj)
 			}
+			require.NoError(t, NamespaceInformer.Informer().GetIndexer().Add(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: nsName}}))
 			dynamicClient.ClearActions()
+			WaitForBound = false
+			WaitForStable = false
+			ClassChangePolicy = ClassChangeImmediate
+			InstanceName = ""
 
 			if tt.setup != nil {
 				tt.setup()
 			}
 
-			reconcileVolumeReplication(key)
+			reconcileVolumeReplication(t.Context(), key)
 
 			if tt.verify != nil {
 				tt.verify(t)
@@ -394,3 +611,134 @@ func TestReconcileVolumeReplication(t *testing.T) {
 		})
 	}
 }
+
+// isVolumeReplicationApply returns whether an action server-side applies a VolumeReplication
+func isVolumeReplicationApply(action k8s_testing.Action) bool {
+	patchAction, ok := action.(k8s_testing.PatchAction)
+	return ok && patchAction.GetPatchType() == types.ApplyPatchType && action.GetResource().Resource == "volumereplications"
+}
+
+func TestReconcileVolumeReplicationStopping(t *testing.T) {
+	dynamicClient := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme())
+	k8s.DynamicClientSet = dynamicClient
+
+	informerFactory := informers.NewSharedInformerFactory(fake.NewClientset(), 0)
+	PvcInformer = informerFactory.Core().V1().PersistentVolumeClaims()
+	NamespaceInformer = informerFactory.Core().V1().Namespaces()
+	VolumeReplicationInformer = dynamicinformer.NewDynamicSharedInformerFactory(dynamicClient, 0).ForResource(VolumeReplicationResource)
+	require.NoError(t, VolumeReplicationInformer.Informer().AddIndexers(volumeReplicationIndexers))
+
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "test-pvc",
+			Namespace:   "test-namespace",
+			Annotations: map[string]string{constants.VrcValueAnnotation: "test-vrc"},
+		},
+	}
+	require.NoError(t, PvcInformer.Informer().GetIndexer().Add(pvc))
+
+	// The context is cancelled when the controller stops, e.g. on leadership loss
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+
+	require.Zero(t, reconcileVolumeReplication(ctx, "test-namespace/test-pvc"))
+	require.Empty(t, dynamicClient.Actions())
+}
+
+func TestProcessNextItemStopped(t *testing.T) {
+	dynamicClient := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme())
+	k8s.DynamicClientSet = dynamicClient
+
+	informerFactory := informers.NewSharedInformerFactory(fake.NewClientset(), 0)
+	PvcInformer = informerFactory.Core().V1().PersistentVolumeClaims()
+	NamespaceInformer = informerFactory.Core().V1().Namespaces()
+	VolumeReplicationInformer = dynamicinformer.NewDynamicSharedInformerFactory(dynamicClient, 0).ForResource(VolumeReplicationResource)
+	require.NoError(t, VolumeReplicationInformer.Informer().AddIndexers(volumeReplicationIndexers))
+
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "test-pvc",
+			Namespace:   "test-namespace",
+			Annotations: map[string]string{constants.VrcValueAnnotation: "test-vrc"},
+		},
+	}
+	require.NoError(t, PvcInformer.Informer().GetIndexer().Add(pvc))
+
+	queue := workqueue.NewTypedRateLimitingQueue(workqueue.DefaultTypedControllerRateLimiter[string]())
+	defer queue.ShutDown()
+	queue.Add("test-namespace/test-pvc")
+
+	// Keys still queued when the controller stops are left to the next leader
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+
+	controller := NewController()
+	require.False(t, controller.processNextItem(ctx, t.Context(), queue))
+	require.Zero(t, queue.Len())
+	require.Empty(t, dynamicClient.Actions())
+}
+
+func TestControllerRun(t *testing.T) {
+	informerFactory := informers.NewSharedInformerFactory(fake.NewClientset(), 0)
+	PvcInformer = informerFactory.Core().V1().PersistentVolumeClaims()
+
+	controller := NewController()
+
+	// Keys are dropped while the controller isn't running
+	controller.enqueue("test-namespace/test-pvc")
+
+	ctx, cancel := context.WithCancel(t.Context())
+	stopped := make(chan struct{})
+	go func() {
+		controller.Run(ctx, t.Context(), 2)
+		close(stopped)
+	}()
+
+	require.Eventually(t, func() bool {
+		controller.mu.RLock()
+		defer controller.mu.RUnlock()
+		return controller.pvcQueue != nil
+	}, time.Second, 10*time.Millisecond)
+
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(ShutdownTimeout):
+		t.Fatal("controller didn't stop")
+	}
+
+	// No key is accepted once the controller stopped
+	controller.mu.RLock()
+	defer controller.mu.RUnlock()
+	require.Nil(t, controller.pvcQueue)
+}
+
+func TestControllerRunLeaseLost(t *testing.T) {
+	informerFactory := informers.NewSharedInformerFactory(fake.NewClientset(), 0)
+	PvcInformer = informerFactory.Core().V1().PersistentVolumeClaims()
+
+	// The shutdown timeout doesn't apply to a leadership loss
+	ShutdownTimeout = time.Hour
+	defer func() { ShutdownTimeout = 10 * time.Second }()
+
+	controller := NewController()
+	leaseCtx, loseLease := context.WithCancel(t.Context())
+	stopped := make(chan struct{})
+	go func() {
+		controller.Run(t.Context(), leaseCtx, 2)
+		close(stopped)
+	}()
+
+	require.Eventually(t, func() bool {
+		controller.mu.RLock()
+		defer controller.mu.RUnlock()
+		return controller.pvcQueue != nil
+	}, time.Second, 10*time.Millisecond)
+
+	loseLease()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("controller didn't stop on leadership loss")
+	}
+}
@@ -0,0 +1,206 @@
+package replicator
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+
+	"github.com/super-phenix/volume-replicator/internal/k8s"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	resourceNamespaces        = "namespaces"
+	resourcePersistentVolumes = "persistentvolumes"
+	resourceStorageClasses    = "storageclasses"
+)
+
+var (
+	// WatchNamespaces restricts the controller to a list of namespaces, every namespace is watched if empty
+	WatchNamespaces []string
+	// WatchNamespaceSelector restricts the controller to the namespaces matching a label selector, nil to watch every namespace
+	WatchNamespaceSelector labels.Selector
+	// Fallback describes the Namespaces and StorageClasses that the controller isn't allowed to read
+	Fallback *FallbackConfig
+
+	// unreadableResources holds the cluster-scoped resources that the controller isn't allowed to read,
+	// so that they are only requested once
+	unreadableResources sync.Map
+)
+
+// FallbackConfig is the content of the file passed through --fallback-config
+type FallbackConfig struct {
+	Namespaces     []FallbackNamespace    `json:"namespaces,omitempty"`
+	StorageClasses []FallbackStorageClass `json:"storageClasses,omitempty"`
+}
+
+// FallbackNamespace holds the metadata of a Namespace that the controller isn't allowed to read
+type FallbackNamespace struct {
+	Name        string            `json:"name"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// FallbackStorageClass holds the attributes of a StorageClass that the controller isn't allowed to read
+type FallbackStorageClass struct {
+	Name        string            `json:"name"`
+	Provisioner string            `json:"provisioner,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Parameters  map[string]string `json:"parameters,omitempty"`
+}
+
+// LoadFallbackConfig reads and validates the fallback Namespaces and StorageClasses from a YAML or JSON file
+func LoadFallbackConfig(path string) (*FallbackConfig, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read fallback config: %w", err)
+	}
+
+	var config FallbackConfig
+	if err = yaml.UnmarshalStrict(content, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse fallback config: %w", err)
+	}
+
+	for i, ns := range config.Namespaces {
+		if ns.Name == "" {
+			return nil, fmt.Errorf("namespace %d has no name", i)
+		}
+	}
+
+	for i, storageClass := range config.StorageClasses {
+		if storageClass.Name == "" {
+			return nil, fmt.Errorf("storageClass %d has no name", i)
+		}
+	}
+
+	return &config, nil
+}
+
+// getNamespace returns the fallback Namespace with this name, nil if it isn't described
+func (f *FallbackConfig) getNamespace(name string) *corev1.Namespace {
+	if f == nil {
+		return nil
+	}
+
+	for _, ns := range f.Namespaces {
+		if ns.Name == name {
+			return &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: ns.Name, Labels: ns.Labels, Annotations: ns.Annotations}}
+		}
+	}
+	return nil
+}
+
+// getStorageClass returns the fallback StorageClass with this name, nil if it isn't described
+func (f *FallbackConfig) getStorageClass(name string) *storagev1.StorageClass {
+	if f == nil {
+		return nil
+	}
+
+	for _, storageClass := range f.StorageClasses {
+		if storageClass.Name == name {
+			return &storagev1.StorageClass{
+				ObjectMeta:  metav1.ObjectMeta{Name: storageClass.Name, Labels: storageClass.Labels},
+				Provisioner: storageClass.Provisioner,
+				Parameters:  storageClass.Parameters,
+			}
+		}
+	}
+	return nil
+}
+
+// isNamespaceScoped returns whether the controller only watches some namespaces
+func isNamespaceScoped() bool {
+	return len(WatchNamespaces) > 0 || WatchNamespaceSelector != nil
+}
+
+// usesNamespaceCaches returns whether PVCs and VolumeReplications are watched per namespace instead of cluster-wide
+func usesNamespaceCaches() bool {
+	return Shards > 0 || isNamespaceScoped()
+}
+
+// watchesNamespace returns whether a namespace is in the scope of the controller.
+// The namespace informer only holds the namespaces matching the selector, if any.
+func watchesNamespace(namespace string) bool {
+	switch {
+	case len(WatchNamespaces) > 0:
+		return slices.Contains(WatchNamespaces, namespace)
+	case WatchNamespaceSelector != nil:
+		_, err := NamespaceInformer.Lister().Get(namespace)
+		return err == nil
+	default:
+		return true
+	}
+}
+
+// listWatchedNamespaces returns the names of the namespaces in the scope of the controller
+func listWatchedNamespaces() ([]string, error) {
+	if len(WatchNamespaces) > 0 {
+		return WatchNamespaces, nil
+	}
+
+	namespaces, err := NamespaceInformer.Lister().List(labels.Everything())
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(namespaces))
+	for _, ns := range namespaces {
+		names = append(names, ns.Name)
+	}
+	return names, nil
+}
+
+// getNamespace returns a Namespace from the cache, or from the fallback config when namespaces can't be read.
+// Namespaces that can't be read and aren't described in the fallback config have neither labels nor annotations.
+func getNamespace(name string) (*corev1.Namespace, error) {
+	if NamespaceInformer != nil {
+		return NamespaceInformer.Lister().Get(name)
+	}
+
+	if ns := Fallback.getNamespace(name); ns != nil {
+		return ns, nil
+	}
+	return &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name}}, nil
+}
+
+// canListNamespaces returns whether the controller is allowed to list namespaces
+func canListNamespaces(ctx context.Context) bool {
+	return canList(ctx, resourceNamespaces, func(ctx context.Context, opts metav1.ListOptions) error {
+		_, err := k8s.ClientSet.CoreV1().Namespaces().List(ctx, opts)
+		return err
+	})
+}
+
+// canList returns whether the controller is allowed to list a cluster-scoped resource, and remembers it if it isn't.
+// Other errors are left to the informer, which retries until the API server is reachable.
+func canList(ctx context.Context, resource string, list func(context.Context, metav1.ListOptions) error) bool {
+	callCtx, cancel := withAPITimeout(ctx)
+	defer cancel()
+	return !isForbidden(resource, list(callCtx, metav1.ListOptions{Limit: 1}))
+}
+
+// isReadable returns whether the controller is allowed to read a cluster-scoped resource, as far as it knows
+func isReadable(resource string) bool {
+	_, unreadable := unreadableResources.Load(resource)
+	return !unreadable
+}
+
+// isForbidden returns whether reading a cluster-scoped resource was forbidden, and remembers it
+func isForbidden(resource string, err error) bool {
+	if !errors.IsForbidden(err) {
+		return false
+	}
+
+	if _, loaded := unreadableResources.LoadOrStore(resource, true); !loaded {
+		klog.Warningf("not allowed to read %s, continuing without them: %s", resource, err.Error())
+	}
+	return true
+}
@@ -0,0 +1,164 @@
+package replicator
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/super-phenix/volume-replicator/internal/k8s"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestLoadFallbackConfig(t *testing.T) {
+	tests := []struct {
+		name          string
+		content       string
+		expectedError bool
+	}{
+		{
+			name: "Valid config",
+			content: `
+namespaces:
+  - name: team-a
+    labels:
+      tier: gold
+    annotations:
+      replication.superphenix.net/class: gold
+storageClasses:
+  - name: fast
+    provisioner: rbd.csi.ceph.com
+    labels:
+      replication.superphenix.net/storageClassGroup: ceph
+`,
+		},
+		{
+			name:          "Namespace without name",
+			content:       "namespaces:\n  - labels:\n      tier: gold\n",
+			expectedError: true,
+		},
+		{
+			name:          "StorageClass without name",
+			content:       "storageClasses:\n  - provisioner: rbd.csi.ceph.com\n",
+			expectedError: true,
+		},
+		{
+			name:          "Unknown field",
+			content:       "secrets: []\n",
+			expectedError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "fallback.yaml")
+			require.NoError(t, os.WriteFile(path, []byte(tt.content), 0o600))
+
+			config, err := LoadFallbackConfig(path)
+			if tt.expectedError {
+				require.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, "gold", config.getNamespace("team-a").Labels["tier"])
+			require.Equal(t, "rbd.csi.ceph.com", config.getStorageClass("fast").Provisioner)
+			require.Nil(t, config.getNamespace("team-b"))
+			require.Nil(t, config.getStorageClass("slow"))
+		})
+	}
+}
+
+func TestGetNamespaceFallback(t *testing.T) {
+	previousInformer := NamespaceInformer
+	NamespaceInformer = nil
+	Fallback = &FallbackConfig{Namespaces: []FallbackNamespace{{Name: "team-a", Labels: map[string]string{"tier": "gold"}}}}
+	defer func() {
+		NamespaceInformer = previousInformer
+		Fallback = nil
+	}()
+
+	ns, err := getNamespace("team-a")
+	require.NoError(t, err)
+	require.Equal(t, "gold", ns.Labels["tier"])
+
+	// Namespaces that aren't described have neither labels nor annotations
+	ns, err = getNamespace("team-b")
+	require.NoError(t, err)
+	require.Equal(t, "team-b", ns.Name)
+	require.Empty(t, ns.Labels)
+	require.Empty(t, ns.Annotations)
+}
+
+func TestGetStorageClassForbidden(t *testing.T) {
+	defer unreadableResources.Clear()
+
+	client := fake.NewClientset()
+	gets := 0
+	client.PrependReactor("get", "storageclasses", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		gets++
+		return true, nil, errors.NewForbidden(schema.GroupResource{Group: "storage.k8s.io", Resource: resourceStorageClasses}, "fast", nil)
+	})
+	k8s.ClientSet = client
+
+	stcName := "fast"
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-pvc", Namespace: "test-namespace"},
+		Spec:       corev1.PersistentVolumeClaimSpec{StorageClassName: &stcName},
+	}
+
+	// StorageClasses that aren't described can't be resolved
+	_, err := getStorageClass(t.Context(), pvc)
+	require.Error(t, err)
+	require.False(t, isReadable(resourceStorageClasses))
+
+	Fallback = &FallbackConfig{StorageClasses: []FallbackStorageClass{{Name: stcName, Provisioner: "rbd.csi.ceph.com"}}}
+	defer func() { Fallback = nil }()
+
+	storageClass, err := getStorageClass(t.Context(), pvc)
+	require.NoError(t, err)
+	require.Equal(t, "rbd.csi.ceph.com", storageClass.Provisioner)
+
+	// StorageClasses are only requested until they are known to be forbidden
+	require.Equal(t, 1, gets)
+}
+
+func TestWatchesNamespace(t *testing.T) {
+	informerFactory := informers.NewSharedInformerFactory(fake.NewClientset(), 0)
+	NamespaceInformer = informerFactory.Core().V1().Namespaces()
+	require.NoError(t, NamespaceInformer.Informer().GetIndexer().Add(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "selected"}}))
+	defer func() {
+		WatchNamespaces = nil
+		WatchNamespaceSelector = nil
+	}()
+
+	require.True(t, watchesNamespace("any"))
+	require.False(t, usesNamespaceCaches())
+
+	WatchNamespaces = []string{"team-a", "team-b"}
+	require.True(t, watchesNamespace("team-a"))
+	require.False(t, watchesNamespace("selected"))
+	require.True(t, usesNamespaceCaches())
+
+	namespaces, err := listWatchedNamespaces()
+	require.NoError(t, err)
+	require.Equal(t, WatchNamespaces, namespaces)
+
+	// With a selector, the namespace informer only holds the selected namespaces
+	WatchNamespaces = nil
+	WatchNamespaceSelector = labels.SelectorFromSet(labels.Set{"replicated": "true"})
+	require.True(t, watchesNamespace("selected"))
+	require.False(t, watchesNamespace("team-a"))
+
+	// Namespaces out of the scope of the controller are never reconciled
+	require.False(t, ownsNamespace("team-a"))
+	require.Nil(t, getPvcIndexer("team-a"))
+}
@@ -0,0 +1,441 @@
+package replicator
+
+import (
+	"context"
+	"hash/fnv"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/super-phenix/volume-replicator/internal/k8s"
+	"github.com/super-phenix/volume-replicator/internal/metrics"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/informers"
+	v1 "k8s.io/client-go/informers/core/v1"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/klog/v2"
+)
+
+// Shards is the number of shards among which namespaces are split, 0 disables sharding
+var Shards int
+
+// namespaceCache holds the informers of a namespace owned by this replica when sharding or watching some namespaces
+type namespaceCache struct {
+	pvcInformer v1.PersistentVolumeClaimInformer
+	vrInformer  informers.GenericInformer
+	// vgrInformer is only set when volume groups are enabled
+	vgrInformer informers.GenericInformer
+	cancel      context.CancelFunc
+	synced      bool
+}
+
+// shardWork tracks the in-flight reconciliations of a shard owned by this replica,
+// so that the lease of the shard is only released once they are done
+type shardWork struct {
+	ctx      context.Context
+	cancel   context.CancelFunc
+	inFlight sync.WaitGroup
+}
+
+// newShardWork returns the tracker of the reconciliations of a newly acquired shard
+func newShardWork() *shardWork {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &shardWork{ctx: ctx, cancel: cancel}
+}
+
+var (
+	// shardMu protects the shards owned by this replica and the caches of their namespaces
+	shardMu         sync.RWMutex
+	ownedShards     = make(map[int]*shardWork)
+	namespaceCaches = make(map[string]*namespaceCache)
+)
+
+// shardOf returns the shard of a namespace.
+// A jump consistent hash is used, so that few namespaces move when the number of shards changes.
+func shardOf(namespace string) int {
+	hash := fnv.New64a()
+	_, _ = hash.Write([]byte(namespace))
+	key := hash.Sum64()
+
+	var bucket, next int64 = -1, 0
+	for next < int64(Shards) {
+		bucket = next
+		key = key*2862933555777941757 + 1
+		next = int64(float64(bucket+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	return int(bucket)
+}
+
+// ownsNamespace returns whether the PVCs of a namespace are reconciled by this replica
+func ownsNamespace(namespace string) bool {
+	if !watchesNamespace(namespace) {
+		return false
+	}
+	if Shards == 0 {
+		return true
+	}
+
+	shardMu.RLock()
+	defer shardMu.RUnlock()
+	return ownedShards[shardOf(namespace)] != nil
+}
+
+// trackNamespaceWork returns whether the PVCs of a namespace are reconciled by this replica, like ownsNamespace.
+// When sharding, the reconciliation is tracked until done is called, so that the shard isn't released meanwhile,
+// and the returned context is cancelled if the lease of the shard is lost.
+func trackNamespaceWork(ctx context.Context, namespace string) (workCtx context.Context, done func(), owned bool) {
+	if !watchesNamespace(namespace) {
+		return ctx, func() {}, false
+	}
+	if Shards == 0 {
+		return ctx, func() {}, true
+	}
+
+	shardMu.RLock()
+	defer shardMu.RUnlock()
+	work := ownedShards[shardOf(namespace)]
+	if work == nil {
+		return ctx, func() {}, false
+	}
+
+	work.inFlight.Add(1)
+	workCtx, cancel := context.WithCancel(ctx)
+	stop := context.AfterFunc(work.ctx, cancel)
+	return workCtx, func() {
+		stop()
+		cancel()
+		work.inFlight.Done()
+	}, true
+}
+
+// getNamespaceCache returns the synced caches of a namespace owned by this replica, nil if it isn't owned or not synced yet
+func getNamespaceCache(namespace string) *namespaceCache {
+	shardMu.RLock()
+	defer shardMu.RUnlock()
+	if nsCache, ok := namespaceCaches[namespace]; ok && nsCache.synced {
+		return nsCache
+	}
+	return nil
+}
+
+// getNamespaceCaches returns the synced caches of a namespace, or of every namespace owned by this replica if the namespace is empty
+func getNamespaceCaches(namespace string) []*namespaceCache {
+	shardMu.RLock()
+	defer shardMu.RUnlock()
+
+	var caches []*namespaceCache
+	for ns, nsCache := range namespaceCaches {
+		if nsCache.synced && (namespace == "" || ns == namespace) {
+			caches = append(caches, nsCache)
+		}
+	}
+	return caches
+}
+
+// RunShards reconciles the PVCs of the shards owned by this replica until the context is cancelled.
+// Replicas announce themselves through member leases, and each one competes for its fair share of the shard leases.
+// Shards are rebalanced when a replica joins or leaves: replicas above their fair share release their extra shards,
+// and the shards of a replica that left are acquired once their lease expires.
+func (c *Controller) RunShards(ctx context.Context, namespace, identity string) {
+	running := make(chan struct{})
+	go func() {
+		defer close(running)
+		c.Run(ctx, context.Background(), 1)
+	}()
+
+	// Elections outlive the context, so that leases are only released once the controller is drained
+	electionCtx, cancelElections := context.WithCancel(context.Background())
+	var elections sync.WaitGroup
+
+	memberElector, err := leaderelection.NewLeaderElector(k8s.GetShardElectionConfig(k8s.GetMemberLease(namespace, identity), func(context.Context) {}))
+	if err != nil {
+		klog.Fatalf("failed to create member elector: %s", err.Error())
+	}
+	elections.Go(func() {
+		memberElector.Run(electionCtx)
+	})
+
+	candidates := make(map[int]context.CancelFunc)
+	var candidatesMu sync.Mutex
+
+	ticker := time.NewTicker(k8s.RetryPeriod)
+	defer ticker.Stop()
+
+	for ctx.Err() == nil {
+		candidatesMu.Lock()
+		c.balanceShards(ctx, namespace, identity, candidates, func(shard int) {
+			shardCtx, cancel := context.WithCancel(electionCtx)
+			candidates[shard] = cancel
+
+			elections.Go(func() {
+				defer func() {
+					candidatesMu.Lock()
+					defer candidatesMu.Unlock()
+					cancel()
+					delete(candidates, shard)
+				}()
+				c.runShardElection(shardCtx, namespace, identity, shard)
+			})
+		})
+		candidatesMu.Unlock()
+
+		select {
+		case <-ctx.Done():
+		case <-ticker.C:
+		}
+	}
+
+	// Wait for in-flight reconciliations before releasing the leases
+	<-running
+	cancelElections()
+	elections.Wait()
+}
+
+// balanceShards starts competing for free shards while this replica holds less than its fair share,
+// and releases the shards held above its fair share
+func (c *Controller) balanceShards(ctx context.Context, namespace, identity string, candidates map[int]context.CancelFunc, compete func(shard int)) {
+	callCtx, cancel := withAPITimeout(ctx)
+	defer cancel()
+	members, shardLeases, err := k8s.ListShardLeases(callCtx, namespace)
+	if err != nil {
+		klog.Errorf("failed to list shard leases: %s", err.Error())
+		return
+	}
+
+	currentTime := now()
+	liveMembers := 0
+	for _, member := range members {
+		if holder := k8s.GetLeaseHolder(member, currentTime); holder != "" && holder != identity {
+			liveMembers++
+		}
+	}
+	// This replica counts as a member even before its member lease is created
+	fairShare := (Shards + liveMembers) / (liveMembers + 1)
+
+	shardsByLease := make(map[string]int, Shards)
+	for shard := range Shards {
+		shardsByLease[k8s.GetShardLeaseName(shard)] = shard
+	}
+
+	holders := make(map[int]string)
+	for _, lease := range shardLeases {
+		if shard, ok := shardsByLease[lease.Name]; ok {
+			holders[shard] = k8s.GetLeaseHolder(lease, currentTime)
+		}
+	}
+
+	// Stop competing for shards held by other replicas
+	for shard, cancelCandidate := range candidates {
+		if holder := holders[shard]; holder != "" && holder != identity {
+			cancelCandidate()
+		}
+	}
+
+	// Release the shards held above the fair share, starting with the last ones
+	if len(candidates) > fairShare {
+		shards := slices.Sorted(maps.Keys(candidates))
+		for _, shard := range shards[fairShare:] {
+			klog.Infof("releasing shard %d, holding more than the fair share of %d shards", shard, fairShare)
+			candidates[shard]()
+		}
+		return
+	}
+
+	// Compete for free shards, starting from a position that depends on the identity to limit contention
+	start := shardOf(identity)
+	for i := range Shards {
+		if len(candidates) >= fairShare {
+			return
+		}
+
+		shard := (start + i) % Shards
+		if _, ok := candidates[shard]; ok || holders[shard] != "" {
+			continue
+		}
+		klog.Infof("competing for shard %d, fair share is %d shards", shard, fairShare)
+		compete(shard)
+	}
+}
+
+// runShardElection competes for the lease of a shard until the context is cancelled, and reconciles the namespaces of the shard while holding it.
+// When the context is cancelled, e.g. to hand the shard over to another replica, the lease is only released once the shard is drained.
+func (c *Controller) runShardElection(ctx context.Context, namespace, identity string, shard int) {
+	// The election outlives the context, it is cancelled once the shard is released
+	electorCtx, cancelElector := context.WithCancel(context.WithoutCancel(ctx))
+	defer cancelElector()
+
+	config := k8s.GetShardElectionConfig(k8s.GetShardLease(namespace, identity, shard), func(leaseCtx context.Context) {
+		defer cancelElector()
+		c.acquireShard(shard)
+
+		select {
+		case <-leaseCtx.Done():
+		case <-ctx.Done():
+		}
+
+		// Another replica may already own a lost shard, its in-flight reconciliations are aborted right away
+		releaseShard(shard, leaseCtx.Err() != nil)
+	})
+
+	elector, err := leaderelection.NewLeaderElector(config)
+	if err != nil {
+		klog.Errorf("failed to create elector for shard %d: %s", shard, err.Error())
+		return
+	}
+
+	// A candidate that doesn't hold the lease has nothing to drain
+	stop := context.AfterFunc(ctx, func() {
+		if !elector.IsLeader() {
+			cancelElector()
+		}
+	})
+	defer stop()
+	elector.Run(electorCtx)
+}
+
+// acquireShard starts the caches of the namespaces of a shard, and reconciles their PVCs
+func (c *Controller) acquireShard(shard int) {
+	shardMu.Lock()
+	ownedShards[shard] = newShardWork()
+	metrics.OwnedShards.Set(float64(len(ownedShards)))
+	shardMu.Unlock()
+
+	namespaces, err := listWatchedNamespaces()
+	if err != nil {
+		klog.Errorf("failed to list namespaces of shard %d: %s", shard, err.Error())
+		return
+	}
+
+	var started sync.WaitGroup
+	for _, ns := range namespaces {
+		if shardOf(ns) == shard {
+			started.Go(func() {
+				c.startNamespaceCache(ns)
+			})
+		}
+	}
+	started.Wait()
+	klog.Infof("acquired shard %d", shard)
+}
+
+// releaseShard stops reconciling the namespaces of a shard, and stops their caches.
+// In-flight reconciliations of the shard are given ShutdownTimeout to finish, or aborted right away if abort is set.
+func releaseShard(shard int, abort bool) {
+	shardMu.Lock()
+	work := ownedShards[shard]
+	delete(ownedShards, shard)
+	metrics.OwnedShards.Set(float64(len(ownedShards)))
+
+	var namespaces []string
+	for ns := range namespaceCaches {
+		if shardOf(ns) == shard {
+			namespaces = append(namespaces, ns)
+		}
+	}
+	shardMu.Unlock()
+
+	if work != nil {
+		drainShard(shard, work, abort)
+	}
+
+	for _, ns := range namespaces {
+		stopNamespaceCache(ns)
+	}
+	klog.Infof("released shard %d", shard)
+}
+
+// drainShard waits for the in-flight reconciliations of a shard that is no longer owned
+func drainShard(shard int, work *shardWork, abort bool) {
+	defer work.cancel()
+	if abort {
+		klog.Warningf("lost shard %d, aborting its in-flight reconciliations", shard)
+		work.cancel()
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		work.inFlight.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+	case <-time.After(ShutdownTimeout):
+		klog.Warningf("in-flight reconciliations of shard %d didn't finish within %s, aborting them", shard, ShutdownTimeout)
+		work.cancel()
+		<-drained
+	}
+}
+
+// namespaceCreated starts the caches of a new namespace if it is watched and belongs to a shard owned by this replica
+func (c *Controller) namespaceCreated(ns *corev1.Namespace) {
+	if !ownsNamespace(ns.Name) {
+		return
+	}
+
+	// Informer handlers must not block, the caches are synced in the background
+	go c.startNamespaceCache(ns.Name)
+}
+
+// startNamespaceCache starts watching the PVCs and VolumeReplications (and VolumeGroupReplications) of a namespace, then reconciles its PVCs.
+// The caches are only used once synced, so that a missing VolumeReplication is never mistaken for a deleted one.
+func (c *Controller) startNamespaceCache(namespace string) {
+	shardMu.Lock()
+	if _, ok := namespaceCaches[namespace]; ok || !watchesNamespace(namespace) || (Shards > 0 && ownedShards[shardOf(namespace)] == nil) {
+		shardMu.Unlock()
+		return
+	}
+
+	cacheCtx, cancel := context.WithCancel(context.Background())
+	informerFactory := informers.NewSharedInformerFactoryWithOptions(k8s.ClientSet, resync, informers.WithNamespace(namespace))
+	dynamicInformerFactory := dynamicinformer.NewFilteredDynamicSharedInformerFactory(k8s.DynamicClientSet, resync, namespace, nil)
+	nsCache := &namespaceCache{
+		pvcInformer: c.createPvcInformer(informerFactory),
+		vrInformer:  c.createVolumeReplicationInformer(dynamicInformerFactory),
+		cancel:      cancel,
+	}
+	if VolumeGroups {
+		nsCache.vgrInformer = c.createVolumeGroupReplicationInformer(dynamicInformerFactory)
+	}
+	namespaceCaches[namespace] = nsCache
+	shardMu.Unlock()
+
+	informerFactory.Start(cacheCtx.Done())
+	dynamicInformerFactory.Start(cacheCtx.Done())
+	informerFactory.WaitForCacheSync(cacheCtx.Done())
+	dynamicInformerFactory.WaitForCacheSync(cacheCtx.Done())
+	if cacheCtx.Err() != nil {
+		return
+	}
+
+	shardMu.Lock()
+	nsCache.synced = true
+	shardMu.Unlock()
+	klog.V(2).Infof("started caches of namespace %s", namespace)
+
+	// Events received while the caches were syncing were dropped
+	pvcs, err := nsCache.pvcInformer.Lister().List(labels.Everything())
+	if err != nil {
+		klog.Errorf("failed to list PVCs of namespace %s: %s", namespace, err.Error())
+		return
+	}
+	for _, pvc := range pvcs {
+		c.enqueue(pvc.Namespace + "/" + pvc.Name)
+	}
+}
+
+// stopNamespaceCache stops watching the PVCs and VolumeReplications of a namespace
+func stopNamespaceCache(namespace string) {
+	shardMu.Lock()
+	nsCache, ok := namespaceCaches[namespace]
+	delete(namespaceCaches, namespace)
+	shardMu.Unlock()
+
+	if ok {
+		nsCache.cancel()
+		klog.V(2).Infof("stopped caches of namespace %s", namespace)
+	}
+}
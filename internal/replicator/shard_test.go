@@ -0,0 +1,222 @@
+package replicator
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/super-phenix/volume-replicator/internal/constants"
+	"github.com/super-phenix/volume-replicator/internal/k8s"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/utils/ptr"
+)
+
+func TestShardOf(t *testing.T) {
+	Shards = 4
+	defer func() { Shards = 0 }()
+
+	counts := make([]int, Shards)
+	assignments := make(map[string]int)
+	for i := range 1000 {
+		namespace := fmt.Sprintf("namespace-%d", i)
+		shard := shardOf(namespace)
+		require.GreaterOrEqual(t, shard, 0)
+		require.Less(t, shard, Shards)
+		require.Equal(t, shard, shardOf(namespace))
+
+		counts[shard]++
+		assignments[namespace] = shard
+	}
+
+	// Namespaces are spread among every shard
+	for _, count := range counts {
+		require.Greater(t, count, 150)
+	}
+
+	// Adding a shard only moves namespaces to the new shard
+	Shards = 5
+	for namespace, shard := range assignments {
+		if moved := shardOf(namespace); moved != shard {
+			require.Equal(t, 4, moved)
+		}
+	}
+}
+
+func newShardLease(name, label, holder string, renewed time.Time) *coordinationv1.Lease {
+	return &coordinationv1.Lease{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "controller",
+			Labels:    map[string]string{label: k8s.LeaseName},
+		},
+		Spec: coordinationv1.LeaseSpec{
+			HolderIdentity:       ptr.To(holder),
+			LeaseDurationSeconds: ptr.To(int32(15)),
+			RenewTime:            &metav1.MicroTime{Time: renewed},
+		},
+	}
+}
+
+func TestBalanceShards(t *testing.T) {
+	currentTime := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	now = func() time.Time { return currentTime }
+	Shards = 4
+	defer func() {
+		now = time.Now
+		Shards = 0
+	}()
+
+	memberLease := func(holder string, renewed time.Time) *coordinationv1.Lease {
+		return newShardLease("member-"+holder, constants.MemberLeaseLabel, holder, renewed)
+	}
+	shardLease := func(shard int, holder string) *coordinationv1.Lease {
+		return newShardLease(k8s.GetShardLeaseName(shard), constants.ShardLeaseLabel, holder, currentTime)
+	}
+
+	tests := []struct {
+		name              string
+		leases            []runtime.Object
+		candidates        []int
+		expectedCompete   []int
+		expectedCancelled []int
+	}{
+		{
+			name:            "Alone -> compete for every shard",
+			expectedCompete: []int{0, 1, 2, 3},
+		},
+		{
+			name: "Another replica holds half of the shards -> compete for the others",
+			leases: []runtime.Object{
+				memberLease("other", currentTime),
+				shardLease(0, "other"),
+				shardLease(1, "other"),
+			},
+			expectedCompete: []int{2, 3},
+		},
+		{
+			name: "Expired replica -> compete for its shards",
+			leases: []runtime.Object{
+				memberLease("other", currentTime.Add(-time.Minute)),
+				newShardLease(k8s.GetShardLeaseName(0), constants.ShardLeaseLabel, "other", currentTime.Add(-time.Minute)),
+			},
+			candidates:      []int{1, 2, 3},
+			expectedCompete: []int{0},
+		},
+		{
+			name: "New replica joined -> release the shards above the fair share",
+			leases: []runtime.Object{
+				memberLease("other", currentTime),
+				shardLease(0, "me"),
+				shardLease(1, "me"),
+				shardLease(2, "me"),
+				shardLease(3, "me"),
+			},
+			candidates:        []int{0, 1, 2, 3},
+			expectedCancelled: []int{2, 3},
+		},
+		{
+			name: "Shard acquired by another replica -> stop competing",
+			leases: []runtime.Object{
+				memberLease("other", currentTime),
+				shardLease(0, "other"),
+			},
+			candidates:        []int{0, 1},
+			expectedCancelled: []int{0},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k8s.ClientSet = fake.NewClientset(tt.leases...)
+
+			var cancelled []int
+			candidates := make(map[int]context.CancelFunc)
+			for _, shard := range tt.candidates {
+				candidates[shard] = func() { cancelled = append(cancelled, shard) }
+			}
+
+			var competed []int
+			controller := NewController()
+			controller.balanceShards(t.Context(), "controller", "me", candidates, func(shard int) {
+				competed = append(competed, shard)
+				candidates[shard] = func() {}
+			})
+
+			slices.Sort(competed)
+			slices.Sort(cancelled)
+			require.Equal(t, tt.expectedCompete, competed)
+			require.Equal(t, tt.expectedCancelled, cancelled)
+		})
+	}
+}
+
+func TestOwnsNamespace(t *testing.T) {
+	Shards = 4
+	defer func() {
+		Shards = 0
+		clear(ownedShards)
+	}()
+
+	namespace := "test-namespace"
+	require.False(t, ownsNamespace(namespace))
+	require.Nil(t, getPvcIndexer(namespace))
+	require.Zero(t, reconcileVolumeReplication(t.Context(), namespace+"/test-pvc"))
+
+	ownedShards[shardOf(namespace)] = newShardWork()
+	require.True(t, ownsNamespace(namespace))
+
+	// The caches of the namespace aren't used until they are synced
+	require.Nil(t, getVolumeReplicationIndexer(namespace))
+}
+
+func TestReleaseShard(t *testing.T) {
+	Shards = 4
+	defer func() {
+		Shards = 0
+		clear(ownedShards)
+	}()
+
+	namespace := "test-namespace"
+	shard := shardOf(namespace)
+
+	// A released shard waits for its in-flight reconciliations
+	ownedShards[shard] = newShardWork()
+	workCtx, done, owned := trackNamespaceWork(t.Context(), namespace)
+	require.True(t, owned)
+
+	released := make(chan struct{})
+	go func() {
+		releaseShard(shard, false)
+		close(released)
+	}()
+
+	require.Eventually(t, func() bool { return !ownsNamespace(namespace) }, time.Second, 10*time.Millisecond)
+	select {
+	case <-released:
+		t.Fatal("shard released before its reconciliations finished")
+	case <-time.After(50 * time.Millisecond):
+	}
+	require.NoError(t, workCtx.Err())
+
+	done()
+	<-released
+	_, _, owned = trackNamespaceWork(t.Context(), namespace)
+	require.False(t, owned)
+
+	// A lost shard aborts its in-flight reconciliations right away
+	ownedShards[shard] = newShardWork()
+	workCtx, done, owned = trackNamespaceWork(t.Context(), namespace)
+	require.True(t, owned)
+	go func() {
+		<-workCtx.Done()
+		done()
+	}()
+	releaseShard(shard, true)
+	require.Error(t, workCtx.Err())
+}
@@ -0,0 +1,243 @@
+package replicator
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/super-phenix/volume-replicator/internal/constants"
+	"github.com/super-phenix/volume-replicator/internal/k8s"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/klog/v2"
+)
+
+const (
+	volumeSnapshotGroup   = "snapshot.storage.k8s.io"
+	volumeSnapshotVersion = "v1"
+
+	// snapshotPollInterval is the delay between two checks of a VolumeSnapshot that isn't ready yet
+	snapshotPollInterval = 10 * time.Second
+)
+
+var (
+	SnapshotBeforeRecreate bool
+	SnapshotTimeout        = 10 * time.Minute
+
+	VolumeSnapshotResource = schema.GroupVersionResource{
+		Group:    volumeSnapshotGroup,
+		Version:  volumeSnapshotVersion,
+		Resource: "volumesnapshots",
+	}
+
+	VolumeSnapshotClassesResource = schema.GroupVersionResource{
+		Group:    volumeSnapshotGroup,
+		Version:  volumeSnapshotVersion,
+		Resource: "volumesnapshotclasses",
+	}
+)
+
+// snapshotBeforeRecreate takes a VolumeSnapshot of a PVC before its VolumeReplication is re-created, if configured.
+// It returns whether the VolumeReplication can be deleted, and if it can't, the delay after which the PVC must be reconciled again.
+// The VolumeReplication can be deleted once the VolumeSnapshot is ready to use, or once the snapshot timeout expired
+// since the first attempt to create it, whether the VolumeSnapshot couldn't be created or never became ready.
+func snapshotBeforeRecreate(ctx context.Context, pvc *corev1.PersistentVolumeClaim, vr *unstructured.Unstructured) (bool, time.Duration) {
+	if !SnapshotBeforeRecreate {
+		return true, 0
+	}
+
+	// The name of the snapshot is tied to the VolumeReplication, so that each re-creation is snapshotted once
+	name := getRecreateSnapshotName(pvc, vr)
+	snapshotClient := k8s.DynamicClientSet.Resource(VolumeSnapshotResource).Namespace(pvc.Namespace)
+	firstAttempt := getRecreateSnapshotAttempt(pvc, name)
+
+	callCtx, cancel := withAPITimeout(ctx)
+	defer cancel()
+	snapshot, err := snapshotClient.Get(callCtx, name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		// The first attempt is recorded, so that the timeout also applies to a VolumeSnapshot that can't be created
+		if firstAttempt.IsZero() {
+			firstAttempt = now()
+			value := fmt.Sprintf("%s/%s", name, firstAttempt.UTC().Format(time.RFC3339))
+			if err = patchPvcAnnotations(ctx, pvc, map[string]*string{constants.RecreateSnapshotAnnotation: &value}); err != nil {
+				klog.Errorf("failed to record VolumeSnapshot %s on PVC %s/%s: %s", name, pvc.Namespace, pvc.Name, err.Error())
+			}
+		}
+
+		if now().Sub(firstAttempt) >= SnapshotTimeout {
+			klog.Errorf("VolumeSnapshot %s/%s couldn't be created within %s, re-creating its VolumeReplication anyway", pvc.Namespace, name, SnapshotTimeout)
+			recordEvent(pvc, corev1.EventTypeWarning, reasonSnapshotTimeout, "VolumeSnapshot %s couldn't be created within %s, re-creating the VolumeReplication anyway", name, SnapshotTimeout)
+			reportSnapshotError(ctx, pvc, "")
+			return true, 0
+		}
+
+		if err = createRecreateSnapshot(ctx, pvc, name); err != nil {
+			klog.Errorf("failed to create VolumeSnapshot %s/%s before re-creating its VolumeReplication: %s", pvc.Namespace, name, err.Error())
+			reportSnapshotError(ctx, pvc, fmt.Sprintf("Failed to create VolumeSnapshot %s: %s", name, err.Error()))
+			return false, requeueWithBackoff
+		}
+
+		klog.Infof("created VolumeSnapshot %s/%s before re-creating its VolumeReplication", pvc.Namespace, name)
+		recordEvent(pvc, corev1.EventTypeNormal, reasonSnapshotCreated, "Created VolumeSnapshot %s before re-creating the VolumeReplication", name)
+		reportSnapshotError(ctx, pvc, "")
+		return false, snapshotPollInterval
+	}
+	if err != nil {
+		klog.Errorf("failed to get VolumeSnapshot %s/%s: %s", pvc.Namespace, name, err.Error())
+		return false, requeueWithBackoff
+	}
+
+	if ready, _, _ := unstructured.NestedBool(snapshot.Object, "status", "readyToUse"); ready {
+		klog.Infof("VolumeSnapshot %s/%s is ready, re-creating its VolumeReplication", pvc.Namespace, name)
+		return true, 0
+	}
+
+	// Give up waiting once the timeout expired, the class change must not be blocked forever
+	if firstAttempt.IsZero() {
+		firstAttempt = snapshot.GetCreationTimestamp().Time
+	}
+	remaining := SnapshotTimeout - now().Sub(firstAttempt)
+	if remaining <= 0 {
+		message, _, _ := unstructured.NestedString(snapshot.Object, "status", "error", "message")
+		klog.Errorf("VolumeSnapshot %s/%s isn't ready after %s, re-creating its VolumeReplication anyway: %s", pvc.Namespace, name, SnapshotTimeout, message)
+		recordEvent(pvc, corev1.EventTypeWarning, reasonSnapshotTimeout, "VolumeSnapshot %s isn't ready after %s, re-creating the VolumeReplication anyway", name, SnapshotTimeout)
+		return true, 0
+	}
+
+	klog.Infof("waiting for VolumeSnapshot %s/%s to be ready before re-creating its VolumeReplication", pvc.Namespace, name)
+	return false, min(remaining, snapshotPollInterval)
+}
+
+// getRecreateSnapshotAttempt returns the time of the first attempt to create a VolumeSnapshot of a PVC,
+// zero if none was recorded for this VolumeSnapshot
+func getRecreateSnapshotAttempt(pvc *corev1.PersistentVolumeClaim, name string) time.Time {
+	value := getKeyValue(pvc.Annotations, constants.RecreateSnapshotAnnotation)
+	recorded, attempt, ok := strings.Cut(value, "/")
+	if !ok || recorded != name {
+		return time.Time{}
+	}
+
+	firstAttempt, err := time.Parse(time.RFC3339, attempt)
+	if err != nil {
+		klog.Errorf("invalid VolumeSnapshot attempt %q on PVC %s/%s: %s", value, pvc.Namespace, pvc.Name, err.Error())
+		return time.Time{}
+	}
+	return firstAttempt
+}
+
+// reportSnapshotError records the last error met creating a VolumeSnapshot on a PVC, an empty message clearing it.
+// An Event is only emitted when the error changes, so that retries don't flood the PVC.
+func reportSnapshotError(ctx context.Context, pvc *corev1.PersistentVolumeClaim, message string) {
+	current, found := lookupKey(pvc.Annotations, constants.RecreateSnapshotErrorAnnotation)
+	if current == message {
+		return
+	}
+
+	var value *string
+	if message != "" {
+		value = &message
+	} else if !found {
+		return
+	}
+	if err := patchPvcAnnotations(ctx, pvc, map[string]*string{constants.RecreateSnapshotErrorAnnotation: value}); err != nil {
+		klog.Errorf("failed to record VolumeSnapshot error on PVC %s/%s: %s", pvc.Namespace, pvc.Name, err.Error())
+	}
+	if message != "" {
+		recordEvent(pvc, corev1.EventTypeWarning, reasonSnapshotFailed, message)
+	}
+}
+
+// getRecreateSnapshotName returns the name of the VolumeSnapshot taken before re-creating a VolumeReplication
+func getRecreateSnapshotName(pvc *corev1.PersistentVolumeClaim, vr *unstructured.Unstructured) string {
+	uid := string(vr.GetUID())
+	if len(uid) > 8 {
+		uid = uid[:8]
+	}
+
+	// Keep the name within the limits of object names
+	name := pvc.Name
+	if maxLength := validation.DNS1123SubdomainMaxLength - len(uid) - 1; len(name) > maxLength {
+		name = strings.TrimRight(name[:maxLength], "-.")
+	}
+	return fmt.Sprintf("%s-%s", name, uid)
+}
+
+// createRecreateSnapshot creates a VolumeSnapshot of a PVC with the VolumeSnapshotClass of its StorageClass group
+func createRecreateSnapshot(ctx context.Context, pvc *corev1.PersistentVolumeClaim, name string) error {
+	snapshotClass, err := getVolumeSnapshotClass(ctx, pvc)
+	if err != nil {
+		return err
+	}
+
+	spec := map[string]any{
+		"source": map[string]any{
+			"persistentVolumeClaimName": pvc.Name,
+		},
+	}
+	// Without a VolumeSnapshotClass, the default VolumeSnapshotClass of the cluster is used
+	if snapshotClass != "" {
+		spec["volumeSnapshotClassName"] = snapshotClass
+	}
+
+	snapshot := &unstructured.Unstructured{}
+	snapshot.SetUnstructuredContent(map[string]any{
+		"apiVersion": fmt.Sprintf("%s/%s", VolumeSnapshotResource.Group, VolumeSnapshotResource.Version),
+		"kind":       "VolumeSnapshot",
+		"metadata": map[string]any{
+			"name":      name,
+			"namespace": pvc.Namespace,
+			"labels": map[string]any{
+				constants.ParentLabel: pvc.Name,
+			},
+		},
+		"spec": spec,
+	})
+
+	resourceInterface := k8s.DynamicClientSet.Resource(VolumeSnapshotResource).Namespace(pvc.Namespace)
+	callCtx, cancel := withAPITimeout(ctx)
+	defer cancel()
+	_, err = resourceInterface.Create(callCtx, snapshot, metav1.CreateOptions{})
+	return err
+}
+
+// getVolumeSnapshotClass returns the VolumeSnapshotClass to use for a PVC.
+// VolumeSnapshotClasses are mapped to StorageClass groups through the same label as VolumeReplicationClasses.
+// An empty name is returned if the PVC has no group or if no VolumeSnapshotClass is labelled for its group.
+func getVolumeSnapshotClass(ctx context.Context, pvc *corev1.PersistentVolumeClaim) (string, error) {
+	group, err := getStorageClassGroup(ctx, pvc)
+	if err != nil {
+		return "", fmt.Errorf("failed to get StorageClass group: %w", err)
+	}
+	if group == "" {
+		return "", nil
+	}
+
+	list, err := listWithDomainLabels(ctx, VolumeSnapshotClassesResource, map[string]string{constants.StorageClassGroup: group})
+	if err != nil {
+		return "", fmt.Errorf("failed to list VolumeSnapshotClasses: %w", err)
+	}
+
+	// Filter for VolumeSnapshotClasses that have the same driver as the provisioner of our PVC
+	pvcProvisioner, _ := getPvcProvisioner(ctx, pvc)
+	var classes []string
+	for _, item := range list {
+		driver, _, _ := unstructured.NestedString(item.Object, "driver")
+		if driver == pvcProvisioner || pvcProvisioner == "" {
+			classes = append(classes, item.GetName())
+		}
+	}
+
+	switch len(classes) {
+	case 0:
+		return "", nil
+	case 1:
+		return classes[0], nil
+	default:
+		return "", fmt.Errorf("found multiple VolumeSnapshotClasses for StorageClass group %s: %v", group, classes)
+	}
+}
@@ -0,0 +1,330 @@
+package replicator
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/super-phenix/volume-replicator/internal/constants"
+	"github.com/super-phenix/volume-replicator/internal/k8s"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	k8s_testing "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/record"
+)
+
+func newVolumeSnapshotClass(name, group, driver string) *unstructured.Unstructured {
+	return &unstructured.Unstructured{
+		Object: map[string]any{
+			"apiVersion": fmt.Sprintf("%s/%s", VolumeSnapshotClassesResource.Group, VolumeSnapshotClassesResource.Version),
+			"kind":       "VolumeSnapshotClass",
+			"metadata": map[string]any{
+				"name":   name,
+				"labels": map[string]any{constants.StorageClassGroup: group},
+			},
+			"driver": driver,
+		},
+	}
+}
+
+func newVolumeSnapshot(name, namespace string, ready bool, created time.Time) *unstructured.Unstructured {
+	return &unstructured.Unstructured{
+		Object: map[string]any{
+			"apiVersion": fmt.Sprintf("%s/%s", VolumeSnapshotResource.Group, VolumeSnapshotResource.Version),
+			"kind":       "VolumeSnapshot",
+			"metadata": map[string]any{
+				"name":              name,
+				"namespace":         namespace,
+				"creationTimestamp": created.Format(time.RFC3339),
+			},
+			"status": map[string]any{
+				"readyToUse": ready,
+			},
+		},
+	}
+}
+
+func setupSnapshotEnvironment(stcName, group string, objects ...runtime.Object) *dynamicfake.FakeDynamicClient {
+	listKinds := map[schema.GroupVersionResource]string{
+		VolumeSnapshotResource:        "VolumeSnapshotList",
+		VolumeSnapshotClassesResource: "VolumeSnapshotClassList",
+	}
+	dynamicClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), listKinds, objects...)
+	k8s.DynamicClientSet = dynamicClient
+
+	k8s.ClientSet = fake.NewClientset(&storagev1.StorageClass{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   stcName,
+			Labels: map[string]string{constants.StorageClassGroup: group},
+		},
+		Provisioner: "rbd.csi.ceph.com",
+	})
+
+	return dynamicClient
+}
+
+func TestGetVolumeSnapshotClass(t *testing.T) {
+	stcName := "ceph-rbd"
+	otherStcName := "no-group"
+
+	tests := []struct {
+		name      string
+		stcName   string
+		classes   []runtime.Object
+		expected  string
+		expectErr bool
+	}{
+		{
+			name:    "Single class for the group and driver",
+			stcName: stcName,
+			classes: []runtime.Object{
+				newVolumeSnapshotClass("ceph-snapshots", "ceph", "rbd.csi.ceph.com"),
+				newVolumeSnapshotClass("other-driver", "ceph", "cephfs.csi.ceph.com"),
+				newVolumeSnapshotClass("other-group", "nfs", "rbd.csi.ceph.com"),
+			},
+			expected: "ceph-snapshots",
+		},
+		{
+			name:     "No class for the group",
+			stcName:  stcName,
+			classes:  []runtime.Object{newVolumeSnapshotClass("other-group", "nfs", "rbd.csi.ceph.com")},
+			expected: "",
+		},
+		{
+			name:     "StorageClass without group",
+			stcName:  otherStcName,
+			classes:  []runtime.Object{newVolumeSnapshotClass("ceph-snapshots", "ceph", "rbd.csi.ceph.com")},
+			expected: "",
+		},
+		{
+			name:    "Ambiguous classes",
+			stcName: stcName,
+			classes: []runtime.Object{
+				newVolumeSnapshotClass("ceph-snapshots", "ceph", "rbd.csi.ceph.com"),
+				newVolumeSnapshotClass("ceph-snapshots-2", "ceph", "rbd.csi.ceph.com"),
+			},
+			expectErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupSnapshotEnvironment(stcName, "ceph", tt.classes...)
+			_, err := k8s.ClientSet.StorageV1().StorageClasses().Create(t.Context(), &storagev1.StorageClass{
+				ObjectMeta: metav1.ObjectMeta{Name: otherStcName},
+			}, metav1.CreateOptions{})
+			require.NoError(t, err)
+
+			pvc := &corev1.PersistentVolumeClaim{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "test-pvc",
+					Namespace:   "test-namespace",
+					Annotations: map[string]string{constants.StorageProvisionerAnnotation: "rbd.csi.ceph.com"},
+				},
+				Spec: corev1.PersistentVolumeClaimSpec{StorageClassName: &tt.stcName},
+			}
+
+			snapshotClass, err := getVolumeSnapshotClass(t.Context(), pvc)
+			if tt.expectErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.expected, snapshotClass)
+		})
+	}
+}
+
+func TestGetRecreateSnapshotName(t *testing.T) {
+	vr := &unstructured.Unstructured{}
+	vr.SetUID(types.UID("0123456789abcdef"))
+
+	pvc := &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: "test-pvc"}}
+	require.Equal(t, "test-pvc-01234567", getRecreateSnapshotName(pvc, vr))
+
+	// Long PVC names are truncated to fit the suffix
+	pvc.Name = strings.Repeat("a", validation.DNS1123SubdomainMaxLength-10) + "-" + strings.Repeat("b", 9)
+	name := getRecreateSnapshotName(pvc, vr)
+	require.Len(t, name, validation.DNS1123SubdomainMaxLength-1)
+	require.Empty(t, validation.IsDNS1123Subdomain(name))
+	require.True(t, strings.HasSuffix(name, "a-01234567"))
+}
+
+func TestSnapshotBeforeRecreate(t *testing.T) {
+	nsName := "test-namespace"
+	stcName := "ceph-rbd"
+	snapshotName := "test-pvc-0a1b2c3d"
+	createdAt := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	vr := &unstructured.Unstructured{}
+	vr.SetUID("0a1b2c3d-4e5f-6789-abcd-ef0123456789")
+
+	tests := []struct {
+		name            string
+		disabled        bool
+		snapshot        *unstructured.Unstructured
+		elapsed         time.Duration
+		expectedReady   bool
+		expectedRequeue time.Duration
+		expectedCreated bool
+	}{
+		{
+			name:          "Disabled",
+			disabled:      true,
+			expectedReady: true,
+		},
+		{
+			name:            "Snapshot missing -> create it",
+			expectedReady:   false,
+			expectedRequeue: snapshotPollInterval,
+			expectedCreated: true,
+		},
+		{
+			name:            "Snapshot not ready",
+			snapshot:        newVolumeSnapshot(snapshotName, nsName, false, createdAt),
+			elapsed:         time.Minute,
+			expectedReady:   false,
+			expectedRequeue: snapshotPollInterval,
+		},
+		{
+			name:            "Snapshot not ready, timeout about to expire",
+			snapshot:        newVolumeSnapshot(snapshotName, nsName, false, createdAt),
+			elapsed:         SnapshotTimeout - 5*time.Second,
+			expectedReady:   false,
+			expectedRequeue: 5 * time.Second,
+		},
+		{
+			name:          "Snapshot not ready, timeout expired",
+			snapshot:      newVolumeSnapshot(snapshotName, nsName, false, createdAt),
+			elapsed:       SnapshotTimeout,
+			expectedReady: true,
+		},
+		{
+			name:          "Snapshot ready",
+			snapshot:      newVolumeSnapshot(snapshotName, nsName, true, createdAt),
+			elapsed:       time.Minute,
+			expectedReady: true,
+		},
+	}
+
+	defer func() {
+		now = time.Now
+		SnapshotBeforeRecreate = false
+	}()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var objects []runtime.Object
+			if tt.snapshot != nil {
+				objects = append(objects, tt.snapshot)
+			}
+			dynamicClient := setupSnapshotEnvironment(stcName, "ceph", objects...)
+
+			pvc := &corev1.PersistentVolumeClaim{
+				ObjectMeta: metav1.ObjectMeta{Name: "test-pvc", Namespace: nsName},
+				Spec:       corev1.PersistentVolumeClaimSpec{StorageClassName: &stcName},
+			}
+			_, err := k8s.ClientSet.CoreV1().PersistentVolumeClaims(nsName).Create(t.Context(), pvc, metav1.CreateOptions{})
+			require.NoError(t, err)
+
+			SnapshotBeforeRecreate = !tt.disabled
+			now = func() time.Time { return createdAt.Add(tt.elapsed) }
+
+			ready, requeueAfter := snapshotBeforeRecreate(t.Context(), pvc, vr)
+			require.Equal(t, tt.expectedReady, ready)
+			require.Equal(t, tt.expectedRequeue, requeueAfter)
+
+			snapshot, err := dynamicClient.Resource(VolumeSnapshotResource).Namespace(nsName).Get(t.Context(), snapshotName, metav1.GetOptions{})
+			if tt.snapshot == nil && !tt.expectedCreated {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+
+			if tt.expectedCreated {
+				source, _, _ := unstructured.NestedString(snapshot.Object, "spec", "source", "persistentVolumeClaimName")
+				require.Equal(t, pvc.Name, source)
+
+				patched, err := k8s.ClientSet.CoreV1().PersistentVolumeClaims(nsName).Get(t.Context(), pvc.Name, metav1.GetOptions{})
+				require.NoError(t, err)
+				require.Equal(t, snapshotName+"/"+createdAt.Format(time.RFC3339), patched.Annotations[constants.RecreateSnapshotAnnotation])
+			}
+		})
+	}
+}
+
+func TestSnapshotBeforeRecreateFailure(t *testing.T) {
+	nsName := "test-namespace"
+	stcName := "ceph-rbd"
+	snapshotName := "test-pvc-0a1b2c3d"
+	firstAttempt := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	vr := &unstructured.Unstructured{}
+	vr.SetUID("0a1b2c3d-4e5f-6789-abcd-ef0123456789")
+
+	dynamicClient := setupSnapshotEnvironment(stcName, "ceph")
+	createError := "admission webhook denied the request"
+	dynamicClient.PrependReactor("create", "volumesnapshots", func(action k8s_testing.Action) (bool, runtime.Object, error) {
+		return true, nil, fmt.Errorf("%s", createError)
+	})
+
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-pvc", Namespace: nsName},
+		Spec:       corev1.PersistentVolumeClaimSpec{StorageClassName: &stcName},
+	}
+	_, err := k8s.ClientSet.CoreV1().PersistentVolumeClaims(nsName).Create(t.Context(), pvc, metav1.CreateOptions{})
+	require.NoError(t, err)
+
+	recorder := record.NewFakeRecorder(10)
+	k8s.Recorder = recorder
+	SnapshotBeforeRecreate = true
+	defer func() {
+		k8s.Recorder = nil
+		now = time.Now
+		SnapshotBeforeRecreate = false
+	}()
+
+	attempt := func(elapsed time.Duration) (bool, time.Duration) {
+		now = func() time.Time { return firstAttempt.Add(elapsed) }
+		pvc, err := k8s.ClientSet.CoreV1().PersistentVolumeClaims(nsName).Get(t.Context(), "test-pvc", metav1.GetOptions{})
+		require.NoError(t, err)
+		return snapshotBeforeRecreate(t.Context(), pvc, vr)
+	}
+
+	// Failures are retried with a backoff, and only reported once while the error doesn't change
+	for _, elapsed := range []time.Duration{0, time.Minute, 2 * time.Minute} {
+		ready, requeueAfter := attempt(elapsed)
+		require.False(t, ready)
+		require.Equal(t, requeueWithBackoff, requeueAfter)
+	}
+	require.Len(t, recorder.Events, 1)
+	require.Contains(t, <-recorder.Events, reasonSnapshotFailed)
+
+	patched, err := k8s.ClientSet.CoreV1().PersistentVolumeClaims(nsName).Get(t.Context(), "test-pvc", metav1.GetOptions{})
+	require.NoError(t, err)
+	require.Equal(t, snapshotName+"/"+firstAttempt.Format(time.RFC3339), patched.Annotations[constants.RecreateSnapshotAnnotation])
+	require.Contains(t, patched.Annotations[constants.RecreateSnapshotErrorAnnotation], createError)
+
+	// A new error is reported
+	createError = "volumesnapshots quota exceeded"
+	ready, _ := attempt(3 * time.Minute)
+	require.False(t, ready)
+	require.Len(t, recorder.Events, 1)
+	require.Contains(t, <-recorder.Events, createError)
+
+	// The timeout applies from the first attempt, the VolumeReplication is re-created without snapshot
+	ready, _ = attempt(SnapshotTimeout)
+	require.True(t, ready)
+	require.Len(t, recorder.Events, 1)
+	require.Contains(t, <-recorder.Events, reasonSnapshotTimeout)
+}
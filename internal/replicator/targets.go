@@ -0,0 +1,180 @@
+package replicator
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/super-phenix/volume-replicator/internal/constants"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// targetSeparator separates the targets of a PVC in its annotations, commas already separating fallback selectors
+	targetSeparator = ";"
+	// targetHashLength is the length of the hash suffixed to the names of the additional targets of a PVC
+	targetHashLength = 8
+	// parentIndex indexes replication objects by the key of their parent PVC
+	parentIndex = "parent"
+)
+
+// NameTemplate names the replication object of the first target of a PVC, nil to name it after the PVC
+var NameTemplate *template.Template
+
+// NameTemplateData is the data from which the name of the replication objects of a PVC is rendered
+type NameTemplateData struct {
+	// PVC is the PVC, as cached by the controller
+	PVC *corev1.PersistentVolumeClaim
+}
+
+// replicationTarget is one of the replication objects requested by a PVC, e.g. one per remote site.
+// A PVC has a target for each entry of its class annotation, or of its selector annotation if it has no class.
+type replicationTarget struct {
+	// name is the name of the replication object of the target
+	name string
+	// value is the class set explicitly for the target
+	value string
+	// selector is the selector chain of the target, when no class is set explicitly
+	selector string
+	// state is the replication state of the target
+	state string
+}
+
+// getReplicationTargets returns the targets of a PVC, in the order of its annotations.
+// The first target is named after the PVC (see replicationName), so that adding targets leaves the existing replication object alone.
+// The others are named after the first one and a hash of their entry, so that they keep their name when other targets change.
+// A PVC that doesn't request replication has a single target, without class.
+func getReplicationTargets(pvc *corev1.PersistentVolumeClaim) []replicationTarget {
+	states := splitTargets(getAnnotationValue(pvc, constants.ReplicationStateAnnotation))
+
+	entries := splitTargets(getVolumeReplicationClassValue(pvc))
+	explicit := len(entries) > 0
+	if !explicit {
+		entries = splitTargets(getVolumeReplicationClassSelector(pvc))
+	}
+	name := replicationName(pvc)
+	if len(entries) == 0 {
+		return []replicationTarget{{name: name, state: targetState(states, 0)}}
+	}
+
+	targets := make([]replicationTarget, 0, len(entries))
+	for i, entry := range entries {
+		target := replicationTarget{name: name, state: targetState(states, i)}
+		if i > 0 {
+			target.name = targetName(name, entry)
+		}
+		if explicit {
+			target.value = entry
+		} else {
+			target.selector = entry
+		}
+		targets = append(targets, target)
+	}
+	return targets
+}
+
+// ParseNameTemplate parses the template naming the replication objects of PVCs, and checks that it renders valid names
+func ParseNameTemplate(value string) (*template.Template, error) {
+	tmpl, err := template.New("name").Funcs(templateFuncs).Option("missingkey=error").Parse(value)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse name template: %w", err)
+	}
+
+	sample := &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: "data", Namespace: "default"}}
+	if _, err = renderName(tmpl, sample); err != nil {
+		return nil, err
+	}
+	return tmpl, nil
+}
+
+// renderName renders the name of the replication object of a PVC
+func renderName(tmpl *template.Template, pvc *corev1.PersistentVolumeClaim) (string, error) {
+	var buffer bytes.Buffer
+	if err := tmpl.Execute(&buffer, NameTemplateData{PVC: pvc}); err != nil {
+		return "", fmt.Errorf("failed to render name template: %w", err)
+	}
+
+	name := strings.TrimSpace(buffer.String())
+	if errs := validation.IsDNS1123Subdomain(name); len(errs) > 0 {
+		return "", fmt.Errorf("name template rendered invalid name %q: %s", name, strings.Join(errs, ", "))
+	}
+	return name, nil
+}
+
+// replicationName returns the name of the replication object of the first target of a PVC, rendered from NameTemplate.
+// PVCs whose name can't be rendered fall back to the name of the PVC.
+func replicationName(pvc *corev1.PersistentVolumeClaim) string {
+	if NameTemplate == nil {
+		return pvc.Name
+	}
+
+	name, err := renderName(NameTemplate, pvc)
+	if err != nil {
+		klog.Errorf("naming the replication objects of PVC %s/%s after it: %s", pvc.Namespace, pvc.Name, err.Error())
+		return pvc.Name
+	}
+	return name
+}
+
+// splitTargets returns the non-empty entries of an annotation holding one entry per target
+func splitTargets(value string) []string {
+	var entries []string
+	for _, entry := range strings.Split(value, targetSeparator) {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// targetState returns the replication state of a target. A single state applies to every target,
+// otherwise each target has the state at its position, and targets without one are primary.
+func targetState(states []string, index int) string {
+	switch {
+	case len(states) == 1:
+		return states[0]
+	case index < len(states):
+		return states[index]
+	}
+	return "primary"
+}
+
+// targetName returns the name of the replication object of an additional target of a PVC
+func targetName(pvcName, entry string) string {
+	hash := sha256.Sum256([]byte(entry))
+	suffix := hex.EncodeToString(hash[:])[:targetHashLength]
+
+	// Keep the name within the limits of object names
+	if maxLength := validation.DNS1123SubdomainMaxLength - len(suffix) - 1; len(pvcName) > maxLength {
+		pvcName = strings.TrimRight(pvcName[:maxLength], "-.")
+	}
+	return fmt.Sprintf("%s-%s", pvcName, suffix)
+}
+
+// indexByParent indexes the replication objects owned by our instance by the key of their parent PVC
+func indexByParent(obj any) ([]string, error) {
+	vr, ok := obj.(*unstructured.Unstructured)
+	if !ok || !isParentLabelPresent(vr.GetLabels()) {
+		return nil, nil
+	}
+	return []string{vr.GetNamespace() + "/" + getKeyValue(vr.GetLabels(), constants.ParentLabel)}, nil
+}
+
+// getParentKey returns the key of the PVC of a replication object, or of the PVC adopting it.
+// Objects without either are keyed by their own name, which is the name of the PVC when no naming template is set.
+func getParentKey(vr *unstructured.Unstructured) string {
+	if parent := getKeyValue(vr.GetLabels(), constants.ParentLabel); parent != "" {
+		return vr.GetNamespace() + "/" + parent
+	}
+	if adopter := getKeyValue(vr.GetAnnotations(), constants.AdoptAnnotation); adopter != "" {
+		return vr.GetNamespace() + "/" + adopter
+	}
+	return vr.GetNamespace() + "/" + vr.GetName()
+}
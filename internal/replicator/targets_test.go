@@ -0,0 +1,233 @@
+package replicator
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/super-phenix/volume-replicator/internal/constants"
+	"github.com/super-phenix/volume-replicator/internal/k8s"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestGetReplicationTargets(t *testing.T) {
+	informerFactory := informers.NewSharedInformerFactory(fake.NewClientset(), 0)
+	NamespaceInformer = informerFactory.Core().V1().Namespaces()
+	require.NoError(t, NamespaceInformer.Informer().GetIndexer().Add(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "test-namespace"}}))
+
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		expected    []replicationTarget
+	}{
+		{
+			name:     "No replication requested",
+			expected: []replicationTarget{{name: "test-pvc", state: "primary"}},
+		},
+		{
+			name:        "Single class",
+			annotations: map[string]string{constants.VrcValueAnnotation: "site-b"},
+			expected:    []replicationTarget{{name: "test-pvc", value: "site-b", state: "primary"}},
+		},
+		{
+			name: "Several classes with a state each",
+			annotations: map[string]string{
+				constants.VrcValueAnnotation:         "site-b; site-c",
+				constants.ReplicationStateAnnotation: "primary;secondary",
+			},
+			expected: []replicationTarget{
+				{name: "test-pvc", value: "site-b", state: "primary"},
+				{name: targetName("test-pvc", "site-c"), value: "site-c", state: "secondary"},
+			},
+		},
+		{
+			name: "Several selectors with a single state",
+			annotations: map[string]string{
+				constants.VrcSelectorAnnotation:      "hourly,daily;weekly;",
+				constants.ReplicationStateAnnotation: "secondary",
+			},
+			expected: []replicationTarget{
+				{name: "test-pvc", selector: "hourly,daily", state: "secondary"},
+				{name: targetName("test-pvc", "weekly"), selector: "weekly", state: "secondary"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pvc := &corev1.PersistentVolumeClaim{
+				ObjectMeta: metav1.ObjectMeta{Name: "test-pvc", Namespace: "test-namespace", Annotations: tt.annotations},
+			}
+			require.Equal(t, tt.expected, getReplicationTargets(pvc))
+		})
+	}
+}
+
+func TestTargetName(t *testing.T) {
+	// Names are deterministic and distinct for each entry
+	require.Equal(t, targetName("test-pvc", "site-b"), targetName("test-pvc", "site-b"))
+	require.NotEqual(t, targetName("test-pvc", "site-b"), targetName("test-pvc", "site-c"))
+	require.True(t, strings.HasPrefix(targetName("test-pvc", "site-b"), "test-pvc-"))
+
+	// Long PVC names are truncated to fit the suffix
+	name := targetName(strings.Repeat("a", validation.DNS1123SubdomainMaxLength), "site-b")
+	require.Len(t, name, validation.DNS1123SubdomainMaxLength)
+	require.Empty(t, validation.IsDNS1123Subdomain(name))
+}
+
+func TestReconcileTargets(t *testing.T) {
+	dynamicClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		VolumeReplicationResource: "VolumeReplicationList",
+	})
+	addApplyReactor(dynamicClient)
+	k8s.DynamicClientSet = dynamicClient
+
+	informerFactory := informers.NewSharedInformerFactory(fake.NewClientset(), 0)
+	PvcInformer = informerFactory.Core().V1().PersistentVolumeClaims()
+	NamespaceInformer = informerFactory.Core().V1().Namespaces()
+	VolumeReplicationInformer = dynamicinformer.NewDynamicSharedInformerFactory(dynamicClient, 0).ForResource(VolumeReplicationResource)
+	require.NoError(t, VolumeReplicationInformer.Informer().AddIndexers(volumeReplicationIndexers))
+	require.NoError(t, NamespaceInformer.Informer().GetIndexer().Add(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "test-namespace"}}))
+
+	key := "test-namespace/test-pvc"
+	siteC := targetName("test-pvc", "site-c")
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "test-pvc",
+			Namespace: "test-namespace",
+			Annotations: map[string]string{
+				constants.VrcValueAnnotation:         "site-b;site-c",
+				constants.ReplicationStateAnnotation: "primary;secondary",
+			},
+		},
+	}
+	require.NoError(t, PvcInformer.Informer().GetIndexer().Add(pvc))
+
+	// syncCache mirrors the VolumeReplications of the API server in the informer cache
+	syncCache := func() {
+		list, err := dynamicClient.Resource(VolumeReplicationResource).Namespace("test-namespace").List(t.Context(), metav1.ListOptions{})
+		require.NoError(t, err)
+		items := make([]any, 0, len(list.Items))
+		for i := range list.Items {
+			items = append(items, &list.Items[i])
+		}
+		require.NoError(t, VolumeReplicationInformer.Informer().GetIndexer().Replace(items, ""))
+	}
+	getSpec := func(name string) map[string]any {
+		vr, err := dynamicClient.Resource(VolumeReplicationResource).Namespace("test-namespace").Get(t.Context(), name, metav1.GetOptions{})
+		require.NoError(t, err)
+		spec, _, _ := unstructured.NestedMap(vr.Object, "spec")
+		return spec
+	}
+
+	// Each target gets its own VolumeReplication, with its own class and state
+	reconcileVolumeReplication(t.Context(), key)
+	syncCache()
+	require.Equal(t, "site-b", getSpec("test-pvc")["volumeReplicationClass"])
+	require.Equal(t, "primary", getSpec("test-pvc")["replicationState"])
+	require.Equal(t, "site-c", getSpec(siteC)["volumeReplicationClass"])
+	require.Equal(t, "secondary", getSpec(siteC)["replicationState"])
+	require.Equal(t, "test-pvc", getSpec(siteC)["dataSource"].(map[string]any)["name"])
+
+	vrs, err := getVolumeReplications(key)
+	require.NoError(t, err)
+	require.Len(t, vrs, 2)
+
+	// The state of a single target is updated in place
+	pvc = pvc.DeepCopy()
+	pvc.Annotations[constants.ReplicationStateAnnotation] = "primary"
+	require.NoError(t, PvcInformer.Informer().GetIndexer().Update(pvc))
+	reconcileVolumeReplication(t.Context(), key)
+	syncCache()
+	require.Equal(t, "primary", getSpec(siteC)["replicationState"])
+
+	// A removed target is deleted, the other one is left alone
+	pvc = pvc.DeepCopy()
+	pvc.Annotations[constants.VrcValueAnnotation] = "site-b"
+	require.NoError(t, PvcInformer.Informer().GetIndexer().Update(pvc))
+	reconcileVolumeReplication(t.Context(), key)
+	syncCache()
+	_, err = dynamicClient.Resource(VolumeReplicationResource).Namespace("test-namespace").Get(t.Context(), siteC, metav1.GetOptions{})
+	require.Error(t, err)
+	require.Equal(t, "site-b", getSpec("test-pvc")["volumeReplicationClass"])
+
+	// Every VolumeReplication of a deleted PVC is deleted
+	pvc.Annotations[constants.VrcValueAnnotation] = "site-b;site-c"
+	require.NoError(t, PvcInformer.Informer().GetIndexer().Update(pvc))
+	reconcileVolumeReplication(t.Context(), key)
+	syncCache()
+	vrs, err = getVolumeReplications(key)
+	require.NoError(t, err)
+	require.Len(t, vrs, 2)
+
+	require.NoError(t, PvcInformer.Informer().GetIndexer().Delete(pvc))
+	reconcileVolumeReplication(t.Context(), key)
+	list, err := dynamicClient.Resource(VolumeReplicationResource).Namespace("test-namespace").List(t.Context(), metav1.ListOptions{})
+	require.NoError(t, err)
+	require.Empty(t, list.Items)
+}
+
+func TestGetParentKey(t *testing.T) {
+	vr := &unstructured.Unstructured{}
+	vr.SetNamespace("test-namespace")
+	vr.SetName(targetName("test-pvc", "site-c"))
+	require.Equal(t, "test-namespace/"+vr.GetName(), getParentKey(vr))
+
+	// Objects handed over to a PVC are keyed by the PVC
+	vr.SetAnnotations(map[string]string{constants.AdoptAnnotation: "other-pvc"})
+	require.Equal(t, "test-namespace/other-pvc", getParentKey(vr))
+
+	vr.SetLabels(map[string]string{constants.ParentLabel: "test-pvc"})
+	require.Equal(t, "test-namespace/test-pvc", getParentKey(vr))
+}
+
+func TestParseNameTemplate(t *testing.T) {
+	_, err := ParseNameTemplate("{{ .PVC.Name }}-replication")
+	require.NoError(t, err)
+
+	// Templates must parse, and render valid names
+	_, err = ParseNameTemplate("{{ .PVC.Name ")
+	require.Error(t, err)
+	_, err = ParseNameTemplate("{{ .PVC.Name }}_replication")
+	require.Error(t, err)
+	_, err = ParseNameTemplate("{{ .Name }}")
+	require.Error(t, err)
+}
+
+func TestNameTemplateTargets(t *testing.T) {
+	informerFactory := informers.NewSharedInformerFactory(fake.NewClientset(), 0)
+	NamespaceInformer = informerFactory.Core().V1().Namespaces()
+	require.NoError(t, NamespaceInformer.Informer().GetIndexer().Add(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "test-namespace"}}))
+
+	var err error
+	NameTemplate, err = ParseNameTemplate(`{{ .PVC.Name }}-{{ index .PVC.Labels "app" | default "replication" }}`)
+	require.NoError(t, err)
+	t.Cleanup(func() { NameTemplate = nil })
+
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "test-pvc",
+			Namespace:   "test-namespace",
+			Labels:      map[string]string{"app": "db"},
+			Annotations: map[string]string{constants.VrcValueAnnotation: "site-b;site-c"},
+		},
+	}
+
+	// Additional targets are named after the first one
+	targets := getReplicationTargets(pvc)
+	require.Equal(t, "test-pvc-db", targets[0].name)
+	require.Equal(t, targetName("test-pvc-db", "site-c"), targets[1].name)
+
+	// PVCs whose name can't be rendered keep the name of the PVC
+	pvc.Labels["app"] = "DB"
+	require.Equal(t, "test-pvc", getReplicationTargets(pvc)[0].name)
+}
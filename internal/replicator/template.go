@@ -0,0 +1,296 @@
+package replicator
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"strings"
+	"text/template"
+
+	"github.com/super-phenix/volume-replicator/internal/constants"
+	"github.com/super-phenix/volume-replicator/internal/k8s"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/yaml"
+)
+
+// Template is the description of the replication objects of the template backend
+var Template *TemplateConfig
+
+// TemplateConfig is the content of the file passed through --backend-template.
+// It describes the replication objects of a storage vendor, so that they can be managed without code changes.
+type TemplateConfig struct {
+	// Kind is the kind of the replication objects
+	Kind string `json:"kind"`
+	// Resource is the resource of the replication objects, its version isn't discovered
+	Resource schema.GroupVersionResource `json:"resource"`
+	// ClassResource is the cluster-scoped resource of the classes, selected like VolumeReplicationClasses.
+	// Without it, classes can only be set explicitly on PVCs and namespaces.
+	ClassResource *schema.GroupVersionResource `json:"classResource,omitempty"`
+	// Template renders the metadata and the spec of the replication object of a PVC, as YAML
+	Template string `json:"template"`
+	// RecreateFields are the fields of the spec that can't be updated, the object is re-created when they change
+	RecreateFields []string `json:"recreateFields,omitempty"`
+	// UpdateFields are the fields of the spec that are updated in place when they change
+	UpdateFields []string `json:"updateFields,omitempty"`
+	// DegradedCondition is the condition reporting that a replication object is unhealthy
+	DegradedCondition *TemplateCondition `json:"degradedCondition,omitempty"`
+
+	parsed *template.Template
+}
+
+// TemplateCondition is a condition of the status of the replication objects
+type TemplateCondition struct {
+	Type   string `json:"type"`
+	Status string `json:"status"`
+}
+
+// TemplateData is the data from which the replication object of a PVC is rendered
+type TemplateData struct {
+	// PVC is the PVC, as cached by the controller
+	PVC *corev1.PersistentVolumeClaim
+	// Namespace is the namespace of the PVC
+	Namespace *corev1.Namespace
+	// StorageClass is the StorageClass of the PVC, nil if it has none
+	StorageClass *storagev1.StorageClass
+	// Name is the name of the replication object, which differs from the name of the PVC for its additional targets
+	Name string
+	// Class is the name of the resolved class
+	Class string
+	// ClassObject is the resolved class, nil without a class resource
+	ClassObject map[string]any
+	// State is the replication state of the target
+	State string
+}
+
+// renderedObject is the output of a template
+type renderedObject struct {
+	Metadata struct {
+		Labels      map[string]string `json:"labels,omitempty"`
+		Annotations map[string]string `json:"annotations,omitempty"`
+	} `json:"metadata"`
+	Spec map[string]any `json:"spec"`
+}
+
+// templateFuncs are the functions available in templates, in addition to the builtin ones
+var templateFuncs = template.FuncMap{
+	// toJson renders a value as JSON, which is valid YAML, e.g. to quote strings or copy maps
+	"toJson": func(value any) (string, error) {
+		content, err := json.Marshal(value)
+		return string(content), err
+	},
+	// default returns a fallback when a value is empty
+	"default": func(fallback, value any) any {
+		if value == nil || value == "" {
+			return fallback
+		}
+		return value
+	},
+}
+
+// LoadTemplateConfig reads and validates the description of the template backend from a YAML or JSON file
+func LoadTemplateConfig(path string) (*TemplateConfig, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read backend template: %w", err)
+	}
+
+	var config TemplateConfig
+	if err = yaml.UnmarshalStrict(content, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse backend template: %w", err)
+	}
+
+	switch {
+	case config.Kind == "":
+		return nil, fmt.Errorf("backend template has no kind")
+	case config.Resource.Group == "" || config.Resource.Version == "" || config.Resource.Resource == "":
+		return nil, fmt.Errorf("backend template must have a resource with a group, a version and a resource")
+	case config.ClassResource != nil && (config.ClassResource.Version == "" || config.ClassResource.Resource == ""):
+		return nil, fmt.Errorf("class resource of the backend template must have a version and a resource")
+	case config.DegradedCondition != nil && (config.DegradedCondition.Type == "" || config.DegradedCondition.Status == ""):
+		return nil, fmt.Errorf("degraded condition of the backend template must have a type and a status")
+	}
+
+	for _, field := range append(config.RecreateFields, config.UpdateFields...) {
+		if !strings.HasPrefix(field, "spec.") {
+			return nil, fmt.Errorf("field %s of the backend template isn't in the spec", field)
+		}
+	}
+
+	config.parsed, err = template.New(config.Kind).Funcs(templateFuncs).Option("missingkey=error").Parse(config.Template)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse template: %w", err)
+	}
+
+	return &config, nil
+}
+
+// render renders the metadata and the spec of a replication object
+func (c *TemplateConfig) render(data TemplateData) (*renderedObject, error) {
+	var buffer bytes.Buffer
+	if err := c.parsed.Execute(&buffer, data); err != nil {
+		return nil, fmt.Errorf("failed to render template: %w", err)
+	}
+
+	var rendered renderedObject
+	if err := yaml.UnmarshalStrict(buffer.Bytes(), &rendered); err != nil {
+		return nil, fmt.Errorf("failed to parse rendered template: %w", err)
+	}
+	if len(rendered.Spec) == 0 {
+		return nil, fmt.Errorf("rendered template has no spec")
+	}
+	return &rendered, nil
+}
+
+// templateBackend replicates PVCs through the replication objects described by Template
+type templateBackend struct{}
+
+func (templateBackend) kind() string {
+	return Template.Kind
+}
+
+func (templateBackend) resource() schema.GroupVersionResource {
+	return Template.Resource
+}
+
+func (templateBackend) requiredResources() []schema.GroupVersionResource {
+	resources := []schema.GroupVersionResource{Template.Resource}
+	if Template.ClassResource != nil && Template.ClassResource.Group == Template.Resource.Group {
+		resources = append(resources, *Template.ClassResource)
+	}
+	return resources
+}
+
+// resolve resolves the class of a target from the same annotations as VolumeReplicationClasses.
+// Selectors only resolve classes when a class resource is described.
+func (templateBackend) resolve(ctx context.Context, pvc *corev1.PersistentVolumeClaim, target replicationTarget) classResolution {
+	var listClasses classLister
+	if Template.ClassResource != nil {
+		listClasses = listClassesOf(*Template.ClassResource)
+	}
+	return resolveTargetClass(ctx, pvc, target, listClasses, Template.Kind+" class")
+}
+
+// build renders the replication object of a target of a PVC.
+// The labels and annotations of the PVC are propagated, those rendered by the template take precedence.
+// The class is recorded in the class annotation of the object, so that class changes can be detected.
+func (templateBackend) build(ctx context.Context, pvc *corev1.PersistentVolumeClaim, target replicationTarget, class string) (*unstructured.Unstructured, error) {
+	data := TemplateData{PVC: pvc, Name: target.name, Class: class, State: target.state}
+
+	var err error
+	if data.Namespace, err = getNamespace(pvc.Namespace); err != nil {
+		return nil, fmt.Errorf("failed to get namespace: %w", err)
+	}
+	if data.StorageClass, err = getStorageClass(ctx, pvc); err != nil {
+		return nil, fmt.Errorf("failed to get StorageClass: %w", err)
+	}
+
+	if Template.ClassResource != nil {
+		callCtx, cancel := withAPITimeout(ctx)
+		defer cancel()
+		classObject, err := k8s.DynamicClientSet.Resource(*Template.ClassResource).Get(callCtx, class, metav1.GetOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("failed to get class %s: %w", class, err)
+		}
+		data.ClassObject = classObject.Object
+	}
+
+	rendered, err := Template.render(data)
+	if err != nil {
+		return nil, err
+	}
+
+	annotations := getPropagatedAnnotations(pvc)
+	for k, v := range rendered.Metadata.Annotations {
+		annotations[k] = v
+	}
+	annotations[constants.VrcValueAnnotation] = class
+
+	pvcLabels := maps.Clone(pvc.Labels)
+	if pvcLabels == nil {
+		pvcLabels = make(map[string]string)
+	}
+	maps.Copy(pvcLabels, rendered.Metadata.Labels)
+	labels := make(map[string]any)
+	for k, v := range getLabelsWithParent(pvcLabels, pvc.Name) {
+		labels[k] = v
+	}
+
+	return &unstructured.Unstructured{Object: map[string]any{
+		"apiVersion": fmt.Sprintf("%s/%s", Template.Resource.Group, Template.Resource.Version),
+		"kind":       Template.Kind,
+		"metadata": map[string]any{
+			"name":        target.name,
+			"namespace":   pvc.Namespace,
+			"annotations": annotations,
+			"labels":      labels,
+		},
+		"spec": rendered.Spec,
+	}}, nil
+}
+
+// compare re-creates objects whose class or one of the recreate fields changed, and updates objects
+// whose update fields changed. Fields listed in neither are only set when the object is created.
+func (b templateBackend) compare(existing, desired *unstructured.Unstructured) comparison {
+	key := fmt.Sprintf("%s/%s", existing.GetNamespace(), existing.GetName())
+
+	if current := b.class(existing); current != b.class(desired) {
+		klog.Infof("%s %s has a class mismatch with its parent (got %s)", Template.Kind, key, current)
+		return needsRecreate
+	}
+
+	if field := firstChangedField(existing, desired, Template.RecreateFields); field != "" {
+		klog.Infof("%s %s has a %s mismatch with its parent", Template.Kind, key, field)
+		return needsRecreate
+	}
+
+	if field := firstChangedField(existing, desired, Template.UpdateFields); field != "" {
+		klog.Infof("%s %s has a %s mismatch with its parent", Template.Kind, key, field)
+		return needsUpdate
+	}
+	return upToDate
+}
+
+// firstChangedField returns the first field whose desired value isn't set in the existing object, empty if there is none.
+// Fields that aren't rendered are ignored.
+func firstChangedField(existing, desired *unstructured.Unstructured, fields []string) string {
+	for _, field := range fields {
+		path := strings.Split(field, ".")
+		desiredValue, found, _ := unstructured.NestedFieldNoCopy(desired.Object, path...)
+		if !found {
+			continue
+		}
+		existingValue, _, _ := unstructured.NestedFieldNoCopy(existing.Object, path...)
+		if !isSubset(desiredValue, existingValue) {
+			return field
+		}
+	}
+	return ""
+}
+
+func (templateBackend) class(obj *unstructured.Unstructured) string {
+	return getKeyValue(obj.GetAnnotations(), constants.VrcValueAnnotation)
+}
+
+func (templateBackend) statusFields() [][]string {
+	if Template.DegradedCondition == nil {
+		return nil
+	}
+	return [][]string{{"status", "conditions"}}
+}
+
+// status reports objects as unhealthy while their degraded condition has its status, always healthy without one
+func (templateBackend) status(obj *unstructured.Unstructured) (bool, string) {
+	if Template.DegradedCondition == nil {
+		return true, ""
+	}
+	degraded, message := getConditionMessage(obj, Template.DegradedCondition.Type, Template.DegradedCondition.Status)
+	return !degraded, message
+}
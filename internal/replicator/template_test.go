@@ -0,0 +1,227 @@
+package replicator
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/super-phenix/volume-replicator/internal/constants"
+	"github.com/super-phenix/volume-replicator/internal/k8s"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+const testBackendTemplate = `
+kind: VendorReplication
+resource:
+  group: replication.vendor.io
+  version: v1beta1
+  resource: vendorreplications
+template: |
+  metadata:
+    labels:
+      vendor.io/tier: {{ index .Namespace.Labels "tier" | default "standard" }}
+  spec:
+    volume: {{ .PVC.Name }}
+    policy: {{ .Class }}
+    role: {{ if eq .State "primary" }}source{{ else }}target{{ end }}
+    retention: 3
+recreateFields:
+  - spec.volume
+  - spec.policy
+updateFields:
+  - spec.role
+degradedCondition:
+  type: Healthy
+  status: "False"
+`
+
+// useTemplateBackend selects the template backend with a template until the end of a test
+func useTemplateBackend(t *testing.T, content string) {
+	path := filepath.Join(t.TempDir(), "backend-template.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+
+	config, err := LoadTemplateConfig(path)
+	require.NoError(t, err)
+	Template = config
+	require.NoError(t, SetBackend(BackendTemplate))
+	t.Cleanup(func() {
+		require.NoError(t, SetBackend(BackendCSIAddons))
+		Template = nil
+	})
+}
+
+func TestLoadTemplateConfig(t *testing.T) {
+	tests := []struct {
+		name          string
+		content       string
+		expectedError bool
+	}{
+		{
+			name:    "Valid template",
+			content: testBackendTemplate,
+		},
+		{
+			name:          "Missing kind",
+			content:       "resource: {group: vendor.io, version: v1, resource: replications}\ntemplate: 'spec: {}'\n",
+			expectedError: true,
+		},
+		{
+			name:          "Missing resource version",
+			content:       "kind: Replication\nresource: {group: vendor.io, resource: replications}\ntemplate: 'spec: {}'\n",
+			expectedError: true,
+		},
+		{
+			name:          "Field outside of the spec",
+			content:       "kind: Replication\nresource: {group: vendor.io, version: v1, resource: replications}\ntemplate: 'spec: {}'\nupdateFields: [metadata.labels]\n",
+			expectedError: true,
+		},
+		{
+			name:          "Invalid template",
+			content:       "kind: Replication\nresource: {group: vendor.io, version: v1, resource: replications}\ntemplate: 'spec: {{ .PVC.Name'\n",
+			expectedError: true,
+		},
+		{
+			name:          "Unknown field",
+			content:       "kind: Replication\nresource: {group: vendor.io, version: v1, resource: replications}\ntemplate: 'spec: {}'\nrecreate: [spec.volume]\n",
+			expectedError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "backend-template.yaml")
+			require.NoError(t, os.WriteFile(path, []byte(tt.content), 0o600))
+
+			config, err := LoadTemplateConfig(path)
+			if tt.expectedError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, "vendorreplications", config.Resource.Resource)
+			require.Equal(t, "v1beta1", config.Resource.Version)
+		})
+	}
+}
+
+func TestTemplateBuild(t *testing.T) {
+	useTemplateBackend(t, testBackendTemplate)
+
+	informerFactory := informers.NewSharedInformerFactory(fake.NewClientset(), 0)
+	NamespaceInformer = informerFactory.Core().V1().Namespaces()
+	require.NoError(t, NamespaceInformer.Informer().GetIndexer().Add(&corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-namespace", Labels: map[string]string{"tier": "gold"}},
+	}))
+
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "test-pvc",
+			Namespace:   "test-namespace",
+			Labels:      map[string]string{"app": "db", "vendor.io/tier": "bronze"},
+			Annotations: map[string]string{constants.ReplicationStateAnnotation: "secondary"},
+		},
+	}
+
+	obj, err := activeBackend.build(t.Context(), pvc, getReplicationTargets(pvc)[0], "gold-policy")
+	require.NoError(t, err)
+	require.Equal(t, "replication.vendor.io/v1beta1", obj.GetAPIVersion())
+	require.Equal(t, "VendorReplication", obj.GetKind())
+	require.Equal(t, "test-pvc", obj.GetName())
+	require.Equal(t, "gold-policy", activeBackend.class(obj))
+
+	// Rendered labels take precedence over those of the PVC, but not over the parent label
+	require.Equal(t, "gold", obj.GetLabels()["vendor.io/tier"])
+	require.Equal(t, "db", obj.GetLabels()["app"])
+	require.Equal(t, "test-pvc", obj.GetLabels()[constants.ParentLabel])
+
+	spec, _, _ := unstructured.NestedMap(obj.Object, "spec")
+	require.Equal(t, map[string]any{"volume": "test-pvc", "policy": "gold-policy", "role": "target", "retention": float64(3)}, spec)
+}
+
+func TestTemplateCompare(t *testing.T) {
+	useTemplateBackend(t, testBackendTemplate)
+
+	newObject := func(class string, spec map[string]any) *unstructured.Unstructured {
+		obj := &unstructured.Unstructured{Object: map[string]any{"spec": spec}}
+		obj.SetAnnotations(map[string]string{constants.VrcValueAnnotation: class})
+		return obj
+	}
+	desired := newObject("gold", map[string]any{"volume": "test-pvc", "policy": "gold", "role": "source", "retention": int64(3)})
+
+	tests := []struct {
+		name     string
+		existing *unstructured.Unstructured
+		expected comparison
+	}{
+		{
+			name:     "Up to date with defaulted fields",
+			existing: newObject("gold", map[string]any{"volume": "test-pvc", "policy": "gold", "role": "source", "retention": int64(3), "interval": "5m"}),
+			expected: upToDate,
+		},
+		{
+			name:     "Unlisted field changed",
+			existing: newObject("gold", map[string]any{"volume": "test-pvc", "policy": "gold", "role": "source", "retention": int64(7)}),
+			expected: upToDate,
+		},
+		{
+			name:     "Update field changed",
+			existing: newObject("gold", map[string]any{"volume": "test-pvc", "policy": "gold", "role": "target"}),
+			expected: needsUpdate,
+		},
+		{
+			name:     "Recreate field changed",
+			existing: newObject("gold", map[string]any{"volume": "other-pvc", "policy": "gold", "role": "source"}),
+			expected: needsRecreate,
+		},
+		{
+			name:     "Class changed",
+			existing: newObject("silver", map[string]any{"volume": "test-pvc", "policy": "gold", "role": "source"}),
+			expected: needsRecreate,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.existing.SetNamespace("test-namespace")
+			tt.existing.SetName("test-pvc")
+			require.Equal(t, tt.expected, activeBackend.compare(tt.existing, desired))
+		})
+	}
+}
+
+func TestTemplateStatus(t *testing.T) {
+	useTemplateBackend(t, testBackendTemplate)
+
+	obj := &unstructured.Unstructured{Object: map[string]any{
+		"status": map[string]any{
+			"conditions": []any{map[string]any{"type": "Healthy", "status": "False", "message": "link down"}},
+		},
+	}}
+	healthy, message := activeBackend.status(obj)
+	require.False(t, healthy)
+	require.Equal(t, "link down", message)
+	require.Equal(t, [][]string{{"status", "conditions"}}, activeBackend.statusFields())
+}
+
+func TestCheckTemplateAPI(t *testing.T) {
+	useTemplateBackend(t, testBackendTemplate)
+
+	client := fake.NewClientset()
+	client.Discovery().(*fakediscovery.FakeDiscovery).Resources = []*metav1.APIResourceList{
+		{GroupVersion: "replication.vendor.io/v1", APIResources: []metav1.APIResource{{Name: "vendorreplications"}}},
+	}
+	k8s.ClientSet = client
+
+	// Only the version of the template can be written
+	require.Error(t, checkReplicationAPI(activeBackend.resource().GroupVersion()))
+
+	client.Discovery().(*fakediscovery.FakeDiscovery).Resources = append(client.Discovery().(*fakediscovery.FakeDiscovery).Resources,
+		&metav1.APIResourceList{GroupVersion: "replication.vendor.io/v1beta1", APIResources: []metav1.APIResource{{Name: "vendorreplications"}}})
+	require.NoError(t, checkReplicationAPI(activeBackend.resource().GroupVersion()))
+}
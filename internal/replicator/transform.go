@@ -0,0 +1,151 @@
+package replicator
+
+import (
+	"maps"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/super-phenix/volume-replicator/internal/constants"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// lastAppliedAnnotation is set by kubectl apply, it holds a full copy of the object and is never read by the controller
+const lastAppliedAnnotation = corev1.LastAppliedConfigAnnotation
+
+// transformPvc strips the fields of a PVC that are never read by the controller before it is cached.
+// The last applied configuration isn't propagated to VolumeReplications either, as it describes the PVC.
+func transformPvc(obj any) (any, error) {
+	pvc, ok := obj.(*corev1.PersistentVolumeClaim)
+	if !ok {
+		return obj, nil
+	}
+
+	pvc.ManagedFields = nil
+	delete(pvc.Annotations, lastAppliedAnnotation)
+	pvc.Status.Capacity = nil
+	pvc.Status.AllocatedResources = nil
+	pvc.Status.ModifyVolumeStatus = nil
+	return pvc, nil
+}
+
+// transformStorageClass strips the fields of a StorageClass that are never read by the controller before it is cached
+func transformStorageClass(obj any) (any, error) {
+	storageClass, ok := obj.(*storagev1.StorageClass)
+	if !ok {
+		return obj, nil
+	}
+
+	storageClass.ManagedFields = nil
+	delete(storageClass.Annotations, lastAppliedAnnotation)
+	return storageClass, nil
+}
+
+// transformPersistentVolume strips the fields of a PersistentVolume that are never read by the controller before it is cached.
+// Only the CSI driver of the volume is kept, as it is the provisioner of PVCs that don't have a provisioner annotation.
+func transformPersistentVolume(obj any) (any, error) {
+	pv, ok := obj.(*corev1.PersistentVolume)
+	if !ok {
+		return obj, nil
+	}
+
+	stripped := &corev1.PersistentVolume{ObjectMeta: metav1.ObjectMeta{
+		Name:            pv.Name,
+		UID:             pv.UID,
+		ResourceVersion: pv.ResourceVersion,
+	}}
+	if pv.Spec.CSI != nil {
+		stripped.Spec.CSI = &corev1.CSIPersistentVolumeSource{Driver: pv.Spec.CSI.Driver}
+	}
+	return stripped, nil
+}
+
+// transformNamespace strips the fields of a namespace that are never read by the controller before it is cached.
+// Labels are kept for namespace selectors, annotations are only read under the domains of the controller.
+func transformNamespace(obj any) (any, error) {
+	ns, ok := obj.(*corev1.Namespace)
+	if !ok {
+		return obj, nil
+	}
+
+	ns.ManagedFields = nil
+	maps.DeleteFunc(ns.Annotations, func(key string, _ string) bool {
+		return !slices.ContainsFunc(constants.Domains(), func(domain string) bool {
+			return strings.HasPrefix(key, domain+"/")
+		})
+	})
+	ns.Spec = corev1.NamespaceSpec{}
+	ns.Status = corev1.NamespaceStatus{}
+	return ns, nil
+}
+
+// transformVolumeReplication strips the fields of a VolumeReplication that are never read by the controller before it is cached.
+// Only the fields of the status read by the backend to report the health of the replication are kept.
+func transformVolumeReplication(obj any) (any, error) {
+	vr, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return obj, nil
+	}
+
+	vr.SetManagedFields(nil)
+	if annotations := vr.GetAnnotations(); annotations[lastAppliedAnnotation] != "" {
+		delete(annotations, lastAppliedAnnotation)
+		vr.SetAnnotations(annotations)
+	}
+
+	status := make(map[string]any)
+	for _, field := range activeBackend.statusFields() {
+		if value, found, _ := unstructured.NestedFieldNoCopy(vr.Object, field...); found {
+			_ = unstructured.SetNestedField(status, value, field[1:]...)
+		}
+	}
+	if len(status) > 0 {
+		vr.Object["status"] = status
+	} else {
+		unstructured.RemoveNestedField(vr.Object, "status")
+	}
+	return vr, nil
+}
+
+// transformVolumeGroupReplication strips the fields of a VolumeGroupReplication that are never read by the controller before it is cached.
+// Only the PVCs replicated by the group are kept from the status, as member VolumeReplications are deleted once listed.
+func transformVolumeGroupReplication(obj any) (any, error) {
+	vgr, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return obj, nil
+	}
+
+	vgr.SetManagedFields(nil)
+	if annotations := vgr.GetAnnotations(); annotations[lastAppliedAnnotation] != "" {
+		delete(annotations, lastAppliedAnnotation)
+		vgr.SetAnnotations(annotations)
+	}
+
+	if refs, found, _ := unstructured.NestedFieldNoCopy(vgr.Object, "status", "persistentVolumeClaimsRefList"); found {
+		vgr.Object["status"] = map[string]any{"persistentVolumeClaimsRefList": refs}
+	} else {
+		unstructured.RemoveNestedField(vgr.Object, "status")
+	}
+	return vgr, nil
+}
+
+// pvcChanged returns whether an update of a PVC can change its VolumeReplication.
+// Periodic resyncs are always handled, other updates only when a field read by the controller changed,
+// so that status and managedFields churn doesn't trigger reconciliations.
+func pvcChanged(oldPvc, pvc *corev1.PersistentVolumeClaim) bool {
+	if oldPvc.ResourceVersion == pvc.ResourceVersion {
+		return true
+	}
+
+	return !maps.Equal(oldPvc.Labels, pvc.Labels) ||
+		!maps.Equal(oldPvc.Annotations, pvc.Annotations) ||
+		!oldPvc.DeletionTimestamp.Equal(pvc.DeletionTimestamp) ||
+		!reflect.DeepEqual(oldPvc.OwnerReferences, pvc.OwnerReferences) ||
+		!reflect.DeepEqual(oldPvc.Spec, pvc.Spec) ||
+		oldPvc.Status.Phase != pvc.Status.Phase ||
+		!reflect.DeepEqual(oldPvc.Status.Conditions, pvc.Status.Conditions) ||
+		!maps.Equal(oldPvc.Status.AllocatedResourceStatuses, pvc.Status.AllocatedResourceStatuses)
+}
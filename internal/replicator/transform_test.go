@@ -0,0 +1,345 @@
+package replicator
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/super-phenix/volume-replicator/internal/constants"
+	"github.com/super-phenix/volume-replicator/internal/k8s"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	k8sruntime "k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/utils/ptr"
+)
+
+// benchmarkPvcs is the number of PVCs cached and updated by the benchmarks
+const benchmarkPvcs = 100_000
+
+// newBenchmarkPvc returns a PVC with the managedFields, last applied configuration and status of a typical PVC
+func newBenchmarkPvc(i int) *corev1.PersistentVolumeClaim {
+	stcName := "fast"
+	fields := fmt.Sprintf(`{"f:metadata":{"f:annotations":{"f:%s":{}},"f:labels":{"f:app":{}}},"f:spec":{"f:accessModes":{},"f:resources":{"f:requests":{"f:storage":{}}},"f:storageClassName":{}}}`, constants.VrcValueAnnotation)
+
+	return &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            fmt.Sprintf("pvc-%d", i),
+			Namespace:       fmt.Sprintf("namespace-%d", i%100),
+			ResourceVersion: "1",
+			Labels:          map[string]string{"app": "database"},
+			Annotations: map[string]string{
+				constants.VrcValueAnnotation: "gold",
+				lastAppliedAnnotation:        strings.Repeat("x", 512),
+			},
+			ManagedFields: []metav1.ManagedFieldsEntry{
+				{Manager: "kubectl", Operation: metav1.ManagedFieldsOperationApply, FieldsType: "FieldsV1", FieldsV1: &metav1.FieldsV1{Raw: []byte(fields)}},
+				{Manager: "kube-controller-manager", Operation: metav1.ManagedFieldsOperationUpdate, Subresource: "status", FieldsType: "FieldsV1", FieldsV1: &metav1.FieldsV1{Raw: []byte(`{"f:status":{"f:accessModes":{},"f:capacity":{"f:storage":{}},"f:phase":{}}}`)}},
+			},
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			StorageClassName: &stcName,
+			AccessModes:      []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+			Resources:        corev1.VolumeResourceRequirements{Requests: corev1.ResourceList{corev1.ResourceStorage: resource.MustParse("10Gi")}},
+			VolumeName:       fmt.Sprintf("pv-%d", i),
+		},
+		Status: corev1.PersistentVolumeClaimStatus{
+			Phase:       corev1.ClaimBound,
+			AccessModes: []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+			Capacity:    corev1.ResourceList{corev1.ResourceStorage: resource.MustParse("10Gi")},
+		},
+	}
+}
+
+func TestTransformPvc(t *testing.T) {
+	pvc := newBenchmarkPvc(0)
+	obj, err := transformPvc(pvc)
+	require.NoError(t, err)
+
+	transformed := obj.(*corev1.PersistentVolumeClaim)
+	require.Empty(t, transformed.ManagedFields)
+	require.Nil(t, transformed.Status.Capacity)
+	require.Equal(t, map[string]string{constants.VrcValueAnnotation: "gold"}, transformed.Annotations)
+	require.Equal(t, corev1.ClaimBound, transformed.Status.Phase)
+	require.Equal(t, "10Gi", transformed.Spec.Resources.Requests.Storage().String())
+
+	// Tombstones are left untouched
+	tombstone := cache.DeletedFinalStateUnknown{Key: "test-namespace/test-pvc"}
+	obj, err = transformPvc(tombstone)
+	require.NoError(t, err)
+	require.Equal(t, tombstone, obj)
+}
+
+func TestTransformNamespace(t *testing.T) {
+	constants.SetDomain(constants.DefaultDomain, []string{"example.com"})
+	defer constants.SetDomain(constants.DefaultDomain, nil)
+
+	obj, err := transformNamespace(&corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   "test-namespace",
+			Labels: map[string]string{"tier": "gold"},
+			Annotations: map[string]string{
+				constants.VrcValueAnnotation:         "gold",
+				"example.com/volumeReplicationClass": "silver",
+				"openshift.io/sa.scc.uid-range":      "1000/10000",
+				lastAppliedAnnotation:                "{}",
+			},
+			ManagedFields: []metav1.ManagedFieldsEntry{{Manager: "kubectl"}},
+		},
+		Spec: corev1.NamespaceSpec{Finalizers: []corev1.FinalizerName{corev1.FinalizerKubernetes}},
+	})
+	require.NoError(t, err)
+
+	ns := obj.(*corev1.Namespace)
+	require.Empty(t, ns.ManagedFields)
+	require.Empty(t, ns.Spec.Finalizers)
+	require.Equal(t, map[string]string{"tier": "gold"}, ns.Labels)
+	require.Equal(t, map[string]string{
+		constants.VrcValueAnnotation:         "gold",
+		"example.com/volumeReplicationClass": "silver",
+	}, ns.Annotations)
+}
+
+func TestTransformVolumeReplication(t *testing.T) {
+	vr := &unstructured.Unstructured{Object: map[string]any{
+		"metadata": map[string]any{
+			"name":          "test-pvc",
+			"annotations":   map[string]any{lastAppliedAnnotation: "{}", "team": "storage"},
+			"managedFields": []any{map[string]any{"manager": constants.ComponentName}},
+		},
+		"spec":   map[string]any{"volumeReplicationClass": "gold"},
+		"status": map[string]any{"state": "Primary"},
+	}}
+
+	obj, err := transformVolumeReplication(vr)
+	require.NoError(t, err)
+
+	transformed := obj.(*unstructured.Unstructured)
+	require.Empty(t, transformed.GetManagedFields())
+	require.Equal(t, map[string]string{"team": "storage"}, transformed.GetAnnotations())
+	require.NotContains(t, transformed.Object, "status")
+	require.Equal(t, map[string]any{"volumeReplicationClass": "gold"}, transformed.Object["spec"])
+}
+
+func TestTransformVolumeReplicationStatus(t *testing.T) {
+	conditions := []any{map[string]any{"type": "Degraded", "status": "True", "message": "peer unreachable"}}
+	vr := &unstructured.Unstructured{Object: map[string]any{
+		"metadata": map[string]any{"name": "test-pvc"},
+		"status":   map[string]any{"state": "Primary", "lastSyncTime": "2026-10-18T00:00:00Z", "conditions": conditions},
+	}}
+
+	obj, err := transformVolumeReplication(vr)
+	require.NoError(t, err)
+
+	// Only the conditions are read to report the health of the replication
+	transformed := obj.(*unstructured.Unstructured)
+	require.Equal(t, map[string]any{"conditions": conditions}, transformed.Object["status"])
+	healthy, message := activeBackend.status(transformed)
+	require.False(t, healthy)
+	require.Equal(t, "peer unreachable", message)
+}
+
+func TestTransformVolumeGroupReplication(t *testing.T) {
+	refs := []any{map[string]any{"name": "data"}}
+	vgr := &unstructured.Unstructured{Object: map[string]any{
+		"metadata": map[string]any{
+			"name":          "database",
+			"managedFields": []any{map[string]any{"manager": constants.ComponentName}},
+		},
+		"spec":   map[string]any{"volumeGroupReplicationClassName": "gold-group"},
+		"status": map[string]any{"state": "Primary", "persistentVolumeClaimsRefList": refs},
+	}}
+
+	obj, err := transformVolumeGroupReplication(vgr)
+	require.NoError(t, err)
+
+	// Only the replicated PVCs are read, to delete their own VolumeReplications
+	transformed := obj.(*unstructured.Unstructured)
+	require.Empty(t, transformed.GetManagedFields())
+	require.Equal(t, map[string]any{"persistentVolumeClaimsRefList": refs}, transformed.Object["status"])
+	require.Equal(t, map[string]any{"volumeGroupReplicationClassName": "gold-group"}, transformed.Object["spec"])
+}
+
+func TestPvcChanged(t *testing.T) {
+	tests := []struct {
+		name     string
+		update   func(pvc *corev1.PersistentVolumeClaim)
+		expected bool
+	}{
+		{
+			name:     "Resync",
+			update:   func(pvc *corev1.PersistentVolumeClaim) {},
+			expected: true,
+		},
+		{
+			name: "ManagedFields only",
+			update: func(pvc *corev1.PersistentVolumeClaim) {
+				pvc.ResourceVersion = "2"
+				pvc.ManagedFields = nil
+			},
+			expected: false,
+		},
+		{
+			name: "Capacity only",
+			update: func(pvc *corev1.PersistentVolumeClaim) {
+				pvc.ResourceVersion = "2"
+				pvc.Status.Capacity = corev1.ResourceList{corev1.ResourceStorage: resource.MustParse("20Gi")}
+			},
+			expected: false,
+		},
+		{
+			name: "Annotation",
+			update: func(pvc *corev1.PersistentVolumeClaim) {
+				pvc.ResourceVersion = "2"
+				pvc.Annotations[constants.VrcValueAnnotation] = "silver"
+			},
+			expected: true,
+		},
+		{
+			name: "Label",
+			update: func(pvc *corev1.PersistentVolumeClaim) {
+				pvc.ResourceVersion = "2"
+				pvc.Labels["app"] = "cache"
+			},
+			expected: true,
+		},
+		{
+			name: "Phase",
+			update: func(pvc *corev1.PersistentVolumeClaim) {
+				pvc.ResourceVersion = "2"
+				pvc.Status.Phase = corev1.ClaimLost
+			},
+			expected: true,
+		},
+		{
+			name: "Resizing",
+			update: func(pvc *corev1.PersistentVolumeClaim) {
+				pvc.ResourceVersion = "2"
+				pvc.Status.Conditions = []corev1.PersistentVolumeClaimCondition{{Type: corev1.PersistentVolumeClaimResizing, Status: corev1.ConditionTrue}}
+			},
+			expected: true,
+		},
+		{
+			name: "VolumeAttributesClass",
+			update: func(pvc *corev1.PersistentVolumeClaim) {
+				pvc.ResourceVersion = "2"
+				pvc.Spec.VolumeAttributesClassName = ptr.To("gold")
+			},
+			expected: true,
+		},
+		{
+			name: "Deletion",
+			update: func(pvc *corev1.PersistentVolumeClaim) {
+				pvc.ResourceVersion = "2"
+				pvc.DeletionTimestamp = &metav1.Time{}
+			},
+			expected: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			oldPvc := newBenchmarkPvc(0)
+			pvc := oldPvc.DeepCopy()
+			tt.update(pvc)
+			require.Equal(t, tt.expected, pvcChanged(oldPvc, pvc))
+		})
+	}
+}
+
+// BenchmarkPvcInformer measures the time and memory needed to cache PVCs, with and without transform
+func BenchmarkPvcInformer(b *testing.B) {
+	objects := make([]k8sruntime.Object, benchmarkPvcs)
+	for i := range objects {
+		objects[i] = newBenchmarkPvc(i)
+	}
+	client := fake.NewClientset(objects...)
+
+	for _, transform := range []bool{false, true} {
+		b.Run(fmt.Sprintf("transform=%t", transform), func(b *testing.B) {
+			for b.Loop() {
+				factory := informers.NewSharedInformerFactory(client, 0)
+				informer := factory.Core().V1().PersistentVolumeClaims().Informer()
+				if transform {
+					require.NoError(b, informer.SetTransform(transformPvc))
+				}
+
+				var before, after runtime.MemStats
+				runtime.GC()
+				runtime.ReadMemStats(&before)
+
+				stop := make(chan struct{})
+				factory.Start(stop)
+				factory.WaitForCacheSync(stop)
+
+				runtime.GC()
+				runtime.ReadMemStats(&after)
+				require.Len(b, informer.GetStore().ListKeys(), benchmarkPvcs)
+				b.ReportMetric(float64(after.HeapAlloc-before.HeapAlloc)/benchmarkPvcs, "heap-B/pvc")
+
+				close(stop)
+				factory.Shutdown()
+			}
+		})
+	}
+}
+
+// BenchmarkPvcUpdates measures the reconciliations caused by status-only updates of every PVC,
+// when every update is enqueued and when only relevant updates are
+func BenchmarkPvcUpdates(b *testing.B) {
+	dynamicClient := dynamicfake.NewSimpleDynamicClient(k8sruntime.NewScheme())
+	k8s.DynamicClientSet = dynamicClient
+	k8s.ClientSet = fake.NewClientset()
+
+	informerFactory := informers.NewSharedInformerFactory(k8s.ClientSet, 0)
+	PvcInformer = informerFactory.Core().V1().PersistentVolumeClaims()
+	NamespaceInformer = informerFactory.Core().V1().Namespaces()
+	VolumeReplicationInformer = dynamicinformer.NewDynamicSharedInformerFactory(dynamicClient, 0).ForResource(VolumeReplicationResource)
+	require.NoError(b, VolumeReplicationInformer.Informer().AddIndexers(volumeReplicationIndexers))
+
+	oldPvcs := make([]*corev1.PersistentVolumeClaim, benchmarkPvcs)
+	pvcs := make([]*corev1.PersistentVolumeClaim, benchmarkPvcs)
+	for i := range benchmarkPvcs {
+		oldPvcs[i] = newBenchmarkPvc(i)
+		pvcs[i] = oldPvcs[i].DeepCopy()
+		pvcs[i].ResourceVersion = "2"
+		pvcs[i].Status.Capacity = corev1.ResourceList{corev1.ResourceStorage: resource.MustParse("20Gi")}
+		require.NoError(b, PvcInformer.Informer().GetIndexer().Add(pvcs[i]))
+		require.NoError(b, NamespaceInformer.Informer().GetIndexer().Add(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: pvcs[i].Namespace}}))
+	}
+
+	for _, predicate := range []bool{false, true} {
+		b.Run(fmt.Sprintf("predicate=%t", predicate), func(b *testing.B) {
+			for b.Loop() {
+				controller := NewController()
+				queue := workqueue.NewTypedRateLimitingQueue(workqueue.DefaultTypedControllerRateLimiter[string]())
+				controller.setQueue(queue)
+
+				for i := range benchmarkPvcs {
+					if predicate {
+						controller.pvcUpdate(oldPvcs[i], pvcs[i])
+					} else {
+						// Every update was enqueued before predicates were introduced
+						controller.enqueue(pvcs[i].Namespace + "/" + pvcs[i].Name)
+					}
+				}
+
+				reconciled := queue.Len()
+				for queue.Len() > 0 {
+					controller.processNextItem(b.Context(), b.Context(), queue)
+				}
+				queue.ShutDown()
+				b.ReportMetric(float64(reconciled), "reconciles/op")
+			}
+		})
+	}
+}
@@ -5,66 +5,87 @@ import (
 	"fmt"
 	"maps"
 	"regexp"
+	"slices"
+	"sync"
+	"time"
 
 	"github.com/super-phenix/volume-replicator/internal/constants"
 	"github.com/super-phenix/volume-replicator/internal/k8s"
 	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/retry"
 	"k8s.io/klog/v2"
 )
 
-var ExclusionRegex *regexp.Regexp
+const (
+	// fieldManager is the field manager used to server-side apply VolumeReplications
+	fieldManager = constants.ComponentName
 
-// isVolumeReplicationCorrect verifies if the definition of a VolumeReplication conforms to its originating PVC
-func isVolumeReplicationCorrect(pvc *corev1.PersistentVolumeClaim, vr *unstructured.Unstructured) bool {
-	key := fmt.Sprintf("%s/%s", vr.GetNamespace(), vr.GetName())
+	provisionerSourceAnnotation       = "annotation"
+	provisionerSourcePersistentVolume = "PersistentVolume"
+	provisionerSourceStorageClass     = "StorageClass"
+)
 
-	// Check that the VRC correspond to the one inherited from the PVC
-	replicationClass, _, _ := unstructured.NestedString(vr.Object, "spec", "volumeReplicationClass")
-	if getVolumeReplicationClass(pvc) != replicationClass {
-		klog.Infof("VolumeReplication %s has a replication class mismatch with its parent (got %s)", key, replicationClass)
-		return false
-	}
+var (
+	ExclusionRegex *regexp.Regexp
+
+	// provisionerFallbacks is the provisioner of each PVC taken from its PersistentVolume or StorageClass, with where it was found
+	provisionerFallbacks     = make(map[string]string)
+	provisionerFallbacksLock sync.Mutex
+
+	// WaitForBound delays the creation of VolumeReplications until their PVC is Bound
+	WaitForBound bool
+	// BindTimeout is how long a PVC can stay Pending before a warning is raised, zero disables the warning
+	BindTimeout time.Duration
+	// StrictProvisioner refuses to select a VolumeReplicationClass for PVCs whose provisioner is unknown
+	StrictProvisioner bool
+	// WaitForStable delays the creation of VolumeReplications while their PVC is being resized or is Lost
+	WaitForStable bool
+	// APITimeout bounds the duration of every call to the API server, zero disables it
+	APITimeout = 30 * time.Second
+)
 
-	// Check that the dataSource points to the PVC
-	dataSource, _, _ := unstructured.NestedNullCoercingStringMap(vr.Object, "spec", "dataSource")
-	if dataSource["apiGroup"] != "v1" || dataSource["kind"] != "PersistentVolumeClaim" || dataSource["name"] != pvc.Name {
-		klog.Infof("VolumeReplication %s has a dataSource mismatch with its parent", key)
-		return false
+// withAPITimeout returns a context bounded by the API timeout, to use for a single call to the API server
+func withAPITimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if APITimeout <= 0 {
+		return context.WithCancel(ctx)
 	}
-
-	return true
+	return context.WithTimeout(ctx, APITimeout)
 }
 
-// cleanupVolumeReplication deletes the VolumeReplication associated with a PVC
-func cleanupVolumeReplication(name, namespace string) {
-	vrNsClientSet := k8s.DynamicClientSet.Resource(VolumeReplicationResource).Namespace(namespace)
+// cleanupVolumeReplication deletes the replication object associated with a PVC
+func cleanupVolumeReplication(ctx context.Context, name, namespace string) {
+	vrNsClientSet := k8s.DynamicClientSet.Resource(activeBackend.resource()).Namespace(namespace)
 
 	// Try to delete the VR, dismiss any error if it simply never existed in the first place
-	err := vrNsClientSet.Delete(context.Background(), name, metav1.DeleteOptions{})
+	callCtx, cancel := withAPITimeout(ctx)
+	defer cancel()
+	err := vrNsClientSet.Delete(callCtx, name, metav1.DeleteOptions{})
 	if err != nil && !errors.IsNotFound(err) {
-		klog.Errorf("couldn't delete VolumeReplication for PVC %s/%s", namespace, name)
+		klog.Errorf("couldn't delete %s for PVC %s/%s", activeBackend.kind(), namespace, name)
 	}
 }
 
-// updateVolumeReplication updates the replicationState of a VolumeReplication
-func updateVolumeReplication(pvc *corev1.PersistentVolumeClaim, vr *unstructured.Unstructured) error {
-	// Update the replicationState
-	err := unstructured.SetNestedField(vr.Object, getReplicationState(pvc), "spec", "replicationState")
-	if err != nil {
-		return err
+// cleanupVolumeReplications deletes replication objects of a PVC
+func cleanupVolumeReplications(ctx context.Context, volumeReplications []*unstructured.Unstructured) {
+	for _, vr := range volumeReplications {
+		cleanupVolumeReplication(ctx, vr.GetName(), vr.GetNamespace())
 	}
-
-	resourceInterface := k8s.DynamicClientSet.Resource(VolumeReplicationResource).Namespace(pvc.Namespace)
-	_, err = resourceInterface.Update(context.Background(), vr, metav1.UpdateOptions{})
-	return err
 }
 
 // getPersistentVolumeClaim returns a PersistentVolumeClaim from its key
 func getPersistentVolumeClaim(key string) (*corev1.PersistentVolumeClaim, error) {
-	pvc, exists, err := PvcInformer.Informer().GetIndexer().GetByKey(key)
+	namespace, _, _ := cache.SplitMetaNamespaceKey(key)
+	indexer := getPvcIndexer(namespace)
+	if indexer == nil {
+		return nil, fmt.Errorf("PVC %s isn't cached by this replica", key)
+	}
+
+	pvc, exists, err := indexer.GetByKey(key)
 	if err != nil && !errors.IsNotFound(err) {
 		return nil, fmt.Errorf("failed to retrieve PVC %s: %s", key, err.Error())
 	}
@@ -76,16 +97,77 @@ func getPersistentVolumeClaim(key string) (*corev1.PersistentVolumeClaim, error)
 	return pvc.(*corev1.PersistentVolumeClaim), nil
 }
 
-// createVolumeReplication creates the corresponding VolumeReplication for a given PVC.
-// The VolumeReplication inherits the same name and metadata (labels, annotations) as the PVC.
-func createVolumeReplication(pvc *corev1.PersistentVolumeClaim) error {
-	// Create an unstructured VolumeReplication with the same name and same metadata as the PVC
-	volumeReplication := &unstructured.Unstructured{}
+// applyVolumeReplication creates or updates the replication object of a PVC, as built by the active backend.
+// It is server-side applied, so that the controller only owns the fields it sets, and other tools
+// (e.g. CSI-addons sidecars) can safely own other fields of the same object.
+// Ownership of the fields set by the controller is forced, so that objects written through Create/Update by earlier
+// versions of the controller, or handed over to a PVC, are taken over. Conflicts left after the retries are reported on the PVC.
+func applyVolumeReplication(ctx context.Context, pvc *corev1.PersistentVolumeClaim, desired *unstructured.Unstructured) error {
+	// Apply the replication object in the same namespace where the PVC is
+	resourceInterface := k8s.DynamicClientSet.Resource(activeBackend.resource()).Namespace(desired.GetNamespace())
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		callCtx, cancel := withAPITimeout(ctx)
+		defer cancel()
+		_, err := resourceInterface.Apply(callCtx, desired.GetName(), desired, metav1.ApplyOptions{
+			FieldManager: fieldManager,
+			Force:        true,
+		})
+		return err
+	})
+	if errors.IsConflict(err) {
+		recordEvent(pvc, corev1.EventTypeWarning, reasonFieldConflict, "%s %s couldn't be applied: %s", activeBackend.kind(), desired.GetName(), err.Error())
+	}
+	return err
+}
 
-	annotations := make(map[string]any)
+// stateAnnotations returns the annotations in which the controller keeps the state of a PVC
+func stateAnnotations() []string {
+	return []string{
+		constants.PendingClassChangeAnnotation,
+		constants.ApproveClassChangeAnnotation,
+		constants.RecreateSnapshotAnnotation,
+		constants.RecreateSnapshotErrorAnnotation,
+		constants.RecreateHistoryAnnotation,
+		constants.FrozenAnnotation,
+		constants.ConflictAnnotation,
+		constants.BindTimeoutAnnotation,
+		constants.ExclusionAnnotation,
+		constants.ClassResolutionAnnotation,
+		constants.GroupBlockedAnnotation,
+	}
+}
+
+// getPropagatedAnnotations returns the annotations of a PVC that are propagated to its replication objects.
+// The annotations in which the controller keeps the state of the PVC are left out, under any domain,
+// as they would make the replication objects change along with the bookkeeping of the controller.
+func getPropagatedAnnotations(pvc *corev1.PersistentVolumeClaim) map[string]any {
+	state := stateAnnotations()
+	annotations := make(map[string]any, len(pvc.Annotations))
 	for k, v := range pvc.Annotations {
+		key := k
+		if canonical, ok := constants.Canonical(k); ok {
+			key = canonical
+		}
+		if slices.Contains(state, key) {
+			continue
+		}
 		annotations[k] = v
 	}
+	return annotations
+}
+
+// buildVolumeReplication returns the fields of the VolumeReplication owned by the controller for the first target of a PVC and a VRC
+func buildVolumeReplication(pvc *corev1.PersistentVolumeClaim, replicationClass string) *unstructured.Unstructured {
+	return buildTargetVolumeReplication(pvc, getReplicationTargets(pvc)[0], replicationClass)
+}
+
+// buildTargetVolumeReplication returns the fields of the VolumeReplication owned by the controller for a target of a PVC and a VRC.
+// The VolumeReplication is named after the target, and inherits the metadata (labels, annotations) of the PVC.
+// Fields that are omitted here are released by the controller on the next apply, so every owned field must be set.
+func buildTargetVolumeReplication(pvc *corev1.PersistentVolumeClaim, target replicationTarget, replicationClass string) *unstructured.Unstructured {
+	volumeReplication := &unstructured.Unstructured{}
+
+	annotations := getPropagatedAnnotations(pvc)
 
 	labels := make(map[string]any)
 	for k, v := range getLabelsWithParent(pvc.Labels, pvc.Name) {
@@ -96,14 +178,14 @@ func createVolumeReplication(pvc *corev1.PersistentVolumeClaim) error {
 		"apiVersion": fmt.Sprintf("%s/%s", VolumeReplicationResource.Group, VolumeReplicationResource.Version),
 		"kind":       "VolumeReplication",
 		"metadata": map[string]any{
-			"name":        pvc.Name,
+			"name":        target.name,
 			"namespace":   pvc.Namespace,
 			"annotations": annotations,
 			"labels":      labels,
 		},
 		"spec": map[string]any{
-			"volumeReplicationClass": getVolumeReplicationClass(pvc),
-			"replicationState":       getReplicationState(pvc),
+			"volumeReplicationClass": replicationClass,
+			"replicationState":       target.state,
 			"dataSource": map[string]any{
 				"apiGroup": "v1",
 				"kind":     "PersistentVolumeClaim",
@@ -112,27 +194,53 @@ func createVolumeReplication(pvc *corev1.PersistentVolumeClaim) error {
 		},
 	})
 
-	// Create the VolumeReplication in the same namespace where the PVC is
-	resourceInterface := k8s.DynamicClientSet.Resource(VolumeReplicationResource).Namespace(pvc.Namespace)
-	_, err := resourceInterface.Create(context.Background(), volumeReplication, metav1.CreateOptions{})
-	return err
+	return volumeReplication
 }
 
-// getVolumeReplication returns the VolumeReplication associated with a PVC
+// getVolumeReplications returns the replication objects of the targets of a PVC, found through their parent label.
+// The objects are shared with the informer cache, they must be deep-copied before being mutated.
+func getVolumeReplications(key string) ([]*unstructured.Unstructured, error) {
+	namespace, _, _ := cache.SplitMetaNamespaceKey(key)
+	indexer := getVolumeReplicationIndexer(namespace)
+	if indexer == nil {
+		return nil, fmt.Errorf("VolumeReplications of PVC %s aren't cached by this replica", key)
+	}
+
+	objs, err := indexer.ByIndex(parentIndex, key)
+	if err != nil {
+		return nil, err
+	}
+
+	volumeReplications := make([]*unstructured.Unstructured, 0, len(objs))
+	for _, obj := range objs {
+		volumeReplications = append(volumeReplications, obj.(*unstructured.Unstructured))
+	}
+	return volumeReplications, nil
+}
+
+// getVolumeReplication returns a replication object from its key, whoever owns it.
+// The object is shared with the informer cache, it must be deep-copied before being mutated.
 func getVolumeReplication(key string) (*unstructured.Unstructured, error) {
-	obj, exists, err := VolumeReplicationInformer.Informer().GetIndexer().GetByKey(key)
+	namespace, _, _ := cache.SplitMetaNamespaceKey(key)
+	indexer := getVolumeReplicationIndexer(namespace)
+	if indexer == nil {
+		return nil, fmt.Errorf("VolumeReplication %s isn't cached by this replica", key)
+	}
+
+	obj, exists, err := indexer.GetByKey(key)
 	if err != nil {
 		return nil, err
 	}
 	if !exists {
-		return nil, errors.NewNotFound(VolumeReplicationResource.GroupResource(), key)
+		return nil, errors.NewNotFound(activeBackend.resource().GroupResource(), key)
 	}
 	return obj.(*unstructured.Unstructured), nil
 }
 
-// isParentLabelPresent returns whether a parent label is present on a VolumeReplication
+// isParentLabelPresent returns whether a parent label is present on a VolumeReplication,
+// and whether the VolumeReplication is stamped with the name of our instance
 func isParentLabelPresent(labels map[string]string) bool {
-	return labels[constants.ParentLabel] != ""
+	return getKeyValue(labels, constants.ParentLabel) != "" && getKeyValue(labels, constants.InstanceLabel) == InstanceName
 }
 
 // getLabelsWithParent returns a new map of labels for a VolumeReplication with its parent PVC embedded.
@@ -143,20 +251,53 @@ func getLabelsWithParent(pvcLabels map[string]string, parent string) map[string]
 		res = make(map[string]string)
 	}
 	res[constants.ParentLabel] = parent
+
+	// Stamp the VolumeReplication with our instance, so that other instances leave it alone
+	delete(res, constants.InstanceLabel)
+	if InstanceName != "" {
+		res[constants.InstanceLabel] = InstanceName
+	}
 	return res
 }
 
-// getStorageClassLabels returns the labels of a StorageClass
-func getStorageClassLabels(pvc *corev1.PersistentVolumeClaim) (map[string]string, error) {
+// getStorageClass returns the StorageClass of a PVC, or nil if the PVC doesn't have any
+func getStorageClass(ctx context.Context, pvc *corev1.PersistentVolumeClaim) (*storagev1.StorageClass, error) {
 	// If the PVC doesn't have a storageClass, we can't do much more
 	if pvc.Spec.StorageClassName == nil {
 		return nil, nil
 	}
 
-	// Retrieve the StorageClass associated with this PVC
+	// Fallback to the config when StorageClasses can't be read
+	if !isReadable(resourceStorageClasses) {
+		return getFallbackStorageClass(*pvc.Spec.StorageClassName)
+	}
+
+	// Retrieve the StorageClass associated with this PVC, from the cache when StorageClasses are watched
+	if StorageClassInformer != nil {
+		return StorageClassInformer.Lister().Get(*pvc.Spec.StorageClassName)
+	}
 	stcGetter := k8s.ClientSet.StorageV1().StorageClasses()
-	storageClass, err := stcGetter.Get(context.Background(), *pvc.Spec.StorageClassName, metav1.GetOptions{})
-	if err != nil {
+	callCtx, cancel := withAPITimeout(ctx)
+	defer cancel()
+	storageClass, err := stcGetter.Get(callCtx, *pvc.Spec.StorageClassName, metav1.GetOptions{})
+	if isForbidden(resourceStorageClasses, err) {
+		return getFallbackStorageClass(*pvc.Spec.StorageClassName)
+	}
+	return storageClass, err
+}
+
+// getFallbackStorageClass returns a StorageClass from the fallback config, or an error if it isn't described
+func getFallbackStorageClass(name string) (*storagev1.StorageClass, error) {
+	if storageClass := Fallback.getStorageClass(name); storageClass != nil {
+		return storageClass, nil
+	}
+	return nil, fmt.Errorf("StorageClass %s can't be read and isn't described in the fallback config", name)
+}
+
+// getStorageClassLabels returns the labels of a StorageClass
+func getStorageClassLabels(ctx context.Context, pvc *corev1.PersistentVolumeClaim) (map[string]string, error) {
+	storageClass, err := getStorageClass(ctx, pvc)
+	if err != nil || storageClass == nil {
 		return nil, err
 	}
 
@@ -164,26 +305,135 @@ func getStorageClassLabels(pvc *corev1.PersistentVolumeClaim) (map[string]string
 }
 
 // getStorageClassGroup returns the StorageClass group of a PVC
-func getStorageClassGroup(pvc *corev1.PersistentVolumeClaim) (string, error) {
+func getStorageClassGroup(ctx context.Context, pvc *corev1.PersistentVolumeClaim) (string, error) {
 	// Retrieve the labels on the StorageClass of that PVC
-	stcLabels, err := getStorageClassLabels(pvc)
+	stcLabels, err := getStorageClassLabels(ctx, pvc)
 	if err != nil {
 		return "", err
 	}
 
 	// Retrieve the group of VolumeReplicationClasses associated with this StorageClass
-	return stcLabels[constants.StorageClassGroup], nil
+	return getKeyValue(stcLabels, constants.StorageClassGroup), nil
 }
 
-// getPvcProvisioner returns the dynamic provisioner used to provision a PVC
-func getPvcProvisioner(pvc *corev1.PersistentVolumeClaim) string {
+// getVolumeAttributesClassName returns the VolumeAttributesClass requested by a PVC, or an empty string if none is
+func getVolumeAttributesClassName(pvc *corev1.PersistentVolumeClaim) string {
+	if pvc.Spec.VolumeAttributesClassName == nil {
+		return ""
+	}
+	return *pvc.Spec.VolumeAttributesClassName
+}
+
+// provisionerKey is the key of the provisioner of the reconciled PVC in the context of a reconciliation
+type provisionerKey struct{}
+
+// pvcProvisioner is the provisioner of a PVC, resolved at most once per reconciliation
+type pvcProvisioner struct {
+	pvc         string
+	once        sync.Once
+	provisioner string
+	source      string
+}
+
+// withPvcProvisioner returns a context in which the provisioner of a PVC is resolved at most once, the first time
+// it is needed by the reconciliation of the PVC. A fallback to the PersistentVolume or the StorageClass of the PVC
+// is reported when it changes.
+func withPvcProvisioner(ctx context.Context, pvc *corev1.PersistentVolumeClaim) context.Context {
+	return context.WithValue(ctx, provisionerKey{}, &pvcProvisioner{pvc: pvc.Namespace + "/" + pvc.Name})
+}
+
+// getPvcProvisioner returns the provisioner of a PVC and where it was found,
+// as resolved for the reconciliation of the PVC when there is one.
+func getPvcProvisioner(ctx context.Context, pvc *corev1.PersistentVolumeClaim) (string, string) {
+	resolved, ok := ctx.Value(provisionerKey{}).(*pvcProvisioner)
+	if !ok || resolved.pvc != pvc.Namespace+"/"+pvc.Name {
+		return resolvePvcProvisioner(ctx, pvc)
+	}
+
+	resolved.once.Do(func() {
+		resolved.provisioner, resolved.source = resolvePvcProvisioner(ctx, pvc)
+		reportProvisionerFallback(pvc, resolved.provisioner, resolved.source)
+	})
+	return resolved.provisioner, resolved.source
+}
+
+// resolvePvcProvisioner returns the provisioner of a PVC and where it was found.
+// The provisioner annotations are tried first, as they are set on dynamically provisioned PVCs.
+// Statically provisioned or imported volumes don't have them, so we fall back to the CSI driver
+// of the bound PersistentVolume, and then to the provisioner of the StorageClass.
+// An empty provisioner is returned if none of them is known.
+func resolvePvcProvisioner(ctx context.Context, pvc *corev1.PersistentVolumeClaim) (string, string) {
 	// Try the well-known annotation first
 	if pvc.Annotations[constants.StorageProvisionerAnnotation] != "" {
-		return pvc.Annotations[constants.StorageProvisionerAnnotation]
+		return pvc.Annotations[constants.StorageProvisionerAnnotation], provisionerSourceAnnotation
 	}
 
 	// Fallback to the deprecated annotation
-	return pvc.Annotations[constants.DeprecatedStorageProvisionerAnnotation]
+	if pvc.Annotations[constants.DeprecatedStorageProvisionerAnnotation] != "" {
+		return pvc.Annotations[constants.DeprecatedStorageProvisionerAnnotation], provisionerSourceAnnotation
+	}
+
+	// Fallback to the CSI driver of the PersistentVolume bound to the PVC
+	if pvc.Spec.VolumeName != "" && isReadable(resourcePersistentVolumes) {
+		pv, err := getPersistentVolume(ctx, pvc.Spec.VolumeName)
+		if isForbidden(resourcePersistentVolumes, err) {
+			klog.V(2).Infof("skipping PersistentVolume %s of PVC %s/%s, PersistentVolumes can't be read", pvc.Spec.VolumeName, pvc.Namespace, pvc.Name)
+		} else if err != nil {
+			klog.Errorf("failed to get PersistentVolume %s of PVC %s/%s: %s", pvc.Spec.VolumeName, pvc.Namespace, pvc.Name, err.Error())
+		} else if pv.Spec.CSI != nil && pv.Spec.CSI.Driver != "" {
+			return pv.Spec.CSI.Driver, provisionerSourcePersistentVolume
+		}
+	}
+
+	// Fallback to the provisioner of the StorageClass
+	storageClass, err := getStorageClass(ctx, pvc)
+	if err != nil {
+		klog.Errorf("failed to get StorageClass of PVC %s/%s: %s", pvc.Namespace, pvc.Name, err.Error())
+	} else if storageClass != nil && storageClass.Provisioner != "" {
+		return storageClass.Provisioner, provisionerSourceStorageClass
+	}
+
+	return "", ""
+}
+
+// getPersistentVolume returns a PersistentVolume, from the cache when PersistentVolumes are watched
+func getPersistentVolume(ctx context.Context, name string) (*corev1.PersistentVolume, error) {
+	if PersistentVolumeInformer != nil {
+		return PersistentVolumeInformer.Lister().Get(name)
+	}
+
+	callCtx, cancel := withAPITimeout(ctx)
+	defer cancel()
+	return k8s.ClientSet.CoreV1().PersistentVolumes().Get(callCtx, name, metav1.GetOptions{})
+}
+
+// reportProvisionerFallback reports that the provisioner of a PVC wasn't found in its annotations,
+// when the provisioner or where it was found changed since the last reconciliation of the PVC
+func reportProvisionerFallback(pvc *corev1.PersistentVolumeClaim, provisioner, source string) {
+	fallback := ""
+	if source == provisionerSourcePersistentVolume || source == provisionerSourceStorageClass {
+		fallback = provisioner + "/" + source
+	}
+	if previous := setProvisionerFallback(pvc.Namespace+"/"+pvc.Name, fallback); fallback == "" || fallback == previous {
+		return
+	}
+
+	klog.Infof("PVC %s/%s has no provisioner annotation, using provisioner %s from its %s", pvc.Namespace, pvc.Name, provisioner, source)
+	recordEvent(pvc, corev1.EventTypeNormal, reasonProvisionerFallback, "Using provisioner %s from the %s", provisioner, source)
+}
+
+// setProvisionerFallback sets the fallback provisioner of a PVC and returns the previous one, empty forgets the PVC
+func setProvisionerFallback(key, fallback string) string {
+	provisionerFallbacksLock.Lock()
+	defer provisionerFallbacksLock.Unlock()
+
+	previous := provisionerFallbacks[key]
+	if fallback == "" {
+		delete(provisionerFallbacks, key)
+	} else {
+		provisionerFallbacks[key] = fallback
+	}
+	return previous
 }
 
 // isPvcPaused returns whether the replication for a PVC is paused
@@ -210,3 +460,76 @@ func pvcNameMatchesExclusion(pvc *corev1.PersistentVolumeClaim) bool {
 	// Match the user-provided regex
 	return ExclusionRegex.MatchString(pvc.Name)
 }
+
+// getPvcNotReadyReason returns why a PVC isn't ready to be replicated yet, or an empty string if it is ready.
+// PVCs are always considered ready unless WaitForBound or WaitForStable are enabled.
+func getPvcNotReadyReason(pvc *corev1.PersistentVolumeClaim) string {
+	if WaitForBound && pvc.Status.Phase != corev1.ClaimBound && pvc.Status.Phase != corev1.ClaimLost {
+		return "PVC is not bound yet"
+	}
+
+	if !WaitForStable {
+		return ""
+	}
+
+	if pvc.Status.Phase == corev1.ClaimLost {
+		return "PVC has lost its PersistentVolume"
+	}
+
+	for _, condition := range pvc.Status.Conditions {
+		if condition.Status != corev1.ConditionTrue {
+			continue
+		}
+		if condition.Type == corev1.PersistentVolumeClaimResizing || condition.Type == corev1.PersistentVolumeClaimFileSystemResizePending {
+			return "PVC is being resized"
+		}
+	}
+
+	switch pvc.Status.AllocatedResourceStatuses[corev1.ResourceStorage] {
+	case corev1.PersistentVolumeClaimControllerResizeInProgress, corev1.PersistentVolumeClaimNodeResizePending, corev1.PersistentVolumeClaimNodeResizeInProgress:
+		return "PVC is being resized"
+	}
+
+	return ""
+}
+
+// waitForPvc handles a PVC that isn't ready to be replicated, and returns when it should be checked again.
+// If the PVC stays Pending for longer than BindTimeout, a warning Event is emitted on it once, when the timeout
+// is crossed, which is recorded in an annotation of the PVC until it is bound.
+// Other state changes of the PVC trigger a new reconciliation, so no requeue is needed for them.
+func waitForPvc(ctx context.Context, pvc *corev1.PersistentVolumeClaim, reason string) time.Duration {
+	if BindTimeout == 0 || pvc.Status.Phase == corev1.ClaimBound || pvc.Status.Phase == corev1.ClaimLost {
+		return 0
+	}
+
+	pendingFor := time.Since(pvc.CreationTimestamp.Time)
+	if pendingFor < BindTimeout {
+		return BindTimeout - pendingFor
+	}
+
+	if _, reported := lookupKey(pvc.Annotations, constants.BindTimeoutAnnotation); reported {
+		return 0
+	}
+
+	klog.Warningf("PVC %s/%s has been waiting for %s: %s", pvc.Namespace, pvc.Name, pendingFor.Round(time.Second), reason)
+	now := time.Now().UTC().Format(time.RFC3339)
+	if err := patchPvcAnnotations(ctx, pvc, map[string]*string{constants.BindTimeoutAnnotation: &now}); err != nil {
+		klog.Errorf("failed to record the bind timeout of PVC %s/%s: %s", pvc.Namespace, pvc.Name, err.Error())
+	}
+	recordEvent(pvc, corev1.EventTypeWarning, reasonBindTimeout, "VolumeReplication not created after %s: %s", pendingFor.Round(time.Second), reason)
+	return 0
+}
+
+// clearBindTimeout removes the bind timeout recorded on a PVC once it is bound
+func clearBindTimeout(ctx context.Context, pvc *corev1.PersistentVolumeClaim) {
+	if pvc.Status.Phase != corev1.ClaimBound {
+		return
+	}
+	if _, reported := lookupKey(pvc.Annotations, constants.BindTimeoutAnnotation); !reported {
+		return
+	}
+
+	if err := patchPvcAnnotations(ctx, pvc, map[string]*string{constants.BindTimeoutAnnotation: nil}); err != nil {
+		klog.Errorf("failed to clear the bind timeout of PVC %s/%s: %s", pvc.Namespace, pvc.Name, err.Error())
+	}
+}
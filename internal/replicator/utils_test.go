@@ -3,7 +3,9 @@ package replicator
 import (
 	"fmt"
 	"regexp"
+	"slices"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 	"github.com/super-phenix/volume-replicator/internal/constants"
@@ -14,16 +16,41 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/dynamic/dynamicinformer"
 	dynamicfake "k8s.io/client-go/dynamic/fake"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes/fake"
 	k8s_testing "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/record"
 )
 
-func TestCreateVolumeReplication(t *testing.T) {
+// addApplyReactor lets the fake dynamic client create or replace objects on server-side apply, which it doesn't support
+func addApplyReactor(dynamicClient *dynamicfake.FakeDynamicClient) {
+	dynamicClient.PrependReactor("patch", "*", func(action k8s_testing.Action) (bool, runtime.Object, error) {
+		patchAction := action.(k8s_testing.PatchAction)
+		if patchAction.GetPatchType() != types.ApplyPatchType {
+			return false, nil, nil
+		}
+
+		obj := &unstructured.Unstructured{}
+		if err := obj.UnmarshalJSON(patchAction.GetPatch()); err != nil {
+			return true, nil, err
+		}
+
+		tracker := dynamicClient.Tracker()
+		err := tracker.Create(action.GetResource(), obj, action.GetNamespace())
+		if errors.IsAlreadyExists(err) {
+			err = tracker.Update(action.GetResource(), obj, action.GetNamespace())
+		}
+		return true, obj, err
+	})
+}
+
+func TestApplyVolumeReplication(t *testing.T) {
 	scheme := runtime.NewScheme()
 	dynamicClient := dynamicfake.NewSimpleDynamicClient(scheme)
+	addApplyReactor(dynamicClient)
 	k8s.DynamicClientSet = dynamicClient
 
 	client := fake.NewClientset()
@@ -54,7 +81,7 @@ func TestCreateVolumeReplication(t *testing.T) {
 	})
 
 	t.Run("Successful creation", func(t *testing.T) {
-		err := createVolumeReplication(pvc)
+		err := applyVolumeReplication(t.Context(), pvc, buildVolumeReplication(pvc, vrcName))
 		require.NoError(t, err)
 
 		// Verify creation
@@ -83,17 +110,94 @@ func TestCreateVolumeReplication(t *testing.T) {
 		require.Equal(t, pvcName, dataSource["name"])
 	})
 
-	t.Run("Creation failure", func(t *testing.T) {
+	t.Run("Successful update", func(t *testing.T) {
+		pvcSecondary := pvc.DeepCopy()
+		pvcSecondary.Annotations[constants.ReplicationStateAnnotation] = "secondary"
+		err := applyVolumeReplication(t.Context(), pvcSecondary, buildVolumeReplication(pvcSecondary, vrcName))
+		require.NoError(t, err)
+
+		vr, err := dynamicClient.Resource(VolumeReplicationResource).Namespace(nsName).Get(t.Context(), pvcName, metav1.GetOptions{})
+		require.NoError(t, err)
+		state, _, _ := unstructured.NestedString(vr.Object, "spec", "replicationState")
+		require.Equal(t, "secondary", state)
+
+		// The apply must only contain the fields owned by the controller
+		actions := dynamicClient.Actions()
+		idx := slices.IndexFunc(actions, func(action k8s_testing.Action) bool { return action.GetVerb() == "patch" })
+		require.GreaterOrEqual(t, idx, 0)
+		patchAction := actions[idx].(k8s_testing.PatchActionImpl)
+		require.Equal(t, types.ApplyPatchType, patchAction.GetPatchType())
+		require.Equal(t, fieldManager, patchAction.PatchOptions.FieldManager)
+		require.True(t, *patchAction.PatchOptions.Force)
+		applied := &unstructured.Unstructured{}
+		require.NoError(t, applied.UnmarshalJSON(patchAction.GetPatch()))
+		require.Empty(t, applied.GetResourceVersion())
+		_, hasStatus := applied.Object["status"]
+		require.False(t, hasStatus)
+	})
+
+	t.Run("Apply failure", func(t *testing.T) {
 		// Set up a reactor to inject an error
-		dynamicClient.PrependReactor("create", "volumereplications", func(action k8s_testing.Action) (handled bool, ret runtime.Object, err error) {
+		dynamicClient.PrependReactor("patch", "volumereplications", func(action k8s_testing.Action) (handled bool, ret runtime.Object, err error) {
 			return true, nil, fmt.Errorf("injected error")
 		})
 		defer func() { dynamicClient.ReactionChain = dynamicClient.ReactionChain[1:] }()
 
-		err := createVolumeReplication(pvc)
+		err := applyVolumeReplication(t.Context(), pvc, buildVolumeReplication(pvc, vrcName))
 		require.Error(t, err)
 		require.Contains(t, err.Error(), "injected error")
 	})
+
+	t.Run("Conflicts are retried", func(t *testing.T) {
+		// The first apply conflicts with a concurrent write, the retry succeeds
+		calls := 0
+		dynamicClient.PrependReactor("patch", "volumereplications", func(action k8s_testing.Action) (handled bool, ret runtime.Object, err error) {
+			calls++
+			if calls > 1 {
+				return false, nil, nil
+			}
+			return true, nil, errors.NewConflict(VolumeReplicationResource.GroupResource(), pvcName, fmt.Errorf("the object has been modified"))
+		})
+		defer func() { dynamicClient.ReactionChain = dynamicClient.ReactionChain[1:] }()
+
+		err := applyVolumeReplication(t.Context(), pvc, buildVolumeReplication(pvc, vrcName))
+		require.NoError(t, err)
+		require.Equal(t, 2, calls)
+	})
+
+	t.Run("Persistent conflict", func(t *testing.T) {
+		dynamicClient.PrependReactor("patch", "volumereplications", func(action k8s_testing.Action) (handled bool, ret runtime.Object, err error) {
+			return true, nil, errors.NewConflict(VolumeReplicationResource.GroupResource(), pvcName, fmt.Errorf("the object has been modified"))
+		})
+		defer func() { dynamicClient.ReactionChain = dynamicClient.ReactionChain[1:] }()
+
+		err := applyVolumeReplication(t.Context(), pvc, buildVolumeReplication(pvc, vrcName))
+		require.True(t, errors.IsConflict(err))
+	})
+}
+
+func TestGetPropagatedAnnotations(t *testing.T) {
+	constants.SetDomain(constants.DefaultDomain, []string{testAliasDomain})
+	defer constants.SetDomain(constants.DefaultDomain, nil)
+
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{
+				constants.VrcValueAnnotation:           "daily",
+				constants.PendingClassChangeAnnotation: "daily->hourly",
+				constants.RecreateHistoryAnnotation:    "2026-01-01T00:00:00Z",
+				constants.FrozenAnnotation:             "true",
+				constants.ConflictAnnotation:           "VolumeReplication test-pvc isn't managed",
+				testAliasDomain + "/recreateSnapshot":  "test-pvc-12345678",
+				"other-annotation":                     "value",
+			},
+		},
+	}
+
+	require.Equal(t, map[string]any{
+		constants.VrcValueAnnotation: "daily",
+		"other-annotation":           "value",
+	}, getPropagatedAnnotations(pvc))
 }
 
 func TestGetPersistentVolumeClaim(t *testing.T) {
@@ -191,7 +295,7 @@ func TestGetStorageClassLabels(t *testing.T) {
 				StorageClassName: nil,
 			},
 		}
-		result, err := getStorageClassLabels(pvc)
+		result, err := getStorageClassLabels(t.Context(), pvc)
 		require.NoError(t, err)
 		require.Nil(t, result)
 	})
@@ -210,7 +314,7 @@ func TestGetStorageClassLabels(t *testing.T) {
 				StorageClassName: &stcName,
 			},
 		}
-		result, err := getStorageClassLabels(pvc)
+		result, err := getStorageClassLabels(t.Context(), pvc)
 		require.NoError(t, err)
 		require.Equal(t, labels, result)
 
@@ -230,7 +334,7 @@ func TestGetStorageClassLabels(t *testing.T) {
 				StorageClassName: &stcName,
 			},
 		}
-		result, err := getStorageClassLabels(pvc)
+		result, err := getStorageClassLabels(t.Context(), pvc)
 		require.NoError(t, err)
 		require.Nil(t, result)
 
@@ -243,7 +347,7 @@ func TestGetStorageClassLabels(t *testing.T) {
 				StorageClassName: &stcName,
 			},
 		}
-		result, err := getStorageClassLabels(pvc)
+		result, err := getStorageClassLabels(t.Context(), pvc)
 		require.Error(t, err)
 		require.True(t, errors.IsNotFound(err))
 		require.Nil(t, result)
@@ -263,7 +367,7 @@ func TestGetStorageClassGroup(t *testing.T) {
 				StorageClassName: nil,
 			},
 		}
-		result, err := getStorageClassGroup(pvc)
+		result, err := getStorageClassGroup(t.Context(), pvc)
 		require.NoError(t, err)
 		require.Equal(t, "", result)
 	})
@@ -281,7 +385,7 @@ func TestGetStorageClassGroup(t *testing.T) {
 				StorageClassName: &stcName,
 			},
 		}
-		result, err := getStorageClassGroup(pvc)
+		result, err := getStorageClassGroup(t.Context(), pvc)
 		require.NoError(t, err)
 		require.Equal(t, "", result)
 
@@ -304,7 +408,7 @@ func TestGetStorageClassGroup(t *testing.T) {
 				StorageClassName: &stcName,
 			},
 		}
-		result, err := getStorageClassGroup(pvc)
+		result, err := getStorageClassGroup(t.Context(), pvc)
 		require.NoError(t, err)
 		require.Equal(t, groupName, result)
 
@@ -317,7 +421,7 @@ func TestGetStorageClassGroup(t *testing.T) {
 				StorageClassName: &stcName,
 			},
 		}
-		result, err := getStorageClassGroup(pvc)
+		result, err := getStorageClassGroup(t.Context(), pvc)
 		require.Error(t, err)
 		require.True(t, errors.IsNotFound(err))
 		require.Equal(t, "", result)
@@ -414,7 +518,7 @@ func TestCleanupVolumeReplication(t *testing.T) {
 		_, err := dynamicClient.Resource(VolumeReplicationResource).Namespace(nsName).Create(t.Context(), vr, metav1.CreateOptions{})
 		require.NoError(t, err)
 
-		cleanupVolumeReplication(vrName, nsName)
+		cleanupVolumeReplication(t.Context(), vrName, nsName)
 
 		// Verify deletion
 		_, err = dynamicClient.Resource(VolumeReplicationResource).Namespace(nsName).Get(t.Context(), vrName, metav1.GetOptions{})
@@ -424,7 +528,7 @@ func TestCleanupVolumeReplication(t *testing.T) {
 
 	t.Run("Deletion when resource is not found", func(t *testing.T) {
 		// Should not panic or return error (it logs it, but we can't easily check logs here without more setup)
-		cleanupVolumeReplication("non-existent", nsName)
+		cleanupVolumeReplication(t.Context(), "non-existent", nsName)
 	})
 
 	t.Run("Deletion failure", func(t *testing.T) {
@@ -435,7 +539,7 @@ func TestCleanupVolumeReplication(t *testing.T) {
 		defer func() { dynamicClient.ReactionChain = dynamicClient.ReactionChain[1:] }()
 
 		// Should handle error gracefully (logs it)
-		cleanupVolumeReplication(vrName, nsName)
+		cleanupVolumeReplication(t.Context(), vrName, nsName)
 	})
 }
 
@@ -444,6 +548,7 @@ func TestGetVolumeReplication(t *testing.T) {
 	dynamicClient := dynamicfake.NewSimpleDynamicClient(scheme)
 	dynamicInformerFactory := dynamicinformer.NewDynamicSharedInformerFactory(dynamicClient, 0)
 	VolumeReplicationInformer = dynamicInformerFactory.ForResource(VolumeReplicationResource)
+	require.NoError(t, VolumeReplicationInformer.Informer().AddIndexers(volumeReplicationIndexers))
 
 	ns := "test-ns"
 	name := "test-vr"
@@ -479,7 +584,7 @@ func TestGetVolumeReplication(t *testing.T) {
 	})
 }
 
-func TestIsVolumeReplicationCorrect(t *testing.T) {
+func TestCompareVolumeReplication(t *testing.T) {
 	client := fake.NewClientset()
 	informerFactory := informers.NewSharedInformerFactory(client, 0)
 	NamespaceInformer = informerFactory.Core().V1().Namespaces()
@@ -506,7 +611,7 @@ func TestIsVolumeReplicationCorrect(t *testing.T) {
 	tests := []struct {
 		name     string
 		vr       *unstructured.Unstructured
-		expected bool
+		expected comparison
 	}{
 		{
 			name: "All fields match",
@@ -527,7 +632,7 @@ func TestIsVolumeReplicationCorrect(t *testing.T) {
 					},
 				},
 			},
-			expected: true,
+			expected: upToDate,
 		},
 		{
 			name: "replicationState mismatch",
@@ -548,7 +653,7 @@ func TestIsVolumeReplicationCorrect(t *testing.T) {
 					},
 				},
 			},
-			expected: true,
+			expected: needsUpdate,
 		},
 		{
 			name: "volumeReplicationClass mismatch",
@@ -568,7 +673,7 @@ func TestIsVolumeReplicationCorrect(t *testing.T) {
 					},
 				},
 			},
-			expected: false,
+			expected: needsRecreate,
 		},
 		{
 			name: "dataSource apiGroup mismatch",
@@ -588,7 +693,7 @@ func TestIsVolumeReplicationCorrect(t *testing.T) {
 					},
 				},
 			},
-			expected: false,
+			expected: needsRecreate,
 		},
 		{
 			name: "dataSource kind mismatch",
@@ -608,7 +713,7 @@ func TestIsVolumeReplicationCorrect(t *testing.T) {
 					},
 				},
 			},
-			expected: false,
+			expected: needsRecreate,
 		},
 		{
 			name: "dataSource name mismatch",
@@ -628,39 +733,71 @@ func TestIsVolumeReplicationCorrect(t *testing.T) {
 					},
 				},
 			},
-			expected: false,
+			expected: needsRecreate,
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			result := isVolumeReplicationCorrect(pvc, tt.vr)
+			result := csiAddonsBackend{}.compare(tt.vr, buildVolumeReplication(pvc, vrcName))
 			require.Equal(t, tt.expected, result)
 		})
 	}
 }
 
 func TestGetPvcProvisioner(t *testing.T) {
-	t.Parallel()
+	client := fake.NewClientset()
+	k8s.ClientSet = client
+
+	stcName := "test-storage-class"
+	_, _ = client.StorageV1().StorageClasses().Create(t.Context(), &storagev1.StorageClass{
+		ObjectMeta:  metav1.ObjectMeta{Name: stcName},
+		Provisioner: "storageclass-provisioner",
+	}, metav1.CreateOptions{})
+
+	_, _ = client.CoreV1().PersistentVolumes().Create(t.Context(), &corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "csi-pv"},
+		Spec: corev1.PersistentVolumeSpec{
+			PersistentVolumeSource: corev1.PersistentVolumeSource{
+				CSI: &corev1.CSIPersistentVolumeSource{Driver: "csi-driver"},
+			},
+		},
+	}, metav1.CreateOptions{})
+
+	_, _ = client.CoreV1().PersistentVolumes().Create(t.Context(), &corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "nfs-pv"},
+		Spec: corev1.PersistentVolumeSpec{
+			PersistentVolumeSource: corev1.PersistentVolumeSource{
+				NFS: &corev1.NFSVolumeSource{Server: "nfs", Path: "/"},
+			},
+		},
+	}, metav1.CreateOptions{})
+
+	missingStcName := "missing-storage-class"
 
 	tests := []struct {
-		name        string
-		annotations map[string]string
-		expected    string
+		name             string
+		annotations      map[string]string
+		volumeName       string
+		storageClassName *string
+		expected         string
+		expectedSource   string
 	}{
 		{
 			name: "standard annotation",
 			annotations: map[string]string{
 				constants.StorageProvisionerAnnotation: "standard-provisioner",
 			},
-			expected: "standard-provisioner",
+			expected:       "standard-provisioner",
+			expectedSource: provisionerSourceAnnotation,
 		},
 		{
 			name: "deprecated annotation",
 			annotations: map[string]string{
 				constants.DeprecatedStorageProvisionerAnnotation: "deprecated-provisioner",
 			},
-			expected: "deprecated-provisioner",
+			expected:       "deprecated-provisioner",
+			expectedSource: provisionerSourceAnnotation,
 		},
 		{
 			name: "both annotations - standard takes precedence",
@@ -668,17 +805,57 @@ func TestGetPvcProvisioner(t *testing.T) {
 				constants.StorageProvisionerAnnotation:           "standard-provisioner",
 				constants.DeprecatedStorageProvisionerAnnotation: "deprecated-provisioner",
 			},
-			expected: "standard-provisioner",
+			expected:       "standard-provisioner",
+			expectedSource: provisionerSourceAnnotation,
+		},
+		{
+			name: "annotation takes precedence over PV and StorageClass",
+			annotations: map[string]string{
+				constants.StorageProvisionerAnnotation: "standard-provisioner",
+			},
+			volumeName:       "csi-pv",
+			storageClassName: &stcName,
+			expected:         "standard-provisioner",
+			expectedSource:   provisionerSourceAnnotation,
+		},
+		{
+			name:             "no annotations - PV CSI driver",
+			volumeName:       "csi-pv",
+			storageClassName: &stcName,
+			expected:         "csi-driver",
+			expectedSource:   provisionerSourcePersistentVolume,
 		},
 		{
-			name:        "no annotations",
-			annotations: map[string]string{},
-			expected:    "",
+			name:             "no annotations - non-CSI PV falls back to StorageClass",
+			volumeName:       "nfs-pv",
+			storageClassName: &stcName,
+			expected:         "storageclass-provisioner",
+			expectedSource:   provisionerSourceStorageClass,
 		},
 		{
-			name:        "nil annotations",
-			annotations: nil,
-			expected:    "",
+			name:             "no annotations - missing PV falls back to StorageClass",
+			volumeName:       "missing-pv",
+			storageClassName: &stcName,
+			expected:         "storageclass-provisioner",
+			expectedSource:   provisionerSourceStorageClass,
+		},
+		{
+			name:             "no annotations - missing StorageClass",
+			storageClassName: &missingStcName,
+			expected:         "",
+			expectedSource:   "",
+		},
+		{
+			name:           "no annotations",
+			annotations:    map[string]string{},
+			expected:       "",
+			expectedSource: "",
+		},
+		{
+			name:           "nil annotations",
+			annotations:    nil,
+			expected:       "",
+			expectedSource: "",
 		},
 	}
 
@@ -688,13 +865,85 @@ func TestGetPvcProvisioner(t *testing.T) {
 				ObjectMeta: metav1.ObjectMeta{
 					Annotations: tt.annotations,
 				},
+				Spec: corev1.PersistentVolumeClaimSpec{
+					VolumeName:       tt.volumeName,
+					StorageClassName: tt.storageClassName,
+				},
 			}
-			result := getPvcProvisioner(pvc)
+			result, source := getPvcProvisioner(t.Context(), pvc)
 			require.Equal(t, tt.expected, result)
+			require.Equal(t, tt.expectedSource, source)
 		})
 	}
 }
 
+func TestGetPvcProvisionerPerReconcile(t *testing.T) {
+	client := fake.NewClientset()
+	k8s.ClientSet = client
+	recorder := record.NewFakeRecorder(10)
+	k8s.Recorder = recorder
+	informerFactory := informers.NewSharedInformerFactory(client, 0)
+	StorageClassInformer = informerFactory.Storage().V1().StorageClasses()
+	PersistentVolumeInformer = informerFactory.Core().V1().PersistentVolumes()
+	defer func() {
+		StorageClassInformer = nil
+		PersistentVolumeInformer = nil
+		k8s.Recorder = nil
+		forgetPvc("test-namespace/test-pvc")
+	}()
+
+	stcName := "test-storage-class"
+	require.NoError(t, StorageClassInformer.Informer().GetIndexer().Add(&storagev1.StorageClass{
+		ObjectMeta:  metav1.ObjectMeta{Name: stcName},
+		Provisioner: "storageclass-provisioner",
+	}))
+	require.NoError(t, PersistentVolumeInformer.Informer().GetIndexer().Add(&corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "csi-pv"},
+		Spec: corev1.PersistentVolumeSpec{
+			PersistentVolumeSource: corev1.PersistentVolumeSource{
+				CSI: &corev1.CSIPersistentVolumeSource{Driver: "csi-driver"},
+			},
+		},
+	}))
+
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-pvc", Namespace: "test-namespace"},
+		Spec:       corev1.PersistentVolumeClaimSpec{StorageClassName: &stcName},
+	}
+	reconcile := func() (string, string) {
+		ctx := withPvcProvisioner(t.Context(), pvc)
+		provisioner, source := getPvcProvisioner(ctx, pvc)
+		again, _ := getPvcProvisioner(ctx, pvc)
+		require.Equal(t, provisioner, again)
+		return provisioner, source
+	}
+
+	// The provisioner is read from the caches, and the fallback is reported once
+	provisioner, source := reconcile()
+	require.Equal(t, "storageclass-provisioner", provisioner)
+	require.Equal(t, provisionerSourceStorageClass, source)
+	reconcile()
+	require.Empty(t, client.Actions())
+	require.Len(t, recorder.Events, 1)
+	require.Contains(t, <-recorder.Events, reasonProvisionerFallback)
+
+	// The fallback is reported again when the PVC is bound to a CSI volume
+	pvc.Spec.VolumeName = "csi-pv"
+	provisioner, source = reconcile()
+	require.Equal(t, "csi-driver", provisioner)
+	require.Equal(t, provisionerSourcePersistentVolume, source)
+	reconcile()
+	require.Len(t, recorder.Events, 1)
+	require.Contains(t, <-recorder.Events, "csi-driver")
+
+	// PVCs with a provisioner annotation don't use any fallback
+	pvc.Annotations = map[string]string{constants.StorageProvisionerAnnotation: "annotation-provisioner"}
+	provisioner, _ = reconcile()
+	require.Equal(t, "annotation-provisioner", provisioner)
+	require.Empty(t, recorder.Events)
+	require.NotContains(t, provisionerFallbacks, "test-namespace/test-pvc")
+}
+
 func TestIsNamespacePaused(t *testing.T) {
 	client := fake.NewClientset()
 	informerFactory := informers.NewSharedInformerFactory(client, 0)
@@ -964,3 +1213,179 @@ func TestPvcNameMatchesExclusion(t *testing.T) {
 		})
 	}
 }
+
+func TestGetPvcNotReadyReason(t *testing.T) {
+	tests := []struct {
+		name          string
+		waitForBound  bool
+		waitForStable bool
+		status        corev1.PersistentVolumeClaimStatus
+		expected      string
+	}{
+		{
+			name:     "No waiting, PVC pending",
+			status:   corev1.PersistentVolumeClaimStatus{Phase: corev1.ClaimPending},
+			expected: "",
+		},
+		{
+			name:         "Waiting for bound, PVC pending",
+			waitForBound: true,
+			status:       corev1.PersistentVolumeClaimStatus{Phase: corev1.ClaimPending},
+			expected:     "PVC is not bound yet",
+		},
+		{
+			name:         "Waiting for bound, PVC without phase",
+			waitForBound: true,
+			expected:     "PVC is not bound yet",
+		},
+		{
+			name:         "Waiting for bound, PVC bound",
+			waitForBound: true,
+			status:       corev1.PersistentVolumeClaimStatus{Phase: corev1.ClaimBound},
+			expected:     "",
+		},
+		{
+			name:         "Waiting for bound, PVC lost",
+			waitForBound: true,
+			status:       corev1.PersistentVolumeClaimStatus{Phase: corev1.ClaimLost},
+			expected:     "",
+		},
+		{
+			name:          "Waiting for stable, PVC lost",
+			waitForStable: true,
+			status:        corev1.PersistentVolumeClaimStatus{Phase: corev1.ClaimLost},
+			expected:      "PVC has lost its PersistentVolume",
+		},
+		{
+			name:          "Waiting for stable, filesystem resize pending",
+			waitForStable: true,
+			status: corev1.PersistentVolumeClaimStatus{
+				Phase: corev1.ClaimBound,
+				Conditions: []corev1.PersistentVolumeClaimCondition{
+					{Type: corev1.PersistentVolumeClaimFileSystemResizePending, Status: corev1.ConditionTrue},
+				},
+			},
+			expected: "PVC is being resized",
+		},
+		{
+			name:          "Waiting for stable, resize condition false",
+			waitForStable: true,
+			status: corev1.PersistentVolumeClaimStatus{
+				Phase: corev1.ClaimBound,
+				Conditions: []corev1.PersistentVolumeClaimCondition{
+					{Type: corev1.PersistentVolumeClaimResizing, Status: corev1.ConditionFalse},
+				},
+			},
+			expected: "",
+		},
+		{
+			name:          "Waiting for stable, controller resize in progress",
+			waitForStable: true,
+			status: corev1.PersistentVolumeClaimStatus{
+				Phase: corev1.ClaimBound,
+				AllocatedResourceStatuses: map[corev1.ResourceName]corev1.ClaimResourceStatus{
+					corev1.ResourceStorage: corev1.PersistentVolumeClaimControllerResizeInProgress,
+				},
+			},
+			expected: "PVC is being resized",
+		},
+		{
+			name:          "Waiting for stable, PVC bound",
+			waitForStable: true,
+			status:        corev1.PersistentVolumeClaimStatus{Phase: corev1.ClaimBound},
+			expected:      "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			WaitForBound = tt.waitForBound
+			WaitForStable = tt.waitForStable
+			defer func() {
+				WaitForBound = false
+				WaitForStable = false
+			}()
+
+			pvc := &corev1.PersistentVolumeClaim{Status: tt.status}
+			require.Equal(t, tt.expected, getPvcNotReadyReason(pvc))
+		})
+	}
+}
+
+func TestWaitForPvc(t *testing.T) {
+	defer func() { BindTimeout = 0 }()
+
+	newPvc := func(age time.Duration, phase corev1.PersistentVolumeClaimPhase) *corev1.PersistentVolumeClaim {
+		return &corev1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:              "test-pvc",
+				Namespace:         "test-namespace",
+				CreationTimestamp: metav1.NewTime(time.Now().Add(-age)),
+			},
+			Status: corev1.PersistentVolumeClaimStatus{Phase: phase},
+		}
+	}
+
+	t.Run("No timeout", func(t *testing.T) {
+		BindTimeout = 0
+		require.Zero(t, waitForPvc(t.Context(), newPvc(time.Hour, corev1.ClaimPending), "PVC is not bound yet"))
+	})
+
+	t.Run("Timeout not reached yet", func(t *testing.T) {
+		BindTimeout = 10 * time.Minute
+		requeueAfter := waitForPvc(t.Context(), newPvc(time.Minute, corev1.ClaimPending), "PVC is not bound yet")
+		require.Greater(t, requeueAfter, 8*time.Minute)
+		require.LessOrEqual(t, requeueAfter, 9*time.Minute)
+	})
+
+	t.Run("Timeout reached", func(t *testing.T) {
+		BindTimeout = 10 * time.Minute
+		pvc := newPvc(time.Hour, corev1.ClaimPending)
+		client := fake.NewClientset(pvc)
+		k8s.ClientSet = client
+		recorder := record.NewFakeRecorder(10)
+		k8s.Recorder = recorder
+		defer func() { k8s.Recorder = nil }()
+
+		require.Zero(t, waitForPvc(t.Context(), pvc, "PVC is not bound yet"))
+		require.Len(t, recorder.Events, 1)
+		require.Contains(t, <-recorder.Events, reasonBindTimeout)
+
+		// The timeout is recorded on the PVC, so that the Event isn't emitted again
+		patched, err := client.CoreV1().PersistentVolumeClaims(pvc.Namespace).Get(t.Context(), pvc.Name, metav1.GetOptions{})
+		require.NoError(t, err)
+		require.Contains(t, patched.Annotations, constants.BindTimeoutAnnotation)
+		require.Zero(t, waitForPvc(t.Context(), patched, "PVC is not bound yet"))
+		require.Empty(t, recorder.Events)
+
+		// The annotation is removed once the PVC is bound
+		patched.Status.Phase = corev1.ClaimBound
+		clearBindTimeout(t.Context(), patched)
+		patched, err = client.CoreV1().PersistentVolumeClaims(pvc.Namespace).Get(t.Context(), pvc.Name, metav1.GetOptions{})
+		require.NoError(t, err)
+		require.NotContains(t, patched.Annotations, constants.BindTimeoutAnnotation)
+	})
+
+	t.Run("Bound PVC waiting for a resize", func(t *testing.T) {
+		BindTimeout = 10 * time.Minute
+		require.Zero(t, waitForPvc(t.Context(), newPvc(time.Minute, corev1.ClaimBound), "PVC is being resized"))
+	})
+}
+
+func TestWithAPITimeout(t *testing.T) {
+	defer func() { APITimeout = 30 * time.Second }()
+
+	APITimeout = time.Minute
+	ctx, cancel := withAPITimeout(t.Context())
+	deadline, ok := ctx.Deadline()
+	require.True(t, ok)
+	require.WithinDuration(t, time.Now().Add(time.Minute), deadline, 5*time.Second)
+	cancel()
+	require.Error(t, ctx.Err())
+
+	APITimeout = 0
+	ctx, cancel = withAPITimeout(t.Context())
+	defer cancel()
+	_, ok = ctx.Deadline()
+	require.False(t, ok)
+}
@@ -0,0 +1,207 @@
+package replicator
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/super-phenix/volume-replicator/internal/constants"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/yaml"
+)
+
+const volSyncGroup = "volsync.backube"
+
+var (
+	ReplicationSourceResource = schema.GroupVersionResource{
+		Group:    volSyncGroup,
+		Version:  "v1alpha1",
+		Resource: "replicationsources",
+	}
+
+	// VolSyncClasses are the classes of the VolSync backend, VolSync having no class resource of its own
+	VolSyncClasses []VolSyncClass
+)
+
+// VolSyncConfig is the content of the file passed through --volsync-classes
+type VolSyncConfig struct {
+	Classes []VolSyncClass `json:"classes"`
+}
+
+// VolSyncClass describes how the PVCs of a class are replicated by VolSync.
+// Classes are selected like VolumeReplicationClasses, through their labels, annotations and provisioner.
+type VolSyncClass struct {
+	Name        string            `json:"name"`
+	Provisioner string            `json:"provisioner,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	// Spec is the spec of the ReplicationSources of the class, e.g. its trigger and its mover.
+	// The sourcePVC and paused fields are set by the controller.
+	Spec map[string]any `json:"spec"`
+}
+
+// LoadVolSyncClasses reads and validates the VolSync classes from a YAML or JSON file
+func LoadVolSyncClasses(path string) ([]VolSyncClass, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read VolSync classes: %w", err)
+	}
+
+	var config VolSyncConfig
+	if err = yaml.UnmarshalStrict(content, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse VolSync classes: %w", err)
+	}
+
+	names := make(map[string]bool)
+	for i, class := range config.Classes {
+		switch {
+		case class.Name == "":
+			return nil, fmt.Errorf("class %d has no name", i)
+		case names[class.Name]:
+			return nil, fmt.Errorf("class %s is defined twice", class.Name)
+		case len(class.Spec) == 0:
+			return nil, fmt.Errorf("class %s has no spec", class.Name)
+		}
+		names[class.Name] = true
+	}
+
+	return config.Classes, nil
+}
+
+// getVolSyncClass returns the VolSync class with this name, nil if it isn't defined
+func getVolSyncClass(name string) *VolSyncClass {
+	for i := range VolSyncClasses {
+		if VolSyncClasses[i].Name == name {
+			return &VolSyncClasses[i]
+		}
+	}
+	return nil
+}
+
+// listVolSyncClasses returns the VolSync classes carrying some labels, as objects that can be filtered like VolumeReplicationClasses
+func listVolSyncClasses(_ context.Context, labels map[string]string) ([]unstructured.Unstructured, error) {
+	var classes []unstructured.Unstructured
+	for _, class := range VolSyncClasses {
+		matches := true
+		for key, value := range labels {
+			if current, _ := lookupKey(class.Labels, key); current != value {
+				matches = false
+				break
+			}
+		}
+		if !matches {
+			continue
+		}
+
+		obj := unstructured.Unstructured{Object: map[string]any{"spec": map[string]any{"provisioner": class.Provisioner}}}
+		obj.SetName(class.Name)
+		obj.SetLabels(class.Labels)
+		obj.SetAnnotations(class.Annotations)
+		classes = append(classes, obj)
+	}
+	return classes, nil
+}
+
+// volSyncBackend replicates PVCs through VolSync ReplicationSources, their class is a VolSync class.
+// ReplicationSources are paused when the PVC isn't primary, as only the primary site is a source.
+type volSyncBackend struct{}
+
+func (volSyncBackend) kind() string {
+	return "ReplicationSource"
+}
+
+func (volSyncBackend) resource() schema.GroupVersionResource {
+	return ReplicationSourceResource
+}
+
+func (volSyncBackend) requiredResources() []schema.GroupVersionResource {
+	return []schema.GroupVersionResource{ReplicationSourceResource}
+}
+
+// resolve resolves the VolSync class of a target from the same annotations as VolumeReplicationClasses
+func (volSyncBackend) resolve(ctx context.Context, pvc *corev1.PersistentVolumeClaim, target replicationTarget) classResolution {
+	return resolveTargetClass(ctx, pvc, target, listVolSyncClasses, "VolSync class")
+}
+
+// build returns the ReplicationSource of a target of a PVC, with the spec of its class.
+// The class is recorded in the class annotation of the ReplicationSource, so that class changes can be detected.
+func (volSyncBackend) build(_ context.Context, pvc *corev1.PersistentVolumeClaim, target replicationTarget, class string) (*unstructured.Unstructured, error) {
+	volSyncClass := getVolSyncClass(class)
+	if volSyncClass == nil {
+		return nil, fmt.Errorf("VolSync class %s isn't defined", class)
+	}
+
+	annotations := getPropagatedAnnotations(pvc)
+	annotations[constants.VrcValueAnnotation] = class
+
+	labels := make(map[string]any)
+	for k, v := range getLabelsWithParent(pvc.Labels, pvc.Name) {
+		labels[k] = v
+	}
+
+	spec := runtime.DeepCopyJSON(volSyncClass.Spec)
+	spec["sourcePVC"] = pvc.Name
+	spec["paused"] = target.state != "primary"
+
+	return &unstructured.Unstructured{Object: map[string]any{
+		"apiVersion": fmt.Sprintf("%s/%s", ReplicationSourceResource.Group, ReplicationSourceResource.Version),
+		"kind":       "ReplicationSource",
+		"metadata": map[string]any{
+			"name":        target.name,
+			"namespace":   pvc.Namespace,
+			"annotations": annotations,
+			"labels":      labels,
+		},
+		"spec": spec,
+	}}, nil
+}
+
+// compare re-creates ReplicationSources whose class or source PVC changed, so that the previous mover is cleaned up.
+// Other fields of the spec, such as the trigger or paused, are updated in place.
+func (b volSyncBackend) compare(existing, desired *unstructured.Unstructured) comparison {
+	key := fmt.Sprintf("%s/%s", existing.GetNamespace(), existing.GetName())
+
+	if current := b.class(existing); current != b.class(desired) {
+		klog.Infof("ReplicationSource %s has a class mismatch with its parent (got %s)", key, current)
+		return needsRecreate
+	}
+
+	sourcePvc, _, _ := unstructured.NestedString(existing.Object, "spec", "sourcePVC")
+	desiredSourcePvc, _, _ := unstructured.NestedString(desired.Object, "spec", "sourcePVC")
+	if sourcePvc != desiredSourcePvc {
+		klog.Infof("ReplicationSource %s has a sourcePVC mismatch with its parent", key)
+		return needsRecreate
+	}
+
+	if !isSubset(desired.Object["spec"], existing.Object["spec"]) {
+		klog.Infof("ReplicationSource %s has a spec mismatch with its class", key)
+		return needsUpdate
+	}
+	return upToDate
+}
+
+func (volSyncBackend) class(obj *unstructured.Unstructured) string {
+	return getKeyValue(obj.GetAnnotations(), constants.VrcValueAnnotation)
+}
+
+func (volSyncBackend) statusFields() [][]string {
+	return [][]string{{"status", "conditions"}, {"status", "latestMoverStatus", "result"}}
+}
+
+// status reports ReplicationSources as unhealthy when their last synchronization failed
+func (volSyncBackend) status(obj *unstructured.Unstructured) (bool, string) {
+	result, _, _ := unstructured.NestedString(obj.Object, "status", "latestMoverStatus", "result")
+	if result != "Failed" {
+		return true, ""
+	}
+
+	_, message := getConditionMessage(obj, "Synchronizing", "False")
+	if message == "" {
+		message = "last synchronization failed"
+	}
+	return false, message
+}
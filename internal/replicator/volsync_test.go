@@ -0,0 +1,222 @@
+package replicator
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/super-phenix/volume-replicator/internal/constants"
+	"github.com/super-phenix/volume-replicator/internal/k8s"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/utils/ptr"
+)
+
+// useVolSyncBackend selects the VolSync backend with some classes until the end of a test
+func useVolSyncBackend(t *testing.T, classes ...VolSyncClass) {
+	require.NoError(t, SetBackend(BackendVolSync))
+	VolSyncClasses = classes
+	t.Cleanup(func() {
+		require.NoError(t, SetBackend(BackendCSIAddons))
+		VolSyncClasses = nil
+	})
+}
+
+// newVolSyncClass returns a class replicating PVCs of a StorageClass group daily through restic
+func newVolSyncClass(name, selector string) VolSyncClass {
+	return VolSyncClass{
+		Name:        name,
+		Provisioner: "rbd.csi.ceph.com",
+		Labels: map[string]string{
+			constants.StorageClassGroup:     "ceph",
+			constants.VrcSelectorAnnotation: selector,
+		},
+		Spec: map[string]any{
+			"trigger": map[string]any{"schedule": "0 2 * * *"},
+			"restic":  map[string]any{"repository": "restic-config", "copyMethod": "Snapshot", "retain": map[string]any{"daily": float64(7)}},
+		},
+	}
+}
+
+func TestLoadVolSyncClasses(t *testing.T) {
+	tests := []struct {
+		name          string
+		content       string
+		expectedError bool
+	}{
+		{
+			name: "Valid classes",
+			content: `
+classes:
+  - name: daily
+    provisioner: rbd.csi.ceph.com
+    labels:
+      replication.superphenix.net/storageClassGroup: ceph
+      replication.superphenix.net/classSelector: daily
+    spec:
+      trigger:
+        schedule: "0 2 * * *"
+      restic:
+        repository: restic-config
+        copyMethod: Snapshot
+`,
+		},
+		{
+			name:          "Class without name",
+			content:       "classes:\n  - spec:\n      trigger:\n        manual: now\n",
+			expectedError: true,
+		},
+		{
+			name:          "Class without spec",
+			content:       "classes:\n  - name: daily\n",
+			expectedError: true,
+		},
+		{
+			name:          "Duplicate class",
+			content:       "classes:\n  - name: daily\n    spec: {paused: false}\n  - name: daily\n    spec: {paused: false}\n",
+			expectedError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "volsync-classes.yaml")
+			require.NoError(t, os.WriteFile(path, []byte(tt.content), 0o600))
+
+			classes, err := LoadVolSyncClasses(path)
+			if tt.expectedError {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			require.Len(t, classes, 1)
+			require.Equal(t, "daily", classes[0].Name)
+		})
+	}
+}
+
+func TestVolSyncResolve(t *testing.T) {
+	useVolSyncBackend(t, newVolSyncClass("daily", "daily"), newVolSyncClass("weekly", "weekly"))
+
+	client := fake.NewClientset(&storagev1.StorageClass{
+		ObjectMeta:  metav1.ObjectMeta{Name: "fast", Labels: map[string]string{constants.StorageClassGroup: "ceph"}},
+		Provisioner: "rbd.csi.ceph.com",
+	})
+	k8s.ClientSet = client
+	setupGroupEnvironment(t)
+
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "test-pvc",
+			Namespace:   "test-namespace",
+			Annotations: map[string]string{constants.VrcSelectorAnnotation: "hourly,weekly"},
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{StorageClassName: ptr.To("fast")},
+	}
+
+	// The same selector chains as for VolumeReplicationClasses apply
+	resolution := activeBackend.resolve(t.Context(), pvc, getReplicationTargets(pvc)[0])
+	require.Equal(t, "weekly", resolution.class)
+	require.Equal(t, resolutionFallback, resolution.outcome)
+
+	pvc.Annotations[constants.VrcValueAnnotation] = "daily"
+	require.Equal(t, "daily", activeBackend.resolve(t.Context(), pvc, getReplicationTargets(pvc)[0]).class)
+}
+
+func TestVolSyncCompare(t *testing.T) {
+	useVolSyncBackend(t, newVolSyncClass("daily", "daily"), newVolSyncClass("weekly", "weekly"))
+
+	pvc := &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: "test-pvc", Namespace: "test-namespace"}}
+	desired, err := activeBackend.build(t.Context(), pvc, getReplicationTargets(pvc)[0], "daily")
+	require.NoError(t, err)
+	require.Equal(t, "test-pvc", desired.Object["spec"].(map[string]any)["sourcePVC"])
+	require.Equal(t, false, desired.Object["spec"].(map[string]any)["paused"])
+
+	// The API server returns integers and defaults other fields
+	existing := desired.DeepCopy()
+	require.NoError(t, unstructured.SetNestedField(existing.Object, int64(7), "spec", "restic", "retain", "daily"))
+	require.NoError(t, unstructured.SetNestedField(existing.Object, "10Gi", "spec", "restic", "cacheCapacity"))
+	require.Equal(t, upToDate, activeBackend.compare(existing, desired))
+
+	secondary := pvc.DeepCopy()
+	secondary.Annotations = map[string]string{constants.ReplicationStateAnnotation: "secondary"}
+	paused, err := activeBackend.build(t.Context(), secondary, getReplicationTargets(secondary)[0], "daily")
+	require.NoError(t, err)
+	require.Equal(t, needsUpdate, activeBackend.compare(existing, paused))
+
+	weekly, err := activeBackend.build(t.Context(), pvc, getReplicationTargets(pvc)[0], "weekly")
+	require.NoError(t, err)
+	require.Equal(t, needsRecreate, activeBackend.compare(existing, weekly))
+
+	_, err = activeBackend.build(t.Context(), pvc, getReplicationTargets(pvc)[0], "unknown")
+	require.Error(t, err)
+}
+
+func TestVolSyncStatus(t *testing.T) {
+	rs := &unstructured.Unstructured{Object: map[string]any{
+		"status": map[string]any{
+			"latestMoverStatus": map[string]any{"result": "Failed"},
+			"conditions":        []any{map[string]any{"type": "Synchronizing", "status": "False", "message": "repository locked"}},
+		},
+	}}
+
+	healthy, message := volSyncBackend{}.status(rs)
+	require.False(t, healthy)
+	require.Equal(t, "repository locked", message)
+
+	require.NoError(t, unstructured.SetNestedField(rs.Object, "Successful", "status", "latestMoverStatus", "result"))
+	healthy, _ = volSyncBackend{}.status(rs)
+	require.True(t, healthy)
+}
+
+func TestReconcileReplicationSource(t *testing.T) {
+	useVolSyncBackend(t, newVolSyncClass("daily", "daily"))
+
+	dynamicClient := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme())
+	addApplyReactor(dynamicClient)
+	k8s.DynamicClientSet = dynamicClient
+
+	informerFactory := informers.NewSharedInformerFactory(fake.NewClientset(), 0)
+	PvcInformer = informerFactory.Core().V1().PersistentVolumeClaims()
+	NamespaceInformer = informerFactory.Core().V1().Namespaces()
+	VolumeReplicationInformer = dynamicinformer.NewDynamicSharedInformerFactory(dynamicClient, 0).ForResource(ReplicationSourceResource)
+	require.NoError(t, VolumeReplicationInformer.Informer().AddIndexers(volumeReplicationIndexers))
+	require.NoError(t, NamespaceInformer.Informer().GetIndexer().Add(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "test-namespace"}}))
+
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "test-pvc",
+			Namespace:   "test-namespace",
+			Annotations: map[string]string{constants.VrcValueAnnotation: "daily"},
+		},
+	}
+	require.NoError(t, PvcInformer.Informer().GetIndexer().Add(pvc))
+
+	reconcileVolumeReplication(t.Context(), "test-namespace/test-pvc")
+
+	rs, err := dynamicClient.Resource(ReplicationSourceResource).Namespace("test-namespace").Get(t.Context(), "test-pvc", metav1.GetOptions{})
+	require.NoError(t, err)
+	require.Equal(t, "test-pvc", rs.GetLabels()[constants.ParentLabel])
+	require.Equal(t, "daily", rs.GetAnnotations()[constants.VrcValueAnnotation])
+	schedule, _, _ := unstructured.NestedString(rs.Object, "spec", "trigger", "schedule")
+	require.Equal(t, "0 2 * * *", schedule)
+
+	// The PVC opts out of replication, its ReplicationSource is deleted
+	require.NoError(t, VolumeReplicationInformer.Informer().GetIndexer().Add(rs))
+	pvc = pvc.DeepCopy()
+	pvc.Annotations = nil
+	require.NoError(t, PvcInformer.Informer().GetIndexer().Update(pvc))
+
+	reconcileVolumeReplication(t.Context(), "test-namespace/test-pvc")
+
+	_, err = dynamicClient.Resource(ReplicationSourceResource).Namespace("test-namespace").Get(t.Context(), "test-pvc", metav1.GetOptions{})
+	require.Error(t, err)
+}
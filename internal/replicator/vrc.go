@@ -2,33 +2,90 @@ package replicator
 
 import (
 	"context"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 
 	"github.com/super-phenix/volume-replicator/internal/constants"
-	"github.com/super-phenix/volume-replicator/internal/k8s"
+	"github.com/super-phenix/volume-replicator/internal/metrics"
 	corev1 "k8s.io/api/core/v1"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/klog/v2"
 )
 
+var (
+	// classResolutions is the outcome of the resolution of the VRC of each target of a PVC, their count is exposed as a metric
+	classResolutions     = make(map[string][]string)
+	classResolutionsLock sync.Mutex
+)
+
+// Outcomes of the resolution of the VolumeReplicationClass of a PVC
+const (
+	resolutionNone      = "none"
+	resolutionExcluded  = "excluded"
+	resolutionValue     = "value"
+	resolutionSelector  = "selector"
+	resolutionFallback  = "fallback"
+	resolutionPriority  = "priority"
+	resolutionAmbiguous = "ambiguous"
+	resolutionError     = "error"
+	// resolutionUnknownProvisioner is the outcome of selectors in strict mode when the provisioner of the PVC is unknown
+	resolutionUnknownProvisioner = "unknownProvisioner"
+)
+
+// classResolution is the result of the resolution of the VolumeReplicationClass of a PVC
+type classResolution struct {
+	// class is the resolved VolumeReplicationClass, empty if none could be resolved
+	class string
+	// outcome describes how the class was resolved, or why it couldn't be
+	outcome string
+	// selector is the selector of the fallback chain that resolved the class
+	selector string
+	// message is a human-readable description of the outcome
+	message string
+}
+
+// isUnresolved returns whether the resolution failed even though the PVC requested replication.
+// Such failures are transient or need an operator to act, they shouldn't be mistaken for an opt-out.
+func (r classResolution) isUnresolved() bool {
+	return r.outcome == resolutionAmbiguous || r.outcome == resolutionError || r.outcome == resolutionUnknownProvisioner
+}
+
 // getVolumeReplicationClass returns the VRC to use for a PVC.
 // The VRC can be provided through annotations as a value or as a selector.
 // The annotations can be placed on the PVC or on its namespace.
-func getVolumeReplicationClass(pvc *corev1.PersistentVolumeClaim) string {
+func getVolumeReplicationClass(ctx context.Context, pvc *corev1.PersistentVolumeClaim) string {
+	return resolveVolumeReplicationClass(ctx, pvc).class
+}
+
+// resolveVolumeReplicationClass resolves the VRC of the first target of a PVC and reports how it was resolved
+func resolveVolumeReplicationClass(ctx context.Context, pvc *corev1.PersistentVolumeClaim) classResolution {
+	return resolveTargetClass(ctx, pvc, getReplicationTargets(pvc)[0], listClassesOf(VolumeReplicationClassesResource), "VolumeReplicationClass")
+}
+
+// resolveTargetClass resolves the class of a target of a PVC, from its explicit value or from its selector chain
+// among the listed classes. Without a lister, only explicit values are resolved. The kind is only used in messages.
+func resolveTargetClass(ctx context.Context, pvc *corev1.PersistentVolumeClaim, target replicationTarget, listClasses classLister, kind string) classResolution {
 	// If the PVC is to be excluded, return an empty replication class
-	if pvcNameMatchesExclusion(pvc) {
-		klog.Infof("PVC %s/%s matches exclusion pattern, no replication class to apply", pvc.Namespace, pvc.Name)
-		return ""
+	if isPvcExcluded(pvc) {
+		klog.Infof("PVC %s/%s is excluded from replication, no replication class to apply", pvc.Namespace, pvc.Name)
+		return classResolution{outcome: resolutionExcluded, message: "PVC is excluded from replication"}
 	}
 
-	// Retrieve the literal VRC provided on the PVC
-	value := getVolumeReplicationClassValue(pvc)
-	if value != "" {
-		return value
+	// Retrieve the literal class provided for the target
+	if target.value != "" {
+		return classResolution{class: target.value, outcome: resolutionValue, message: fmt.Sprintf("%s %s set explicitly", kind, target.value)}
 	}
 
-	// If no VRC value was provided, fallback to the selector
-	return getVolumeReplicationClassFromSelector(pvc)
+	// If no class value was provided, fallback to the selector
+	if listClasses == nil {
+		return classResolution{outcome: resolutionNone, message: fmt.Sprintf("no %s resource to select classes from", kind)}
+	}
+	return resolveClassFromSelector(ctx, pvc, listClasses, kind, target.selector)
 }
 
 // getVolumeReplicationClassFromSelector finds a VolumeReplicationClass that matches the StorageClass group of a PVC
@@ -36,42 +93,217 @@ func getVolumeReplicationClass(pvc *corev1.PersistentVolumeClaim) string {
 // This function is used to automatically infer the correct VRC to use based on a standard label
 // placed on each VolumeReplication (e.g. "replication.superphenix.net/classSelector: daily" for VRCs
 // that synchronize the data every day).
-func getVolumeReplicationClassFromSelector(pvc *corev1.PersistentVolumeClaim) string {
+func getVolumeReplicationClassFromSelector(ctx context.Context, pvc *corev1.PersistentVolumeClaim) string {
+	return resolveVolumeReplicationClassFromSelector(ctx, pvc).class
+}
+
+// resolveVolumeReplicationClassFromSelector resolves the VRC of a PVC from its selector annotation.
+// The annotation can hold an ordered fallback chain of selectors (e.g. "daily,weekly"), the first selector
+// matching a VRC wins. Within a selector, ties between VRCs are broken by their priority label.
+func resolveVolumeReplicationClassFromSelector(ctx context.Context, pvc *corev1.PersistentVolumeClaim) classResolution {
+	return resolveClassFromSelector(ctx, pvc, listClassesOf(VolumeReplicationClassesResource), "VolumeReplicationClass", getVolumeReplicationClassSelector(pvc))
+}
+
+// classLister returns the classes carrying some labels, under the domain of the controller or one of its aliases
+type classLister func(ctx context.Context, labels map[string]string) ([]unstructured.Unstructured, error)
+
+// listClassesOf returns the lister of the classes of a resource
+func listClassesOf(resource schema.GroupVersionResource) classLister {
+	return func(ctx context.Context, labels map[string]string) ([]unstructured.Unstructured, error) {
+		return listWithDomainLabels(ctx, resource, labels)
+	}
+}
+
+// resolveClassFromSelector resolves a class of a PVC from a selector chain, among the listed classes
+// that are in the StorageClass group of the PVC and have the same provisioner.
+// The kind of the class is only used in messages.
+func resolveClassFromSelector(ctx context.Context, pvc *corev1.PersistentVolumeClaim, listClasses classLister, kind, selectorValue string) classResolution {
 	// If the selector is not provided, we cannot proceed with filtering
-	selector := getVolumeReplicationClassSelector(pvc)
-	if selector == "" {
-		return ""
+	selectors := parseSelectorChain(selectorValue)
+	if len(selectors) == 0 {
+		return classResolution{outcome: resolutionNone}
 	}
 
 	// Retrieve the StorageClass group of the PVC
-	group, err := getStorageClassGroup(pvc)
+	group, err := getStorageClassGroup(ctx, pvc)
 	if err != nil {
 		klog.Errorf("failed to get StorageClass group for PVC %s/%s: %s", pvc.Namespace, pvc.Name, err.Error())
-		return ""
+		return classResolution{outcome: resolutionError, message: fmt.Sprintf("failed to get StorageClass group: %s", err.Error())}
 	}
 
 	// Abort if no group is specified
 	if group == "" {
 		klog.Infof("no StorageClass group on PVC %s/%s", pvc.Namespace, pvc.Name)
-		return ""
+		return classResolution{outcome: resolutionNone, message: "StorageClass has no group"}
+	}
+
+	// In strict mode, refuse to select a VRC if we can't verify that it has the same provisioner as the PVC.
+	// The provisioner may only be known once the PVC is bound, so the existing replication is kept meanwhile.
+	provisioner, source := getPvcProvisioner(ctx, pvc)
+	if provisioner == "" && StrictProvisioner {
+		klog.Errorf("unknown provisioner for PVC %s/%s, refusing to select a %s in strict mode", pvc.Namespace, pvc.Name, kind)
+		return classResolution{outcome: resolutionUnknownProvisioner, message: fmt.Sprintf("Unknown provisioner, no %s can be selected in strict mode", kind)}
 	}
+	klog.V(2).Infof("using provisioner %q (from %s) to filter %ses for PVC %s/%s", provisioner, source, kind, pvc.Namespace, pvc.Name)
 
-	// Filter all VolumeReplicationClasses in the correct group and with the correct classSelector/provisioner
-	volumeReplicationClasses, err := filterVrcFromSelector(group, selector, getPvcProvisioner(pvc))
+	// Try every selector of the chain in order, the first one matching a VRC wins
+	for i, selector := range selectors {
+		// Filter all VolumeReplicationClasses in the correct group and with the correct classSelector/provisioner
+		volumeReplicationClasses, err := filterClassesFromSelector(ctx, listClasses, group, selector, provisioner)
+		if err != nil {
+			klog.Errorf("failed to filter %ses for PVC %s/%s: %s", kind, pvc.Namespace, pvc.Name, err.Error())
+			return classResolution{outcome: resolutionError, selector: selector, message: fmt.Sprintf("failed to list %ses: %s", kind, err.Error())}
+		}
+
+		// Only keep the VRCs whose match criteria and VolumeAttributesClass are fulfilled by the PVC
+		volumeReplicationClasses, err = filterVrcFromMatchCriteria(ctx, volumeReplicationClasses, pvc)
+		if err != nil {
+			klog.Errorf("failed to filter %ses for PVC %s/%s: %s", kind, pvc.Namespace, pvc.Name, err.Error())
+			return classResolution{outcome: resolutionError, selector: selector, message: err.Error()}
+		}
+		volumeReplicationClasses = filterVrcFromVolumeAttributesClass(volumeReplicationClasses, pvc)
+		if len(volumeReplicationClasses) == 0 {
+			klog.V(2).Infof("no %s matches selector %s for PVC %s/%s", kind, selector, pvc.Namespace, pvc.Name)
+			continue
+		}
+
+		// We expect to find exactly one VolumeReplicationClass with the highest priority
+		candidates := selectHighestPriority(volumeReplicationClasses)
+		if len(candidates) > 1 {
+			names := make([]string, 0, len(candidates))
+			for _, candidate := range candidates {
+				names = append(names, candidate.GetName())
+			}
+			klog.Errorf("found %d matching %ses for PVC %s/%s with selector %s, expected 1: %v", len(candidates), kind, pvc.Namespace, pvc.Name, selector, names)
+			return classResolution{outcome: resolutionAmbiguous, selector: selector, message: fmt.Sprintf("selector %s matches several %ses with the same priority: %s", selector, kind, strings.Join(names, ", "))}
+		}
+
+		res := classResolution{class: candidates[0].GetName(), outcome: resolutionSelector, selector: selector}
+		switch {
+		case i > 0:
+			res.outcome = resolutionFallback
+			res.message = fmt.Sprintf("%s %s selected by fallback selector %s", kind, res.class, selector)
+		case len(volumeReplicationClasses) > 1:
+			res.outcome = resolutionPriority
+			res.message = fmt.Sprintf("%s %s selected by priority among %d matches of selector %s", kind, res.class, len(volumeReplicationClasses), selector)
+		default:
+			res.message = fmt.Sprintf("%s %s selected by selector %s", kind, res.class, selector)
+		}
+		return res
+	}
+
+	return classResolution{outcome: resolutionNone, message: fmt.Sprintf("no %s matches selectors %s", kind, strings.Join(selectors, ","))}
+}
+
+// parseSelectorChain splits a selector annotation into its ordered list of selectors
+func parseSelectorChain(value string) []string {
+	var selectors []string
+	for _, selector := range strings.Split(value, ",") {
+		if selector = strings.TrimSpace(selector); selector != "" {
+			selectors = append(selectors, selector)
+		}
+	}
+	return selectors
+}
+
+// selectHighestPriority returns the VRCs that share the highest priority label
+func selectHighestPriority(classes []unstructured.Unstructured) []unstructured.Unstructured {
+	var selected []unstructured.Unstructured
+	highest := math.MinInt
+	for _, class := range classes {
+		priority := getVrcPriority(class)
+		if priority > highest {
+			highest = priority
+			selected = nil
+		}
+		if priority == highest {
+			selected = append(selected, class)
+		}
+	}
+	return selected
+}
+
+// getVrcPriority returns the priority of a VRC from its label, VRCs without a valid priority have a priority of 0
+func getVrcPriority(vrc unstructured.Unstructured) int {
+	value, ok := lookupKey(vrc.GetLabels(), constants.PriorityLabel)
+	if !ok {
+		return 0
+	}
+
+	priority, err := strconv.Atoi(value)
 	if err != nil {
-		klog.Errorf("failed to filter VRCs for PVC %s/%s: %s", pvc.Namespace, pvc.Name, err.Error())
-		return ""
+		klog.Errorf("invalid priority %q on VRC %s, defaulting to 0", value, vrc.GetName())
+		return 0
 	}
+	return priority
+}
 
-	// We expect to find exactly one VolumeReplicationClass
-	if len(volumeReplicationClasses) != 1 {
-		if len(volumeReplicationClasses) > 1 {
-			klog.Errorf("found %d matching VRCs for PVC %s/%s, expected 1", len(volumeReplicationClasses), pvc.Namespace, pvc.Name)
+// reportClassResolutions exposes the outcome of the resolution of the VRC of each target of a PVC through metrics and Events.
+// The resolved classes and outcomes are recorded in an annotation of the PVC, so that Events are only emitted
+// for the targets whose class or outcome changed. Targets that don't request replication aren't recorded.
+func reportClassResolutions(ctx context.Context, pvc *corev1.PersistentVolumeClaim, targets []replicationTarget, resolutions []classResolution) {
+	outcomes := make([]string, len(resolutions))
+	var states []string
+	for i, res := range resolutions {
+		outcomes[i] = res.outcome
+		if res.outcome != resolutionNone {
+			states = append(states, fmt.Sprintf("%s=%s/%s", targets[i].name, res.class, res.outcome))
 		}
-		return ""
+	}
+	setClassResolutions(pvc.Namespace+"/"+pvc.Name, outcomes)
+
+	state := strings.Join(states, ",")
+	current, found := lookupKey(pvc.Annotations, constants.ClassResolutionAnnotation)
+	if state == current {
+		return
+	}
+
+	previous := strings.Split(current, ",")
+	for i, res := range resolutions {
+		if res.outcome == resolutionNone || slices.Contains(previous, fmt.Sprintf("%s=%s/%s", targets[i].name, res.class, res.outcome)) {
+			continue
+		}
+
+		switch res.outcome {
+		case resolutionFallback, resolutionPriority:
+			recordEvent(pvc, corev1.EventTypeNormal, reasonVolumeReplicationClassResolved, res.message)
+		case resolutionAmbiguous:
+			recordEvent(pvc, corev1.EventTypeWarning, reasonAmbiguousVolumeReplicationClass, res.message)
+		case resolutionError:
+			recordEvent(pvc, corev1.EventTypeWarning, reasonVolumeReplicationClassError, res.message)
+		case resolutionUnknownProvisioner:
+			recordEvent(pvc, corev1.EventTypeWarning, reasonUnknownProvisioner, res.message)
+		}
+	}
+
+	var value *string
+	if state != "" {
+		value = &state
+	} else if !found {
+		return
+	}
+	if err := patchPvcAnnotations(ctx, pvc, map[string]*string{constants.ClassResolutionAnnotation: value}); err != nil {
+		klog.Errorf("failed to record the class resolution of PVC %s/%s: %s", pvc.Namespace, pvc.Name, err.Error())
+	}
+}
+
+// setClassResolutions sets the outcomes of the resolution of the VRC of the targets of a PVC, nil forgets the PVC
+func setClassResolutions(key string, outcomes []string) {
+	classResolutionsLock.Lock()
+	defer classResolutionsLock.Unlock()
+
+	for _, outcome := range classResolutions[key] {
+		metrics.ClassResolutions.WithLabelValues(outcome).Dec()
+	}
+	for _, outcome := range outcomes {
+		metrics.ClassResolutions.WithLabelValues(outcome).Inc()
 	}
 
-	return volumeReplicationClasses[0]
+	if outcomes == nil {
+		delete(classResolutions, key)
+	} else {
+		classResolutions[key] = outcomes
+	}
 }
 
 // getVolumeReplicationClassValue returns the VRC to use for a PVC.
@@ -90,16 +322,12 @@ func getVolumeReplicationClassSelector(pvc *corev1.PersistentVolumeClaim) string
 	return getAnnotationValue(pvc, constants.VrcSelectorAnnotation)
 }
 
-// getReplicationState returns the replication state to use for a PVC.
+// getReplicationState returns the replication state to use for the first target of a PVC.
 // The replication state is specified through an annotation on the PVC or on its namespace.
 // The annotation on the PVC has priority over the one of the namespace.
 // If no replication state is found on either PVC or namespace, we return "primary" by default.
 func getReplicationState(pvc *corev1.PersistentVolumeClaim) string {
-	state := getAnnotationValue(pvc, constants.ReplicationStateAnnotation)
-	if state == "" {
-		return "primary"
-	}
-	return state
+	return targetState(splitTargets(getAnnotationValue(pvc, constants.ReplicationStateAnnotation)), 0)
 }
 
 // getAnnotationValue returns the value of an annotation from a PVC or its namespace.
@@ -110,7 +338,7 @@ func getAnnotationValue(pvc *corev1.PersistentVolumeClaim, annotation string) st
 	}
 
 	// If the PVC has the annotation specified, it has priority over the one of the namespace
-	if value, ok := pvc.Annotations[annotation]; ok && value != "" {
+	if value := getKeyValue(pvc.Annotations, annotation); value != "" {
 		return value
 	}
 
@@ -120,43 +348,43 @@ func getAnnotationValue(pvc *corev1.PersistentVolumeClaim, annotation string) st
 
 // getNamespaceAnnotationValue returns the value of an annotation from a namespace.
 func getNamespaceAnnotationValue(namespace string, annotation string) string {
-	ns, err := NamespaceInformer.Lister().Get(namespace)
+	ns, err := getNamespace(namespace)
 	if err != nil {
 		klog.Errorf("failed to retrieve namespace %s: %s", namespace, err.Error())
 		return ""
 	}
 
-	return ns.Annotations[annotation]
+	return getKeyValue(ns.Annotations, annotation)
 }
 
-// filterVrcFromSelector returns a VolumeReplicationClass that is in a specific StorageClass Group
+// filterVrcFromSelector returns the VolumeReplicationClasses that are in a specific StorageClass Group
 // and with a specific VolumeReplicationClass selector. It also filters for faulty provisioners.
 // It is assumed that a VRC must have a provisioner identical to the provisioner of the PVC.
-func filterVrcFromSelector(group, selector, pvcProvisioner string) ([]string, error) {
-	// Filter only VRCs in the right StorageClass group and with the right selector
-	vrcLister := k8s.DynamicClientSet.Resource(VolumeReplicationClassesResource)
-	labelSelector := &metav1.LabelSelector{
-		MatchLabels: map[string]string{
-			constants.StorageClassGroup:     group,
-			constants.VrcSelectorAnnotation: selector,
-		},
-	}
-
-	// Retrieve the VRCs that match our labelSelector
-	list, err := vrcLister.List(context.Background(), metav1.ListOptions{LabelSelector: metav1.FormatLabelSelector(labelSelector)})
+func filterVrcFromSelector(ctx context.Context, group, selector, pvcProvisioner string) ([]unstructured.Unstructured, error) {
+	return filterClassesFromSelector(ctx, listClassesOf(VolumeReplicationClassesResource), group, selector, pvcProvisioner)
+}
+
+// filterClassesFromSelector returns the listed classes that are in a specific StorageClass group,
+// with a specific selector and with the same provisioner as the PVC
+func filterClassesFromSelector(ctx context.Context, listClasses classLister, group, selector, pvcProvisioner string) ([]unstructured.Unstructured, error) {
+	// Filter only classes in the right StorageClass group and with the right selector
+	list, err := listClasses(ctx, map[string]string{
+		constants.StorageClassGroup:     group,
+		constants.VrcSelectorAnnotation: selector,
+	})
 	if err != nil {
 		return nil, err
 	}
 
 	// Filter for VRCs that have the same provisioner as our PVC
-	var classes []string
-	for _, item := range list.Items {
+	var classes []unstructured.Unstructured
+	for _, item := range list {
 		vrcProvisioner, _, _ := unstructured.NestedString(item.Object, "spec", "provisioner")
 		// Allow the pvcProvisioner to be empty, as some CSI may not place it in any annotation.
 		if vrcProvisioner == pvcProvisioner || pvcProvisioner == "" {
-			classes = append(classes, item.GetName())
+			classes = append(classes, item)
 		} else {
-			klog.V(2).Infof("discarded VRC %s as it doesn't have the same provisioner as the PVC, got %s, expected %s", item.GetName(), vrcProvisioner, pvcProvisioner)
+			klog.V(2).Infof("discarded class %s as it doesn't have the same provisioner as the PVC, got %s, expected %s", item.GetName(), vrcProvisioner, pvcProvisioner)
 		}
 	}
 
@@ -17,6 +17,7 @@ import (
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes/fake"
 	k8s_testing "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/record"
 )
 
 func setupTestEnvironment() (*fake.Clientset, *dynamicfake.FakeDynamicClient, informers.SharedInformerFactory) {
@@ -35,6 +36,38 @@ func setupTestEnvironment() (*fake.Clientset, *dynamicfake.FakeDynamicClient, in
 	return client, dynamicClient, informerFactory
 }
 
+func newVrc(name, group, selector, provisioner string, labels map[string]any) *unstructured.Unstructured {
+	allLabels := map[string]any{
+		constants.StorageClassGroup:     group,
+		constants.VrcSelectorAnnotation: selector,
+	}
+	for k, v := range labels {
+		allLabels[k] = v
+	}
+
+	return &unstructured.Unstructured{
+		Object: map[string]any{
+			"apiVersion": fmt.Sprintf("%s/%s", VolumeReplicationClassesResource.Group, VolumeReplicationClassesResource.Version),
+			"kind":       "VolumeReplicationClass",
+			"metadata": map[string]any{
+				"name":   name,
+				"labels": allLabels,
+			},
+			"spec": map[string]any{
+				"provisioner": provisioner,
+			},
+		},
+	}
+}
+
+func vrcNames(classes []unstructured.Unstructured) []string {
+	var names []string
+	for _, class := range classes {
+		names = append(names, class.GetName())
+	}
+	return names
+}
+
 func clearNamespaceIndexer(t *testing.T) {
 	indexer := NamespaceInformer.Informer().GetIndexer()
 	for _, obj := range indexer.List() {
@@ -223,7 +256,7 @@ func TestGetVolumeReplicationClass(t *testing.T) {
 				require.NoError(t, err)
 			}
 
-			result := getVolumeReplicationClass(tt.pvc)
+			result := getVolumeReplicationClass(t.Context(), tt.pvc)
 			require.Equal(t, tt.expectedResult, result)
 		})
 	}
@@ -484,7 +517,7 @@ func TestGetVolumeReplicationClassFromSelector(t *testing.T) {
 				Annotations: map[string]string{},
 			},
 		}
-		result := getVolumeReplicationClassFromSelector(pvc)
+		result := getVolumeReplicationClassFromSelector(t.Context(), pvc)
 		require.Equal(t, "", result)
 	})
 
@@ -500,7 +533,7 @@ func TestGetVolumeReplicationClassFromSelector(t *testing.T) {
 				StorageClassName: &stcName,
 			},
 		}
-		result := getVolumeReplicationClassFromSelector(pvc)
+		result := getVolumeReplicationClassFromSelector(t.Context(), pvc)
 		require.Equal(t, "vrc-matched", result)
 	})
 
@@ -516,8 +549,74 @@ func TestGetVolumeReplicationClassFromSelector(t *testing.T) {
 				StorageClassName: &stcName,
 			},
 		}
-		result := getVolumeReplicationClassFromSelector(pvc)
+		result := getVolumeReplicationClassFromSelector(t.Context(), pvc)
+		require.Equal(t, "", result)
+	})
+
+	t.Run("PVC without provisioner annotation, provisioner from StorageClass", func(t *testing.T) {
+		stcWithProvisioner := "stc-with-provisioner"
+		stc := &storagev1.StorageClass{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:   stcWithProvisioner,
+				Labels: map[string]string{constants.StorageClassGroup: groupName},
+			},
+			Provisioner: "other-provisioner",
+		}
+		_, _ = client.StorageV1().StorageClasses().Create(t.Context(), stc, metav1.CreateOptions{})
+		defer func() {
+			_ = client.StorageV1().StorageClasses().Delete(t.Context(), stcWithProvisioner, metav1.DeleteOptions{})
+		}()
+
+		pvc := &corev1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{
+				Annotations: map[string]string{
+					constants.VrcSelectorAnnotation: selectorValue,
+				},
+			},
+			Spec: corev1.PersistentVolumeClaimSpec{
+				StorageClassName: &stcWithProvisioner,
+			},
+		}
+		result := getVolumeReplicationClassFromSelector(t.Context(), pvc)
+		require.Equal(t, "", result, "the provisioner of the StorageClass doesn't match the VRC")
+	})
+
+	t.Run("Unknown provisioner, strict mode", func(t *testing.T) {
+		StrictProvisioner = true
+		defer func() { StrictProvisioner = false }()
+
+		pvc := &corev1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{
+				Annotations: map[string]string{
+					constants.VrcSelectorAnnotation: selectorValue,
+				},
+			},
+			Spec: corev1.PersistentVolumeClaimSpec{
+				StorageClassName: &stcName,
+			},
+		}
+		result := getVolumeReplicationClassFromSelector(t.Context(), pvc)
 		require.Equal(t, "", result)
+
+		// The resolution fails instead of opting out, so that an existing VolumeReplication is kept
+		resolution := resolveClassFromSelector(t.Context(), pvc, listClassesOf(VolumeReplicationClassesResource), "VolumeReplicationClass", selectorValue)
+		require.Equal(t, resolutionUnknownProvisioner, resolution.outcome)
+		require.True(t, resolution.isUnresolved())
+	})
+
+	t.Run("Unknown provisioner, lenient mode", func(t *testing.T) {
+		pvc := &corev1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{
+				Annotations: map[string]string{
+					constants.VrcSelectorAnnotation: selectorValue,
+				},
+			},
+			Spec: corev1.PersistentVolumeClaimSpec{
+				StorageClassName: &stcName,
+			},
+		}
+		result := getVolumeReplicationClassFromSelector(t.Context(), pvc)
+		require.Equal(t, "vrc-matched", result)
 	})
 
 	t.Run("StorageClass has no group", func(t *testing.T) {
@@ -542,7 +641,7 @@ func TestGetVolumeReplicationClassFromSelector(t *testing.T) {
 				StorageClassName: &stcNoGroup,
 			},
 		}
-		result := getVolumeReplicationClassFromSelector(pvc)
+		result := getVolumeReplicationClassFromSelector(t.Context(), pvc)
 		require.Equal(t, "", result)
 	})
 
@@ -557,7 +656,7 @@ func TestGetVolumeReplicationClassFromSelector(t *testing.T) {
 				StorageClassName: &stcName,
 			},
 		}
-		result := getVolumeReplicationClassFromSelector(pvc)
+		result := getVolumeReplicationClassFromSelector(t.Context(), pvc)
 		require.Equal(t, "", result)
 	})
 
@@ -594,7 +693,7 @@ func TestGetVolumeReplicationClassFromSelector(t *testing.T) {
 				StorageClassName: &stcName,
 			},
 		}
-		result := getVolumeReplicationClassFromSelector(pvc)
+		result := getVolumeReplicationClassFromSelector(t.Context(), pvc)
 		require.Equal(t, "", result)
 	})
 
@@ -609,7 +708,7 @@ func TestGetVolumeReplicationClassFromSelector(t *testing.T) {
 				StorageClassName: &[]string{"non-existent"}[0],
 			},
 		}
-		result := getVolumeReplicationClassFromSelector(pvc)
+		result := getVolumeReplicationClassFromSelector(t.Context(), pvc)
 		require.Equal(t, "", result)
 	})
 
@@ -624,7 +723,7 @@ func TestGetVolumeReplicationClassFromSelector(t *testing.T) {
 				StorageClassName: nil,
 			},
 		}
-		result := getVolumeReplicationClassFromSelector(pvc)
+		result := getVolumeReplicationClassFromSelector(t.Context(), pvc)
 		require.Equal(t, "", result)
 	})
 }
@@ -674,27 +773,27 @@ func TestFilterVrcFromSelector(t *testing.T) {
 	_, _ = dynamicClient.Resource(VolumeReplicationClassesResource).Create(t.Context(), vrc2, metav1.CreateOptions{})
 
 	t.Run("Match found with both labels and provisioner", func(t *testing.T) {
-		list, err := filterVrcFromSelector("group-1", "match", "provisioner-1")
+		list, err := filterVrcFromSelector(t.Context(), "group-1", "match", "provisioner-1")
 		require.NoError(t, err)
-		require.Equal(t, []string{"vrc-1"}, list)
+		require.Equal(t, []string{"vrc-1"}, vrcNames(list))
 	})
 
 	t.Run("No match found - wrong provisioner", func(t *testing.T) {
-		list, err := filterVrcFromSelector("group-1", "match", "wrong-provisioner")
+		list, err := filterVrcFromSelector(t.Context(), "group-1", "match", "wrong-provisioner")
 		require.NoError(t, err)
 		require.Empty(t, list)
 	})
 
 	t.Run("No match found - wrong selector", func(t *testing.T) {
-		list, err := filterVrcFromSelector("group-1", "no-match", "provisioner-1")
+		list, err := filterVrcFromSelector(t.Context(), "group-1", "no-match", "provisioner-1")
 		require.NoError(t, err)
 		require.Empty(t, list)
 	})
 
 	t.Run("Match found - empty pvcProvisioner", func(t *testing.T) {
-		list, err := filterVrcFromSelector("group-1", "match", "")
+		list, err := filterVrcFromSelector(t.Context(), "group-1", "match", "")
 		require.NoError(t, err)
-		require.Equal(t, []string{"vrc-1"}, list)
+		require.Equal(t, []string{"vrc-1"}, vrcNames(list))
 	})
 
 	t.Run("API error", func(t *testing.T) {
@@ -704,7 +803,7 @@ func TestFilterVrcFromSelector(t *testing.T) {
 		})
 		defer func() { dynamicClient.ReactionChain = dynamicClient.ReactionChain[1:] }()
 
-		list, err := filterVrcFromSelector("group-1", "match", "provisioner-1")
+		list, err := filterVrcFromSelector(t.Context(), "group-1", "match", "provisioner-1")
 		require.Error(t, err)
 		require.Contains(t, err.Error(), "injected list error")
 		require.Nil(t, list)
@@ -791,3 +890,204 @@ func TestGetReplicationState(t *testing.T) {
 		})
 	}
 }
+
+func TestResolveVolumeReplicationClassFromSelector(t *testing.T) {
+	client, dynamicClient, _ := setupTestEnvironment()
+
+	stcName := "test-storage-class"
+	groupName := "test-group"
+	provisionerName := "test-provisioner"
+
+	_, _ = client.StorageV1().StorageClasses().Create(t.Context(), &storagev1.StorageClass{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   stcName,
+			Labels: map[string]string{constants.StorageClassGroup: groupName},
+		},
+		Provisioner: provisionerName,
+	}, metav1.CreateOptions{})
+
+	vrcs := []*unstructured.Unstructured{
+		newVrc("weekly", groupName, "weekly", provisionerName, nil),
+		newVrc("hourly-low", groupName, "hourly", provisionerName, map[string]any{constants.PriorityLabel: "1"}),
+		newVrc("hourly-high", groupName, "hourly", provisionerName, map[string]any{constants.PriorityLabel: "10"}),
+		newVrc("tied-a", groupName, "tied", provisionerName, map[string]any{constants.PriorityLabel: "5"}),
+		newVrc("tied-b", groupName, "tied", provisionerName, map[string]any{constants.PriorityLabel: "5"}),
+		newVrc("tied-low", groupName, "tied", provisionerName, nil),
+		newVrc("invalid-priority", groupName, "invalid", provisionerName, map[string]any{constants.PriorityLabel: "high"}),
+		newVrc("negative-priority", groupName, "invalid", provisionerName, map[string]any{constants.PriorityLabel: "-1"}),
+		newVrc("tiered-block", groupName, "tiered", provisionerName, nil),
+		newVrc("tiered-filesystem", groupName, "tiered", provisionerName, nil),
+	}
+	vrcs[8].SetAnnotations(map[string]string{constants.PvcSelectorAnnotation: constants.VolumeModeAttribute + "=Block"})
+	vrcs[9].SetAnnotations(map[string]string{constants.PvcSelectorAnnotation: constants.VolumeModeAttribute + "=Filesystem"})
+	for _, vrc := range vrcs {
+		_, err := dynamicClient.Resource(VolumeReplicationClassesResource).Create(t.Context(), vrc, metav1.CreateOptions{})
+		require.NoError(t, err)
+	}
+
+	tests := []struct {
+		name             string
+		selector         string
+		expectedClass    string
+		expectedOutcome  string
+		expectedSelector string
+	}{
+		{
+			name:            "No selector",
+			selector:        "",
+			expectedClass:   "",
+			expectedOutcome: resolutionNone,
+		},
+		{
+			name:             "Single selector, single match",
+			selector:         "weekly",
+			expectedClass:    "weekly",
+			expectedOutcome:  resolutionSelector,
+			expectedSelector: "weekly",
+		},
+		{
+			name:             "Fallback to second selector",
+			selector:         "daily, weekly",
+			expectedClass:    "weekly",
+			expectedOutcome:  resolutionFallback,
+			expectedSelector: "weekly",
+		},
+		{
+			name:             "First selector wins",
+			selector:         "weekly,hourly",
+			expectedClass:    "weekly",
+			expectedOutcome:  resolutionSelector,
+			expectedSelector: "weekly",
+		},
+		{
+			name:             "Tie broken by priority",
+			selector:         "hourly",
+			expectedClass:    "hourly-high",
+			expectedOutcome:  resolutionPriority,
+			expectedSelector: "hourly",
+		},
+		{
+			name:             "Tie at the highest priority is ambiguous",
+			selector:         "tied,weekly",
+			expectedClass:    "",
+			expectedOutcome:  resolutionAmbiguous,
+			expectedSelector: "tied",
+		},
+		{
+			name:             "Invalid priority defaults to 0",
+			selector:         "invalid",
+			expectedClass:    "invalid-priority",
+			expectedOutcome:  resolutionPriority,
+			expectedSelector: "invalid",
+		},
+		{
+			name:             "Match criteria discriminate VRCs of the same selector",
+			selector:         "tiered",
+			expectedClass:    "tiered-filesystem",
+			expectedOutcome:  resolutionSelector,
+			expectedSelector: "tiered",
+		},
+		{
+			name:            "No selector matches",
+			selector:        "daily,monthly",
+			expectedClass:   "",
+			expectedOutcome: resolutionNone,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pvc := &corev1.PersistentVolumeClaim{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{constants.VrcSelectorAnnotation: tt.selector},
+				},
+				Spec: corev1.PersistentVolumeClaimSpec{StorageClassName: &stcName},
+			}
+
+			res := resolveVolumeReplicationClassFromSelector(t.Context(), pvc)
+			require.Equal(t, tt.expectedClass, res.class)
+			require.Equal(t, tt.expectedOutcome, res.outcome)
+			require.Equal(t, tt.expectedSelector, res.selector)
+			require.Equal(t, tt.expectedOutcome == resolutionAmbiguous, res.isUnresolved())
+		})
+	}
+
+	t.Run("API error", func(t *testing.T) {
+		dynamicClient.PrependReactor("list", "volumereplicationclasses", func(action k8s_testing.Action) (handled bool, ret runtime.Object, err error) {
+			return true, nil, fmt.Errorf("injected list error")
+		})
+		defer func() { dynamicClient.ReactionChain = dynamicClient.ReactionChain[1:] }()
+
+		pvc := &corev1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{
+				Annotations: map[string]string{constants.VrcSelectorAnnotation: "weekly"},
+			},
+			Spec: corev1.PersistentVolumeClaimSpec{StorageClassName: &stcName},
+		}
+
+		res := resolveVolumeReplicationClassFromSelector(t.Context(), pvc)
+		require.Equal(t, resolutionError, res.outcome)
+		require.True(t, res.isUnresolved())
+	})
+}
+
+func TestParseSelectorChain(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		value    string
+		expected []string
+	}{
+		{value: "", expected: nil},
+		{value: "daily", expected: []string{"daily"}},
+		{value: "daily,weekly", expected: []string{"daily", "weekly"}},
+		{value: " daily , , weekly ", expected: []string{"daily", "weekly"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			require.Equal(t, tt.expected, parseSelectorChain(tt.value))
+		})
+	}
+}
+
+func TestReportClassResolutions(t *testing.T) {
+	pvc := &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: "test-pvc", Namespace: "test-namespace"}}
+	client := fake.NewClientset(pvc)
+	k8s.ClientSet = client
+	recorder := record.NewFakeRecorder(10)
+	k8s.Recorder = recorder
+	defer func() { k8s.Recorder = nil }()
+	t.Cleanup(func() { setClassResolutions("test-namespace/test-pvc", nil) })
+
+	targets := []replicationTarget{{name: "test-pvc"}, {name: "test-pvc-dr"}}
+	report := func(resolutions ...classResolution) {
+		patched, err := client.CoreV1().PersistentVolumeClaims(pvc.Namespace).Get(t.Context(), pvc.Name, metav1.GetOptions{})
+		require.NoError(t, err)
+		pvc = patched
+		reportClassResolutions(t.Context(), pvc, targets, resolutions)
+	}
+	fallback := classResolution{class: "daily", outcome: resolutionFallback, message: "fallback"}
+	ambiguous := classResolution{outcome: resolutionAmbiguous, message: "ambiguous"}
+
+	// The resolution is reported once, as long as it doesn't change
+	report(fallback, ambiguous)
+	report(fallback, ambiguous)
+	require.Len(t, recorder.Events, 2)
+	require.Contains(t, <-recorder.Events, reasonVolumeReplicationClassResolved)
+	require.Contains(t, <-recorder.Events, reasonAmbiguousVolumeReplicationClass)
+	require.Equal(t, []string{resolutionFallback, resolutionAmbiguous}, classResolutions["test-namespace/test-pvc"])
+
+	// Only the target whose resolution changed is reported
+	report(fallback, classResolution{class: "hourly", outcome: resolutionPriority, message: "priority"})
+	require.Len(t, recorder.Events, 1)
+	require.Contains(t, <-recorder.Events, "priority")
+	require.Equal(t, []string{resolutionFallback, resolutionPriority}, classResolutions["test-namespace/test-pvc"])
+
+	// The annotation is removed once the PVC doesn't request replication anymore
+	report(classResolution{outcome: resolutionNone}, classResolution{outcome: resolutionNone})
+	patched, err := client.CoreV1().PersistentVolumeClaims(pvc.Namespace).Get(t.Context(), pvc.Name, metav1.GetOptions{})
+	require.NoError(t, err)
+	require.NotContains(t, patched.Annotations, constants.ClassResolutionAnnotation)
+	require.Empty(t, recorder.Events)
+}